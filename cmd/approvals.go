@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lachlan2k/acmespider/internal/dtos"
+	"github.com/urfave/cli/v2"
+)
+
+const envAdminURL = "ACMESPIDER_ADMIN_URL"
+const envAdminToken = "ACMESPIDER_ADMIN_TOKEN"
+
+var approvalsFlags = []cli.Flag{
+	&cli.StringFlag{Name: "url", Usage: "server's base URL", EnvVars: []string{envAdminURL, envBaseURL}, Required: true},
+	&cli.StringFlag{Name: "token", Usage: "admin API token", EnvVars: []string{envAdminToken}, Required: true},
+}
+
+// adminRequest calls the admin API, decoding the JSON response into out
+func adminRequest(cCtx *cli.Context, method string, path string, body any, out any) error {
+	var reqBody io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequestWithContext(cCtx.Context, method, strings.TrimSuffix(cCtx.String("url"), "/")+"/admin"+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+cCtx.String("token"))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var errResp struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&errResp)
+		return fmt.Errorf("admin API returned %s: %s", resp.Status, errResp.Message)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func runApprovalsList(cCtx *cli.Context) error {
+	status := cCtx.String("status")
+	if status == "all" {
+		status = ""
+	}
+
+	var resp dtos.ApprovalListResponseDTO
+	err := adminRequest(cCtx, http.MethodGet, "/approvals?status="+url.QueryEscape(status), nil, &resp)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tIDENTIFIER\tACCOUNT\tSTATUS\tREQUESTED\tEXPIRES\tDECIDED BY")
+	for _, a := range resp.Approvals {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", a.ID, a.Identifier, a.AccountID, a.Status, a.RequestedAt, a.Expires, a.DecidedBy)
+	}
+	return w.Flush()
+}
+
+func runApprovalsApprove(cCtx *cli.Context) error {
+	return decideApproval(cCtx, "approve")
+}
+
+func runApprovalsDeny(cCtx *cli.Context) error {
+	return decideApproval(cCtx, "deny")
+}
+
+func decideApproval(cCtx *cli.Context, decision string) error {
+	if cCtx.NArg() != 1 {
+		return fmt.Errorf("expected one approval ID")
+	}
+
+	var approval dtos.ApprovalDTO
+	err := adminRequest(cCtx, http.MethodPost, "/approvals/"+url.PathEscape(cCtx.Args().First())+"/"+decision, dtos.ApprovalDecisionRequestDTO{Reason: cCtx.String("reason")}, &approval)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s for %s is now %s\n", approval.ID, approval.Identifier, approval.Status)
+	return nil
+}
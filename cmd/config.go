@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/lachlan2k/acmespider/internal/config"
+	"github.com/lachlan2k/acmespider/internal/policy"
+	"github.com/lachlan2k/acmespider/internal/server"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+const envConfigFile = "ACMESPIDER_CONFIG"
+
+var configFlag = &cli.PathFlag{Name: "config", Usage: "YAML config file, which environment variables override", EnvVars: []string{envConfigFile}}
+
+type logConfig struct {
+	level     log.Level
+	formatter log.Formatter
+}
+
+// getLogConfig reads the logging settings, which Validate has already checked
+func getLogConfig(f *config.File) logConfig {
+	conf := logConfig{level: log.InfoLevel, formatter: &log.TextFormatter{}}
+	if level, err := log.ParseLevel(f.LogLevel); f.LogLevel != "" && err == nil {
+		conf.level = level
+	}
+	if strings.ToLower(f.LogFormat) == "json" {
+		conf.formatter = &log.JSONFormatter{}
+	}
+	return conf
+}
+
+func (l logConfig) apply() {
+	log.SetLevel(l.level)
+	log.SetFormatter(l.formatter)
+}
+
+// reloadOnSIGHUP reads the config again on every SIGHUP, passing it on to the server if it's valid.
+// Logging is changed here, and the server applies what it can of the rest
+func reloadOnSIGHUP(path string, reloads chan<- server.Config) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for range hup {
+		log.WithField("path", path).Info("Reloading config")
+
+		f, _, err := config.Load(path, os.Getenv)
+		if err != nil {
+			log.WithError(err).Error("Failed to reload config, keeping the current one")
+			continue
+		}
+		conf, err := buildServerConfig(f)
+		if err != nil {
+			log.WithError(err).Error("Failed to reload config, keeping the current one")
+			continue
+		}
+
+		getLogConfig(f).apply()
+		reloads <- conf
+	}
+}
+
+// runConfigCheck checks the config the server would start with, without starting it
+func runConfigCheck(cCtx *cli.Context) error {
+	path := cCtx.Path("config")
+	f, overridden, err := config.Load(path, os.Getenv)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	conf, err := buildServerConfig(f)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	if conf.PolicyFile != "" {
+		if _, err = policy.Load(conf.PolicyFile); err != nil {
+			return cli.Exit(err, 1)
+		}
+	}
+
+	sort.Strings(overridden)
+	for _, name := range overridden {
+		fmt.Printf("%s is set in the environment, overriding the config file\n", name)
+	}
+
+	if path == "" {
+		fmt.Println("Config from the environment is valid")
+	} else {
+		fmt.Printf("Config in %s is valid\n", path)
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/lachlan2k/acmespider/internal/config"
+	"github.com/lachlan2k/acmespider/internal/server"
+	"github.com/urfave/cli/v2"
+)
+
+var doctorFlags = []cli.Flag{
+	configFlag,
+	&cli.StringFlag{Name: "http01-name", Usage: "internal name to check ACMESpider can reach for HTTP-01 validation"},
+	&cli.DurationFlag{Name: "propagation-timeout", Usage: "how long to wait for the test TXT record to reach the public resolvers", Value: 2 * time.Minute},
+}
+
+// runDoctor checks the deployment from the config up, exiting non-zero if anything failed
+func runDoctor(cCtx *cli.Context) error {
+	f, _, err := config.Load(cCtx.Path("config"), os.Getenv)
+	if err != nil {
+		fmt.Printf("[FAIL] Config: %v\n", err)
+		return cli.Exit("", 1)
+	}
+	conf, err := buildServerConfig(f)
+	if err != nil {
+		fmt.Printf("[FAIL] Config: %v\n", err)
+		return cli.Exit("", 1)
+	}
+	fmt.Println("[ ok ] Config is valid")
+
+	opts := server.DoctorOptions{
+		HTTP01Name:         cCtx.String("http01-name"),
+		PropagationTimeout: cCtx.Duration("propagation-timeout"),
+	}
+	if !server.Doctor(conf, opts, os.Stdout) {
+		return cli.Exit("", 1)
+	}
+	return nil
+}
@@ -1,39 +1,33 @@
 package main
 
 import (
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"net"
 	"net/url"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/go-acme/lego/v4/certcrypto"
 	"github.com/go-acme/lego/v4/lego"
+	"github.com/lachlan2k/acmespider/internal/acme_controller"
+	"github.com/lachlan2k/acmespider/internal/config"
+	"github.com/lachlan2k/acmespider/internal/issuer"
+	"github.com/lachlan2k/acmespider/internal/nonce"
 	"github.com/lachlan2k/acmespider/internal/server"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/urfave/cli/v2"
 )
 
-const envPort = "ACMESPIDER_PORT"
-const envUseTLS = "ACMESPIDER_TLS"
+// Used as defaults by the commands that talk to a running server
 const envBaseURL = "ACMESPIDER_BASE_URL"
-const envHost = "ACMESPIDER_HOSTNAME"
-const envStoragePath = "ACMESPIDER_STORAGE_PATH"
-
-const envACMEPublicResolvers = "ACMESPIDER_PUBLIC_RESOLVERS"
-const envACMEDNSProvider = "ACMESPIDER_DNS_PROVIDER"
-const envACMEDirectory = "ACMESPIDER_ACME_CA_DIRECTORY"
-const envACMETOSAccept = "ACMESPIDER_ACME_TOS_ACCEPT"
-const envACMEEmail = "ACMESPIDER_ACME_EMAIL"
-const envACMEKeyType = "ACMESPIDER_KEY_TYPE"
-const envACMEMetaTosURL = "ACMESPIDER_META_TOS_URL"
-const envACMEMetaCAAs = "ACMESPIDER_META_CAAS"
-const envACMEMetaWebsite = "ACMESPIDER_META_WEBSITE"
-
-func strIsTruthy(str string) bool {
-	l := strings.TrimSpace(strings.ToLower(str))
-	return l == "yes" || l == "true" || l == "1"
-}
+const envPolicyFile = "ACMESPIDER_POLICY_FILE"
 
 func getKeytype(keystr string) certcrypto.KeyType {
 	l := strings.TrimSpace(strings.ToLower(keystr))
@@ -54,36 +48,242 @@ func getKeytype(keystr string) certcrypto.KeyType {
 	return certcrypto.RSA2048
 }
 
-func runServe(cCtx *cli.Context) error {
-	port := os.Getenv(envPort)
+// isSet reports whether a setting left out of the config is true
+func isSet(b *bool) bool {
+	return b != nil && *b
+}
+
+// loadCertPool reads a PEM bundle from disk, returning nil (i.e. use system roots) if no path is given
+func loadCertPool(pemPath string) (*x509.CertPool, error) {
+	if pemPath == "" {
+		return nil, nil
+	}
+	pemData, err := os.ReadFile(pemPath)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemData) {
+		return nil, fmt.Errorf("no certificates found in %s", pemPath)
+	}
+	return pool, nil
+}
+
+// parseCIDRs parses a list of CIDRs, where bare addresses are taken to be a single host
+func parseCIDRs(strs []string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, s := range strs {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if ip := net.ParseIP(s); ip != nil {
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// getHTTP01Config reads the HTTP-01 validator's settings, leaving anything unset as zero so the defaults apply
+func getHTTP01Config(f *config.File) acme_controller.HTTP01Config {
+	conf := acme_controller.HTTP01Config{
+		Resolvers:           f.InternalResolvers,
+		LookupTimeout:       time.Duration(f.HTTP01.LookupTimeout),
+		ConnectTimeout:      time.Duration(f.HTTP01.ConnectTimeout),
+		ReadTimeout:         time.Duration(f.HTTP01.ReadTimeout),
+		MaxRedirects:        f.HTTP01.MaxRedirects,
+		RequireAllAddresses: isSet(f.HTTP01.RequireAllAddresses),
+	}
+	if f.HTTP01.MaxBodySize != nil {
+		conf.MaxBodySize = *f.HTTP01.MaxBodySize
+	}
+	for _, delay := range f.HTTP01.AttemptSchedule {
+		conf.AttemptSchedule = append(conf.AttemptSchedule, time.Duration(delay))
+	}
+
+	// Validate has made sure every address parses
+	if len(f.HTTP01.Hosts) > 0 {
+		conf.Hosts = map[string][]net.IP{}
+		for name, addrs := range f.HTTP01.Hosts {
+			for _, addr := range addrs {
+				conf.Hosts[name] = append(conf.Hosts[name], net.ParseIP(addr))
+			}
+		}
+	}
+	return conf
+}
+
+// getAbuseConfig reads the limits on each client, starting from the defaults so only setting one to 0 turns it off
+func getAbuseConfig(f *config.File) acme_controller.AbuseConfig {
+	conf := acme_controller.DefaultAbuseConfig()
+
+	if f.Limits.RequestsPerSecond != nil {
+		conf.RequestsPerSecond = *f.Limits.RequestsPerSecond
+	}
+	if f.Limits.RequestBurst != nil {
+		conf.RequestBurst = *f.Limits.RequestBurst
+	}
+	if f.Limits.MaxBodySize != nil {
+		conf.MaxBodyBytes = *f.Limits.MaxBodySize
+	}
+	if f.Limits.AccountsPerNetwork != nil {
+		conf.AccountsPerNetwork = *f.Limits.AccountsPerNetwork
+	}
+	if f.Limits.AccountWindow != 0 {
+		conf.AccountWindow = time.Duration(f.Limits.AccountWindow)
+	}
+	if f.Limits.PendingOrders != nil {
+		conf.MaxPendingOrders = *f.Limits.PendingOrders
+	}
+	if f.Limits.IdentifiersPerOrder != nil {
+		conf.MaxIdentifiersPerOrder = *f.Limits.IdentifiersPerOrder
+	}
+	return conf
+}
+
+// getNonceConfig reads how long nonces last and how many are remembered, leaving anything unset as zero so the defaults apply
+func getNonceConfig(f *config.File) nonce.Config {
+	conf := nonce.Config{
+		Lifetime:    time.Duration(f.Nonce.Lifetime),
+		KeyRotation: time.Duration(f.Nonce.KeyRotation),
+	}
+	if f.Nonce.Capacity != nil {
+		conf.Capacity = *f.Nonce.Capacity
+	}
+	return conf
+}
+
+// getRateLimitConfig reads the upstream rate limit budget, leaving anything unset as zero so the defaults apply
+func getRateLimitConfig(f *config.File) acme_controller.RateLimitConfig {
+	conf := acme_controller.RateLimitConfig{
+		Window:       time.Duration(f.RateLimit.Window),
+		Queue:        isSet(f.RateLimit.Queue),
+		MaxQueueWait: time.Duration(f.RateLimit.MaxQueueWait),
+	}
+	if f.RateLimit.PerDomain != nil {
+		conf.CertsPerRegisteredDomain = *f.RateLimit.PerDomain
+	}
+	if f.RateLimit.PerNameSet != nil {
+		conf.CertsPerNameSet = *f.RateLimit.PerNameSet
+	}
+	return conf
+}
+
+// getApprovalConfig reads which zones need manual approval, and the admin API tokens used to give it, keyed by token
+func getApprovalConfig(f *config.File) (acme_controller.ApprovalConfig, map[string]string) {
+	conf := acme_controller.ApprovalConfig{
+		Domains:    f.Approval.Domains,
+		Expiry:     time.Duration(f.Approval.Expiry),
+		WebhookURL: f.Approval.Webhook,
+	}
+
+	tokens := map[string]string{}
+	for name, token := range f.AdminTokens {
+		tokens[token] = name
+	}
+
+	if len(conf.Domains) > 0 && len(tokens) == 0 {
+		log.Warn("approval.domains is set without any admin_tokens, so approvals can't be given")
+	}
+	return conf, tokens
+}
+
+// getTenantPolicy reads a directory's identifier policy and EAB settings. Validate has made sure the keys decode
+func getTenantPolicy(allowedDomains []string, eabKeys map[string]string, eabRequired *bool) acme_controller.TenantConfig {
+	conf := acme_controller.TenantConfig{
+		AllowedDomains: allowedDomains,
+		RequireEAB:     isSet(eabRequired),
+	}
+	if len(eabKeys) > 0 {
+		conf.EABKeys = map[string][]byte{}
+		for kid, encoded := range eabKeys {
+			conf.EABKeys[kid], _ = base64.RawURLEncoding.DecodeString(strings.TrimRight(strings.TrimSpace(encoded), "="))
+		}
+	}
+	return conf
+}
+
+// getTenants reads the named tenants
+func getTenants(f *config.File) []server.TenantConfig {
+	tenants := []server.TenantConfig{}
+	for _, t := range f.Tenants {
+		policy := getTenantPolicy(t.AllowedDomains, t.EABKeys, t.EABRequired)
+		policy.Name = strings.TrimSpace(strings.ToLower(t.Name))
+
+		tenant := server.TenantConfig{
+			TenantConfig:   policy,
+			UpstreamIssuer: strings.TrimSpace(strings.ToLower(t.UpstreamIssuer)),
+			CADirectory:    t.CADirectory,
+			DNSProvider:    t.DNSProvider,
+			VaultMount:     t.VaultPKIMount,
+			VaultRole:      t.VaultPKIRole,
+		}
+		if t.KeyType != "" {
+			tenant.KeyType = getKeytype(t.KeyType)
+		}
+		tenants = append(tenants, tenant)
+	}
+	return tenants
+}
+
+// buildServerConfig turns the validated config, with the environment already overlaid, into the server's config
+func buildServerConfig(f *config.File) (server.Config, error) {
+	port := f.Port
 	if port == "" {
 		port = "443"
 	}
 
-	useTLS := false
-	useTLSStr := os.Getenv(envUseTLS)
-	if strIsTruthy(useTLSStr) || (useTLSStr == "" && port == "443") {
-		useTLS = true
+	useTLS := isSet(f.TLS) || (f.TLS == nil && port == "443")
+
+	upstreamIssuer := strings.TrimSpace(strings.ToLower(f.Upstream.Issuer))
+	if upstreamIssuer == "" {
+		upstreamIssuer = issuer.UpstreamIssuerACME
+	}
+
+	defaultTenant := getTenantPolicy(f.AllowedDomains, f.EABKeys, f.EABRequired)
+	tenants := getTenants(f)
+
+	usesIssuer := func(name string) bool {
+		if upstreamIssuer == name {
+			return true
+		}
+		for _, tenant := range tenants {
+			if tenant.UpstreamIssuer == name {
+				return true
+			}
+		}
+		return false
 	}
 
-	if !strIsTruthy(os.Getenv(envACMETOSAccept)) {
-		return fmt.Errorf("please indicate that you accept the terms-of-service for your ACME provider by setting %s=true", envACMETOSAccept)
+	if usesIssuer(issuer.UpstreamIssuerACME) && !isSet(f.ACME.TOSAccept) {
+		return server.Config{}, errors.New("please indicate that you accept the terms-of-service for your ACME provider by setting acme.tos_accept to true")
 	}
 
-	baseURL := os.Getenv(envBaseURL)
-	hostname := os.Getenv(envHost)
+	baseURL := f.BaseURL
+	hostname := f.Hostname
 
 	hasHostname := hostname != ""
 	hasBaseurl := baseURL != ""
 
 	if !hasHostname && !hasBaseurl {
-		return fmt.Errorf("please provide a base URL in %s and/or a hostname in %s", envBaseURL, envHost)
+		return server.Config{}, errors.New("please provide a base_url and/or a hostname")
 	}
 
 	if hasBaseurl && !hasHostname {
 		parsed, err := url.Parse(baseURL)
 		if err != nil {
-			return fmt.Errorf("failed to parse provided baseurl: %v", err)
+			return server.Config{}, fmt.Errorf("failed to parse base_url: %v", err)
 		}
 		hostname = parsed.Host
 		log.Infof("Using hostname %q for TLS, parsed from base URL", hostname)
@@ -104,53 +304,168 @@ func runServe(cCtx *cli.Context) error {
 		log.Infof("Using base URL %q calculated from host, port, and scheme", baseURL)
 	}
 
-	dnsProv := os.Getenv(envACMEDNSProvider)
-
-	acmeDirectory := os.Getenv(envACMEDirectory)
+	acmeDirectory := f.ACME.CADirectory
 	if acmeDirectory == "" {
 		acmeDirectory = lego.LEDirectoryProduction
 		log.Infof("No ACME directory specified, defaulting to %s", acmeDirectory)
 	}
 
-	acmeEmail := os.Getenv(envACMEEmail)
-	if acmeEmail == "" {
-		log.Warnf("No email was provided to %s. Most ACME providers require this, please consider setting one.", envACMEEmail)
+	if f.ACME.Email == "" {
+		log.Warn("No acme.email was provided. Most ACME providers require this, please consider setting one.")
 	}
 
-	storagepath := os.Getenv(envStoragePath)
+	storagepath := f.StoragePath
 	if storagepath == "" {
 		storagepath = "./"
 	}
 
-	dnsServerStr := os.Getenv(envACMEPublicResolvers)
-	publicServers := []string{"1.1.1.1", "8.8.8.8"}
-	if dnsServerStr != "" {
-		publicServers = strings.Split(dnsServerStr, ",")
-	} else {
+	publicServers := f.ACME.PublicResolvers
+	if len(publicServers) == 0 {
+		publicServers = []string{"1.1.1.1", "8.8.8.8"}
 		log.Infof("Using default public DNS resolvers of %v", publicServers)
 	}
 
-	return server.Listen(server.Config{
+	approvalConf, adminTokens := getApprovalConfig(f)
+
+	var clientCAs *x509.CertPool
+	if f.ClientCA != "" {
+		if !useTLS {
+			return server.Config{}, errors.New("client_ca requires tls, client certificates are only asked for over TLS")
+		}
+		var err error
+		if clientCAs, err = loadCertPool(f.ClientCA); err != nil {
+			return server.Config{}, fmt.Errorf("failed to load client_ca: %v", err)
+		}
+	}
+
+	trustedProxies, err := parseCIDRs(f.TrustedProxies)
+	if err != nil {
+		return server.Config{}, fmt.Errorf("failed to parse trusted_proxies: %v", err)
+	}
+	proxyProtocol := isSet(f.ProxyProtocol)
+	if proxyProtocol && len(trustedProxies) == 0 {
+		return server.Config{}, errors.New("proxy_protocol requires the proxies' addresses to be set in trusted_proxies")
+	}
+
+	vaultRootCAs, err := loadCertPool(f.Upstream.Vault.CACert)
+	if err != nil {
+		return server.Config{}, fmt.Errorf("failed to load upstream.vault.ca_cert: %v", err)
+	}
+
+	stepCAConf := issuer.StepCAConfig{
+		URL:             f.Upstream.StepCA.URL,
+		ProvisionerName: f.Upstream.StepCA.Provisioner,
+	}
+	if usesIssuer(issuer.UpstreamIssuerStepCA) {
+		keyData, err := os.ReadFile(f.Upstream.StepCA.ProvisionerKey)
+		if err != nil {
+			return server.Config{}, fmt.Errorf("failed to read upstream.stepca.provisioner_key: %v", err)
+		}
+		stepCAConf.ProvisionerKey, err = issuer.LoadStepCAProvisionerKey(keyData, f.Upstream.StepCA.ProvisionerPassword)
+		if err != nil {
+			return server.Config{}, err
+		}
+		stepCAConf.RootCAs, err = loadCertPool(f.Upstream.StepCA.Root)
+		if err != nil {
+			return server.Config{}, fmt.Errorf("failed to load upstream.stepca.root: %v", err)
+		}
+	}
+
+	return server.Config{
 		Port:               port,
-		Email:              acmeEmail,
+		Email:              f.ACME.Email,
 		CADirectory:        acmeDirectory,
-		DNSProvider:        dnsProv,
+		DNSProvider:        f.ACME.DNSProvider,
 		BaseURL:            baseURL,
 		StoragePath:        storagepath,
 		UseTLS:             useTLS,
 		Hostname:           hostname,
-		KeyType:            getKeytype(os.Getenv(envACMEKeyType)),
+		TLSNames:           f.TLSNames,
+		TLSCertFile:        f.TLSCertFile,
+		TLSKeyFile:         f.TLSKeyFile,
+		ClientCAs:          clientCAs,
+		KeyType:            getKeytype(f.ACME.KeyType),
 		PublicDNSResolvers: publicServers,
 
-		MetaTosURL:  os.Getenv(envACMEMetaTosURL),
-		MetaCAAs:    strings.Split(os.Getenv(envACMEMetaCAAs), ","),
-		MetaWebsite: os.Getenv(envACMEMetaWebsite),
-	})
+		DNSPropagationTimeout: time.Duration(f.ACME.PropagationTimeout),
+
+		MetaTosURL:  f.Meta.TOSURL,
+		MetaCAAs:    f.Meta.CAAs,
+		MetaWebsite: f.Meta.Website,
+
+		LocalCADomains:      f.LocalCA.Domains,
+		LocalCACertLifetime: time.Duration(f.LocalCA.CertLifetime),
+
+		SourceIPBinding:      isSet(f.SourceIPBinding),
+		InternalDNSResolvers: f.InternalResolvers,
+		HTTP01:               getHTTP01Config(f),
+		TrustedProxies:       trustedProxies,
+		ProxyProtocol:        proxyProtocol,
+
+		RateLimits: getRateLimitConfig(f),
+		Abuse:      getAbuseConfig(f),
+		CertReuse: acme_controller.CertReuseConfig{
+			Enabled:              isSet(f.CertReuse.Enabled),
+			MinRemainingLifetime: time.Duration(f.CertReuse.MinLifetime),
+		},
+
+		Deactivation: acme_controller.DeactivationConfig{
+			RevokeCertificates: isSet(f.Deactivation.RevokeCerts),
+		},
+
+		Nonce:        getNonceConfig(f),
+		NoncePersist: isSet(f.Nonce.Persist),
+
+		PolicyFile:    f.PolicyFile,
+		Approvals:     approvalConf,
+		AdminTokens:   adminTokens,
+		DefaultTenant: defaultTenant,
+		Tenants:       tenants,
+
+		UpstreamIssuer:       upstreamIssuer,
+		UpstreamCertLifetime: time.Duration(f.Upstream.CertLifetime),
+		Vault: issuer.VaultConfig{
+			Addr:    f.Upstream.Vault.Addr,
+			Token:   f.Upstream.Vault.Token,
+			Mount:   f.Upstream.Vault.PKIMount,
+			Role:    f.Upstream.Vault.PKIRole,
+			RootCAs: vaultRootCAs,
+		},
+		StepCA: stepCAConf,
+
+		HealthDNSProbe:  isSet(f.Health.DNSProbe),
+		ShutdownTimeout: time.Duration(f.ShutdownTimeout),
+	}, nil
 }
 
-func main() {
-	log.SetLevel(log.DebugLevel)
+func runServe(cCtx *cli.Context) error {
+	path := cCtx.Path("config")
+	f, _, err := config.Load(path, os.Getenv)
+	if err != nil {
+		return err
+	}
+	getLogConfig(f).apply()
 
+	conf, err := buildServerConfig(f)
+	if err != nil {
+		return err
+	}
+
+	reloads := make(chan server.Config)
+	conf.Reloads = reloads
+	go reloadOnSIGHUP(path, reloads)
+
+	// The first SIGINT or SIGTERM shuts down gracefully, and a second one kills the process straight away
+	ctx, stop := signal.NotifyContext(cCtx.Context, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	return server.Listen(ctx, conf)
+}
+
+func main() {
 	app := &cli.App{
 		Name:        "ACMESpider",
 		Description: "ACMESpider",
@@ -158,8 +473,65 @@ func main() {
 			{
 				Name:   "serve",
 				Usage:  "run the ACMESpider server",
+				Flags:  []cli.Flag{configFlag},
 				Action: runServe,
 			},
+			{
+				Name:  "config",
+				Usage: "work with config files",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "check",
+						Usage:  "check the config the server would start with, including environment variables",
+						Flags:  []cli.Flag{configFlag},
+						Action: runConfigCheck,
+					},
+				},
+			},
+			{
+				Name:   "doctor",
+				Usage:  "check the DNS provider, public resolvers, upstream and HTTP-01 reachability work with the config",
+				Flags:  doctorFlags,
+				Action: runDoctor,
+			},
+			{
+				Name:  "policy",
+				Usage: "work with issuance policy files",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "test",
+						Usage:  "evaluate a policy against a made-up request, without running the server",
+						Flags:  policyTestFlags,
+						Action: runPolicyTest,
+					},
+				},
+			},
+			{
+				Name:  "approvals",
+				Usage: "review orders held for manual approval, through the admin API",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "list",
+						Usage:  "list approvals, pending ones unless --status says otherwise",
+						Flags:  append([]cli.Flag{&cli.StringFlag{Name: "status", Usage: "pending, approved, denied, expired or all", Value: "pending"}}, approvalsFlags...),
+						Action: runApprovalsList,
+					},
+					{
+						Name:      "approve",
+						Usage:     "approve a pending approval, letting its orders be validated",
+						ArgsUsage: "<approval ID>",
+						Flags:     append([]cli.Flag{&cli.StringFlag{Name: "reason", Usage: "recorded with the decision"}}, approvalsFlags...),
+						Action:    runApprovalsApprove,
+					},
+					{
+						Name:      "deny",
+						Usage:     "deny a pending approval, failing its orders",
+						ArgsUsage: "<approval ID>",
+						Flags:     append([]cli.Flag{&cli.StringFlag{Name: "reason", Usage: "recorded with the decision, and given to the client"}}, approvalsFlags...),
+						Action:    runApprovalsDeny,
+					},
+				},
+			},
 		},
 	}
 
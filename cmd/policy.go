@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/lachlan2k/acmespider/internal/policy"
+	"github.com/urfave/cli/v2"
+)
+
+var policyTestFlags = []cli.Flag{
+	&cli.StringFlag{Name: "file", Usage: "policy file to evaluate", EnvVars: []string{envPolicyFile}, Required: true},
+	&cli.StringFlag{Name: "stage", Usage: "order or finalize", Value: policy.StageOrder},
+	&cli.StringSliceFlag{Name: "identifier", Usage: "name in the order, can be repeated"},
+	&cli.StringFlag{Name: "source-ip", Usage: "address the request comes from"},
+	&cli.StringFlag{Name: "account-id", Usage: "requesting account's ID"},
+	&cli.StringFlag{Name: "tenant", Usage: "tenant the account belongs to"},
+	&cli.StringSliceFlag{Name: "contact", Usage: "account contact, can be repeated"},
+	&cli.StringFlag{Name: "eab-key-id", Usage: "external account the account is bound to"},
+	&cli.DurationFlag{Name: "validity", Usage: "requested certificate lifetime, if the order asks for one"},
+	&cli.PathFlag{Name: "csr", Usage: "PEM CSR to evaluate at the finalize stage"},
+}
+
+// runPolicyTest is a dry run of the policy engine, exiting non-zero if the request would be denied
+func runPolicyTest(cCtx *cli.Context) error {
+	p, err := policy.Load(cCtx.String("file"))
+	if err != nil {
+		return err
+	}
+
+	stage := cCtx.String("stage")
+	if stage != policy.StageOrder && stage != policy.StageFinalize {
+		return fmt.Errorf("stage must be %s or %s", policy.StageOrder, policy.StageFinalize)
+	}
+
+	in := policy.Input{
+		Stage:       stage,
+		AccountID:   cCtx.String("account-id"),
+		Tenant:      cCtx.String("tenant"),
+		Contacts:    cCtx.StringSlice("contact"),
+		EABKeyID:    cCtx.String("eab-key-id"),
+		Identifiers: cCtx.StringSlice("identifier"),
+	}
+
+	if ipStr := cCtx.String("source-ip"); ipStr != "" {
+		in.SourceIP = net.ParseIP(ipStr)
+		if in.SourceIP == nil {
+			return fmt.Errorf("invalid source IP %q", ipStr)
+		}
+	}
+
+	if validity := cCtx.Duration("validity"); validity != 0 {
+		in.NotBefore = time.Now()
+		in.NotAfter = in.NotBefore.Add(validity)
+	}
+
+	if csrPath := cCtx.Path("csr"); csrPath != "" {
+		csrPEM, err := os.ReadFile(csrPath)
+		if err != nil {
+			return err
+		}
+		block, _ := pem.Decode(csrPEM)
+		if block == nil {
+			return fmt.Errorf("no PEM data in %s", csrPath)
+		}
+		in.CSR, err = x509.ParseCertificateRequest(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("failed to parse CSR: %v", err)
+		}
+		if len(in.Identifiers) == 0 {
+			in.Identifiers = in.CSR.DNSNames
+		}
+	}
+
+	decision := p.Evaluate(in)
+
+	rule := decision.Rule
+	if rule == "" {
+		rule = "default"
+	}
+	if decision.Allowed {
+		fmt.Printf("allow (%s)\n", rule)
+		return nil
+	}
+	return cli.Exit(fmt.Sprintf("deny (%s): %s", rule, decision.Message), 1)
+}
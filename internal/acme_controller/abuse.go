@@ -0,0 +1,204 @@
+package acme_controller
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// AbuseConfig limits how much any one client can ask of ACMESpider, as new-nonce, new-account and the directory
+// can be hit by anyone who can reach it. Zero leaves a limit off, besides MaxBodyBytes which always has a default
+type AbuseConfig struct {
+	// Sustained requests per second from each address, allowing bursts of up to RequestBurst
+	RequestsPerSecond float64
+	RequestBurst      int
+	// Largest signed request accepted
+	MaxBodyBytes int64
+
+	// Accounts created from each source network (IPv4 /24, IPv6 /48) within AccountWindow
+	AccountsPerNetwork int
+	AccountWindow      time.Duration
+
+	// Orders each account can have pending or ready at once
+	MaxPendingOrders int
+	// Identifiers in each order
+	MaxIdentifiersPerOrder int
+}
+
+const (
+	defaultMaxBodyBytes  = 64 * 1024
+	defaultAccountWindow = time.Hour
+	// How often addresses that have been quiet long enough to have a full burst again are forgotten
+	requestLimiterSweepInterval = time.Minute
+)
+
+// DefaultAbuseConfig is generous enough for a busy network of well-behaved clients
+func DefaultAbuseConfig() AbuseConfig {
+	return AbuseConfig{
+		RequestsPerSecond:      20,
+		RequestBurst:           40,
+		MaxBodyBytes:           defaultMaxBodyBytes,
+		AccountsPerNetwork:     20,
+		AccountWindow:          defaultAccountWindow,
+		MaxPendingOrders:       100,
+		MaxIdentifiersPerOrder: 100,
+	}
+}
+
+// AbuseLimiter counts requests and new accounts by client. Clients are the same whichever tenant they use,
+// so one is shared by every controller
+type AbuseLimiter struct {
+	conf AbuseConfig
+
+	lock      sync.Mutex
+	requests  map[string]*rate.Limiter
+	lastSweep time.Time
+	// When each recent account was created, by source network
+	accounts map[string][]time.Time
+}
+
+func NewAbuseLimiter(conf AbuseConfig) *AbuseLimiter {
+	if conf.MaxBodyBytes <= 0 {
+		conf.MaxBodyBytes = defaultMaxBodyBytes
+	}
+	if conf.AccountWindow == 0 {
+		conf.AccountWindow = defaultAccountWindow
+	}
+	if conf.RequestBurst < 1 {
+		conf.RequestBurst = 1
+	}
+	return &AbuseLimiter{
+		conf:      conf,
+		requests:  map[string]*rate.Limiter{},
+		lastSweep: time.Now(),
+		accounts:  map[string][]time.Time{},
+	}
+}
+
+// SetAbuseLimiter sets the limiter requests are counted against, which must be shared with every other controller
+func (ac *ACMEController) SetAbuseLimiter(limiter *AbuseLimiter) {
+	ac.abuse = limiter
+}
+
+// MaxBodyBytes is the largest signed request that's read
+func (ac ACMEController) MaxBodyBytes() int64 {
+	return ac.abuse.conf.MaxBodyBytes
+}
+
+// clientKey is what requests are counted against: the address, or the /64 for IPv6, as hosts are usually given a whole one
+func clientKey(ip net.IP) string {
+	if ip.To4() == nil && ip.To16() != nil {
+		return ip.Mask(net.CIDRMask(64, 128)).String()
+	}
+	return ip.String()
+}
+
+// sourceNetwork is what account creation is counted against
+func sourceNetwork(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String() + "/48"
+}
+
+// CheckRequestRate counts a request from ip, turning it away if the address is sending too many
+func (ac ACMEController) CheckRequestRate(ip net.IP) error {
+	b := ac.abuse
+	if b.conf.RequestsPerSecond <= 0 || ip == nil {
+		return nil
+	}
+
+	now := time.Now()
+	key := clientKey(ip)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if now.Sub(b.lastSweep) > requestLimiterSweepInterval {
+		for k, limiter := range b.requests {
+			if limiter.TokensAt(now) >= float64(b.conf.RequestBurst) {
+				delete(b.requests, k)
+			}
+		}
+		b.lastSweep = now
+	}
+
+	limiter, ok := b.requests[key]
+	if !ok {
+		limiter = rate.NewLimiter(rate.Limit(b.conf.RequestsPerSecond), b.conf.RequestBurst)
+		b.requests[key] = limiter
+	}
+
+	reservation := limiter.ReserveN(now, 1)
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		ac.logger.WithField("client", key).Debug("Client is sending too many requests")
+		return RateLimitedProblem("Too many requests from this address", now.Add(delay))
+	}
+	return nil
+}
+
+// checkNewAccountRate counts an account being created from ip, turning it away if its network has created too many recently
+func (ac ACMEController) checkNewAccountRate(ip net.IP) error {
+	b := ac.abuse
+	if b.conf.AccountsPerNetwork <= 0 || ip == nil {
+		return nil
+	}
+
+	now := time.Now()
+	network := sourceNetwork(ip)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	// Drop the ones outside the window, from every network so ones that stop creating accounts are forgotten
+	for n, created := range b.accounts {
+		recent := created[:0]
+		for _, t := range created {
+			if now.Sub(t) < b.conf.AccountWindow {
+				recent = append(recent, t)
+			}
+		}
+		if len(recent) == 0 {
+			delete(b.accounts, n)
+		} else {
+			b.accounts[n] = recent
+		}
+	}
+
+	created := b.accounts[network]
+	if len(created) >= b.conf.AccountsPerNetwork {
+		ac.logger.WithField("network", network).Warn("Too many accounts created from network")
+		return RateLimitedProblem(fmt.Sprintf("Too many accounts created from %s, try again later", network), created[0].Add(b.conf.AccountWindow))
+	}
+	b.accounts[network] = append(created, now)
+	return nil
+}
+
+// checkOrderLimits turns away orders with too many identifiers, or from accounts with too many orders still to be finalized.
+// The pending order limit is checked again when the order's created, so orders made at the same time can't get past it together
+func (ac ACMEController) checkOrderLimits(accountID []byte, identifierCount int) error {
+	conf := ac.abuse.conf
+	if conf.MaxIdentifiersPerOrder > 0 && identifierCount > conf.MaxIdentifiersPerOrder {
+		return MalformedProblem(fmt.Sprintf("Orders can have at most %d identifiers", conf.MaxIdentifiersPerOrder))
+	}
+	if conf.MaxPendingOrders <= 0 {
+		return nil
+	}
+
+	pending, nextExpiry, err := ac.db.CountPendingOrders(string(accountID), time.Now().Unix())
+	if err != nil {
+		return InternalErrorProblem(err)
+	}
+	if pending >= conf.MaxPendingOrders {
+		return pendingOrdersProblem(pending, nextExpiry)
+	}
+	return nil
+}
+
+func pendingOrdersProblem(pending int, nextExpiry int64) *ProblemDetails {
+	return RateLimitedProblem(fmt.Sprintf("Account has %d orders that haven't been finalized, finish or wait for some to expire first", pending), timeUnmarshalDB(nextExpiry))
+}
@@ -0,0 +1,117 @@
+package acme_controller
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lachlan2k/acmespider/internal/db"
+	"github.com/lachlan2k/acmespider/internal/dtos"
+	"github.com/lachlan2k/acmespider/internal/links"
+)
+
+func TestSourceNetworks(t *testing.T) {
+	tests := map[string][2]string{
+		"10.0.3.7":             {"10.0.3.7", "10.0.3.0/24"},
+		"::ffff:10.0.3.7":      {"10.0.3.7", "10.0.3.0/24"},
+		"2001:db8:1:2:3:4:5:6": {"2001:db8:1:2::", "2001:db8:1::/48"},
+	}
+	for addr, want := range tests {
+		ip := net.ParseIP(addr)
+		if got := clientKey(ip); got != want[0] {
+			t.Errorf("expected %s to be rate limited as %s, got %s", addr, want[0], got)
+		}
+		if got := sourceNetwork(ip); got != want[1] {
+			t.Errorf("expected %s to be in network %s, got %s", addr, want[1], got)
+		}
+	}
+}
+
+func TestNewAccountRate(t *testing.T) {
+	ac := New(nil, nil, nil, links.LinkController{})
+	ac.SetAbuseLimiter(NewAbuseLimiter(AbuseConfig{AccountsPerNetwork: 2, AccountWindow: time.Hour}))
+
+	for _, addr := range []string{"10.0.3.1", "10.0.3.2"} {
+		if err := ac.checkNewAccountRate(net.ParseIP(addr)); err != nil {
+			t.Fatalf("expected account from %s to be allowed, got %v", addr, err)
+		}
+	}
+	err := ac.checkNewAccountRate(net.ParseIP("10.0.3.3"))
+	prob, ok := err.(*ProblemDetails)
+	if !ok || prob.Type != rateLimitedErr || prob.RetryAfter().Before(time.Now().Add(59*time.Minute)) {
+		t.Fatalf("expected the third account from the network to be rate limited for the window, got %v", err)
+	}
+	if err = ac.checkNewAccountRate(net.ParseIP("10.0.4.1")); err != nil {
+		t.Fatalf("expected another network to be allowed, got %v", err)
+	}
+
+	// Once they're outside the window, they don't count
+	ac.abuse.lock.Lock()
+	for i := range ac.abuse.accounts["10.0.3.0/24"] {
+		ac.abuse.accounts["10.0.3.0/24"][i] = time.Now().Add(-2 * time.Hour)
+	}
+	ac.abuse.lock.Unlock()
+	if err = ac.checkNewAccountRate(net.ParseIP("10.0.3.3")); err != nil {
+		t.Fatalf("expected accounts outside the window to be forgotten, got %v", err)
+	}
+}
+
+func TestPendingOrderLimit(t *testing.T) {
+	boltDb, err := db.NewBoltDb(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	ac := New(boltDb, nil, nil, links.LinkController{})
+	ac.SetAbuseLimiter(NewAbuseLimiter(AbuseConfig{MaxPendingOrders: 2}))
+	now := time.Now()
+
+	createOrder := func(id string, expires time.Time) error {
+		order := db.DBOrder{ID: id, AccountID: "acct", Status: dtos.OrderStatusPending, Expires: expires.Unix()}
+		return boltDb.CreateOrder(order, ac.abuse.conf.MaxPendingOrders, now.Unix())
+	}
+
+	// Orders that have expired don't count, and neither do other accounts'
+	if err = createOrder("expired", now.Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	err = boltDb.CreateOrder(db.DBOrder{ID: "other", AccountID: "other", Status: dtos.OrderStatusPending, Expires: now.Add(time.Hour).Unix()}, 2, now.Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"first", "second"} {
+		if err = ac.checkOrderLimits([]byte("acct"), 1); err != nil {
+			t.Fatalf("expected order %s to be allowed, got %v", id, err)
+		}
+	}
+	if err = createOrder("first", now.Add(2*time.Minute)); err != nil {
+		t.Fatalf("failed to create first order: %v", err)
+	}
+	if err = createOrder("second", now.Add(time.Minute)); err != nil {
+		t.Fatalf("failed to create second order: %v", err)
+	}
+
+	// A third order that got past the first check alongside them isn't saved
+	var pendingErr *db.PendingOrdersError
+	if err = createOrder("third", now.Add(time.Minute)); !errors.As(err, &pendingErr) || pendingErr.Pending != 2 {
+		t.Fatalf("expected the third order to be refused, got %v", err)
+	}
+	err = ac.checkOrderLimits([]byte("acct"), 1)
+	prob, ok := err.(*ProblemDetails)
+	if !ok || prob.Type != rateLimitedErr || prob.RetryAfter().Unix() != now.Add(time.Minute).Unix() {
+		t.Fatalf("expected to be rate limited until the second order expires, got %v", err)
+	}
+
+	// Once an order's finalized, it makes room for another
+	_, err = boltDb.UpdateOrder([]byte("first"), func(order *db.DBOrder) error {
+		order.Status = dtos.OrderStatusProcessing
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = createOrder("third", now.Add(time.Minute)); err != nil {
+		t.Fatalf("expected the third order to fit once the first was finalized, got %v", err)
+	}
+}
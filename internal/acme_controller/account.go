@@ -2,17 +2,51 @@ package acme_controller
 
 import (
 	"bytes"
+	"errors"
+	"net"
 
 	"github.com/go-jose/go-jose/v3"
 	"github.com/lachlan2k/acmespider/internal/db"
 	"github.com/lachlan2k/acmespider/internal/dtos"
 )
 
-func (ac ACMEController) NewAccount(payload dtos.AccountRequestDTO, jwk jose.JSONWebKey) (*db.DBAccount, error) {
+// NewAccount creates an account for jwk, bound to the subject of the client's certificate if there is one.
+// If jwk already has an account, that's returned instead, along with true. RFC8555 7.3.1
+func (ac ACMEController) NewAccount(payload dtos.AccountRequestDTO, jwk jose.JSONWebKey, clientCertSubject string, sourceIP net.IP) (*db.DBAccount, bool, error) {
+	acc, err := ac.accountForKey(jwk)
+	if err == nil {
+		// The key alone doesn't let another device find the account
+		if err = ac.checkClientCertSubject(acc, clientCertSubject); err != nil {
+			return nil, false, err
+		}
+		return acc, true, nil
+	}
+	if !db.IsErrNotFound(err) {
+		return nil, false, err
+	}
+	if payload.OnlyReturnExisting {
+		return nil, false, AccountDoesNotExistProblem("No account exists with this key")
+	}
+
+	eabKeyID, err := ac.verifyExternalAccountBinding(payload.ExternalAccountBinding, jwk)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Otherwise the account would never be bound, and any device could use it
+	if ac.clientCert.Required && clientCertSubject == "" {
+		return nil, false, UnauthorizedProblem("A client certificate is required")
+	}
+
+	err = ac.checkNewAccountRate(sourceIP)
+	if err != nil {
+		return nil, false, err
+	}
+
 	newId, err := GenerateID()
 
 	if err != nil {
-		return nil, InternalErrorProblem(err)
+		return nil, false, InternalErrorProblem(err)
 	}
 
 	accToCreate := db.DBAccount{
@@ -21,14 +55,44 @@ func (ac ACMEController) NewAccount(payload dtos.AccountRequestDTO, jwk jose.JSO
 		Contact:              payload.Contact,
 		TermsOfServiceAgreed: payload.TermsOfServiceAgreed,
 		Orders:               []string{},
+		Tenant:               ac.tenant.Name,
+		EABKeyID:             eabKeyID,
+		ClientCertSubject:    clientCertSubject,
 	}
 
 	err = ac.db.CreateAccount(accToCreate, &jwk)
+	if errors.Is(err, db.ErrAccountKeyInUse) {
+		// Another request created an account with the key first
+		acc, err = ac.accountForKey(jwk)
+		if err == nil {
+			err = ac.checkClientCertSubject(acc, clientCertSubject)
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		return acc, true, nil
+	}
 	if err != nil {
-		return nil, InternalErrorProblem(err)
+		return nil, false, InternalErrorProblem(err)
 	}
 
-	return &accToCreate, err
+	return &accToCreate, false, nil
+}
+
+// accountForKey returns the tenant's account with jwk, turning away deactivated ones.
+// It returns db.ErrNotFound if there's no account with the key
+func (ac ACMEController) accountForKey(jwk jose.JSONWebKey) (*db.DBAccount, error) {
+	acc, err := ac.db.GetAccountByKey(ac.tenant.Name, &jwk)
+	if err != nil {
+		if db.IsErrNotFound(err) {
+			return nil, err
+		}
+		return nil, InternalErrorProblem(err)
+	}
+	if acc.Status == dtos.AccountStatusDeactivated {
+		return nil, UnauthorizedProblem("Account has been deactivated")
+	}
+	return acc, nil
 }
 
 func (ac ACMEController) GetAccount(accountIDToQuery []byte, requestAccountID []byte) (*db.DBAccount, error) {
@@ -48,6 +112,13 @@ func (ac ACMEController) GetAccount(accountIDToQuery []byte, requestAccountID []
 }
 
 func (ac ACMEController) GetAccountKey(accountID []byte) (*jose.JSONWebKey, error) {
+	inTenant, err := ac.accountInTenant(accountID)
+	if err != nil {
+		return nil, err
+	}
+	if !inTenant {
+		return nil, db.ErrNotFound
+	}
 	return ac.db.GetAccountKey(accountID)
 }
 
@@ -56,21 +127,11 @@ func (ac ACMEController) UpdateAccount(accountIDToQuery []byte, requestAccountID
 		return nil, UnauthorizedProblem("Account ID did not match requested account")
 	}
 
-	acc, err := ac.db.GetAccount(accountIDToQuery)
-	if err != nil {
-		return nil, InternalErrorProblem(err)
-	}
-
 	// There are two kinds of updates we can do
-	// - deactivating the account: we just delete the account to do this, as we 401 anyway when an account isn't recognised
+	// - deactivating the account: it's kept, but every request signed with its key is turned away from then on
 	// - updating Contact field
 	if payload.Status == dtos.AccountStatusDeactivated {
-		acc.Status = dtos.AccountStatusDeactivated
-		err := ac.db.DeleteAccount(accountIDToQuery)
-		if err != nil {
-			return nil, InternalErrorProblem(err)
-		}
-		return acc, nil
+		return ac.deactivateAccount(accountIDToQuery)
 	}
 
 	updatedAccount, err := ac.db.UpdateAccount(accountIDToQuery, func(dbAcc *db.DBAccount) error {
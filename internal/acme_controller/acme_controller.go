@@ -1,21 +1,63 @@
 package acme_controller
 
 import (
-	"github.com/go-acme/lego/v4/lego"
+	"sync/atomic"
+
 	"github.com/lachlan2k/acmespider/internal/db"
+	"github.com/lachlan2k/acmespider/internal/issuer"
 	"github.com/lachlan2k/acmespider/internal/links"
+	"github.com/lachlan2k/acmespider/internal/localca"
+	"github.com/lachlan2k/acmespider/internal/policy"
+	log "github.com/sirupsen/logrus"
 )
 
 type ACMEController struct {
-	db         db.DB
-	acmeClient *lego.Client
-	linkCtrl   links.LinkController
+	db       db.DB
+	upstream issuer.Issuer
+	localCA  *localca.CA
+	linkCtrl links.LinkController
+	http01   *HTTP01Validator
+	sourceIP *sourceIPBinder
+
+	rateBudget   *UpstreamBudget
+	abuse        *AbuseLimiter
+	certReuse    CertReuseConfig
+	tenant       TenantConfig
+	policy       *policy.Engine
+	clientCert   ClientCertConfig
+	deactivation DeactivationConfig
+	// Swapped as a whole, as the webhook can be changed while running
+	approvals *atomic.Pointer[ApprovalConfig]
+	work      *WorkTracker
+	// Carries the fields of the request being handled, if any, including into the work it starts
+	logger *log.Entry
 }
 
-func New(db db.DB, acmeClient *lego.Client, linkCtrl links.LinkController) *ACMEController {
-	return &ACMEController{
-		db:         db,
-		acmeClient: acmeClient,
-		linkCtrl:   linkCtrl,
+// New creates an ACMEController. localCA may be nil, in which case every order is issued upstream
+func New(db db.DB, upstream issuer.Issuer, localCA *localca.CA, linkCtrl links.LinkController) *ACMEController {
+	ac := &ACMEController{
+		db:       db,
+		upstream: upstream,
+		localCA:  localCA,
+		linkCtrl: linkCtrl,
+		http01:   NewHTTP01Validator(DefaultHTTP01Config()),
+
+		rateBudget: NewUpstreamBudget("", RateLimitConfig{}),
+		abuse:      NewAbuseLimiter(AbuseConfig{}),
+		approvals:  &atomic.Pointer[ApprovalConfig]{},
+		work:       NewWorkTracker(),
+		logger:     log.NewEntry(log.StandardLogger()),
 	}
+	ac.SetApprovalConfig(ApprovalConfig{})
+	return ac
+}
+
+// WithLogger returns a copy of the controller that logs with logger, so log lines can be tied to the request they came from
+func (ac ACMEController) WithLogger(logger *log.Entry) *ACMEController {
+	ac.logger = logger
+	return &ac
+}
+
+func (ac *ACMEController) SetHTTP01Config(conf HTTP01Config) {
+	ac.http01 = NewHTTP01Validator(conf)
 }
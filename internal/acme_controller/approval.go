@@ -0,0 +1,452 @@
+package acme_controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lachlan2k/acmespider/internal/db"
+	"github.com/lachlan2k/acmespider/internal/dtos"
+)
+
+const defaultApprovalExpiry = 72 * time.Hour
+
+const approvalWebhookTimeout = 10 * time.Second
+
+var (
+	ErrApprovalNotFound = errors.New("approval not found")
+	ErrApprovalDecided  = errors.New("approval is no longer pending")
+)
+
+// ApprovalConfig holds orders for names in sensitive zones until an operator approves them,
+// the first time an account orders each name. Challenges aren't validated until then
+type ApprovalConfig struct {
+	// Names under these domains need approval. If empty, nothing does
+	Domains []string
+	// How long a request waits for a decision before it expires. If zero, 72 hours
+	Expiry time.Duration
+	// If set, a JSON ApprovalNotificationDTO is POSTed here when approval is requested
+	WebhookURL string
+}
+
+func (ac *ACMEController) SetApprovalConfig(conf ApprovalConfig) {
+	if conf.Expiry == 0 {
+		conf.Expiry = defaultApprovalExpiry
+	}
+	ac.approvals.Store(&conf)
+}
+
+// SetApprovalWebhook changes where approval notifications are sent, leaving the rest of the approval config alone
+func (ac *ACMEController) SetApprovalWebhook(url string) {
+	conf := *ac.approvals.Load()
+	conf.WebhookURL = url
+	ac.approvals.Store(&conf)
+}
+
+func ApprovalToDTO(approval *db.DBApproval) dtos.ApprovalDTO {
+	dto := dtos.ApprovalDTO{
+		ID:          approval.ID,
+		AccountID:   approval.AccountID,
+		Identifier:  approval.Identifier,
+		OrderIDs:    approval.OrderIDs,
+		Status:      approval.Status,
+		RequestedAt: dtos.TimeMarshalDTO(time.Unix(approval.RequestedAt, 0)),
+		Expires:     dtos.TimeMarshalDTO(time.Unix(approval.ExpiresAt, 0)),
+		DecidedBy:   approval.DecidedBy,
+		Reason:      approval.Reason,
+	}
+	if approval.DecidedAt != 0 {
+		dto.DecidedAt = dtos.TimeMarshalDTO(time.Unix(approval.DecidedAt, 0))
+	}
+	return dto
+}
+
+// currentApproval applies expiry, which is only noticed when an approval is read
+func (ac ACMEController) currentApproval(approval *db.DBApproval) (*db.DBApproval, error) {
+	if approval.Status != db.ApprovalStatusPending || time.Now().Unix() < approval.ExpiresAt {
+		return approval, nil
+	}
+
+	ac.logger.WithField("approval_id", approval.ID).WithField("identifier", approval.Identifier).Info("Approval request expired without a decision")
+	return ac.db.UpdateApproval([]byte(approval.ID), func(a *db.DBApproval) error {
+		a.Status = db.ApprovalStatusExpired
+		return nil
+	})
+}
+
+// requestApprovals finds or creates the approvals an order needs, for names in sensitive zones the account hasn't had a certificate for.
+// It returns those still pending, and the earliest they'll expire. If it fails, the order is withdrawn from any it was added to
+func (ac ACMEController) requestApprovals(accountID string, orderID string, identifiers []db.DBOrderIdentifier) (pending []string, expires time.Time, err error) {
+	defer func() {
+		if err != nil {
+			ac.withdrawApprovals(pending, orderID)
+			pending = nil
+		}
+	}()
+
+	conf := ac.approvals.Load()
+	if len(conf.Domains) == 0 {
+		return pending, expires, nil
+	}
+
+	for _, id := range identifiers {
+		name := strings.TrimSuffix(strings.ToLower(id.Value), ".")
+		if !domainMatches(name, conf.Domains) {
+			continue
+		}
+
+		issued, err := ac.db.CertificateIssuedFor(accountID, name)
+		if err != nil {
+			return pending, expires, err
+		}
+		if issued {
+			continue
+		}
+
+		approval, err := ac.requestApproval(accountID, orderID, name)
+		if err != nil {
+			return pending, expires, err
+		}
+		if approval.Status == db.ApprovalStatusApproved {
+			continue
+		}
+
+		pending = append(pending, approval.ID)
+		if approvalExpires := time.Unix(approval.ExpiresAt, 0); expires.IsZero() || approvalExpires.Before(expires) {
+			expires = approvalExpires
+		}
+	}
+
+	return pending, expires, nil
+}
+
+// withdrawApprovals takes an order that couldn't be created off the approvals requested for it.
+// Approvals left with no orders waiting on them are expired, so operators aren't asked about them
+func (ac ACMEController) withdrawApprovals(approvalIDs []string, orderID string) {
+	for _, approvalID := range approvalIDs {
+		_, err := ac.db.UpdateApproval([]byte(approvalID), func(a *db.DBApproval) error {
+			orderIDs := []string{}
+			for _, id := range a.OrderIDs {
+				if id != orderID {
+					orderIDs = append(orderIDs, id)
+				}
+			}
+			a.OrderIDs = orderIDs
+			if len(orderIDs) == 0 && a.Status == db.ApprovalStatusPending {
+				a.Status = db.ApprovalStatusExpired
+			}
+			return nil
+		})
+		if err != nil {
+			ac.logger.WithError(err).WithField("approval_id", approvalID).WithField("order_id", orderID).Error("Failed to withdraw order from approval")
+		}
+	}
+}
+
+// requestApproval finds the account's pending or approved approval for a name, adding the order to it if it's pending,
+// or creates one and notifies the webhook if there isn't one
+func (ac ACMEController) requestApproval(accountID string, orderID string, name string) (*db.DBApproval, error) {
+	id, err := GenerateID()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	approval, created, err := ac.db.RequestApproval(db.DBApproval{
+		ID:          id,
+		AccountID:   accountID,
+		Identifier:  name,
+		OrderIDs:    []string{orderID},
+		Status:      db.ApprovalStatusPending,
+		RequestedAt: now.Unix(),
+		ExpiresAt:   now.Add(ac.approvals.Load().Expiry).Unix(),
+	}, now.Unix())
+	if err != nil || !created {
+		return approval, err
+	}
+
+	ac.logger.WithField("approval_id", id).WithField("account_id", accountID).WithField("identifier", name).Info("Order held for approval")
+	notified := *approval
+	ac.work.run(func(ctx context.Context) {
+		ac.notifyApprovalRequested(ctx, notified)
+	})
+	return approval, nil
+}
+
+func (ac ACMEController) notifyApprovalRequested(ctx context.Context, approval db.DBApproval) {
+	webhookURL := ac.approvals.Load().WebhookURL
+	if webhookURL == "" {
+		return
+	}
+	logger := ac.logger.WithField("approval_id", approval.ID).WithField("webhook", webhookURL)
+
+	body, err := json.Marshal(dtos.ApprovalNotificationDTO{
+		Event:    "approval_requested",
+		Approval: ApprovalToDTO(&approval),
+	})
+	if err != nil {
+		logger.WithError(err).Error("Failed to encode approval notification")
+		return
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(body))
+	if err != nil {
+		logger.WithError(err).Error("Failed to build approval notification")
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := http.Client{Timeout: approvalWebhookTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		logger.WithError(err).Error("Failed to send approval notification")
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		logger.WithField("status", resp.StatusCode).Error("Approval webhook returned an error")
+	}
+}
+
+// awaitingApproval reports whether any of an order's approvals are still pending
+func (ac ACMEController) awaitingApproval(order *db.DBOrder) (bool, error) {
+	for _, approvalID := range order.ApprovalIDs {
+		approval, err := ac.db.GetApproval([]byte(approvalID))
+		if err != nil {
+			return false, err
+		}
+		approval, err = ac.currentApproval(approval)
+		if err != nil {
+			return false, err
+		}
+		if approval.Status == db.ApprovalStatusPending {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// holdChallenge marks a challenge as processing without validating it, if its order is waiting for approval.
+// It's validated once the order is approved
+func (ac ACMEController) holdChallenge(order *db.DBOrder, authzID []byte, challengeIndex int) (bool, error) {
+	waiting, err := ac.awaitingApproval(order)
+	if err != nil || !waiting {
+		return false, err
+	}
+
+	challID := ac.makeChallengeID(string(authzID), challengeIndex)
+	_, err = ac.db.UpdateOrder([]byte(order.ID), func(orderToUpdate *db.DBOrder) error {
+		if !containsString(orderToUpdate.HeldChallengeIDs, challID) {
+			orderToUpdate.HeldChallengeIDs = append(orderToUpdate.HeldChallengeIDs, challID)
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	_, err = ac.db.UpdateAuthz(authzID, func(authzToUpdate *db.DBAuthz) error {
+		authzToUpdate.Challenges[challengeIndex].Status = dtos.ChallengeStatusProcessing
+		return nil
+	})
+	return true, err
+}
+
+// ListApprovals returns approvals with the given status, or all of them if it's empty
+func (ac ACMEController) ListApprovals(status string) ([]db.DBApproval, error) {
+	approvals, err := ac.db.FindApprovals(func(*db.DBApproval) bool { return true })
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := []db.DBApproval{}
+	for i := range approvals {
+		approval, err := ac.currentApproval(&approvals[i])
+		if err != nil {
+			return nil, err
+		}
+		if status == "" || approval.Status == status {
+			filtered = append(filtered, *approval)
+		}
+	}
+	return filtered, nil
+}
+
+func (ac ACMEController) GetApproval(approvalID string) (*db.DBApproval, error) {
+	approval, err := ac.db.GetApproval([]byte(approvalID))
+	if err != nil {
+		if db.IsErrNotFound(err) {
+			return nil, ErrApprovalNotFound
+		}
+		return nil, err
+	}
+	return ac.currentApproval(approval)
+}
+
+// ApprovalTenant returns the tenant of the account an approval is for
+func (ac ACMEController) ApprovalTenant(approvalID string) (string, error) {
+	approval, err := ac.GetApproval(approvalID)
+	if err != nil {
+		return "", err
+	}
+	acc, err := ac.db.GetAccount([]byte(approval.AccountID))
+	if err != nil {
+		return "", err
+	}
+	return acc.Tenant, nil
+}
+
+// decideApproval records an operator's decision on a pending approval
+func (ac ACMEController) decideApproval(approvalID string, status string, approver string, reason string) (*db.DBApproval, error) {
+	approval, err := ac.GetApproval(approvalID)
+	if err != nil {
+		return nil, err
+	}
+	if approval.Status != db.ApprovalStatusPending {
+		return nil, ErrApprovalDecided
+	}
+
+	approval, err = ac.db.UpdateApproval([]byte(approvalID), func(a *db.DBApproval) error {
+		if a.Status != db.ApprovalStatusPending {
+			return ErrApprovalDecided
+		}
+		a.Status = status
+		a.DecidedAt = time.Now().Unix()
+		a.DecidedBy = approver
+		a.Reason = reason
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ac.logger.WithField("approval_id", approval.ID).
+		WithField("account_id", approval.AccountID).
+		WithField("identifier", approval.Identifier).
+		WithField("decided_by", approver).
+		WithField("reason", reason).
+		Infof("Approval %s", status)
+	return approval, nil
+}
+
+// Approve lets the orders waiting on an approval carry on, validating any challenges held in the meantime
+func (ac ACMEController) Approve(approvalID string, approver string, reason string) (*db.DBApproval, error) {
+	approval, err := ac.decideApproval(approvalID, db.ApprovalStatusApproved, approver, reason)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, orderID := range approval.OrderIDs {
+		err = ac.releaseOrder(orderID)
+		if err != nil {
+			ac.logger.WithError(err).WithField("order_id", orderID).Error("Failed to release approved order")
+		}
+	}
+	return approval, nil
+}
+
+func (ac ACMEController) releaseOrder(orderID string) error {
+	order, err := ac.db.GetOrder([]byte(orderID))
+	if err != nil {
+		return err
+	}
+	if order.Status != dtos.OrderStatusPending {
+		return nil
+	}
+	waiting, err := ac.awaitingApproval(order)
+	if err != nil || waiting {
+		return err
+	}
+
+	heldChallengeIDs := order.HeldChallengeIDs
+	_, err = ac.db.UpdateOrder([]byte(orderID), func(orderToUpdate *db.DBOrder) error {
+		// The client may still be polling, so give it as long as a fresh order to finish
+		orderToUpdate.Expires = time.Now().Add(orderExpiryTime).Unix()
+		orderToUpdate.HeldChallengeIDs = nil
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, challID := range heldChallengeIDs {
+		authzID, challengeIndex, err := ac.splitChallengeID([]byte(challID))
+		if err != nil {
+			return err
+		}
+		authz, err := ac.db.UpdateAuthz(authzID, func(authzToUpdate *db.DBAuthz) error {
+			if challengeIndex >= len(authzToUpdate.Challenges) {
+				return fmt.Errorf("challenge index is invalid")
+			}
+			authzToUpdate.Challenges[challengeIndex].Status = dtos.ChallengeStatusPending
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		ac.work.run(func(ctx context.Context) {
+			err := ac.doHTTP01ChallengeVerifyLoop(ctx, order, authz, challengeIndex, false)
+			if err != nil {
+				ac.logger.WithError(err).WithField("authz_id", authz.ID).Error("Failed to validate challenge held for approval")
+			}
+		})
+	}
+	return nil
+}
+
+// Deny fails the orders waiting on an approval, with a rejectedIdentifier error for the name
+func (ac ACMEController) Deny(approvalID string, approver string, reason string) (*db.DBApproval, error) {
+	approval, err := ac.decideApproval(approvalID, db.ApprovalStatusDenied, approver, reason)
+	if err != nil {
+		return nil, err
+	}
+
+	detail := "An operator denied issuance for this name"
+	if reason != "" {
+		detail += ": " + reason
+	}
+
+	for _, orderID := range approval.OrderIDs {
+		err = ac.rejectApprovedIdentifier(orderID, approval.Identifier, detail)
+		if err != nil {
+			ac.logger.WithError(err).WithField("order_id", orderID).Error("Failed to fail denied order")
+		}
+	}
+	return approval, nil
+}
+
+func (ac ACMEController) rejectApprovedIdentifier(orderID string, name string, detail string) error {
+	order, err := ac.db.GetOrder([]byte(orderID))
+	if err != nil {
+		return err
+	}
+	if order.Status != dtos.OrderStatusPending {
+		return nil
+	}
+
+	for _, authzID := range order.AuthzIDs {
+		_, err = ac.db.UpdateAuthz([]byte(authzID), func(authzToUpdate *db.DBAuthz) error {
+			if strings.TrimSuffix(strings.ToLower(authzToUpdate.Identifier.Value), ".") != name {
+				return nil
+			}
+			prob := RejectedIdentifierProblem(IdentifierForProblemDetails{Type: authzToUpdate.Identifier.Type, Value: authzToUpdate.Identifier.Value}, detail)
+			authzToUpdate.Status = dtos.AuthzStatusInvalid
+			for i := range authzToUpdate.Challenges {
+				authzToUpdate.Challenges[i].Status = dtos.ChallengeStatusInvalid
+				authzToUpdate.Challenges[i].Error = problemToDB(prob)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return ac.recomputeOrderStatus([]byte(orderID))
+}
@@ -0,0 +1,118 @@
+package acme_controller
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"time"
+
+	"github.com/lachlan2k/acmespider/internal/db"
+	"github.com/lachlan2k/acmespider/internal/dtos"
+)
+
+// CertReuseConfig lets a finalize request be answered with a certificate the account already has for the same key and names,
+// rather than issuing another. Clients that re-finalize the same order in a loop otherwise spend upstream quota every time
+type CertReuseConfig struct {
+	Enabled bool
+	// Certificates with less than this left before they expire aren't reused.
+	// If zero, it's two thirds of the certificate's lifetime, so a client renewing at the usual point gets a new one
+	MinRemainingLifetime time.Duration
+}
+
+func (ac *ACMEController) SetCertReuseConfig(conf CertReuseConfig) {
+	ac.certReuse = conf
+}
+
+func publicKeySHA256(csr *x509.CertificateRequest) string {
+	sum := sha256.Sum256(csr.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+// parseLeaf returns the first certificate in a PEM bundle
+func parseLeaf(certPEM []byte) (*x509.Certificate, error) {
+	for {
+		var block *pem.Block
+		block, certPEM = pem.Decode(certPEM)
+		if block == nil {
+			return nil, fmt.Errorf("no certificate in PEM bundle")
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
+
+// reusableCertificate finds a certificate previously issued to the order's account for the CSR's key and the order's names,
+// with enough lifetime left. Returns nil if there isn't one, or reuse is disabled
+func (ac ACMEController) reusableCertificate(order *db.DBOrder, csr *x509.CertificateRequest) (*db.DBCertificate, error) {
+	// An order asking for particular validity wants a new certificate
+	if !ac.certReuse.Enabled || order.NotBefore != nil || order.NotAfter != nil {
+		return nil, nil
+	}
+
+	certs, err := ac.db.FindCertificates(order.AccountID, publicKeySHA256(csr), namesFor(order.Identifiers).nameSet)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var best *db.DBCertificate
+	for i := range certs {
+		cert := &certs[i]
+		notAfter := time.Unix(cert.NotAfter, 0)
+
+		minRemaining := ac.certReuse.MinRemainingLifetime
+		if minRemaining == 0 {
+			minRemaining = notAfter.Sub(time.Unix(cert.NotBefore, 0)) * 2 / 3
+		}
+		if notAfter.Sub(now) < minRemaining {
+			continue
+		}
+
+		// Revocations through revoke-cert or account deactivation are recorded, whichever CA issued the certificate.
+		// The local CA is asked as well, as it knows about revocations from before they were recorded
+		if cert.RevokedAt != nil {
+			continue
+		}
+		revoked, err := ac.isRevokedByLocalCA(cert)
+		if err != nil {
+			return nil, err
+		}
+		if revoked {
+			continue
+		}
+
+		if best == nil || cert.NotAfter > best.NotAfter {
+			best = cert
+		}
+	}
+	return best, nil
+}
+
+func (ac ACMEController) isRevokedByLocalCA(cert *db.DBCertificate) (bool, error) {
+	if ac.localCA == nil {
+		return false, nil
+	}
+	leaf, err := parseLeaf(cert.Certificate)
+	if err != nil {
+		return false, err
+	}
+	return ac.localCA.IsRevoked(leaf)
+}
+
+// reuseCertificate completes order with an existing certificate
+func (ac ACMEController) reuseCertificate(order *db.DBOrder, cert *db.DBCertificate) (*db.DBOrder, error) {
+	ac.logger.WithField("order_id", order.ID).WithField("certificate_id", cert.ID).Info("Reusing existing certificate for identical finalize request")
+
+	updated, err := ac.db.UpdateOrder([]byte(order.ID), func(orderToUpdate *db.DBOrder) error {
+		orderToUpdate.Status = dtos.OrderStatusValid
+		orderToUpdate.CertificateID = cert.ID
+		return nil
+	})
+	if err != nil {
+		return nil, InternalErrorProblem(err)
+	}
+	return updated, nil
+}
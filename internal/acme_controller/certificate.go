@@ -1,7 +1,16 @@
 package acme_controller
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
 	"github.com/lachlan2k/acmespider/internal/db"
+	"github.com/lachlan2k/acmespider/internal/issuer"
+	"github.com/lachlan2k/acmespider/internal/localca"
 )
 
 func (ac ACMEController) GetCertificate(accountID []byte, certID []byte) ([]byte, error) {
@@ -21,3 +30,118 @@ func (ac ACMEController) GetCertificate(accountID []byte, certID []byte) ([]byte
 
 	return dbCert.Certificate, nil
 }
+
+// RFC5280 5.3.1: reason codes go up to aACompromise, and 7 isn't used
+const (
+	revocationReasonAACompromise = 10
+	revocationReasonUnused       = 7
+)
+
+// RevokeCertificate revokes a certificate with the issuer that issued it. RFC8555 7.6.
+// The request is signed either by the account the certificate was issued to, in which case accountID is set,
+// or by the certificate's own key, in which case jwk is
+func (ac ACMEController) RevokeCertificate(certDER []byte, reason *uint, accountID []byte, jwk *jose.JSONWebKey) error {
+	leaf, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return MalformedProblem("Certificate could not be parsed")
+	}
+
+	var revocationReason uint
+	if reason != nil {
+		revocationReason = *reason
+	}
+	if revocationReason > revocationReasonAACompromise || revocationReason == revocationReasonUnused {
+		return BadRevocationReasonProblem("Revocation reason must be an RFC5280 reason code")
+	}
+
+	dbCert, err := ac.db.GetCertificateBySerial(db.CertificateSerial(leaf.SerialNumber))
+	if err != nil {
+		if db.IsErrNotFound(err) {
+			return UnauthorizedProblem("Certificate was not issued by this server")
+		}
+		return InternalErrorProblem(err)
+	}
+	storedLeaf, err := parseLeaf(dbCert.Certificate)
+	if err != nil {
+		return InternalErrorProblem(err)
+	}
+	// Serials are only unique per issuer
+	if !bytes.Equal(storedLeaf.Raw, leaf.Raw) {
+		return UnauthorizedProblem("Certificate was not issued by this server")
+	}
+
+	inTenant, err := ac.accountInTenant([]byte(dbCert.AccountID))
+	if err != nil {
+		return InternalErrorProblem(err)
+	}
+	if !inTenant {
+		return UnauthorizedProblem("Certificate was not issued by this server")
+	}
+
+	if accountID != nil {
+		if dbCert.AccountID != string(accountID) {
+			return UnauthorizedProblem("Certificate was issued to a different account")
+		}
+	} else {
+		ok, err := jwkMatchesCertificate(jwk, leaf)
+		if err != nil {
+			return InternalErrorProblem(err)
+		}
+		if !ok {
+			return UnauthorizedProblem("Request was not signed with the certificate's key")
+		}
+	}
+
+	if dbCert.RevokedAt != nil {
+		return AlreadyRevokedProblem("")
+	}
+	return ac.revoke(dbCert, leaf, revocationReason)
+}
+
+func jwkMatchesCertificate(jwk *jose.JSONWebKey, leaf *x509.Certificate) (bool, error) {
+	if jwk == nil {
+		return false, nil
+	}
+	requestThumbprint, err := jwk.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return false, nil
+	}
+	certThumbprint, err := (&jose.JSONWebKey{Key: leaf.PublicKey}).Thumbprint(crypto.SHA256)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(requestThumbprint, certThumbprint), nil
+}
+
+// revoke revokes cert with the issuer of the order it was issued for, and records that it was
+func (ac ACMEController) revoke(cert *db.DBCertificate, leaf *x509.Certificate, reason uint) error {
+	order, err := ac.db.GetOrder([]byte(cert.OrderID))
+	if err != nil {
+		return InternalErrorProblem(err)
+	}
+
+	err = ac.issuerForOrder(order).Revoke(leaf, reason)
+	if err != nil && !errors.Is(err, localca.ErrAlreadyRevoked) {
+		wrapped := InternalErrorProblem(err)
+		var upstreamProb *issuer.Problem
+		if errors.As(err, &upstreamProb) {
+			if prob := upstreamProblem(upstreamProb, wrapped); prob != nil {
+				return prob
+			}
+		}
+		ac.logger.WithError(err).WithField("certificate_id", cert.ID).WithField("error_id", wrapped.ID()).Error("Failed to revoke certificate")
+		return wrapped
+	}
+
+	now := timeMarshalDB(time.Now())
+	_, err = ac.db.UpdateCertificate([]byte(cert.ID), func(certToUpdate *db.DBCertificate) error {
+		certToUpdate.RevokedAt = &now
+		certToUpdate.RevocationReason = int(reason)
+		return nil
+	})
+	if err != nil {
+		return InternalErrorProblem(err)
+	}
+	ac.logger.WithField("certificate_id", cert.ID).WithField("reason", reason).Info("Certificate revoked")
+	return nil
+}
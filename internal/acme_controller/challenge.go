@@ -31,6 +31,11 @@ func (ac ACMEController) splitChallengeID(challID []byte) (authzID []byte, chall
 }
 
 func (ac ACMEController) InitiateChallenge(challID []byte, requesterAccountID []byte) (*db.DBAuthzChallenge, error) {
+	err := ac.work.checkNotDraining()
+	if err != nil {
+		return nil, err
+	}
+
 	authzID, challengeIndex, err := ac.splitChallengeID(challID)
 	if err != nil {
 		return nil, err
@@ -54,7 +59,13 @@ func (ac ACMEController) InitiateChallenge(challID []byte, requesterAccountID []
 		return nil, InternalErrorProblem(fmt.Errorf("failed to get order when initiating challenge: %v", err))
 	}
 
-	err = ac.startHTTP01Challenge(order, authz, challengeIndex)
+	held, err := ac.holdChallenge(order, authzID, challengeIndex)
+	if err != nil {
+		return nil, InternalErrorProblem(err)
+	}
+	if !held {
+		err = ac.startHTTP01Challenge(order, authz, challengeIndex)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -96,17 +107,40 @@ func (ac ACMEController) recomputeOrderStatus(orderID []byte) error {
 	}
 
 	allValid := true
+	failed := []ProblemDetails{}
 	for _, authzID := range order.AuthzIDs {
 		authz, err := ac.db.GetAuthz([]byte(authzID))
 		if err != nil {
 			return err
 		}
+		if authz.Status == dtos.AuthzStatusInvalid {
+			failed = append(failed, authzProblem(authz))
+		}
 		if authz.Status != dtos.AuthzStatusValid {
 			allValid = false
-			break
 		}
 	}
 
+	// Any authz failing means the order can never be fulfilled
+	if len(failed) > 0 {
+		orderErr := CompoundProblem(fmt.Sprintf("Validation failed for %d identifiers", len(failed)), failed)
+		if len(failed) == 1 {
+			orderErr = &ProblemDetails{
+				Type:        failed[0].Type,
+				Detail:      fmt.Sprintf("Validation failed for %s", failed[0].Identifier.Value),
+				HTTPStatus:  failed[0].HTTPStatus,
+				Subproblems: failed,
+			}
+		}
+
+		_, err := ac.db.UpdateOrder(orderID, func(orderToUpdate *db.DBOrder) error {
+			orderToUpdate.Status = dtos.OrderStatusInvalid
+			orderToUpdate.Error = problemToDB(orderErr)
+			return nil
+		})
+		return err
+	}
+
 	if allValid {
 		ac.db.UpdateOrder(orderID, func(orderToUpdate *db.DBOrder) error {
 			orderToUpdate.Status = "ready"
@@ -116,3 +150,18 @@ func (ac ACMEController) recomputeOrderStatus(orderID []byte) error {
 
 	return nil
 }
+
+// authzProblem explains why an invalid authz failed, as a subproblem for its identifier
+func authzProblem(authz *db.DBAuthz) ProblemDetails {
+	prob := UnauthorizedProblem("Authorization is " + authz.Status)
+	for _, chall := range authz.Challenges {
+		if chall.Error != nil {
+			prob = problemFromDB(chall.Error)
+			break
+		}
+	}
+
+	prob.Identifier = &IdentifierForProblemDetails{Type: authz.Identifier.Type, Value: authz.Identifier.Value}
+	prob.Subproblems = nil
+	return *prob
+}
@@ -0,0 +1,89 @@
+package acme_controller
+
+import (
+	"github.com/lachlan2k/acmespider/internal/db"
+)
+
+// ClientCertConfig is whether clients must present a certificate from the trust bundle before using the API.
+// If so, each account is bound to the subject of the certificate it was created with, or its SANs if the subject is empty, and can't be used with any other
+type ClientCertConfig struct {
+	Required bool
+}
+
+func (ac *ACMEController) SetClientCertConfig(conf ClientCertConfig) {
+	ac.clientCert = conf
+}
+
+func (ac ACMEController) ClientCertRequired() bool {
+	return ac.clientCert.Required
+}
+
+// CheckClientCert makes sure an account is used with the client certificate it's bound to.
+// Accounts that aren't bound yet pass, and are bound by BindClientCert once the request is known to be genuine
+func (ac ACMEController) CheckClientCert(accountID []byte, subject string) error {
+	if !ac.clientCert.Required {
+		return nil
+	}
+
+	account, err := ac.db.GetAccount(accountID)
+	if err != nil {
+		if db.IsErrNotFound(err) {
+			return UnauthorizedProblem("")
+		}
+		return InternalErrorProblem(err)
+	}
+	return ac.checkClientCertSubject(account, subject)
+}
+
+func (ac ACMEController) checkClientCertSubject(account *db.DBAccount, subject string) error {
+	if !ac.clientCert.Required {
+		return nil
+	}
+	// Nothing to bind to, so it would pass on any account
+	if subject == "" {
+		return UnauthorizedProblem("A client certificate is required")
+	}
+	if account.ClientCertSubject == "" || account.ClientCertSubject == subject {
+		return nil
+	}
+	ac.logger.WithField("bound_subject", account.ClientCertSubject).WithField("client_subject", subject).Warn("Account used with a different client certificate")
+	return UnauthorizedProblem("Account is bound to a different client certificate")
+}
+
+// BindClientCert binds accounts created before certificates were required to the first one they're used with.
+// It must only be called once the request's nonce and URL have been checked, so a replayed request can't claim an account
+func (ac ACMEController) BindClientCert(accountID []byte, subject string) error {
+	if !ac.clientCert.Required {
+		return nil
+	}
+	if subject == "" {
+		return UnauthorizedProblem("A client certificate is required")
+	}
+
+	account, err := ac.db.GetAccount(accountID)
+	if err != nil {
+		if db.IsErrNotFound(err) {
+			return UnauthorizedProblem("")
+		}
+		return InternalErrorProblem(err)
+	}
+	if account.ClientCertSubject != "" {
+		return ac.checkClientCertSubject(account, subject)
+	}
+
+	_, err = ac.db.UpdateAccount(accountID, func(dbAcc *db.DBAccount) error {
+		if dbAcc.ClientCertSubject != "" && dbAcc.ClientCertSubject != subject {
+			return UnauthorizedProblem("Account is bound to a different client certificate")
+		}
+		dbAcc.ClientCertSubject = subject
+		return nil
+	})
+	if err != nil {
+		if prob, ok := err.(*ProblemDetails); ok {
+			return prob
+		}
+		return InternalErrorProblem(err)
+	}
+	ac.logger.WithField("client_subject", subject).Info("Bound account to client certificate")
+	return nil
+}
@@ -0,0 +1,44 @@
+package acme_controller
+
+import (
+	"crypto/x509"
+	"fmt"
+	"strings"
+
+	"github.com/lachlan2k/acmespider/internal/db"
+)
+
+// Upstream CAs check the CSR against the order themselves, but the local CA signs whatever it's handed,
+// so finalize has to hold every CSR to the order before it reaches an issuer
+
+// RFC8555 7.4: the CSR must request exactly the identifiers in the order
+func checkCSRMatchesOrder(csr *x509.CertificateRequest, order *db.DBOrder) error {
+	csrNames := map[string]bool{}
+	for _, name := range csr.DNSNames {
+		csrNames[strings.ToLower(name)] = true
+	}
+	if csr.Subject.CommonName != "" {
+		csrNames[strings.ToLower(csr.Subject.CommonName)] = true
+	}
+
+	orderNames := map[string]bool{}
+	for _, id := range order.Identifiers {
+		orderNames[strings.ToLower(id.Value)] = true
+	}
+
+	for name := range csrNames {
+		if !orderNames[name] {
+			return BadCSRProblem(fmt.Sprintf("CSR requested %s, which is not an identifier in the order", name))
+		}
+	}
+	for name := range orderNames {
+		if !csrNames[name] {
+			return BadCSRProblem(fmt.Sprintf("CSR did not request %s, which is an identifier in the order", name))
+		}
+	}
+	if len(csr.IPAddresses) > 0 || len(csr.EmailAddresses) > 0 || len(csr.URIs) > 0 {
+		return BadCSRProblem("CSR may only request DNS names")
+	}
+
+	return nil
+}
@@ -0,0 +1,36 @@
+package acme_controller
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"testing"
+
+	"github.com/lachlan2k/acmespider/internal/db"
+)
+
+func TestCheckCSRMatchesOrder(t *testing.T) {
+	order := &db.DBOrder{Identifiers: []db.DBOrderIdentifier{
+		{Type: "dns", Value: "printer.lan"},
+		{Type: "dns", Value: "scanner.lan"},
+	}}
+
+	tests := []struct {
+		name string
+		csr  x509.CertificateRequest
+		ok   bool
+	}{
+		{"exact", x509.CertificateRequest{DNSNames: []string{"printer.lan", "scanner.lan"}}, true},
+		{"case and common name", x509.CertificateRequest{Subject: pkix.Name{CommonName: "Printer.lan"}, DNSNames: []string{"SCANNER.lan"}}, true},
+		{"missing name", x509.CertificateRequest{DNSNames: []string{"printer.lan"}}, false},
+		{"extra name", x509.CertificateRequest{DNSNames: []string{"printer.lan", "scanner.lan", "nas.lan"}}, false},
+		{"extra common name", x509.CertificateRequest{Subject: pkix.Name{CommonName: "nas.lan"}, DNSNames: []string{"printer.lan", "scanner.lan"}}, false},
+		{"ip address", x509.CertificateRequest{DNSNames: []string{"printer.lan", "scanner.lan"}, IPAddresses: []net.IP{net.ParseIP("10.0.0.1")}}, false},
+	}
+	for _, tt := range tests {
+		err := checkCSRMatchesOrder(&tt.csr, order)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: expected ok=%v, got %v", tt.name, tt.ok, err)
+		}
+	}
+}
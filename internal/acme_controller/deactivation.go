@@ -0,0 +1,114 @@
+package acme_controller
+
+import (
+	"time"
+
+	"github.com/lachlan2k/acmespider/internal/db"
+	"github.com/lachlan2k/acmespider/internal/dtos"
+)
+
+// DeactivationConfig is what happens to an account's certificates when it's deactivated.
+// Its unfinished orders and authorizations are always deactivated along with it
+type DeactivationConfig struct {
+	// Revoke the account's certificates that haven't expired yet
+	RevokeCertificates bool
+}
+
+// RFC5280 5.3.1, the reason certificates of deactivated accounts are revoked with
+const revocationReasonCessationOfOperation = 5
+
+func (ac *ACMEController) SetDeactivationConfig(conf DeactivationConfig) {
+	ac.deactivation = conf
+}
+
+// CheckAccountActive turns away requests from accounts that have been deactivated. RFC8555 7.3.6
+func (ac ACMEController) CheckAccountActive(accountID []byte) error {
+	account, err := ac.db.GetAccount(accountID)
+	if err != nil {
+		if db.IsErrNotFound(err) {
+			return UnauthorizedProblem("")
+		}
+		return InternalErrorProblem(err)
+	}
+	if account.Status == dtos.AccountStatusDeactivated {
+		return UnauthorizedProblem("Account has been deactivated")
+	}
+	return nil
+}
+
+// deactivateAccount marks the account deactivated, keeping it and its key, then deactivates everything it left unfinished.
+// Orders already processing are stopped by startProcessing, which checks the account before issuing
+func (ac ACMEController) deactivateAccount(accountID []byte) (*db.DBAccount, error) {
+	now := timeMarshalDB(time.Now())
+	acc, err := ac.db.UpdateAccount(accountID, func(dbAcc *db.DBAccount) error {
+		dbAcc.Status = dtos.AccountStatusDeactivated
+		dbAcc.DeactivatedAt = &now
+		return nil
+	})
+	if err != nil {
+		return nil, InternalErrorProblem(err)
+	}
+	ac.logger.Info("Account deactivated")
+
+	// The account's deactivated either way, so failures from here on are only logged
+	prob := UnauthorizedProblem("Account was deactivated")
+	for _, orderID := range acc.Orders {
+		order, err := ac.db.UpdateOrder([]byte(orderID), func(orderToUpdate *db.DBOrder) error {
+			if orderToUpdate.Status == dtos.OrderStatusPending || orderToUpdate.Status == dtos.OrderStatusReady {
+				orderToUpdate.Status = dtos.OrderStatusInvalid
+				orderToUpdate.Error = problemToDB(prob)
+			}
+			return nil
+		})
+		if err != nil {
+			if !db.IsErrNotFound(err) {
+				ac.logger.WithError(err).WithField("order_id", orderID).Error("Failed to deactivate order of deactivated account")
+			}
+			continue
+		}
+
+		for _, authzID := range order.AuthzIDs {
+			_, err = ac.db.UpdateAuthz([]byte(authzID), func(authzToUpdate *db.DBAuthz) error {
+				if authzToUpdate.Status == dtos.AuthzStatusPending {
+					authzToUpdate.Status = dtos.AuthzStatusDeactivated
+				}
+				return nil
+			})
+			if err != nil && !db.IsErrNotFound(err) {
+				ac.logger.WithError(err).WithField("authz_id", authzID).Error("Failed to deactivate authz of deactivated account")
+			}
+		}
+
+		if ac.deactivation.RevokeCertificates && order.Status == dtos.OrderStatusValid && order.CertificateID != "" {
+			ac.revokeForDeactivation(order)
+		}
+	}
+
+	return acc, nil
+}
+
+// revokeForDeactivation revokes the certificate order was issued, unless it's already expired or revoked
+func (ac ACMEController) revokeForDeactivation(order *db.DBOrder) {
+	logger := ac.logger.WithField("order_id", order.ID).WithField("cert_id", order.CertificateID)
+
+	cert, err := ac.db.GetCertificate([]byte(order.CertificateID))
+	if err != nil {
+		logger.WithError(err).Error("Failed to get certificate of deactivated account")
+		return
+	}
+	leaf, err := parseLeaf(cert.Certificate)
+	if err != nil {
+		logger.WithError(err).Error("Failed to parse certificate of deactivated account")
+		return
+	}
+	if cert.RevokedAt != nil || time.Now().After(leaf.NotAfter) {
+		return
+	}
+
+	err = ac.revoke(cert, leaf, revocationReasonCessationOfOperation)
+	if err != nil {
+		logger.WithError(err).Error("Failed to revoke certificate of deactivated account")
+		return
+	}
+	logger.Info("Revoked certificate of deactivated account")
+}
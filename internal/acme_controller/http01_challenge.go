@@ -1,28 +1,23 @@
 package acme_controller
 
 import (
-	"bytes"
+	"context"
 	"crypto"
 	"encoding/base64"
 	"fmt"
-	"io"
-	"net/http"
-	"net/url"
-	"strings"
 	"time"
 
 	"github.com/lachlan2k/acmespider/internal/db"
 	"github.com/lachlan2k/acmespider/internal/dtos"
-	"github.com/sirupsen/logrus"
 )
 
 const HTTP01ChallengeType = "http-01"
 
 func (ac ACMEController) startHTTP01Challenge(order *db.DBOrder, authz *db.DBAuthz, challengeIndex int) error {
 	errChan := make(chan error, 1)
-	go func() {
-		errChan <- ac.doHTTP01ChallengeVerifyLoop(order, authz, challengeIndex)
-	}()
+	ac.work.run(func(ctx context.Context) {
+		errChan <- ac.doHTTP01ChallengeVerifyLoop(ctx, order, authz, challengeIndex, false)
+	})
 
 	select {
 	case err := <-errChan:
@@ -32,7 +27,9 @@ func (ac ACMEController) startHTTP01Challenge(order *db.DBOrder, authz *db.DBAut
 	}
 }
 
-func (ac ACMEController) doHTTP01ChallengeVerifyLoop(order *db.DBOrder, authz *db.DBAuthz, challengeIndex int) error {
+// doHTTP01ChallengeVerifyLoop validates a challenge, making attempts on the configured schedule.
+// If ctx is done first, the server is shutting down, so the challenge is left processing to be resumed after the restart
+func (ac ACMEController) doHTTP01ChallengeVerifyLoop(ctx context.Context, order *db.DBOrder, authz *db.DBAuthz, challengeIndex int, resume bool) error {
 	lockSuccess, err := ac.db.TryTakeAuthzLock([]byte(authz.ID))
 	if err != nil {
 		return err
@@ -40,6 +37,8 @@ func (ac ACMEController) doHTTP01ChallengeVerifyLoop(order *db.DBOrder, authz *d
 	if !lockSuccess {
 		return fmt.Errorf("authz %s is locked - challenge in progress", authz.ID)
 	}
+	ac.work.startValidating(authz)
+	defer ac.work.doneValidating(authz.ID)
 	defer ac.db.UnlockAuthz([]byte(authz.ID))
 	defer ac.recomputeOrderStatus([]byte(order.ID))
 
@@ -50,7 +49,8 @@ func (ac ACMEController) doHTTP01ChallengeVerifyLoop(order *db.DBOrder, authz *d
 	if challenge.Type != HTTP01ChallengeType {
 		return fmt.Errorf("challenge type is %s not %s", challenge.Type, HTTP01ChallengeType)
 	}
-	if challenge.Status != dtos.ChallengeStatusPending {
+	resumable := resume && challenge.Status == dtos.ChallengeStatusProcessing
+	if challenge.Status != dtos.ChallengeStatusPending && !resumable {
 		return fmt.Errorf("challenge status is %s not %s", challenge.Status, dtos.ChallengeStatusPending)
 	}
 
@@ -59,75 +59,56 @@ func (ac ACMEController) doHTTP01ChallengeVerifyLoop(order *db.DBOrder, authz *d
 		return err
 	}
 
-	computedThumbprint, err := accKey.Thumbprint(crypto.SHA256)
+	thumbprint, err := accKey.Thumbprint(crypto.SHA256)
 	if err != nil {
 		return err
 	}
-
-	challURL := url.URL{
-		Scheme: "http",
-		Host:   authz.Identifier.Value,
-		Path:   "/.well-known/acme-challenge/" + challenge.Token,
-	}
-
-	attempt := func() bool {
-		resp, err := http.Get(challURL.String())
-		if err != nil {
-			logrus.WithError(err).WithField("url", challURL.String()).Debug("failed to make request when completing challenge")
-			return false
-		}
-
-		respBody, err := io.ReadAll(resp.Body)
-		if err != nil {
-			logrus.WithError(err).WithField("url", challURL.String()).Debug("failed to ready body when completing challenge")
-			return false
-		}
-
-		token, thumbprint, cutOk := strings.Cut(string(respBody), ".")
-		if !cutOk {
-			return false
-		}
-
-		if token != challenge.Token {
-			return false
-		}
-
-		decodedThumbprint, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(thumbprint, " "))
-		if err != nil {
-			return false
-		}
-
-		return bytes.Equal(computedThumbprint, decodedThumbprint)
-	}
+	keyAuth := challenge.Token + "." + base64.RawURLEncoding.EncodeToString(thumbprint)
 
 	_, err = ac.db.UpdateAuthz([]byte(authz.ID), func(authzToUpdate *db.DBAuthz) error {
 		authzToUpdate.Challenges[challengeIndex].Status = dtos.ChallengeStatusProcessing
 		return nil
 	})
 
-	// Tries once a second for a minute
-	endTime := time.Now().Add(time.Minute)
-	for time.Now().Before(endTime) {
-		result := attempt()
-		if result {
+	logger := ac.logger.WithField("authz_id", authz.ID).WithField("identifier", authz.Identifier.Value)
+
+	var prob *ProblemDetails
+	for i, delay := range ac.http01.conf.AttemptSchedule {
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+		if ctx.Err() == nil {
+			prob = ac.http01.Validate(ctx, authz.Identifier.Value, challenge.Token, keyAuth)
+		}
+		if ctx.Err() != nil {
+			logger.Info("HTTP-01 challenge cut short by shutdown, leaving it to resume after the restart")
+			return nil
+		}
+		if prob == nil {
 			_, err = ac.db.UpdateAuthz([]byte(authz.ID), func(authzToUpdate *db.DBAuthz) error {
 				authzToUpdate.Status = dtos.AuthzStatusValid
 				authzToUpdate.Challenges[challengeIndex].Status = dtos.ChallengeStatusValid
 
 				valTime := timeMarshalDB(time.Now())
 				authzToUpdate.Challenges[challengeIndex].ValidatedTime = &valTime
+				authzToUpdate.Challenges[challengeIndex].Error = nil
 				return nil
 			})
+			logger.WithField("attempt", i+1).Info("HTTP-01 challenge validated")
 			return err
 		}
 
-		time.Sleep(time.Second)
+		logger.WithField("attempt", i+1).WithField("problem", prob.Type).Debug(prob.Detail)
 	}
 
 	_, err = ac.db.UpdateAuthz([]byte(authz.ID), func(authzToUpdate *db.DBAuthz) error {
 		authzToUpdate.Status = dtos.AuthzStatusInvalid
 		authzToUpdate.Challenges[challengeIndex].Status = dtos.ChallengeStatusInvalid
+		// The last attempt's problem is kept, so clients can see why
+		authzToUpdate.Challenges[challengeIndex].Error = problemToDB(prob)
 		return nil
 	})
+	logger.WithField("problem", prob.Type).Info("HTTP-01 challenge failed: " + prob.Detail)
 	return err
 }
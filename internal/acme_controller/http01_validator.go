@@ -0,0 +1,314 @@
+package acme_controller
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// HTTP01Config controls how HTTP-01 challenges are validated
+type HTTP01Config struct {
+	// DNS servers to resolve identifiers with, the system resolver is used if empty
+	Resolvers []string
+	// Static addresses for names, checked before the resolvers
+	Hosts map[string][]net.IP
+
+	// How long to wait for an identifier's A and AAAA records, including those of names redirected to
+	LookupTimeout  time.Duration
+	ConnectTimeout time.Duration
+	// How long to wait for the response once connected
+	ReadTimeout time.Duration
+	// Redirects are only followed to http on port 80 or https on port 443, up to MaxRedirects hops.
+	// Nil uses the default, 0 doesn't follow redirects at all
+	MaxRedirects *int
+	// Responses longer than this are rejected
+	MaxBodySize int64
+
+	// Delay before each attempt at validating a challenge. The challenge is invalid once every attempt has failed
+	AttemptSchedule []time.Duration
+	// If set, every address an identifier resolves to must pass the challenge.
+	// Otherwise, addresses are tried IPv6 first until one can be connected to, and its response is used
+	RequireAllAddresses bool
+
+	// If set, used to make connections instead of a plain dialer. Addresses are already resolved by the time this is called
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+func DefaultHTTP01Config() HTTP01Config {
+	maxRedirects := 10
+	return HTTP01Config{
+		LookupTimeout:  10 * time.Second,
+		ConnectTimeout: 10 * time.Second,
+		ReadTimeout:    10 * time.Second,
+		MaxRedirects:   &maxRedirects,
+		MaxBodySize:    8 * 1024,
+		AttemptSchedule: []time.Duration{
+			0,
+			time.Second,
+			2 * time.Second,
+			4 * time.Second,
+			8 * time.Second,
+			15 * time.Second,
+			30 * time.Second,
+		},
+	}
+}
+
+// withDefaults fills in anything left unset with the defaults
+func (conf HTTP01Config) withDefaults() HTTP01Config {
+	defaults := DefaultHTTP01Config()
+	if conf.LookupTimeout == 0 {
+		conf.LookupTimeout = defaults.LookupTimeout
+	}
+	if conf.ConnectTimeout == 0 {
+		conf.ConnectTimeout = defaults.ConnectTimeout
+	}
+	if conf.ReadTimeout == 0 {
+		conf.ReadTimeout = defaults.ReadTimeout
+	}
+	if conf.MaxRedirects == nil {
+		conf.MaxRedirects = defaults.MaxRedirects
+	}
+	if conf.MaxBodySize == 0 {
+		conf.MaxBodySize = defaults.MaxBodySize
+	}
+	if len(conf.AttemptSchedule) == 0 {
+		conf.AttemptSchedule = defaults.AttemptSchedule
+	}
+	return conf
+}
+
+type HTTP01Validator struct {
+	conf     HTTP01Config
+	resolver *net.Resolver
+}
+
+func NewHTTP01Validator(conf HTTP01Config) *HTTP01Validator {
+	conf = conf.withDefaults()
+	return &HTTP01Validator{
+		conf:     conf,
+		resolver: newResolver(conf.Resolvers),
+	}
+}
+
+// Validate makes one attempt at fetching the key authorization for token from domain.
+// A nil return means it passed, otherwise the problem says why it didn't
+func (v *HTTP01Validator) Validate(ctx context.Context, domain string, token string, keyAuth string) *ProblemDetails {
+	domain = strings.TrimSuffix(domain, ".")
+
+	addrs, err := v.resolve(ctx, domain)
+	if err != nil {
+		return DNSProblem(fmt.Sprintf("Failed to resolve %s: %v", domain, err))
+	}
+
+	challURL := url.URL{
+		Scheme: "http",
+		Host:   domain,
+		Path:   "/.well-known/acme-challenge/" + token,
+	}
+
+	var lastProb *ProblemDetails
+	for _, addr := range addrs {
+		connected, prob := v.fetch(ctx, challURL.String(), domain, addr, keyAuth)
+		if v.conf.RequireAllAddresses {
+			if prob != nil {
+				return prob
+			}
+			continue
+		}
+		if connected {
+			return prob
+		}
+		lastProb = prob
+	}
+	return lastProb
+}
+
+// fetch requests challURL with domain pinned to addr, reporting whether a connection to addr was made at all
+func (v *HTTP01Validator) fetch(ctx context.Context, challURL string, domain string, addr net.IP, keyAuth string) (bool, *ProblemDetails) {
+	ctx, cancel := context.WithTimeout(ctx, v.conf.ConnectTimeout+v.conf.ReadTimeout)
+	defer cancel()
+
+	var connected atomic.Bool
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, hostPort string) (net.Conn, error) {
+			host, port, err := net.SplitHostPort(hostPort)
+			if err != nil {
+				return nil, err
+			}
+			if host == domain {
+				conn, err := v.dial(ctx, network, net.JoinHostPort(addr.String(), port))
+				if err == nil {
+					connected.Store(true)
+				}
+				return conn, err
+			}
+			return v.dialName(ctx, network, host, port)
+		},
+		// Like other ACME servers, the certificate isn't checked if a challenge is redirected to https,
+		// as the point is that it doesn't have a certificate yet
+		TLSClientConfig:       &tls.Config{InsecureSkipVerify: true},
+		ResponseHeaderTimeout: v.conf.ReadTimeout,
+		DisableKeepAlives:     true,
+	}
+	defer transport.CloseIdleConnections()
+
+	client := &http.Client{
+		Transport:     transport,
+		CheckRedirect: v.checkRedirect,
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, challURL, nil)
+	if err != nil {
+		return true, InternalErrorProblem(err)
+	}
+	req.Header.Set("User-Agent", "ACMESpider")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		var redirectErr *redirectError
+		if errors.As(err, &redirectErr) {
+			return true, ConnectionProblem(redirectErr.Error())
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return connected.Load(), ConnectionProblem(fmt.Sprintf("Timed out fetching %s from %s", challURL, addr))
+		}
+		return connected.Load(), ConnectionProblem(fmt.Sprintf("Fetching %s from %s: %v", challURL, addr, err))
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, v.conf.MaxBodySize+1))
+	if err != nil {
+		return true, ConnectionProblem(fmt.Sprintf("Reading response from %s: %v", addr, err))
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return true, UnauthorizedProblem(fmt.Sprintf("%s returned HTTP %d for %s", addr, resp.StatusCode, resp.Request.URL))
+	}
+	if int64(len(body)) > v.conf.MaxBodySize {
+		return true, UnauthorizedProblem(fmt.Sprintf("Response from %s for %s was over %d bytes", addr, resp.Request.URL, v.conf.MaxBodySize))
+	}
+	// RFC8555 8.3 says trailing whitespace is allowed
+	got := strings.TrimRight(string(body), " \t\r\n")
+	if got != keyAuth {
+		gotToken, _, _ := strings.Cut(got, ".")
+		wantToken, _, _ := strings.Cut(keyAuth, ".")
+		if gotToken != wantToken {
+			return true, IncorrectResponseProblem(fmt.Sprintf("Response from %s for %s had the wrong token, expected %q but got %q", addr, resp.Request.URL, wantToken, truncate(gotToken, 64)))
+		}
+		return true, IncorrectResponseProblem(fmt.Sprintf("Response from %s for %s had the right token, but its thumbprint doesn't match the account key", addr, resp.Request.URL))
+	}
+
+	return true, nil
+}
+
+type redirectError struct {
+	reason string
+}
+
+func (e *redirectError) Error() string {
+	return "Redirect not followed: " + e.reason
+}
+
+func (v *HTTP01Validator) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > *v.conf.MaxRedirects {
+		if *v.conf.MaxRedirects == 0 {
+			return &redirectError{"redirects are disabled"}
+		}
+		return &redirectError{fmt.Sprintf("more than %d redirects", *v.conf.MaxRedirects)}
+	}
+
+	u := req.URL
+	port := u.Port()
+	switch u.Scheme {
+	case "http":
+		if port != "" && port != "80" {
+			return &redirectError{fmt.Sprintf("%s isn't on port 80", u)}
+		}
+	case "https":
+		if port != "" && port != "443" {
+			return &redirectError{fmt.Sprintf("%s isn't on port 443", u)}
+		}
+	default:
+		return &redirectError{fmt.Sprintf("%s isn't http or https", u)}
+	}
+
+	if net.ParseIP(u.Hostname()) != nil {
+		return &redirectError{fmt.Sprintf("%s is to an IP address rather than a name", u)}
+	}
+	return nil
+}
+
+// resolve looks up A and AAAA records for name, with IPv6 addresses first
+func (v *HTTP01Validator) resolve(ctx context.Context, name string) ([]net.IP, error) {
+	var addrs []net.IP
+	if static, ok := v.conf.Hosts[name]; ok {
+		addrs = append(addrs, static...)
+	} else {
+		lookupCtx, cancel := context.WithTimeout(ctx, v.conf.LookupTimeout)
+		defer cancel()
+
+		ipAddrs, err := v.resolver.LookupIPAddr(lookupCtx, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range ipAddrs {
+			addrs = append(addrs, a.IP)
+		}
+	}
+
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no A or AAAA records")
+	}
+
+	sort.SliceStable(addrs, func(i, j int) bool {
+		return addrs[i].To4() == nil && addrs[j].To4() != nil
+	})
+	return addrs, nil
+}
+
+// dialName resolves host and connects to the first address that works, for hosts reached by redirect
+func (v *HTTP01Validator) dialName(ctx context.Context, network string, host string, port string) (net.Conn, error) {
+	addrs, err := v.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for _, addr := range addrs {
+		conn, err := v.dial(ctx, network, net.JoinHostPort(addr.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func (v *HTTP01Validator) dial(ctx context.Context, network string, addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, v.conf.ConnectTimeout)
+	defer cancel()
+
+	if v.conf.DialContext != nil {
+		return v.conf.DialContext(ctx, network, addr)
+	}
+	d := net.Dialer{}
+	return d.DialContext(ctx, network, addr)
+}
+
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	return s[:max] + "..."
+}
@@ -0,0 +1,184 @@
+package acme_controller
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testToken = "tok"
+const testKeyAuth = "tok.thumbprint"
+
+// newTestValidator makes a validator where each address in routes is served by the given handler, whatever the port
+func newTestValidator(t *testing.T, conf HTTP01Config, routes map[string]http.Handler) *HTTP01Validator {
+	servers := map[string]string{}
+	for ip, handler := range routes {
+		srv := httptest.NewServer(handler)
+		t.Cleanup(srv.Close)
+		servers[ip] = srv.Listener.Addr().String()
+	}
+
+	conf.ConnectTimeout = time.Second
+	conf.ReadTimeout = time.Second
+	conf.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, _ := net.SplitHostPort(addr)
+		srvAddr, ok := servers[host]
+		if !ok {
+			return nil, fmt.Errorf("connection refused to %s", addr)
+		}
+		return (&net.Dialer{}).DialContext(ctx, network, srvAddr)
+	}
+	return NewHTTP01Validator(conf)
+}
+
+func respond(body string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/.well-known/acme-challenge/"+testToken {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(body))
+	})
+}
+
+func redirectTo(location string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, location, http.StatusFound)
+	})
+}
+
+func expectProblemType(t *testing.T, prob *ProblemDetails, problemType string) {
+	t.Helper()
+	if problemType == "" {
+		if prob != nil {
+			t.Fatalf("expected validation to pass, got %s: %s", prob.Type, prob.Detail)
+		}
+		return
+	}
+	if prob == nil {
+		t.Fatalf("expected %s, but validation passed", problemType)
+	}
+	if prob.Type != errNS+problemType {
+		t.Fatalf("expected %s, got %s: %s", problemType, prob.Type, prob.Detail)
+	}
+}
+
+func TestHTTP01Responses(t *testing.T) {
+	hosts := map[string][]net.IP{"host.test": {net.ParseIP("10.0.0.1")}}
+
+	tests := []struct {
+		name        string
+		handler     http.Handler
+		problemType string
+	}{
+		{name: "correct", handler: respond(testKeyAuth)},
+		{name: "trailing whitespace", handler: respond(testKeyAuth + " \r\n")},
+		{name: "wrong key authorization", handler: respond("tok.other"), problemType: "incorrectResponse"},
+		{name: "not found", handler: http.NotFoundHandler(), problemType: "unauthorized"},
+		{name: "body over limit", handler: respond(testKeyAuth + strings.Repeat(" ", 100)), problemType: "unauthorized"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newTestValidator(t, HTTP01Config{Hosts: hosts, MaxBodySize: 64}, map[string]http.Handler{"10.0.0.1": tt.handler})
+			expectProblemType(t, v.Validate(context.Background(), "host.test", testToken, testKeyAuth), tt.problemType)
+		})
+	}
+}
+
+func TestHTTP01Redirects(t *testing.T) {
+	hosts := map[string][]net.IP{
+		"host.test":  {net.ParseIP("10.0.0.1")},
+		"other.test": {net.ParseIP("10.0.0.2")},
+	}
+
+	var loop http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, r.URL.Path+"x", http.StatusFound)
+	}
+
+	tests := []struct {
+		name        string
+		handler     http.Handler
+		problemType string
+		noRedirects bool
+	}{
+		{name: "to another name", handler: redirectTo("http://other.test/.well-known/acme-challenge/" + testToken)},
+		{name: "to port 80", handler: redirectTo("http://other.test:80/.well-known/acme-challenge/" + testToken)},
+		{name: "to another port", handler: redirectTo("http://other.test:8080/.well-known/acme-challenge/" + testToken), problemType: "connection"},
+		{name: "to https on port 80", handler: redirectTo("https://other.test:80/.well-known/acme-challenge/" + testToken), problemType: "connection"},
+		{name: "to another scheme", handler: redirectTo("ftp://other.test/.well-known/acme-challenge/" + testToken), problemType: "connection"},
+		{name: "to an IP", handler: redirectTo("http://10.0.0.2/.well-known/acme-challenge/" + testToken), problemType: "connection"},
+		{name: "too many hops", handler: loop, problemType: "connection"},
+		{name: "redirects disabled", handler: redirectTo("http://other.test/.well-known/acme-challenge/" + testToken), problemType: "connection", noRedirects: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			maxRedirects := 3
+			if tt.noRedirects {
+				maxRedirects = 0
+			}
+			v := newTestValidator(t, HTTP01Config{Hosts: hosts, MaxRedirects: &maxRedirects}, map[string]http.Handler{
+				"10.0.0.1": tt.handler,
+				"10.0.0.2": respond(testKeyAuth),
+			})
+			expectProblemType(t, v.Validate(context.Background(), "host.test", testToken, testKeyAuth), tt.problemType)
+		})
+	}
+}
+
+func TestHTTP01Addresses(t *testing.T) {
+	dualStack := map[string][]net.IP{"host.test": {net.ParseIP("10.0.0.1"), net.ParseIP("fd00::1")}}
+
+	tests := []struct {
+		name        string
+		requireAll  bool
+		routes      map[string]http.Handler
+		problemType string
+	}{
+		{
+			name:   "both addresses pass",
+			routes: map[string]http.Handler{"10.0.0.1": respond(testKeyAuth), "fd00::1": respond(testKeyAuth)},
+		},
+		{
+			name:   "falls back to IPv4 if IPv6 can't connect",
+			routes: map[string]http.Handler{"10.0.0.1": respond(testKeyAuth)},
+		},
+		{
+			name:        "IPv6 is preferred",
+			routes:      map[string]http.Handler{"10.0.0.1": respond(testKeyAuth), "fd00::1": respond("wrong")},
+			problemType: "incorrectResponse",
+		},
+		{
+			name:        "no address can connect",
+			routes:      map[string]http.Handler{},
+			problemType: "connection",
+		},
+		{
+			name:        "every address required",
+			requireAll:  true,
+			routes:      map[string]http.Handler{"10.0.0.1": respond(testKeyAuth)},
+			problemType: "connection",
+		},
+		{
+			name:       "every address required and passes",
+			requireAll: true,
+			routes:     map[string]http.Handler{"10.0.0.1": respond(testKeyAuth), "fd00::1": respond(testKeyAuth)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newTestValidator(t, HTTP01Config{Hosts: dualStack, RequireAllAddresses: tt.requireAll}, tt.routes)
+			expectProblemType(t, v.Validate(context.Background(), "host.test", testToken, testKeyAuth), tt.problemType)
+		})
+	}
+
+	v := newTestValidator(t, HTTP01Config{Hosts: map[string][]net.IP{"empty.test": {}}}, nil)
+	expectProblemType(t, v.Validate(context.Background(), "empty.test", testToken, testKeyAuth), "dns")
+}
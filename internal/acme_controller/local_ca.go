@@ -0,0 +1,43 @@
+package acme_controller
+
+import (
+	"errors"
+
+	"github.com/lachlan2k/acmespider/internal/localca"
+)
+
+func (ac ACMEController) HasLocalCA() bool {
+	return ac.localCA != nil
+}
+
+func (ac ACMEController) GetLocalCARoot() ([]byte, error) {
+	if ac.localCA == nil {
+		return nil, NotFoundProblem("Local CA is not enabled")
+	}
+	return ac.localCA.RootPEM(), nil
+}
+
+func (ac ACMEController) GetLocalCACRL() ([]byte, error) {
+	if ac.localCA == nil {
+		return nil, NotFoundProblem("Local CA is not enabled")
+	}
+	crl, err := ac.localCA.CRL()
+	if err != nil {
+		return nil, InternalErrorProblem(err)
+	}
+	return crl, nil
+}
+
+func (ac ACMEController) GetLocalCAOCSPResponse(requestDER []byte) ([]byte, error) {
+	if ac.localCA == nil {
+		return nil, NotFoundProblem("Local CA is not enabled")
+	}
+	resp, err := ac.localCA.OCSPResponse(requestDER)
+	if err != nil {
+		if errors.Is(err, localca.ErrMalformedOCSPRequest) {
+			return nil, MalformedProblem("Invalid OCSP request")
+		}
+		return nil, InternalErrorProblem(err)
+	}
+	return resp, nil
+}
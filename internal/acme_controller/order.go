@@ -2,15 +2,18 @@ package acme_controller
 
 import (
 	"bytes"
+	"context"
 	"crypto/x509"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"net"
 	"time"
 
-	"github.com/go-acme/lego/v4/certificate"
 	"github.com/lachlan2k/acmespider/internal/db"
 	"github.com/lachlan2k/acmespider/internal/dtos"
-	log "github.com/sirupsen/logrus"
+	"github.com/lachlan2k/acmespider/internal/issuer"
+	"github.com/lachlan2k/acmespider/internal/policy"
 )
 
 const orderExpiryTime = 2 * time.Minute
@@ -19,9 +22,19 @@ func (ac ACMEController) makeChallengeID(authzID string, index int) string {
 	return fmt.Sprintf("%s%02x", authzID, index)
 }
 
-func (ac ACMEController) NewOrder(payload dtos.OrderCreateRequestDTO, accountID []byte) (*db.DBOrder, error) {
+func (ac ACMEController) NewOrder(payload dtos.OrderCreateRequestDTO, accountID []byte, sourceIP net.IP) (*db.DBOrder, error) {
 	// TODO: can we decide what orders the account is/isn't allowed to create?
 
+	err := ac.work.checkNotDraining()
+	if err != nil {
+		return nil, err
+	}
+
+	err = ac.checkOrderLimits(accountID, len(payload.Identifiers))
+	if err != nil {
+		return nil, err
+	}
+
 	newId, err := GenerateID()
 	if err != nil {
 		return nil, InternalErrorProblem(err)
@@ -33,18 +46,40 @@ func (ac ACMEController) NewOrder(payload dtos.OrderCreateRequestDTO, accountID
 			return nil, MalformedProblem(fmt.Sprintf("identifier index %d has an empty value", i))
 		}
 
-		// TODO: here, decide if a client is/isn't allowed to create a specific Value
-
 		if identifier.Type != "dns" {
 			return nil, MalformedProblem(fmt.Sprintf("identifier index %d had a type of %q, but the only supported type is \"dns\"", i, identifier.Type))
 		}
 
+		if !ac.identifierAllowed(identifier.Value) {
+			return nil, RejectedIdentifierProblem(IdentifierForProblemDetails{Type: identifier.Type, Value: identifier.Value}, "This directory doesn't issue certificates for this name")
+		}
+
 		dbIdentifiers[i] = db.DBOrderIdentifier{
 			Type:  identifier.Type,
 			Value: identifier.Value,
 		}
 	}
 
+	err = ac.checkSourceIP(sourceIP, dbIdentifiers)
+	if err != nil {
+		return nil, err
+	}
+
+	// Orders go to either the local CA or upstream, never both
+	if ac.localCA != nil && len(dbIdentifiers) > 0 {
+		firstIsLocal := ac.localCA.Handles(dbIdentifiers[0].Value)
+		for _, id := range dbIdentifiers[1:] {
+			if ac.localCA.Handles(id.Value) != firstIsLocal {
+				return nil, RejectedIdentifierProblem(IdentifierForProblemDetails{Type: id.Type, Value: id.Value}, "Orders can't mix local CA and public names")
+			}
+		}
+	}
+
+	err = ac.checkRateBudget(dbIdentifiers)
+	if err != nil {
+		return nil, err
+	}
+
 	// TODO: validate these?
 	nbfT, err := dtos.TimeUnmarshalDTO(payload.NotBefore)
 	if err != nil && payload.NotBefore != "" {
@@ -66,6 +101,18 @@ func (ac ACMEController) NewOrder(payload dtos.OrderCreateRequestDTO, accountID
 		naft = &naftu
 	}
 
+	var policyNbf, policyNaft time.Time
+	if nbfT != nil {
+		policyNbf = *nbfT
+	}
+	if naftT != nil {
+		policyNaft = *naftT
+	}
+	err = ac.checkPolicy(policy.StageOrder, accountID, sourceIP, dbIdentifiers, policyNbf, policyNaft, nil)
+	if err != nil {
+		return nil, err
+	}
+
 	expires := time.Now().Add(orderExpiryTime)
 
 	authzs := make([]db.DBAuthz, len(dbIdentifiers))
@@ -120,10 +167,43 @@ func (ac ACMEController) NewOrder(payload dtos.OrderCreateRequestDTO, accountID
 		AuthzIDs:    authzIDs,
 	}
 
-	err = ac.db.CreateOrder(dbOrder)
+	err = ac.db.CreateOrder(dbOrder, ac.abuse.conf.MaxPendingOrders, time.Now().Unix())
 	if err != nil {
+		var pendingErr *db.PendingOrdersError
+		if errors.As(err, &pendingErr) {
+			return nil, pendingOrdersProblem(pendingErr.Pending, pendingErr.NextExpiry)
+		}
 		return nil, InternalErrorProblem(err)
 	}
+
+	// Only requested once the order exists, so operators are never asked to approve one that doesn't.
+	// The client can't know the order's ID before it's returned, so can't get ahead of the approvals
+	approvalIDs, approvalExpires, err := ac.requestApprovals(string(accountID), newId, dbIdentifiers)
+	if err != nil {
+		return nil, InternalErrorProblem(err)
+	}
+	if len(approvalIDs) > 0 {
+		// Orders waiting for approval last until the approval expires
+		updatedOrder, err := ac.db.UpdateOrder([]byte(newId), func(orderToUpdate *db.DBOrder) error {
+			orderToUpdate.ApprovalIDs = approvalIDs
+			orderToUpdate.Expires = approvalExpires.Unix()
+			return nil
+		})
+		if err != nil {
+			ac.withdrawApprovals(approvalIDs, newId)
+			return nil, InternalErrorProblem(err)
+		}
+		dbOrder = *updatedOrder
+	}
+
+	_, err = ac.db.UpdateAccount(accountID, func(acc *db.DBAccount) error {
+		acc.Orders = append(acc.Orders, newId)
+		return nil
+	})
+	if err != nil {
+		ac.withdrawApprovals(approvalIDs, newId)
+		return nil, InternalErrorProblem(fmt.Errorf("failed to add order to account: %v", err))
+	}
 	return &dbOrder, nil
 }
 
@@ -164,31 +244,48 @@ func (ac ACMEController) GetOrdersByAccountID(accountIDToQuery []byte, requester
 }
 
 func (ac ACMEController) processOrder(order *db.DBOrder, csr *x509.CertificateRequest, nbf time.Time, naft time.Time) error {
-	obtainResult, err := ac.acmeClient.Certificate.ObtainForCSR(certificate.ObtainForCSRRequest{
-		CSR:       csr,
-		NotBefore: nbf,
-		NotAfter:  naft,
-		Bundle:    true,
-		// TODO what to do with the other params in this struct?
-	})
+	certID, err := GenerateID()
 	if err != nil {
 		return err
 	}
 
-	certID, err := GenerateID()
+	certPEM, err := ac.issuerForOrder(order).ObtainForCSR(issuer.ObtainRequest{
+		CSR:           csr,
+		NotBefore:     nbf,
+		NotAfter:      naft,
+		CertificateID: certID,
+	})
 	if err != nil {
 		return err
 	}
 
-	if len(obtainResult.Certificate) == 0 {
-		return fmt.Errorf("obtained certificate is empty: %v", obtainResult)
+	if len(certPEM) == 0 {
+		return fmt.Errorf("obtained certificate for order %s is empty", order.ID)
+	}
+
+	leaf, err := parseLeaf(certPEM)
+	if err != nil {
+		return fmt.Errorf("obtained certificate for order %s can't be parsed: %v", order.ID, err)
+	}
+
+	if ac.countsAgainstBudget(order) {
+		// The certificate exists either way, so a failure here only means the budget undercounts
+		if err := ac.recordIssuance(order); err != nil {
+			ac.logger.WithError(err).WithField("order_id", order.ID).Error("Failed to record upstream issuance")
+		}
 	}
 
 	newCert := db.DBCertificate{
 		ID:          certID,
 		OrderID:     order.ID,
 		AccountID:   order.AccountID,
-		Certificate: obtainResult.Certificate,
+		Certificate: certPEM,
+		Serial:      db.CertificateSerial(leaf.SerialNumber),
+
+		PublicKeySHA256: publicKeySHA256(csr),
+		NameSet:         namesFor(order.Identifiers).nameSet,
+		NotBefore:       leaf.NotBefore.Unix(),
+		NotAfter:        leaf.NotAfter.Unix(),
 	}
 
 	err = ac.db.CreateCertificate(newCert)
@@ -199,31 +296,78 @@ func (ac ACMEController) processOrder(order *db.DBOrder, csr *x509.CertificateRe
 	_, err = ac.db.UpdateOrder([]byte(order.ID), func(orderToUpdate *db.DBOrder) error {
 		orderToUpdate.CertificateID = certID
 		orderToUpdate.Status = dtos.OrderStatusValid
+		orderToUpdate.CSR = nil
 		return nil
 	})
 	if err != nil {
 		return err
 	}
+	ac.logger.WithField("order_id", order.ID).WithField("certificate_id", certID).Info("Certificate issued")
 	return nil
 }
 
-func (ac ACMEController) startProcessing(order *db.DBOrder, csr *x509.CertificateRequest, nbf time.Time, naft time.Time) {
-	go func() {
-		err := ac.processOrder(order, csr, nbf, naft)
+// startProcessing issues order in the background, first waiting for the rate limit budget if queuedUntil is set
+func (ac ACMEController) startProcessing(order *db.DBOrder, csr *x509.CertificateRequest, nbf time.Time, naft time.Time, queuedUntil time.Time) {
+	ac.work.run(func(ctx context.Context) {
+		ac.work.startIssuing(order.ID)
+		defer ac.work.doneIssuing(order.ID)
+		defer ac.releaseRateBudget(order.ID)
+
+		err := ac.waitForRateBudget(ctx, order, queuedUntil)
+		if err != nil && ctx.Err() != nil {
+			ac.logger.WithField("order_id", order.ID).Warn("Leaving queued order to be resumed after the restart")
+			return
+		}
+		if err == nil {
+			// The account may have been deactivated while the order was queued
+			err = ac.CheckAccountActive([]byte(order.AccountID))
+		}
+		if err == nil {
+			err = ac.processOrder(order, csr, nbf, naft)
+		}
 		if err != nil {
 			wrapped := InternalErrorProblem(err)
-			log.WithError(wrapped.Unwrap()).WithField("error_id", wrapped.ID()).Error("order processing error " + wrapped.ID())
+			ac.logger.WithError(wrapped.Unwrap()).WithField("order_id", order.ID).WithField("error_id", wrapped.ID()).Error("order processing error " + wrapped.ID())
+
+			// Our own problems (e.g. from the rate limit budget) and those the upstream reported about the order are passed on,
+			// anything else stays behind the error ID
+			var orderErr *db.DBProblem
+			var retryAt time.Time
+			var prob *ProblemDetails
+			var upstreamProb *issuer.Problem
+			if errors.As(err, &prob) {
+				orderErr = problemToDB(prob)
+				retryAt = prob.RetryAfter()
+			} else if errors.As(err, &upstreamProb) {
+				orderErr = problemToDB(upstreamProblem(upstreamProb, wrapped))
+				if orderErr != nil {
+					retryAt = upstreamProb.RetryAfter
+				}
+			}
+			var retryAfter *int64
+			if !retryAt.IsZero() {
+				unix := retryAt.Unix()
+				retryAfter = &unix
+			}
 
 			ac.db.UpdateOrder([]byte(order.ID), func(orderToUpdate *db.DBOrder) error {
 				orderToUpdate.Status = dtos.OrderStatusInvalid
+				orderToUpdate.CSR = nil
 				orderToUpdate.ErrorID = wrapped.ID()
+				orderToUpdate.Error = orderErr
+				orderToUpdate.RetryAfter = retryAfter
 				return nil
 			})
 		}
-	}()
+	})
 }
 
-func (ac ACMEController) FinalizeOrder(orderID []byte, payload dtos.OrderFinalizeRequestDTO, requestersAccountID []byte) (*db.DBOrder, error) {
+func (ac ACMEController) FinalizeOrder(orderID []byte, payload dtos.OrderFinalizeRequestDTO, requestersAccountID []byte, sourceIP net.IP) (*db.DBOrder, error) {
+	err := ac.work.checkNotDraining()
+	if err != nil {
+		return nil, err
+	}
+
 	order, err := ac.db.GetOrder([]byte(orderID))
 	if err != nil {
 		if db.IsErrNotFound(err) {
@@ -236,6 +380,12 @@ func (ac ACMEController) FinalizeOrder(orderID []byte, payload dtos.OrderFinaliz
 		return nil, UnauthorizedProblem("")
 	}
 
+	// Checked again, as the host could have changed since the order was made
+	err = ac.checkSourceIP(sourceIP, order.Identifiers)
+	if err != nil {
+		return nil, err
+	}
+
 	derCSR, err := base64.RawURLEncoding.DecodeString(payload.CSRB64)
 	if err != nil {
 		return nil, BadCSRProblem("Invalid CSR Base64")
@@ -246,6 +396,11 @@ func (ac ACMEController) FinalizeOrder(orderID []byte, payload dtos.OrderFinaliz
 		return nil, BadCSRProblem("Invalid CSR")
 	}
 
+	err = checkCSRMatchesOrder(csr, order)
+	if err != nil {
+		return nil, err
+	}
+
 	// Check all authz are complete
 	for i, authzID := range order.AuthzIDs {
 		authz, err := ac.db.GetAuthz([]byte(authzID))
@@ -266,15 +421,35 @@ func (ac ACMEController) FinalizeOrder(orderID []byte, payload dtos.OrderFinaliz
 		naft = timeUnmarshalDB(*order.NotAfter)
 	}
 
+	err = ac.checkPolicy(policy.StageFinalize, requestersAccountID, sourceIP, order.Identifiers, nbf, naft, csr)
+	if err != nil {
+		return nil, err
+	}
+
+	reusable, err := ac.reusableCertificate(order, csr)
+	if err != nil {
+		return nil, InternalErrorProblem(err)
+	}
+	if reusable != nil {
+		return ac.reuseCertificate(order, reusable)
+	}
+
+	queuedUntil, err := ac.reserveRateBudget(order)
+	if err != nil {
+		return nil, err
+	}
+
 	orderWithProcessing, err := ac.db.UpdateOrder([]byte(order.ID), func(orderToUpdate *db.DBOrder) error {
 		orderToUpdate.Status = dtos.OrderStatusProcessing
+		orderToUpdate.CSR = csr.Raw
 		return nil
 	})
 	if err != nil {
+		ac.releaseRateBudget(order.ID)
 		return nil, InternalErrorProblem(err)
 	}
 
-	ac.startProcessing(order, csr, nbf, naft)
+	ac.startProcessing(order, csr, nbf, naft, queuedUntil)
 
 	return orderWithProcessing, nil
 }
@@ -294,3 +469,22 @@ func (ac ACMEController) GetAuthorization(authzID []byte, requesterAccountID []b
 
 	return authz, nil
 }
+
+func (ac ACMEController) issuerForOrder(order *db.DBOrder) issuer.Issuer {
+	if ac.isLocalCAOrder(order) {
+		return ac.localCA
+	}
+	return ac.upstream
+}
+
+func (ac ACMEController) isLocalCAOrder(order *db.DBOrder) bool {
+	if ac.localCA == nil || len(order.Identifiers) == 0 {
+		return false
+	}
+	for _, id := range order.Identifiers {
+		if !ac.localCA.Handles(id.Value) {
+			return false
+		}
+	}
+	return true
+}
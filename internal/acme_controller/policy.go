@@ -0,0 +1,74 @@
+package acme_controller
+
+import (
+	"crypto/x509"
+	"net"
+	"time"
+
+	"github.com/lachlan2k/acmespider/internal/db"
+	"github.com/lachlan2k/acmespider/internal/issuer"
+	"github.com/lachlan2k/acmespider/internal/policy"
+)
+
+// SetPolicy has orders and finalize requests checked against an issuance policy. If nil, everything is allowed
+func (ac *ACMEController) SetPolicy(engine *policy.Engine) {
+	ac.policy = engine
+}
+
+// checkPolicy evaluates the issuance policy for a request. csr is nil at the order stage.
+// Without a notAfter the issuer picks the lifetime, so the policy is given the issuer's default lifetime if it has one.
+// If that isn't known either, requests are denied when the policy checks validity, rather than issuing a certificate it might not allow
+func (ac ACMEController) checkPolicy(stage string, accountID []byte, sourceIP net.IP, identifiers []db.DBOrderIdentifier, notBefore, notAfter time.Time, csr *x509.CertificateRequest) error {
+	if ac.policy == nil {
+		return nil
+	}
+
+	acc, err := ac.db.GetAccount(accountID)
+	if err != nil {
+		return InternalErrorProblem(err)
+	}
+
+	if notAfter.IsZero() {
+		if lifetime := issuer.DefaultLifetime(ac.issuerForOrder(&db.DBOrder{Identifiers: identifiers})); lifetime > 0 {
+			start := notBefore
+			if start.IsZero() {
+				start = time.Now()
+			}
+			notAfter = start.Add(lifetime)
+		}
+	}
+	if notAfter.IsZero() && ac.policy.UsesValidity() {
+		ac.logger.WithField("account_id", acc.ID).WithField("stage", stage).Info("Request denied as the issuance policy checks validity, but the upstream's certificate lifetime isn't known")
+		return RejectedByPolicyProblem("The issuance policy checks certificate validity, so the order must set notAfter")
+	}
+
+	names := make([]string, len(identifiers))
+	for i, id := range identifiers {
+		names[i] = id.Value
+	}
+
+	decision := ac.policy.Evaluate(policy.Input{
+		Stage:       stage,
+		AccountID:   acc.ID,
+		Tenant:      acc.Tenant,
+		Contacts:    acc.Contact,
+		EABKeyID:    acc.EABKeyID,
+		SourceIP:    sourceIP,
+		Identifiers: names,
+		NotBefore:   notBefore,
+		NotAfter:    notAfter,
+		CSR:         csr,
+	})
+	if decision.Allowed {
+		return nil
+	}
+
+	ac.logger.WithField("account_id", acc.ID).WithField("stage", stage).WithField("rule", decision.Rule).WithField("identifiers", names).Info("Request denied by issuance policy")
+	switch decision.Cause {
+	case policy.CauseCSR:
+		return BadCSRProblem(decision.Message)
+	case policy.CauseRequester:
+		return UnauthorizedProblem(decision.Message)
+	}
+	return RejectedByPolicyProblem(decision.Message)
+}
@@ -3,8 +3,11 @@ package acme_controller
 import (
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/lachlan2k/acmespider/internal/db"
+	"github.com/lachlan2k/acmespider/internal/issuer"
 )
 
 const (
@@ -25,6 +28,10 @@ const (
 	orderNotReadyErr       = errNS + "orderNotReady"
 	badPublicKeyErr        = errNS + "badPublicKey"
 	rejectedIdentifierErr  = errNS + "rejectedIdentifier"
+	dnsErr                 = errNS + "dns"
+	incorrectResponseErr   = errNS + "incorrectResponse"
+	compoundErr            = errNS + "compound"
+	rateLimitedErr         = errNS + "rateLimited"
 )
 
 type ProblemDetails struct {
@@ -35,6 +42,7 @@ type ProblemDetails struct {
 	Subproblems []ProblemDetails             `json:"subproblems,omitempty"`
 	wrapped     error
 	wrappedId   string
+	retryAfter  time.Time
 }
 
 type IdentifierForProblemDetails struct {
@@ -54,6 +62,11 @@ func (pd ProblemDetails) ID() string {
 	return pd.wrappedId
 }
 
+// RetryAfter is when the client should try again, zero if it doesn't matter
+func (pd ProblemDetails) RetryAfter() time.Time {
+	return pd.retryAfter
+}
+
 func InternalErrorProblem(wrapped error) *ProblemDetails {
 	id := uuid.NewString()
 
@@ -66,6 +79,26 @@ func InternalErrorProblem(wrapped error) *ProblemDetails {
 	}
 }
 
+// ShuttingDownProblem is for work the server won't start, or couldn't finish, because it's shutting down
+func ShuttingDownProblem() *ProblemDetails {
+	return &ProblemDetails{
+		Type:       serverInternalErr,
+		Detail:     "ACMESpider is shutting down, please try again shortly",
+		HTTPStatus: http.StatusServiceUnavailable,
+		retryAfter: time.Now().Add(shutdownRetryAfter),
+	}
+}
+
+// IsDNSProblem reports whether validation failed to resolve the identifier
+func (p *ProblemDetails) IsDNSProblem() bool {
+	return p.Type == dnsErr
+}
+
+// IsConnectionProblem reports whether validation failed to connect to the identifier, or to get a response from it
+func (p *ProblemDetails) IsConnectionProblem() bool {
+	return p.Type == connectionErr
+}
+
 func MalformedProblem(detail string) *ProblemDetails {
 	return &ProblemDetails{
 		Type:       malformedErr,
@@ -138,6 +171,50 @@ func ConnectionProblem(detail string) *ProblemDetails {
 	}
 }
 
+func DNSProblem(detail string) *ProblemDetails {
+	return &ProblemDetails{
+		Type:       dnsErr,
+		Detail:     detail,
+		HTTPStatus: http.StatusBadRequest,
+	}
+}
+
+// CompoundProblem wraps several problems, e.g. one per failed identifier in an order
+func CompoundProblem(detail string, subproblems []ProblemDetails) *ProblemDetails {
+	return &ProblemDetails{
+		Type:        compoundErr,
+		Detail:      detail,
+		HTTPStatus:  http.StatusForbidden,
+		Subproblems: subproblems,
+	}
+}
+
+func IncorrectResponseProblem(detail string) *ProblemDetails {
+	return &ProblemDetails{
+		Type:       incorrectResponseErr,
+		Detail:     detail,
+		HTTPStatus: http.StatusBadRequest,
+	}
+}
+
+func RateLimitedProblem(detail string, retryAfter time.Time) *ProblemDetails {
+	return &ProblemDetails{
+		Type:       rateLimitedErr,
+		Detail:     detail,
+		HTTPStatus: http.StatusTooManyRequests,
+		retryAfter: retryAfter,
+	}
+}
+
+// RequestTooLargeProblem is a malformed problem, with the status saying why
+func RequestTooLargeProblem(maxBytes int64) *ProblemDetails {
+	return &ProblemDetails{
+		Type:       malformedErr,
+		Detail:     fmt.Sprintf("Request body is larger than %d bytes", maxBytes),
+		HTTPStatus: http.StatusRequestEntityTooLarge,
+	}
+}
+
 func UnauthorizedProblem(detail string) *ProblemDetails {
 	return &ProblemDetails{
 		Type:       unauthorizedErr,
@@ -224,3 +301,102 @@ func RejectedIdentifierProblem(ident IdentifierForProblemDetails, detail string)
 		},
 	}
 }
+
+// RejectedByPolicyProblem is for orders the issuance policy won't allow, which might not be down to any one identifier
+func RejectedByPolicyProblem(detail string) *ProblemDetails {
+	return &ProblemDetails{
+		Type:       rejectedIdentifierErr,
+		Detail:     detail,
+		HTTPStatus: http.StatusBadRequest,
+	}
+}
+
+// problemToDB converts a problem to its stored form, so it can be shown to the client later
+func problemToDB(pd *ProblemDetails) *db.DBProblem {
+	if pd == nil {
+		return nil
+	}
+
+	stored := &db.DBProblem{
+		Type:   pd.Type,
+		Detail: pd.Detail,
+		Status: pd.HTTPStatus,
+	}
+	if pd.Identifier != nil {
+		stored.Identifier = &db.DBOrderIdentifier{Type: pd.Identifier.Type, Value: pd.Identifier.Value}
+	}
+	for i := range pd.Subproblems {
+		stored.Subproblems = append(stored.Subproblems, *problemToDB(&pd.Subproblems[i]))
+	}
+	return stored
+}
+
+// problemFromDB is the inverse of problemToDB
+func problemFromDB(stored *db.DBProblem) *ProblemDetails {
+	if stored == nil {
+		return nil
+	}
+
+	pd := &ProblemDetails{
+		Type:       stored.Type,
+		Detail:     stored.Detail,
+		HTTPStatus: stored.Status,
+	}
+	if stored.Identifier != nil {
+		pd.Identifier = &IdentifierForProblemDetails{Type: stored.Identifier.Type, Value: stored.Identifier.Value}
+	}
+	for i := range stored.Subproblems {
+		pd.Subproblems = append(pd.Subproblems, *problemFromDB(&stored.Subproblems[i]))
+	}
+	return pd
+}
+
+// Upstream problem types that describe the order itself rather than something wrong with ACMESpider, so are safe to show the client
+var clientFacingUpstreamProblems = map[string]bool{
+	issuer.ProblemRateLimited:           true,
+	issuer.ProblemCAA:                   true,
+	issuer.ProblemRejectedIdentifier:    true,
+	issuer.ProblemUnsupportedIdentifier: true,
+	issuer.ProblemBadCSR:                true,
+	issuer.ProblemDNS:                   true,
+}
+
+// upstreamProblem converts a problem from the upstream CA into one for the client, hiding anything not client facing behind internal's error ID.
+// Returns nil if nothing in the problem was client facing
+func upstreamProblem(prob *issuer.Problem, internal *ProblemDetails) *ProblemDetails {
+	passed := clientFacingUpstreamProblems[prob.Type]
+	pd := &ProblemDetails{
+		Type:       prob.Type,
+		Detail:     "Upstream CA: " + prob.Detail,
+		HTTPStatus: prob.Status,
+	}
+	if !passed && prob.Type != compoundErr {
+		pd.Type = serverInternalErr
+		pd.Detail = internal.Detail
+	}
+
+	for _, sub := range prob.Subproblems {
+		subPD := ProblemDetails{
+			Type:   sub.Type,
+			Detail: sub.Detail,
+		}
+		if sub.Identifier != "" {
+			subPD.Identifier = &IdentifierForProblemDetails{Type: "dns", Value: sub.Identifier}
+		}
+		if clientFacingUpstreamProblems[sub.Type] {
+			passed = true
+		} else {
+			subPD.Type = serverInternalErr
+			subPD.Detail = internal.Detail
+		}
+		pd.Subproblems = append(pd.Subproblems, subPD)
+	}
+
+	if !passed {
+		return nil
+	}
+	if pd.HTTPStatus == 0 {
+		pd.HTTPStatus = http.StatusForbidden
+	}
+	return pd
+}
@@ -0,0 +1,432 @@
+package acme_controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lachlan2k/acmespider/internal/db"
+	"github.com/lachlan2k/acmespider/internal/issuer"
+	"golang.org/x/net/publicsuffix"
+)
+
+// RateLimitConfig sets ceilings on certificates obtained from the upstream CA.
+// Public CAs limit issuance per registered domain and per exact set of names (e.g. Let's Encrypt's certificates per registered domain
+// and duplicate certificate limits), and hitting those blocks every internal service under the domain at once.
+// Keeping under these ceilings turns orders away before the upstream is ever called.
+// Only upstreams with limits like these count, so local CA, Vault and step-ca orders don't
+type RateLimitConfig struct {
+	// Certificates per registered domain (eTLD+1) within Window, zero for no limit
+	CertsPerRegisteredDomain int
+	// Certificates for exactly the same set of names within Window, zero for no limit
+	CertsPerNameSet int
+	Window          time.Duration
+
+	// If set, finalize requests over budget stay processing until there's room, rather than being rejected
+	Queue bool
+	// Orders that would be queued for longer than this are rejected instead
+	MaxQueueWait time.Duration
+}
+
+const (
+	defaultRateLimitWindow = 7 * 24 * time.Hour
+	defaultMaxQueueWait    = 6 * time.Hour
+	// How long to wait when only in-flight orders are using the budget, as they'll be issued or fail soon
+	inFlightBudgetRetry = time.Minute
+)
+
+// UpstreamBudget keeps count of certificates against one upstream CA's rate limits.
+// Tenants sharing an upstream share its budget, so the orders every tenant has in flight are counted together
+type UpstreamBudget struct {
+	conf RateLimitConfig
+	// Which upstream the issuance history is kept for, empty for the server's default upstream
+	upstream string
+
+	lock sync.Mutex
+	// Orders being issued upstream right now, which count against the budget until they're recorded or fail
+	inFlight map[string]issuanceNames
+}
+
+// issuanceNames is what a certificate counts against in the budget
+type issuanceNames struct {
+	registeredDomains []string
+	nameSet           string
+	// Tenant the order was placed through, which only decides who can see it in reports
+	tenant string
+}
+
+func NewUpstreamBudget(upstream string, conf RateLimitConfig) *UpstreamBudget {
+	if conf.Window == 0 {
+		conf.Window = defaultRateLimitWindow
+	}
+	if conf.MaxQueueWait == 0 {
+		conf.MaxQueueWait = defaultMaxQueueWait
+	}
+	return &UpstreamBudget{conf: conf, upstream: upstream, inFlight: map[string]issuanceNames{}}
+}
+
+// SetUpstreamBudget sets the budget for the controller's upstream, which must be shared with every controller using the same upstream
+func (ac *ACMEController) SetUpstreamBudget(budget *UpstreamBudget) {
+	ac.rateBudget = budget
+}
+
+func (b *UpstreamBudget) enabled() bool {
+	return b.conf.CertsPerRegisteredDomain > 0 || b.conf.CertsPerNameSet > 0
+}
+
+func namesFor(identifiers []db.DBOrderIdentifier) issuanceNames {
+	seenNames := map[string]bool{}
+	seenDomains := map[string]bool{}
+	var names issuanceNames
+	var nameList []string
+
+	for _, id := range identifiers {
+		name := strings.TrimSuffix(strings.ToLower(id.Value), ".")
+		if !seenNames[name] {
+			seenNames[name] = true
+			nameList = append(nameList, name)
+		}
+
+		domain := registeredDomain(name)
+		if !seenDomains[domain] {
+			seenDomains[domain] = true
+			names.registeredDomains = append(names.registeredDomains, domain)
+		}
+	}
+
+	sort.Strings(nameList)
+	sort.Strings(names.registeredDomains)
+	names.nameSet = strings.Join(nameList, ",")
+	return names
+}
+
+// registeredDomain returns name's eTLD+1, or name itself if it doesn't have one
+func registeredDomain(name string) string {
+	domain, err := publicsuffix.EffectiveTLDPlusOne(strings.TrimPrefix(name, "*."))
+	if err != nil {
+		return name
+	}
+	return domain
+}
+
+// countsAgainstBudget reports whether an order would be issued by a CA with issuance rate limits
+func (ac ACMEController) countsAgainstBudget(order *db.DBOrder) bool {
+	return !ac.isLocalCAOrder(order) && issuer.LimitsIssuance(ac.upstream)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// budgetCounter counts issuance against one limit
+type budgetCounter struct {
+	name     string
+	limit    int
+	issued   func(db.DBIssuance) bool
+	inFlight func(issuanceNames) bool
+}
+
+func (b *UpstreamBudget) countersFor(names issuanceNames) []budgetCounter {
+	var counters []budgetCounter
+	if b.conf.CertsPerRegisteredDomain > 0 {
+		for _, domain := range names.registeredDomains {
+			domain := domain
+			counters = append(counters, budgetCounter{
+				name:     "registered domain " + domain,
+				limit:    b.conf.CertsPerRegisteredDomain,
+				issued:   func(iss db.DBIssuance) bool { return containsString(iss.RegisteredDomains, domain) },
+				inFlight: func(n issuanceNames) bool { return containsString(n.registeredDomains, domain) },
+			})
+		}
+	}
+	if b.conf.CertsPerNameSet > 0 {
+		counters = append(counters, budgetCounter{
+			name:     "names " + names.nameSet,
+			limit:    b.conf.CertsPerNameSet,
+			issued:   func(iss db.DBIssuance) bool { return iss.NameSet == names.nameSet },
+			inFlight: func(n issuanceNames) bool { return n.nameSet == names.nameSet },
+		})
+	}
+	return counters
+}
+
+// overBudgetUntil returns when another certificate for names would fit in the budget, or zero if it already does,
+// along with the limit that's in the way. The caller must hold the budget's lock
+func (ac ACMEController) overBudgetUntil(names issuanceNames, now time.Time) (time.Time, string, error) {
+	b := ac.rateBudget
+	if !b.enabled() {
+		return time.Time{}, "", nil
+	}
+
+	issuances, err := ac.db.GetIssuancesSince(b.upstream, now.Add(-b.conf.Window).Unix())
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	sort.Slice(issuances, func(i, j int) bool { return issuances[i].Time < issuances[j].Time })
+
+	var until time.Time
+	var blockedBy string
+	for _, counter := range b.countersFor(names) {
+		var times []int64
+		for _, iss := range issuances {
+			if counter.issued(iss) {
+				times = append(times, iss.Time)
+			}
+		}
+		inFlight := 0
+		for _, n := range b.inFlight {
+			if counter.inFlight(n) {
+				inFlight++
+			}
+		}
+
+		// How many of the counted certificates need to leave the window before there's room for one more
+		over := len(times) + inFlight - counter.limit + 1
+		if over <= 0 {
+			continue
+		}
+
+		free := now.Add(inFlightBudgetRetry)
+		if over <= len(times) {
+			free = time.Unix(times[over-1], 0).Add(b.conf.Window)
+		}
+		if free.After(until) {
+			until = free
+			blockedBy = counter.name
+		}
+	}
+	return until, blockedBy, nil
+}
+
+func (ac ACMEController) rateBudgetProblem(until time.Time, blockedBy string) *ProblemDetails {
+	return RateLimitedProblem(
+		fmt.Sprintf("Issuing this order would exceed the upstream rate limit budget of %s, try again after %s", blockedBy, until.UTC().Format(time.RFC3339)),
+		until,
+	)
+}
+
+// checkRateBudget rejects new upstream orders that are over budget, unless they'd be queued when finalized
+func (ac ACMEController) checkRateBudget(identifiers []db.DBOrderIdentifier) error {
+	b := ac.rateBudget
+	if !b.enabled() || !ac.countsAgainstBudget(&db.DBOrder{Identifiers: identifiers}) {
+		return nil
+	}
+
+	now := time.Now()
+	b.lock.Lock()
+	until, blockedBy, err := ac.overBudgetUntil(namesFor(identifiers), now)
+	b.lock.Unlock()
+	if err != nil {
+		return InternalErrorProblem(err)
+	}
+
+	if until.IsZero() || (b.conf.Queue && until.Sub(now) <= b.conf.MaxQueueWait) {
+		return nil
+	}
+	return ac.rateBudgetProblem(until, blockedBy)
+}
+
+// reserveRateBudget counts order against the budget until it's issued or fails.
+// If it doesn't fit but can be queued, it returns when to try again
+func (ac ACMEController) reserveRateBudget(order *db.DBOrder) (time.Time, error) {
+	b := ac.rateBudget
+	if !ac.countsAgainstBudget(order) {
+		return time.Time{}, nil
+	}
+
+	names := namesFor(order.Identifiers)
+	names.tenant = ac.tenant.Name
+	now := time.Now()
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	until, blockedBy, err := ac.overBudgetUntil(names, now)
+	if err != nil {
+		return time.Time{}, InternalErrorProblem(err)
+	}
+	if until.IsZero() {
+		b.inFlight[order.ID] = names
+		return time.Time{}, nil
+	}
+	if !b.conf.Queue || until.Sub(now) > b.conf.MaxQueueWait {
+		return time.Time{}, ac.rateBudgetProblem(until, blockedBy)
+	}
+	return until, nil
+}
+
+// waitForRateBudget blocks a queued order until it fits in the budget
+func (ac ACMEController) waitForRateBudget(ctx context.Context, order *db.DBOrder, until time.Time) error {
+	for !until.IsZero() {
+		ac.logger.WithField("order_id", order.ID).WithField("until", until).Info("Order queued for upstream rate limit budget")
+		select {
+		case <-ctx.Done():
+			return ShuttingDownProblem()
+		case <-time.After(time.Until(until)):
+		}
+
+		var err error
+		until, err = ac.reserveRateBudget(order)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ac ACMEController) releaseRateBudget(orderID string) {
+	b := ac.rateBudget
+	b.lock.Lock()
+	delete(b.inFlight, orderID)
+	b.lock.Unlock()
+}
+
+// recordIssuance adds an upstream certificate to the issuance history, and forgets anything that's left the window
+func (ac ACMEController) recordIssuance(order *db.DBOrder) error {
+	names := namesFor(order.Identifiers)
+	names.tenant = ac.tenant.Name
+	return ac.rateBudget.record(ac.db, names, order.ID)
+}
+
+// RecordIssuance adds a certificate obtained from the upstream without an order, like ACMESpider's own, to the issuance history
+func (b *UpstreamBudget) RecordIssuance(boltDb db.DB, names []string) error {
+	identifiers := make([]db.DBOrderIdentifier, len(names))
+	for i, name := range names {
+		identifiers[i] = db.DBOrderIdentifier{Value: name}
+	}
+	return b.record(boltDb, namesFor(identifiers), "")
+}
+
+func (b *UpstreamBudget) record(boltDb db.DB, names issuanceNames, orderID string) error {
+	id, err := GenerateID()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	err = boltDb.CreateIssuance(db.DBIssuance{
+		ID:                id,
+		OrderID:           orderID,
+		Time:              now.Unix(),
+		RegisteredDomains: names.registeredDomains,
+		NameSet:           names.nameSet,
+		Tenant:            names.tenant,
+		Upstream:          b.upstream,
+	})
+	if err != nil {
+		return err
+	}
+
+	return boltDb.DeleteIssuancesBefore(b.upstream, now.Add(-b.conf.Window).Unix())
+}
+
+// BudgetUsage is how much of one upstream rate limit has been used
+type BudgetUsage struct {
+	Name     string
+	Issued   int
+	InFlight int
+	// Zero if there's no limit
+	Limit int
+	// When the oldest counted certificate leaves the window, zero if none have been issued
+	NextFreed time.Time
+}
+
+type RateBudgetReport struct {
+	Window            time.Duration
+	RegisteredDomains []BudgetUsage
+	// Only set if names were asked about
+	NameSet *BudgetUsage
+}
+
+// RateBudget reports upstream issuance within the window for every registered domain this tenant has issued for,
+// and for the exact set of names if given. The counts include every tenant's certificates, as they share the upstream's limits
+func (ac ACMEController) RateBudget(names []string) (*RateBudgetReport, error) {
+	for _, name := range names {
+		if !ac.identifierAllowed(name) {
+			return nil, RejectedIdentifierProblem(IdentifierForProblemDetails{Type: "dns", Value: name}, "This directory doesn't issue certificates for this name")
+		}
+	}
+
+	b := ac.rateBudget
+	now := time.Now()
+
+	issuances, err := ac.db.GetIssuancesSince(b.upstream, now.Add(-b.conf.Window).Unix())
+	if err != nil {
+		return nil, InternalErrorProblem(err)
+	}
+	sort.Slice(issuances, func(i, j int) bool { return issuances[i].Time < issuances[j].Time })
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	usage := func(name string, limit int, issued func(db.DBIssuance) bool, inFlight func(issuanceNames) bool) BudgetUsage {
+		u := BudgetUsage{Name: name, Limit: limit}
+		for _, iss := range issuances {
+			if issued(iss) {
+				if u.Issued == 0 {
+					u.NextFreed = time.Unix(iss.Time, 0).Add(b.conf.Window)
+				}
+				u.Issued++
+			}
+		}
+		for _, n := range b.inFlight {
+			if inFlight(n) {
+				u.InFlight++
+			}
+		}
+		return u
+	}
+
+	domains := map[string]bool{}
+	for _, iss := range issuances {
+		if iss.Tenant != ac.tenant.Name {
+			continue
+		}
+		for _, domain := range iss.RegisteredDomains {
+			domains[domain] = true
+		}
+	}
+	for _, n := range b.inFlight {
+		if n.tenant != ac.tenant.Name {
+			continue
+		}
+		for _, domain := range n.registeredDomains {
+			domains[domain] = true
+		}
+	}
+
+	report := &RateBudgetReport{Window: b.conf.Window, RegisteredDomains: []BudgetUsage{}}
+	for domain := range domains {
+		domain := domain
+		report.RegisteredDomains = append(report.RegisteredDomains, usage(domain, b.conf.CertsPerRegisteredDomain,
+			func(iss db.DBIssuance) bool { return containsString(iss.RegisteredDomains, domain) },
+			func(n issuanceNames) bool { return containsString(n.registeredDomains, domain) },
+		))
+	}
+	sort.Slice(report.RegisteredDomains, func(i, j int) bool {
+		return report.RegisteredDomains[i].Name < report.RegisteredDomains[j].Name
+	})
+
+	if len(names) > 0 {
+		ids := make([]db.DBOrderIdentifier, len(names))
+		for i, name := range names {
+			ids[i] = db.DBOrderIdentifier{Type: "dns", Value: name}
+		}
+		nameSet := namesFor(ids).nameSet
+		setUsage := usage(nameSet, b.conf.CertsPerNameSet,
+			func(iss db.DBIssuance) bool { return iss.NameSet == nameSet },
+			func(n issuanceNames) bool { return n.nameSet == nameSet },
+		)
+		report.NameSet = &setUsage
+	}
+
+	return report, nil
+}
@@ -0,0 +1,215 @@
+package acme_controller
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lachlan2k/acmespider/internal/db"
+	"github.com/lachlan2k/acmespider/internal/issuer"
+	"github.com/lachlan2k/acmespider/internal/links"
+)
+
+// limitedIssuer stands in for an upstream with Let's Encrypt style limits, it's never asked to issue
+type limitedIssuer struct {
+	issuer.Issuer
+}
+
+func (limitedIssuer) LimitsIssuance() bool { return true }
+
+func newBudgetTestController(t *testing.T, conf RateLimitConfig, issuedAgo ...time.Duration) *ACMEController {
+	boltDb, err := db.NewBoltDb(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+
+	ac := New(boltDb, limitedIssuer{}, nil, links.LinkController{})
+	ac.SetUpstreamBudget(NewUpstreamBudget("", conf))
+
+	names := namesFor([]db.DBOrderIdentifier{{Type: "dns", Value: "wiki.internal.example.com"}})
+	for i, ago := range issuedAgo {
+		err = boltDb.CreateIssuance(db.DBIssuance{
+			ID:                string(rune('a' + i)),
+			Time:              time.Now().Add(-ago).Unix(),
+			RegisteredDomains: names.registeredDomains,
+			NameSet:           names.nameSet,
+		})
+		if err != nil {
+			t.Fatalf("failed to create issuance: %v", err)
+		}
+	}
+	return ac
+}
+
+func TestNamesFor(t *testing.T) {
+	names := namesFor([]db.DBOrderIdentifier{
+		{Type: "dns", Value: "Wiki.Internal.Example.com."},
+		{Type: "dns", Value: "*.apps.example.co.uk"},
+		{Type: "dns", Value: "printer.lan"},
+		{Type: "dns", Value: "wiki.internal.example.com"},
+	})
+
+	if names.nameSet != "*.apps.example.co.uk,printer.lan,wiki.internal.example.com" {
+		t.Fatalf("unexpected name set %q", names.nameSet)
+	}
+	want := []string{"example.co.uk", "example.com", "printer.lan"}
+	if len(names.registeredDomains) != len(want) {
+		t.Fatalf("expected registered domains %v, got %v", want, names.registeredDomains)
+	}
+	for i := range want {
+		if names.registeredDomains[i] != want[i] {
+			t.Fatalf("expected registered domains %v, got %v", want, names.registeredDomains)
+		}
+	}
+}
+
+func TestRateBudget(t *testing.T) {
+	window := 24 * time.Hour
+	order := &db.DBOrder{ID: "order", Identifiers: []db.DBOrderIdentifier{{Type: "dns", Value: "wiki.internal.example.com"}}}
+	otherNames := &db.DBOrder{ID: "other", Identifiers: []db.DBOrderIdentifier{{Type: "dns", Value: "docs.internal.example.com"}}}
+
+	t.Run("under budget", func(t *testing.T) {
+		ac := newBudgetTestController(t, RateLimitConfig{CertsPerNameSet: 1, Window: window})
+		if err := ac.checkRateBudget(order.Identifiers); err != nil {
+			t.Fatalf("order under budget was rejected: %v", err)
+		}
+		if until, err := ac.reserveRateBudget(order); err != nil || !until.IsZero() {
+			t.Fatalf("failed to reserve budget: %v %s", err, until)
+		}
+
+		// The in-flight order uses the last of the budget
+		_, err := ac.reserveRateBudget(&db.DBOrder{ID: "second", Identifiers: order.Identifiers})
+		if p, ok := err.(*ProblemDetails); !ok || p.Type != rateLimitedErr {
+			t.Fatalf("expected rateLimited, got %v", err)
+		}
+		if until := prob(err).RetryAfter(); time.Until(until) > inFlightBudgetRetry {
+			t.Fatalf("expected to retry soon while the budget is only used by in-flight orders, got %s", until)
+		}
+
+		ac.releaseRateBudget(order.ID)
+		if until, err := ac.reserveRateBudget(&db.DBOrder{ID: "second", Identifiers: order.Identifiers}); err != nil || !until.IsZero() {
+			t.Fatalf("budget wasn't released: %v %s", err, until)
+		}
+	})
+
+	t.Run("over budget", func(t *testing.T) {
+		ac := newBudgetTestController(t, RateLimitConfig{CertsPerNameSet: 2, CertsPerRegisteredDomain: 5, Window: window}, 2*time.Hour, 3*time.Hour, 48*time.Hour)
+		err := ac.checkRateBudget(order.Identifiers)
+		if err == nil {
+			t.Fatal("order over budget was accepted")
+		}
+		// Room is made when the oldest issuance in the window leaves it
+		wantFree := time.Now().Add(window - 3*time.Hour)
+		if got := prob(err).RetryAfter(); got.Sub(wantFree).Abs() > 2*time.Second {
+			t.Fatalf("expected to retry at %s, got %s", wantFree, got)
+		}
+
+		if err := ac.checkRateBudget(otherNames.Identifiers); err != nil {
+			t.Fatalf("order for other names under the same registered domain was rejected: %v", err)
+		}
+	})
+
+	t.Run("queued", func(t *testing.T) {
+		ac := newBudgetTestController(t, RateLimitConfig{CertsPerNameSet: 1, Queue: true, MaxQueueWait: time.Hour, Window: window}, window-time.Minute)
+		if err := ac.checkRateBudget(order.Identifiers); err != nil {
+			t.Fatalf("order that can be queued was rejected: %v", err)
+		}
+		until, err := ac.reserveRateBudget(order)
+		if err != nil || until.IsZero() {
+			t.Fatalf("expected order to be queued, got %v %s", err, until)
+		}
+
+		ac = newBudgetTestController(t, RateLimitConfig{CertsPerNameSet: 1, Queue: true, MaxQueueWait: time.Hour, Window: window}, time.Hour)
+		if err := ac.checkRateBudget(order.Identifiers); err == nil {
+			t.Fatal("order that would be queued too long was accepted")
+		}
+	})
+
+	t.Run("recorded", func(t *testing.T) {
+		ac := newBudgetTestController(t, RateLimitConfig{Window: window}, 2*window)
+		if err := ac.recordIssuance(order); err != nil {
+			t.Fatalf("failed to record issuance: %v", err)
+		}
+		report, err := ac.RateBudget([]string{"WIKI.internal.example.com"})
+		if err != nil {
+			t.Fatalf("failed to get report: %v", err)
+		}
+		if len(report.RegisteredDomains) != 1 || report.RegisteredDomains[0].Issued != 1 || report.NameSet.Issued != 1 {
+			t.Fatalf("expected only the new issuance to be counted, got %+v %+v", report.RegisteredDomains, report.NameSet)
+		}
+	})
+}
+
+func TestRateBudgetUnlimitedUpstream(t *testing.T) {
+	ac := newBudgetTestController(t, RateLimitConfig{CertsPerNameSet: 1}, time.Hour)
+	// Vault and step-ca don't limit issuance, so their orders aren't held to the budget
+	ac.upstream = &issuer.VaultIssuer{}
+
+	order := &db.DBOrder{ID: "order", Identifiers: []db.DBOrderIdentifier{{Type: "dns", Value: "wiki.internal.example.com"}}}
+	if err := ac.checkRateBudget(order.Identifiers); err != nil {
+		t.Fatalf("order for an upstream without limits was rejected: %v", err)
+	}
+	if until, err := ac.reserveRateBudget(order); err != nil || !until.IsZero() || len(ac.rateBudget.inFlight) != 0 {
+		t.Fatalf("order for an upstream without limits was counted: %v %s", err, until)
+	}
+}
+
+func TestRateBudgetTenants(t *testing.T) {
+	ac := newBudgetTestController(t, RateLimitConfig{CertsPerNameSet: 5}, time.Hour)
+	ac.SetTenantConfig(TenantConfig{Name: "ot-net", AllowedDomains: []string{"ot.example.net"}})
+
+	order := &db.DBOrder{ID: "order", Identifiers: []db.DBOrderIdentifier{{Type: "dns", Value: "plc.ot.example.net"}}}
+	if err := ac.recordIssuance(order); err != nil {
+		t.Fatalf("failed to record issuance: %v", err)
+	}
+
+	// The default tenant's issuance for example.com isn't shown
+	report, err := ac.RateBudget(nil)
+	if err != nil {
+		t.Fatalf("failed to get report: %v", err)
+	}
+	if len(report.RegisteredDomains) != 1 || report.RegisteredDomains[0].Name != "example.net" || report.RegisteredDomains[0].Issued != 1 {
+		t.Fatalf("expected only the tenant's registered domain, got %+v", report.RegisteredDomains)
+	}
+
+	_, err = ac.RateBudget([]string{"wiki.internal.example.com"})
+	if err == nil || prob(err).Type != "urn:ietf:params:acme:error:rejectedIdentifier" {
+		t.Fatalf("expected names outside the tenant to be rejected, got %v", err)
+	}
+}
+
+func TestRateBudgetSharedUpstream(t *testing.T) {
+	ac := newBudgetTestController(t, RateLimitConfig{CertsPerNameSet: 1})
+	order := &db.DBOrder{ID: "order", Identifiers: []db.DBOrderIdentifier{{Type: "dns", Value: "wiki.internal.example.com"}}}
+
+	// Another tenant on the same upstream sees the order in flight
+	other := New(ac.db, ac.upstream, nil, links.LinkController{})
+	other.SetTenantConfig(TenantConfig{Name: "lab"})
+	other.SetUpstreamBudget(ac.rateBudget)
+	if _, err := ac.reserveRateBudget(order); err != nil {
+		t.Fatalf("failed to reserve budget: %v", err)
+	}
+	if err := other.checkRateBudget(order.Identifiers); err == nil {
+		t.Fatal("order in flight through another tenant wasn't counted")
+	}
+
+	if err := ac.recordIssuance(order); err != nil {
+		t.Fatalf("failed to record issuance: %v", err)
+	}
+	ac.releaseRateBudget(order.ID)
+	if err := other.checkRateBudget(order.Identifiers); err == nil {
+		t.Fatal("issuance through another tenant wasn't counted")
+	}
+
+	// A tenant with its own upstream keeps its own history
+	own := New(ac.db, ac.upstream, nil, links.LinkController{})
+	own.SetTenantConfig(TenantConfig{Name: "lab"})
+	own.SetUpstreamBudget(NewUpstreamBudget("lab", RateLimitConfig{CertsPerNameSet: 1}))
+	if err := own.checkRateBudget(order.Identifiers); err != nil {
+		t.Fatalf("issuance from another upstream was counted: %v", err)
+	}
+}
+
+func prob(err error) *ProblemDetails {
+	return err.(*ProblemDetails)
+}
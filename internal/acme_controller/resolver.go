@@ -0,0 +1,26 @@
+package acme_controller
+
+import (
+	"context"
+	"math/rand"
+	"net"
+)
+
+// newResolver returns a resolver using the given DNS servers, or the system resolver if there are none
+func newResolver(servers []string) *net.Resolver {
+	if len(servers) == 0 {
+		return net.DefaultResolver
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			server := servers[rand.Intn(len(servers))]
+			if _, _, err := net.SplitHostPort(server); err != nil {
+				server = net.JoinHostPort(server, "53")
+			}
+			d := net.Dialer{}
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
@@ -0,0 +1,88 @@
+package acme_controller
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/lachlan2k/acmespider/internal/db"
+)
+
+// SourceIPConfig controls source IP binding.
+// When enabled, new orders and finalize requests are only accepted if the requester's address
+// is one of the addresses every identifier in the order resolves to.
+// This stops one internal host getting certificates for another host that happens to serve an open /.well-known/acme-challenge path
+type SourceIPConfig struct {
+	Enabled bool
+	// DNS servers to resolve identifiers with, the system resolver is used if empty
+	Resolvers     []string
+	LookupTimeout time.Duration
+}
+
+const defaultSourceIPLookupTimeout = 5 * time.Second
+
+type sourceIPBinder struct {
+	conf     SourceIPConfig
+	resolver *net.Resolver
+}
+
+func newSourceIPBinder(conf SourceIPConfig) *sourceIPBinder {
+	if conf.LookupTimeout == 0 {
+		conf.LookupTimeout = defaultSourceIPLookupTimeout
+	}
+
+	return &sourceIPBinder{conf: conf, resolver: newResolver(conf.Resolvers)}
+}
+
+func (ac *ACMEController) SetSourceIPConfig(conf SourceIPConfig) {
+	if !conf.Enabled {
+		ac.sourceIP = nil
+		return
+	}
+	ac.sourceIP = newSourceIPBinder(conf)
+}
+
+// checkSourceIP returns an unauthorized problem unless every identifier resolves to sourceIP, or if binding is disabled
+func (ac ACMEController) checkSourceIP(sourceIP net.IP, identifiers []db.DBOrderIdentifier) error {
+	if ac.sourceIP == nil {
+		return nil
+	}
+	if sourceIP == nil {
+		return InternalErrorProblem(fmt.Errorf("source IP binding is enabled, but the request's source IP is unknown"))
+	}
+
+	for _, id := range identifiers {
+		// A wildcard isn't a single host, so there's nothing to bind to
+		if strings.HasPrefix(id.Value, "*.") {
+			return UnauthorizedProblem(fmt.Sprintf("Wildcard identifier %s can't be issued while source IP binding is enabled", id.Value))
+		}
+
+		addrs, err := ac.sourceIP.lookup(id.Value)
+		if err != nil {
+			ac.logger.WithError(err).WithField("identifier", id.Value).Debug("Source IP binding lookup failed")
+			return UnauthorizedProblem(fmt.Sprintf("Couldn't resolve %s to check it against the request's source address", id.Value))
+		}
+
+		found := false
+		for _, addr := range addrs {
+			if addr.IP.Equal(sourceIP) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			ac.logger.WithField("identifier", id.Value).WithField("source_ip", sourceIP.String()).WithField("resolved", addrs).Info("Rejected request for identifier not resolving to requester")
+			return UnauthorizedProblem(fmt.Sprintf("%s does not resolve to the request's source address %s", id.Value, sourceIP))
+		}
+	}
+
+	return nil
+}
+
+func (b *sourceIPBinder) lookup(name string) ([]net.IPAddr, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), b.conf.LookupTimeout)
+	defer cancel()
+	return b.resolver.LookupIPAddr(ctx, strings.TrimSuffix(name, "."))
+}
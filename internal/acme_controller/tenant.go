@@ -0,0 +1,124 @@
+package acme_controller
+
+import (
+	"crypto"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/lachlan2k/acmespider/internal/db"
+)
+
+// TenantConfig is what sets one tenant's ACME directory apart from the others sharing the deployment.
+// The default tenant, served at /acme, has an empty Name
+type TenantConfig struct {
+	Name string
+	// Identifiers must be one of these domains, or under one. If empty, any identifier is allowed
+	AllowedDomains []string
+	// HMAC keys for external account binding, by key ID
+	EABKeys map[string][]byte
+	// If set, new accounts must be bound to one of EABKeys
+	RequireEAB bool
+}
+
+func (ac *ACMEController) SetTenantConfig(conf TenantConfig) {
+	ac.tenant = conf
+}
+
+// identifierAllowed checks the tenant's policy allows a name
+func (ac ACMEController) identifierAllowed(name string) bool {
+	return len(ac.tenant.AllowedDomains) == 0 || domainMatches(name, ac.tenant.AllowedDomains)
+}
+
+// domainMatches reports whether a name is one of domains, or under one
+func domainMatches(name string, domains []string) bool {
+	name = strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(name, "*."), "."))
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+		if domain == "" {
+			continue
+		}
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// accountInTenant checks an account was created through this tenant's directory, so KIDs can't be used across tenants
+func (ac ACMEController) accountInTenant(accountID []byte) (bool, error) {
+	acc, err := ac.db.GetAccount(accountID)
+	if err != nil {
+		if db.IsErrNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return acc.Tenant == ac.tenant.Name, nil
+}
+
+var eabAlgorithms = map[jose.SignatureAlgorithm]bool{
+	jose.HS256: true,
+	jose.HS384: true,
+	jose.HS512: true,
+}
+
+// verifyExternalAccountBinding checks a newAccount request's binding, returning the EAB key ID the account is bound to.
+// If there's no binding and the tenant doesn't require one, the key ID is empty
+// ref: https://datatracker.ietf.org/doc/html/rfc8555#section-7.3.4
+func (ac ACMEController) verifyExternalAccountBinding(binding json.RawMessage, accountKey jose.JSONWebKey) (string, error) {
+	if len(binding) == 0 || string(binding) == "null" {
+		if ac.tenant.RequireEAB {
+			return "", ExternalAccountRequiredProblem("This directory requires new accounts to be bound to an external account")
+		}
+		return "", nil
+	}
+
+	jws, err := jose.ParseSigned(string(binding))
+	if err != nil || len(jws.Signatures) != 1 {
+		return "", MalformedProblem("externalAccountBinding is not a valid JWS")
+	}
+	protected := jws.Signatures[0].Protected
+
+	if !eabAlgorithms[jose.SignatureAlgorithm(protected.Algorithm)] {
+		return "", MalformedProblem(fmt.Sprintf("externalAccountBinding must use a MAC algorithm, not %s", protected.Algorithm))
+	}
+	if protected.Nonce != "" {
+		return "", MalformedProblem("externalAccountBinding must not contain a nonce")
+	}
+	url, _ := protected.ExtraHeaders["url"].(string)
+	if url != ac.linkCtrl.NewAccountPath().Abs() {
+		return "", MalformedProblem("externalAccountBinding url doesn't match the newAccount URL")
+	}
+
+	hmacKey, ok := ac.tenant.EABKeys[protected.KeyID]
+	if !ok || protected.KeyID == "" {
+		return "", UnauthorizedProblem("Unknown external account key ID")
+	}
+
+	payload, err := jws.Verify(hmacKey)
+	if err != nil {
+		return "", UnauthorizedProblem("externalAccountBinding signature is invalid")
+	}
+
+	var boundKey jose.JSONWebKey
+	err = json.Unmarshal(payload, &boundKey)
+	if err != nil {
+		return "", MalformedProblem("externalAccountBinding payload is not a JWK")
+	}
+	boundThumbprint, err := boundKey.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", MalformedProblem("externalAccountBinding payload is not a JWK")
+	}
+	accountThumbprint, err := accountKey.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", InternalErrorProblem(err)
+	}
+	if subtle.ConstantTimeCompare(boundThumbprint, accountThumbprint) != 1 {
+		return "", UnauthorizedProblem("externalAccountBinding is for a different account key")
+	}
+
+	return protected.KeyID, nil
+}
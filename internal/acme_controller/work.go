@@ -0,0 +1,255 @@
+package acme_controller
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lachlan2k/acmespider/internal/db"
+	"github.com/lachlan2k/acmespider/internal/dtos"
+	log "github.com/sirupsen/logrus"
+)
+
+// How long clients are asked to wait before retrying while the server is shutting down
+const shutdownRetryAfter = 30 * time.Second
+
+// WorkTracker keeps track of the validation and issuance controllers do in the background,
+// so that shutdown can wait for it. Controllers sharing a database should share a tracker
+type WorkTracker struct {
+	wg       sync.WaitGroup
+	ctx      context.Context
+	cancel   context.CancelFunc
+	draining atomic.Bool
+
+	lock sync.Mutex
+	// Authzs being validated and orders being issued, to clean up after if they don't finish in time
+	authzs map[string]*db.DBAuthz
+	orders map[string]bool
+}
+
+func NewWorkTracker() *WorkTracker {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &WorkTracker{
+		ctx:    ctx,
+		cancel: cancel,
+		authzs: map[string]*db.DBAuthz{},
+		orders: map[string]bool{},
+	}
+}
+
+func (ac *ACMEController) SetWorkTracker(w *WorkTracker) {
+	ac.work = w
+}
+
+// Drain stops controllers from taking on new orders, challenges and finalizations
+func (w *WorkTracker) Drain() {
+	w.draining.Store(true)
+}
+
+func (w *WorkTracker) Draining() bool {
+	return w.draining.Load()
+}
+
+// checkNotDraining is called before anything that would start background work
+func (w *WorkTracker) checkNotDraining() error {
+	if w.Draining() {
+		return ShuttingDownProblem()
+	}
+	return nil
+}
+
+// Context is done once shutdown has stopped waiting for background work.
+// Work the tracker doesn't run itself, like waiting on DNS propagation inside the upstream client, should give up with it
+func (w *WorkTracker) Context() context.Context {
+	return w.ctx
+}
+
+// run runs fn in the background. fn should give up when ctx is done
+func (w *WorkTracker) run(fn func(ctx context.Context)) {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		fn(w.ctx)
+	}()
+}
+
+func (w *WorkTracker) startValidating(authz *db.DBAuthz) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.authzs[authz.ID] = authz
+}
+
+func (w *WorkTracker) doneValidating(authzID string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	delete(w.authzs, authzID)
+}
+
+func (w *WorkTracker) startIssuing(orderID string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.orders[orderID] = true
+}
+
+func (w *WorkTracker) doneIssuing(orderID string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	delete(w.orders, orderID)
+}
+
+// Wait waits for background work to finish until ctx is done.
+// After that, validations are cancelled and left processing to be resumed after a restart, with their authz unlocked.
+// Orders still being issued are left processing too, to be resumed by ResumeIssuance. The database must still be open
+func (w *WorkTracker) Wait(ctx context.Context, database db.DB) error {
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	// Validations and orders queued for the rate limit budget stop straight away, which is quick. Upstream issuance can't be interrupted
+	w.cancel()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(time.Second):
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for _, authz := range w.authzs {
+		log.WithField("authz_id", authz.ID).Warn("Leaving validation that didn't finish before shutdown to resume after the restart")
+		if err := database.UnlockAuthz([]byte(authz.ID)); err != nil {
+			log.WithError(err).WithField("authz_id", authz.ID).Error("Failed to release authz lock")
+		}
+	}
+	for orderID := range w.orders {
+		log.WithField("order_id", orderID).Warn("Leaving order that wasn't issued before shutdown to resume after the restart")
+	}
+
+	return fmt.Errorf("%d validations and %d orders didn't finish before shutdown", len(w.authzs), len(w.orders))
+}
+
+// ResumeValidations picks up the validations of this controller's tenant that were cut short by the last shutdown.
+// It must be called before the server starts taking requests, as any authz locks left behind are taken to be stale
+func (ac ACMEController) ResumeValidations() error {
+	authzs, err := ac.db.GetAuthzsWithChallengeStatus(dtos.ChallengeStatusProcessing)
+	if err != nil {
+		return err
+	}
+
+	for i := range authzs {
+		authz := &authzs[i]
+		if authz.Status != dtos.AuthzStatusPending {
+			continue
+		}
+		inTenant, err := ac.accountInTenant([]byte(authz.AccountID))
+		if err != nil {
+			return err
+		}
+		if !inTenant {
+			continue
+		}
+
+		order, err := ac.db.GetOrder([]byte(authz.OrderID))
+		if err != nil {
+			return err
+		}
+		if err = ac.db.UnlockAuthz([]byte(authz.ID)); err != nil {
+			return err
+		}
+
+		for challengeIndex, chall := range authz.Challenges {
+			// Challenges held for approval are processing too, but are started when the order's approved
+			held := containsString(order.HeldChallengeIDs, ac.makeChallengeID(authz.ID, challengeIndex))
+			if chall.Status != dtos.ChallengeStatusProcessing || chall.Type != HTTP01ChallengeType || held {
+				continue
+			}
+			challengeIndex := challengeIndex
+			logger := ac.logger.WithField("authz_id", authz.ID).WithField("identifier", authz.Identifier.Value)
+			logger.Info("Resuming validation cut short by the last shutdown")
+			ac.work.run(func(ctx context.Context) {
+				if err := ac.doHTTP01ChallengeVerifyLoop(ctx, order, authz, challengeIndex, true); err != nil {
+					logger.WithError(err).Error("Failed to resume validation")
+				}
+			})
+		}
+	}
+	return nil
+}
+
+// ResumeIssuance picks up the issuance of this controller's tenant's orders that were cut short by the last shutdown or a crash.
+// The upstream can't be asked whether it finished, so the certificate is obtained again with the CSR the order was finalized with.
+// It must be called before the server starts taking requests
+func (ac ACMEController) ResumeIssuance() error {
+	orders, err := ac.db.GetOrdersWithStatus(dtos.OrderStatusProcessing)
+	if err != nil {
+		return err
+	}
+
+	for i := range orders {
+		order := &orders[i]
+		inTenant, err := ac.accountInTenant([]byte(order.AccountID))
+		if err != nil {
+			return err
+		}
+		if !inTenant {
+			continue
+		}
+		logger := ac.logger.WithField("order_id", order.ID)
+
+		csr, err := x509.ParseCertificateRequest(order.CSR)
+		if err != nil {
+			logger.WithError(err).Warn("Failing order cut short by the last shutdown, as its CSR wasn't kept")
+			if err = ac.failOrder(order.ID, ShuttingDownProblem()); err != nil {
+				return err
+			}
+			continue
+		}
+
+		queuedUntil, err := ac.reserveRateBudget(order)
+		if err != nil {
+			prob, ok := err.(*ProblemDetails)
+			if !ok {
+				return err
+			}
+			logger.WithError(err).Warn("Failing order cut short by the last shutdown, as it no longer fits the rate limit budget")
+			if err = ac.failOrder(order.ID, prob); err != nil {
+				return err
+			}
+			continue
+		}
+
+		nbf := time.Time{}
+		if order.NotBefore != nil {
+			nbf = timeUnmarshalDB(*order.NotBefore)
+		}
+		naft := time.Time{}
+		if order.NotAfter != nil {
+			naft = timeUnmarshalDB(*order.NotAfter)
+		}
+		logger.Info("Resuming issuance cut short by the last shutdown")
+		ac.startProcessing(order, csr, nbf, naft, queuedUntil)
+	}
+	return nil
+}
+
+func (ac ACMEController) failOrder(orderID string, prob *ProblemDetails) error {
+	_, err := ac.db.UpdateOrder([]byte(orderID), func(orderToUpdate *db.DBOrder) error {
+		orderToUpdate.Status = dtos.OrderStatusInvalid
+		orderToUpdate.CSR = nil
+		orderToUpdate.Error = problemToDB(prob)
+		return nil
+	})
+	return err
+}
@@ -0,0 +1,271 @@
+// Package config reads ACMESpider's config file.
+// Every setting in the file has an equivalent environment variable, which takes precedence over it
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix starts every environment variable, and tenant settings are further prefixed with TenantEnvPrefix<NAME>_
+const EnvPrefix = "ACMESPIDER_"
+const TenantEnvPrefix = EnvPrefix + "TENANT_"
+
+// Duration is a time.Duration written like 90s or 72h
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	parsed, err := time.ParseDuration(node.Value)
+	if err != nil || node.Kind != yaml.ScalarNode {
+		return fmt.Errorf("line %d: %q is not a duration like 90s or 72h", node.Line, node.Value)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// File is the config file's layout. The env tags name each setting's environment variable, after EnvPrefix.
+// Settings left out of the file are unset, so pointers are used where false or 0 differ from unset
+type File struct {
+	Port string `yaml:"port" env:"PORT"`
+	TLS  *bool  `yaml:"tls" env:"TLS"`
+	// Names our own certificate covers besides the hostname, or files to load it from instead
+	TLSNames    []string `yaml:"tls_names" env:"TLS_NAMES"`
+	TLSCertFile string   `yaml:"tls_cert_file" env:"TLS_CERT_FILE"`
+	TLSKeyFile  string   `yaml:"tls_key_file" env:"TLS_KEY_FILE"`
+	// Bundle of CAs ACME clients' certificates must chain to
+	ClientCA    string `yaml:"client_ca" env:"CLIENT_CA"`
+	BaseURL     string `yaml:"base_url" env:"BASE_URL"`
+	Hostname    string `yaml:"hostname" env:"HOSTNAME"`
+	StoragePath string `yaml:"storage_path" env:"STORAGE_PATH"`
+	LogLevel    string `yaml:"log_level" env:"LOG_LEVEL"`
+	LogFormat   string `yaml:"log_format" env:"LOG_FORMAT"`
+
+	ShutdownTimeout Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+
+	Health struct {
+		DNSProbe *bool `yaml:"dns_probe" env:"HEALTH_DNS_PROBE"`
+	} `yaml:"health"`
+
+	ACME struct {
+		TOSAccept       *bool    `yaml:"tos_accept" env:"ACME_TOS_ACCEPT"`
+		Email           string   `yaml:"email" env:"ACME_EMAIL"`
+		CADirectory     string   `yaml:"ca_directory" env:"ACME_CA_DIRECTORY"`
+		DNSProvider     string   `yaml:"dns_provider" env:"DNS_PROVIDER"`
+		PublicResolvers []string `yaml:"public_resolvers" env:"PUBLIC_RESOLVERS"`
+		// How long to wait for DNS-01 records to reach the zone's nameservers
+		PropagationTimeout Duration `yaml:"propagation_timeout" env:"DNS_PROPAGATION_TIMEOUT"`
+		KeyType            string   `yaml:"key_type" env:"KEY_TYPE"`
+	} `yaml:"acme"`
+
+	Meta struct {
+		TOSURL  string   `yaml:"tos_url" env:"META_TOS_URL"`
+		CAAs    []string `yaml:"caas" env:"META_CAAS"`
+		Website string   `yaml:"website" env:"META_WEBSITE"`
+	} `yaml:"meta"`
+
+	LocalCA struct {
+		Domains      []string `yaml:"domains" env:"LOCAL_CA_DOMAINS"`
+		CertLifetime Duration `yaml:"cert_lifetime" env:"LOCAL_CA_CERT_LIFETIME"`
+	} `yaml:"local_ca"`
+
+	SourceIPBinding   *bool    `yaml:"source_ip_binding" env:"SOURCE_IP_BINDING"`
+	InternalResolvers []string `yaml:"internal_resolvers" env:"INTERNAL_RESOLVERS"`
+	TrustedProxies    []string `yaml:"trusted_proxies" env:"TRUSTED_PROXIES"`
+	ProxyProtocol     *bool    `yaml:"proxy_protocol" env:"PROXY_PROTOCOL"`
+
+	HTTP01 struct {
+		// Names mapped to the addresses to validate them at
+		Hosts               map[string][]string `yaml:"hosts" env:"HTTP01_HOSTS"`
+		LookupTimeout       Duration            `yaml:"lookup_timeout" env:"HTTP01_LOOKUP_TIMEOUT"`
+		ConnectTimeout      Duration            `yaml:"connect_timeout" env:"HTTP01_CONNECT_TIMEOUT"`
+		ReadTimeout         Duration            `yaml:"read_timeout" env:"HTTP01_READ_TIMEOUT"`
+		MaxRedirects        *int                `yaml:"max_redirects" env:"HTTP01_MAX_REDIRECTS"`
+		MaxBodySize         *int64              `yaml:"max_body_size" env:"HTTP01_MAX_BODY_SIZE"`
+		AttemptSchedule     []Duration          `yaml:"attempt_schedule" env:"HTTP01_ATTEMPT_SCHEDULE"`
+		RequireAllAddresses *bool               `yaml:"require_all_addresses" env:"HTTP01_REQUIRE_ALL_ADDRESSES"`
+	} `yaml:"http01"`
+
+	RateLimit struct {
+		PerDomain    *int     `yaml:"per_domain" env:"RATE_LIMIT_PER_DOMAIN"`
+		PerNameSet   *int     `yaml:"per_name_set" env:"RATE_LIMIT_PER_NAME_SET"`
+		Window       Duration `yaml:"window" env:"RATE_LIMIT_WINDOW"`
+		Queue        *bool    `yaml:"queue" env:"RATE_LIMIT_QUEUE"`
+		MaxQueueWait Duration `yaml:"max_queue_wait" env:"RATE_LIMIT_MAX_QUEUE_WAIT"`
+	} `yaml:"rate_limit"`
+
+	// Limits on each client, all on by default. 0 turns one off
+	Limits struct {
+		RequestsPerSecond   *float64 `yaml:"requests_per_second" env:"LIMIT_REQUESTS_PER_SECOND"`
+		RequestBurst        *int     `yaml:"request_burst" env:"LIMIT_REQUEST_BURST"`
+		MaxBodySize         *int64   `yaml:"max_body_size" env:"LIMIT_MAX_BODY_SIZE"`
+		AccountsPerNetwork  *int     `yaml:"accounts_per_network" env:"LIMIT_ACCOUNTS_PER_NETWORK"`
+		AccountWindow       Duration `yaml:"account_window" env:"LIMIT_ACCOUNT_WINDOW"`
+		PendingOrders       *int     `yaml:"pending_orders" env:"LIMIT_PENDING_ORDERS"`
+		IdentifiersPerOrder *int     `yaml:"identifiers_per_order" env:"LIMIT_IDENTIFIERS_PER_ORDER"`
+	} `yaml:"limits"`
+
+	Nonce struct {
+		Lifetime    Duration `yaml:"lifetime" env:"NONCE_LIFETIME"`
+		Capacity    *int     `yaml:"capacity" env:"NONCE_CAPACITY"`
+		KeyRotation Duration `yaml:"key_rotation" env:"NONCE_KEY_ROTATION"`
+		// Keep nonce keys in the storage path, so restarts don't invalidate outstanding nonces
+		Persist *bool `yaml:"persist" env:"NONCE_PERSIST"`
+	} `yaml:"nonce"`
+
+	CertReuse struct {
+		Enabled     *bool    `yaml:"enabled" env:"CERT_REUSE"`
+		MinLifetime Duration `yaml:"min_lifetime" env:"CERT_REUSE_MIN_LIFETIME"`
+	} `yaml:"cert_reuse"`
+
+	Deactivation struct {
+		// Revoke a deactivated account's certificates that haven't expired yet
+		RevokeCerts *bool `yaml:"revoke_certs" env:"DEACTIVATION_REVOKE_CERTS"`
+	} `yaml:"deactivation"`
+
+	// The default directory's policy
+	AllowedDomains []string          `yaml:"allowed_domains" env:"ALLOWED_DOMAINS"`
+	EABKeys        map[string]string `yaml:"eab_keys" env:"EAB_KEYS"`
+	EABRequired    *bool             `yaml:"eab_required" env:"EAB_REQUIRED"`
+
+	PolicyFile string `yaml:"policy_file" env:"POLICY_FILE"`
+
+	Approval struct {
+		Domains []string `yaml:"domains" env:"APPROVAL_DOMAINS"`
+		Expiry  Duration `yaml:"expiry" env:"APPROVAL_EXPIRY"`
+		Webhook string   `yaml:"webhook" env:"APPROVAL_WEBHOOK"`
+	} `yaml:"approval"`
+	// Operator names mapped to their admin API token
+	AdminTokens map[string]string `yaml:"admin_tokens" env:"ADMIN_TOKENS"`
+
+	Upstream struct {
+		Issuer string `yaml:"issuer" env:"UPSTREAM_ISSUER"`
+		// How long the upstream's certificates last, for issuance policy rules that check validity
+		CertLifetime Duration `yaml:"cert_lifetime" env:"UPSTREAM_CERT_LIFETIME"`
+		Vault        struct {
+			Addr     string `yaml:"addr" env:"VAULT_ADDR"`
+			Token    string `yaml:"token" env:"VAULT_TOKEN"`
+			PKIMount string `yaml:"pki_mount" env:"VAULT_PKI_MOUNT"`
+			PKIRole  string `yaml:"pki_role" env:"VAULT_PKI_ROLE"`
+			CACert   string `yaml:"ca_cert" env:"VAULT_CA_CERT"`
+		} `yaml:"vault"`
+		StepCA struct {
+			URL                 string `yaml:"url" env:"STEPCA_URL"`
+			Provisioner         string `yaml:"provisioner" env:"STEPCA_PROVISIONER"`
+			ProvisionerKey      string `yaml:"provisioner_key" env:"STEPCA_PROVISIONER_KEY"`
+			ProvisionerPassword string `yaml:"provisioner_password" env:"STEPCA_PROVISIONER_PASSWORD"`
+			Root                string `yaml:"root" env:"STEPCA_ROOT"`
+		} `yaml:"stepca"`
+	} `yaml:"upstream"`
+
+	Tenants []Tenant `yaml:"tenants"`
+}
+
+// Tenant is a named tenant's settings. Upstream settings left unset are inherited
+type Tenant struct {
+	Name           string            `yaml:"name"`
+	AllowedDomains []string          `yaml:"allowed_domains" env:"ALLOWED_DOMAINS"`
+	EABKeys        map[string]string `yaml:"eab_keys" env:"EAB_KEYS"`
+	EABRequired    *bool             `yaml:"eab_required" env:"EAB_REQUIRED"`
+
+	UpstreamIssuer string `yaml:"upstream_issuer" env:"UPSTREAM_ISSUER"`
+	CADirectory    string `yaml:"ca_directory" env:"ACME_CA_DIRECTORY"`
+	DNSProvider    string `yaml:"dns_provider" env:"DNS_PROVIDER"`
+	KeyType        string `yaml:"key_type" env:"KEY_TYPE"`
+	VaultPKIMount  string `yaml:"vault_pki_mount" env:"VAULT_PKI_MOUNT"`
+	VaultPKIRole   string `yaml:"vault_pki_role" env:"VAULT_PKI_ROLE"`
+}
+
+// Load reads the config file at path, if there is one, overlays the environment variables getenv finds on top of it,
+// and validates the result. It returns the names of the environment variables that replaced a value set in the file
+func Load(path string, getenv func(string) string) (*File, []string, error) {
+	f := &File{}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if f, err = decode(data); err != nil {
+			return nil, nil, fmt.Errorf("invalid config in %s:\n%v", path, err)
+		}
+	}
+
+	overridden, err := f.ApplyEnv(getenv)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = f.Validate(); err != nil {
+		if path == "" {
+			return nil, nil, fmt.Errorf("invalid config:\n%v", err)
+		}
+		return nil, nil, fmt.Errorf("invalid config in %s, or the environment variables overriding it:\n%v", path, err)
+	}
+	return f, overridden, nil
+}
+
+// Parse decodes and validates a config file's contents. Unknown keys are an error, to catch typos
+func Parse(data []byte) (*File, error) {
+	f, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = f.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func decode(data []byte) (*File, error) {
+	var f File
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	err := dec.Decode(&f)
+	if err != nil && !errors.Is(err, io.EOF) {
+		var typeErr *yaml.TypeError
+		if errors.As(err, &typeErr) {
+			return nil, errors.New(strings.Join(readableTypeErrors(typeErr), "\n"))
+		}
+		return nil, err
+	}
+	return &f, nil
+}
+
+// readableTypeErrors rewrites yaml's unknown field errors, which name the Go type, in terms of the file
+func readableTypeErrors(typeErr *yaml.TypeError) []string {
+	errs := make([]string, len(typeErr.Errors))
+	for i, msg := range typeErr.Errors {
+		if before, _, found := strings.Cut(msg, " not found in type "); found {
+			msg = strings.Replace(before, ": field ", ": unknown key ", 1)
+		}
+		errs[i] = msg
+	}
+	return errs
+}
+
+// EnvTenantName is how a tenant's name appears in its environment variables
+func EnvTenantName(name string) string {
+	return strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,191 @@
+package config
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApplyEnv(t *testing.T) {
+	f, err := Parse([]byte(`
+port: "8443"
+tls: false
+base_url: https://acme.internal.example.com
+acme:
+  tos_accept: true
+  public_resolvers: [1.1.1.1, 9.9.9.9]
+eab_keys:
+  team-a: YmFy
+tenants:
+  - name: ot-net
+    allowed_domains: [ot.example.com]
+    upstream_issuer: vault
+  - name: lab
+`))
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	env := map[string]string{
+		"ACMESPIDER_PORT":                          "9443",
+		"ACMESPIDER_TLS":                           "yes",
+		"ACMESPIDER_HTTP01_MAX_REDIRECTS":          "0",
+		"ACMESPIDER_HTTP01_ATTEMPT_SCHEDULE":       "0s, 5s,1m",
+		"ACMESPIDER_HTTP01_HOSTS":                  "wiki.internal=10.0.0.1,wiki.internal=10.0.0.2",
+		"ACMESPIDER_EAB_KEYS":                      "team-b=Zm9v",
+		"ACMESPIDER_TENANTS":                       "ot-net,ci",
+		"ACMESPIDER_TENANT_OT_NET_UPSTREAM_ISSUER": "acme",
+		"ACMESPIDER_TENANT_CI_ALLOWED_DOMAINS":     "ci.example.com",
+	}
+	overridden, err := f.ApplyEnv(func(name string) string { return env[name] })
+	if err != nil {
+		t.Fatalf("failed to apply env: %v", err)
+	}
+
+	expectedOverridden := []string{"ACMESPIDER_PORT", "ACMESPIDER_TLS", "ACMESPIDER_EAB_KEYS", "ACMESPIDER_TENANTS", "ACMESPIDER_TENANT_OT_NET_UPSTREAM_ISSUER"}
+	sort.Strings(overridden)
+	sort.Strings(expectedOverridden)
+	if !reflect.DeepEqual(overridden, expectedOverridden) {
+		t.Errorf("expected %v to be overridden, got %v", expectedOverridden, overridden)
+	}
+
+	if f.Port != "9443" || f.TLS == nil || !*f.TLS || f.BaseURL != "https://acme.internal.example.com" {
+		t.Errorf("top level settings weren't overlaid: port %s, tls %v, base URL %s", f.Port, f.TLS, f.BaseURL)
+	}
+	if !reflect.DeepEqual(f.ACME.PublicResolvers, []string{"1.1.1.1", "9.9.9.9"}) {
+		t.Errorf("expected settings without a variable to be kept, got %v", f.ACME.PublicResolvers)
+	}
+	if f.HTTP01.MaxRedirects == nil || *f.HTTP01.MaxRedirects != 0 {
+		t.Errorf("expected max redirects to be set to 0, got %v", f.HTTP01.MaxRedirects)
+	}
+	if !reflect.DeepEqual(f.HTTP01.AttemptSchedule, []Duration{0, Duration(5 * time.Second), Duration(time.Minute)}) {
+		t.Errorf("unexpected attempt schedule %v", f.HTTP01.AttemptSchedule)
+	}
+	if !reflect.DeepEqual(f.HTTP01.Hosts, map[string][]string{"wiki.internal": {"10.0.0.1", "10.0.0.2"}}) {
+		t.Errorf("unexpected HTTP-01 hosts %v", f.HTTP01.Hosts)
+	}
+	if !reflect.DeepEqual(f.EABKeys, map[string]string{"team-b": "Zm9v"}) {
+		t.Errorf("expected the environment's EAB keys to replace the file's, got %v", f.EABKeys)
+	}
+
+	expectedTenants := []Tenant{
+		{Name: "ot-net", AllowedDomains: []string{"ot.example.com"}, UpstreamIssuer: "acme"},
+		{Name: "ci", AllowedDomains: []string{"ci.example.com"}},
+	}
+	if !reflect.DeepEqual(f.Tenants, expectedTenants) {
+		t.Errorf("expected tenants %+v, got %+v", expectedTenants, f.Tenants)
+	}
+}
+
+func TestApplyEnvErrors(t *testing.T) {
+	var f File
+	env := map[string]string{
+		"ACMESPIDER_HTTP01_MAX_REDIRECTS": "lots",
+		"ACMESPIDER_RATE_LIMIT_WINDOW":    "a week",
+		"ACMESPIDER_ADMIN_TOKENS":         "alice",
+	}
+	_, err := f.ApplyEnv(func(name string) string { return env[name] })
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for name := range env {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("expected error to mention %s, got %v", name, err)
+		}
+	}
+}
+
+func TestEmptyFile(t *testing.T) {
+	f, err := Parse(nil)
+	if err != nil {
+		t.Fatalf("failed to parse empty file: %v", err)
+	}
+	if !reflect.DeepEqual(*f, File{}) {
+		t.Fatalf("expected nothing to be set, got %+v", *f)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := map[string]struct {
+		file string
+		keys []string
+	}{
+		"unknown key":  {file: "acme:\n  emial: a@example.com\n", keys: []string{"line 2: unknown key emial"}},
+		"bad duration": {file: "rate_limit:\n  window: a week\n", keys: []string{"line 2"}},
+		"wrong type":   {file: "http01:\n  max_redirects: lots\n", keys: []string{"line 2"}},
+		"bad values": {
+			file: `
+port: "99999"
+log_level: loud
+log_format: xml
+base_url: acme.example.com
+tls_cert_file: /etc/acmespider/tls.crt
+acme:
+  key_type: ec512
+trusted_proxies: [10.0.0.0/8, proxy.example.com]
+http01:
+  hosts:
+    wiki.internal: [wiki]
+cert_reuse:
+  min_lifetime: -1h
+limits:
+  pending_orders: -1
+  requests_per_second: -5
+eab_required: true
+approval:
+  webhook: ftp://hooks.example.com
+admin_tokens:
+  alice: ""
+tenants:
+  - allowed_domains: [ot.example.com]
+  - name: ot
+    upstream_issuer: cfssl
+    eab_keys:
+      k1: "not base64!"
+  - name: ot
+  - name: ot-net
+  - name: OT_NET
+`,
+			keys: []string{
+				"port", "log_level", "log_format", "base_url", "tls_cert_file", "acme.key_type", "trusted_proxies[1]", "http01.hosts.wiki.internal[0]",
+				"cert_reuse.min_lifetime", "limits.pending_orders", "limits.requests_per_second", "eab_required", "approval.webhook", "admin_tokens.alice",
+				"tenants[0].name", "tenants[1].upstream_issuer", "tenants[1].eab_keys.k1", "tenants[2].name", "tenants[4].name",
+			},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.file))
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+
+			var validationErrs ValidationErrors
+			if !errors.As(err, &validationErrs) {
+				for _, key := range tt.keys {
+					if !strings.Contains(err.Error(), key) {
+						t.Errorf("expected error to mention %q, got %v", key, err)
+					}
+				}
+				return
+			}
+
+			found := map[string]bool{}
+			for _, e := range validationErrs {
+				found[e.Key] = true
+			}
+			for _, key := range tt.keys {
+				if !found[key] {
+					t.Errorf("expected an error for %s, got:\n%v", key, err)
+				}
+			}
+			if len(validationErrs) != len(tt.keys) {
+				t.Errorf("expected %d errors, got:\n%v", len(tt.keys), err)
+			}
+		})
+	}
+}
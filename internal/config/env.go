@@ -0,0 +1,176 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ApplyEnv overlays the environment variables getenv finds on top of the file's settings, returning the names of
+// those that replaced a value the file set. ACMESPIDER_TENANTS, if set, replaces the file's list of tenants,
+// keeping the settings of those the file has too
+func (f *File) ApplyEnv(getenv func(string) string) ([]string, error) {
+	a := &envApplier{getenv: getenv}
+	a.apply(EnvPrefix, reflect.ValueOf(f).Elem())
+
+	if names := getenv(EnvPrefix + "TENANTS"); names != "" {
+		if len(f.Tenants) > 0 {
+			a.overridden = append(a.overridden, EnvPrefix+"TENANTS")
+		}
+		tenants := []Tenant{}
+		for _, name := range strings.Split(names, ",") {
+			name = strings.TrimSpace(strings.ToLower(name))
+			if name == "" {
+				continue
+			}
+			tenant := Tenant{Name: name}
+			for _, existing := range f.Tenants {
+				if strings.EqualFold(existing.Name, name) {
+					tenant = existing
+					break
+				}
+			}
+			tenants = append(tenants, tenant)
+		}
+		f.Tenants = tenants
+	}
+
+	for i := range f.Tenants {
+		a.apply(TenantEnvPrefix+EnvTenantName(f.Tenants[i].Name)+"_", reflect.ValueOf(&f.Tenants[i]).Elem())
+	}
+
+	if len(a.errs) > 0 {
+		return nil, errors.Join(a.errs...)
+	}
+	return a.overridden, nil
+}
+
+type envApplier struct {
+	getenv     func(string) string
+	overridden []string
+	errs       []error
+}
+
+// apply sets the struct v's fields from their environment variables, recursing into nested structs
+func (a *envApplier) apply(prefix string, v reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := v.Field(i)
+		name, hasEnv := t.Field(i).Tag.Lookup("env")
+		if !hasEnv {
+			if field.Kind() == reflect.Struct {
+				a.apply(prefix, field)
+			}
+			continue
+		}
+
+		str := a.getenv(prefix + name)
+		if str == "" {
+			continue
+		}
+		wasSet := !field.IsZero()
+		if err := setFromEnv(field, str); err != nil {
+			a.errs = append(a.errs, fmt.Errorf("failed to parse %s: %v", prefix+name, err))
+			continue
+		}
+		if wasSet {
+			a.overridden = append(a.overridden, prefix+name)
+		}
+	}
+}
+
+// setFromEnv parses str the way a setting's environment variable is written: lists are comma separated,
+// and maps are comma separated key=value entries, with repeated keys for maps of lists
+func setFromEnv(v reflect.Value, str string) error {
+	switch v.Interface().(type) {
+	case string:
+		v.SetString(str)
+
+	case *bool:
+		l := strings.TrimSpace(strings.ToLower(str))
+		b := l == "yes" || l == "true" || l == "1"
+		v.Set(reflect.ValueOf(&b))
+
+	case *int:
+		n, err := strconv.Atoi(strings.TrimSpace(str))
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(&n))
+
+	case *int64:
+		n, err := strconv.ParseInt(strings.TrimSpace(str), 10, 64)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(&n))
+
+	case *float64:
+		n, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(&n))
+
+	case Duration:
+		d, err := time.ParseDuration(strings.TrimSpace(str))
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(Duration(d)))
+
+	case []string:
+		v.Set(reflect.ValueOf(splitList(str)))
+
+	case []Duration:
+		durations := []Duration{}
+		for _, item := range splitList(str) {
+			d, err := time.ParseDuration(item)
+			if err != nil {
+				return err
+			}
+			durations = append(durations, Duration(d))
+		}
+		v.Set(reflect.ValueOf(durations))
+
+	case map[string]string:
+		m := map[string]string{}
+		for _, item := range splitList(str) {
+			key, value, ok := strings.Cut(item, "=")
+			if !ok || key == "" {
+				return fmt.Errorf("entries should look like key=value, got %q", item)
+			}
+			m[key] = value
+		}
+		v.Set(reflect.ValueOf(m))
+
+	case map[string][]string:
+		m := map[string][]string{}
+		for _, item := range splitList(str) {
+			key, value, ok := strings.Cut(item, "=")
+			if !ok || key == "" {
+				return fmt.Errorf("entries should look like key=value, got %q", item)
+			}
+			m[key] = append(m[key], value)
+		}
+		v.Set(reflect.ValueOf(m))
+
+	default:
+		return fmt.Errorf("settings of type %s can't be set from the environment", v.Type())
+	}
+	return nil
+}
+
+// splitList splits a comma separated list, dropping empty items
+func splitList(str string) []string {
+	items := []string{}
+	for _, item := range strings.Split(str, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,204 @@
+package config
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/lachlan2k/acmespider/internal/issuer"
+	log "github.com/sirupsen/logrus"
+)
+
+var keyTypes = []string{"rsa", "rsa2048", "rsa3072", "rsa4096", "rsa8192", "ec256", "ec384"}
+
+var upstreamIssuers = []string{issuer.UpstreamIssuerACME, issuer.UpstreamIssuerVault, issuer.UpstreamIssuerStepCA}
+
+// ValidationError is a problem with one setting, named by its path in the file
+type ValidationError struct {
+	Key     string
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	return e.Key + ": " + e.Message
+}
+
+// ValidationErrors is every problem found in a file
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	lines := make([]string, len(e))
+	for i, err := range e {
+		lines[i] = err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+type validator struct {
+	errs ValidationErrors
+}
+
+func (v *validator) add(key string, format string, args ...any) {
+	v.errs = append(v.errs, ValidationError{Key: key, Message: fmt.Sprintf(format, args...)})
+}
+
+// Validate checks the file's settings make sense, beyond being the right types
+func (f *File) Validate() error {
+	v := &validator{}
+	v.checkValues("", reflect.ValueOf(*f))
+
+	if f.Port != "" {
+		if port, err := strconv.Atoi(f.Port); err != nil || port < 1 || port > 65535 {
+			v.add("port", "%q is not a port number", f.Port)
+		}
+	}
+	if f.LogLevel != "" {
+		if _, err := log.ParseLevel(f.LogLevel); err != nil {
+			v.add("log_level", "%q is not a log level", f.LogLevel)
+		}
+	}
+	v.checkOneOf("log_format", strings.ToLower(f.LogFormat), []string{"text", "json"})
+	if f.BaseURL != "" {
+		v.checkURL("base_url", f.BaseURL)
+	}
+	if (f.TLSCertFile == "") != (f.TLSKeyFile == "") {
+		v.add("tls_cert_file", "must be set together with tls_key_file")
+	}
+	v.checkOneOf("acme.key_type", strings.ToLower(f.ACME.KeyType), keyTypes)
+	v.checkOneOf("upstream.issuer", strings.ToLower(f.Upstream.Issuer), upstreamIssuers)
+
+	for i, proxy := range f.TrustedProxies {
+		if net.ParseIP(proxy) != nil {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(proxy); err != nil {
+			v.add(fmt.Sprintf("trusted_proxies[%d]", i), "%q is not an address or CIDR", proxy)
+		}
+	}
+	for _, name := range sortedKeys(f.HTTP01.Hosts) {
+		for i, addr := range f.HTTP01.Hosts[name] {
+			if net.ParseIP(addr) == nil {
+				v.add(fmt.Sprintf("http01.hosts.%s[%d]", name, i), "%q is not an address", addr)
+			}
+		}
+	}
+
+	limits := map[string]*int{
+		"http01.max_redirects":         f.HTTP01.MaxRedirects,
+		"limits.request_burst":         f.Limits.RequestBurst,
+		"limits.accounts_per_network":  f.Limits.AccountsPerNetwork,
+		"limits.pending_orders":        f.Limits.PendingOrders,
+		"limits.identifiers_per_order": f.Limits.IdentifiersPerOrder,
+		"nonce.capacity":               f.Nonce.Capacity,
+	}
+	for _, key := range sortedKeys(limits) {
+		if limits[key] != nil && *limits[key] < 0 {
+			v.add(key, "can't be negative")
+		}
+	}
+	if f.Limits.RequestsPerSecond != nil && *f.Limits.RequestsPerSecond < 0 {
+		v.add("limits.requests_per_second", "can't be negative")
+	}
+	if f.Limits.MaxBodySize != nil && *f.Limits.MaxBodySize < 0 {
+		v.add("limits.max_body_size", "can't be negative")
+	}
+
+	v.checkEAB("", f.EABKeys, f.EABRequired)
+
+	if f.Approval.Webhook != "" {
+		v.checkURL("approval.webhook", f.Approval.Webhook)
+	}
+	for _, name := range sortedKeys(f.AdminTokens) {
+		if f.AdminTokens[name] == "" {
+			v.add("admin_tokens."+name, "token is empty")
+		}
+	}
+
+	// Tenants are told apart by their environment variables' prefix, so names that only differ in case or - and _ clash
+	names := map[string]string{}
+	for i, tenant := range f.Tenants {
+		key := fmt.Sprintf("tenants[%d]", i)
+		envName := EnvTenantName(tenant.Name)
+		switch {
+		case tenant.Name == "":
+			v.add(key+".name", "every tenant needs a name")
+		case strings.Contains(tenant.Name, ","):
+			v.add(key+".name", "%q can't contain a comma", tenant.Name)
+		case names[envName] == tenant.Name:
+			v.add(key+".name", "tenant %s is configured more than once", tenant.Name)
+		case names[envName] != "":
+			v.add(key+".name", "tenant %s can't be told apart from tenant %s in environment variables", tenant.Name, names[envName])
+		}
+		if names[envName] == "" {
+			names[envName] = tenant.Name
+		}
+
+		v.checkEAB(key+".", tenant.EABKeys, tenant.EABRequired)
+		v.checkOneOf(key+".key_type", strings.ToLower(tenant.KeyType), keyTypes)
+		v.checkOneOf(key+".upstream_issuer", strings.ToLower(tenant.UpstreamIssuer), upstreamIssuers)
+	}
+
+	if len(v.errs) > 0 {
+		return v.errs
+	}
+	return nil
+}
+
+func (v *validator) checkOneOf(key string, value string, allowed []string) {
+	if value == "" {
+		return
+	}
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	v.add(key, "%q isn't one of %s", value, strings.Join(allowed, ", "))
+}
+
+func (v *validator) checkURL(key string, value string) {
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		v.add(key, "%q is not an http or https URL", value)
+	}
+}
+
+func (v *validator) checkEAB(prefix string, keys map[string]string, required *bool) {
+	for _, kid := range sortedKeys(keys) {
+		if _, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(keys[kid], "=")); err != nil {
+			v.add(prefix+"eab_keys."+kid, "key is not base64url encoded")
+		}
+	}
+	if required != nil && *required && len(keys) == 0 {
+		v.add(prefix+"eab_required", "no keys are set in %seab_keys", prefix)
+	}
+}
+
+// checkValues makes sure durations aren't negative, wherever they are
+func (v *validator) checkValues(key string, val reflect.Value) {
+	switch val.Kind() {
+	case reflect.Struct:
+		t := val.Type()
+		for i := 0; i < t.NumField(); i++ {
+			name, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+			if key != "" {
+				name = key + "." + name
+			}
+			v.checkValues(name, val.Field(i))
+		}
+
+	case reflect.Slice:
+		for i := 0; i < val.Len(); i++ {
+			v.checkValues(fmt.Sprintf("%s[%d]", key, i), val.Index(i))
+		}
+
+	case reflect.Int64:
+		if d, ok := val.Interface().(Duration); ok && d < 0 {
+			v.add(key, "can't be negative")
+		}
+	}
+}
@@ -1,9 +1,16 @@
 package db
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/go-jose/go-jose/v3"
@@ -21,13 +28,51 @@ var (
 	accountKeysBucketName  = []byte("acme_account_keys")
 	authzsBucketName       = []byte("acme_authzs")
 	certificatesBucketName = []byte("acme_certificates")
+	// Certificate IDs by their leaf's serial number
+	certificateSerialsBucketName = []byte("acme_certificate_serials")
+	// Certificate IDs by the account, key and names they were issued for, see certificateReusePrefix
+	certificateReuseBucketName = []byte("acme_certificate_reuse")
+	// Certificate IDs by the account and each name they were issued for, see certificateNamePrefix
+	certificateNamesBucketName = []byte("acme_certificate_names")
+	// Account IDs by their tenant and key's thumbprint, see accountKeyIndex
+	accountThumbprintsBucketName = []byte("acme_account_thumbprints")
+	// When each account's pending and ready orders expire, see pendingOrderKey
+	pendingOrdersBucketName = []byte("acme_pending_orders")
+
+	localCAIssuedBucketName = []byte("local_ca_issued")
+
+	// Upstream issuances by upstream and time, see issuanceKey
+	upstreamIssuancesBucketName = []byte("upstream_issuances")
+
+	approvalsBucketName = []byte("approvals")
+
+	dnsRecordsBucketName = []byte("dns_records")
+
+	healthBucketName = []byte("health")
+	lastCheckK       = []byte("last_check")
 
 	globalKeyBucketName = []byte("global_key")
 	globalKeyK          = []byte("global_acme_k")
+	localCAK            = []byte("local_ca")
+	ownCertificateK     = []byte("own_certificate")
 )
 
 var ErrNotFound = errors.New("not found")
 
+// PendingOrdersError is returned by CreateOrder when the account already has as many pending orders as it's allowed
+type PendingOrdersError struct {
+	Pending int
+	// Unix time the first of them expires, making room for another
+	NextExpiry int64
+}
+
+func (e *PendingOrdersError) Error() string {
+	return fmt.Sprintf("account has %d pending orders", e.Pending)
+}
+
+// ErrAccountKeyInUse is returned when creating an account with a key another account in the tenant already has
+var ErrAccountKeyInUse = errors.New("key is already used by another account")
+
 func IsErrNotFound(err error) bool {
 	return errors.Is(err, ErrNotFound)
 }
@@ -90,7 +135,16 @@ func (b BoltDB) SaveAccountKey(accountID []byte, key *jose.JSONWebKey) error {
 			return err
 		}
 
-		return bucket.Put(accountID, v)
+		err = bucket.Put(accountID, v)
+		if err != nil {
+			return err
+		}
+
+		account, err := boltGetterTx[DBAccount](tx, accountsBucketName, accountID)
+		if err != nil {
+			return err
+		}
+		return indexAccountKeyTx(tx, account, key)
 	})
 }
 
@@ -169,27 +223,71 @@ func boltUpdator[DbT any](db *bolt.DB, bucketName []byte, key []byte, updateCall
 }
 
 func boltGetter[DbT any](db *bolt.DB, bucketName []byte, key []byte) (*DbT, error) {
+	var obj *DbT
+
+	err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		obj, err = boltGetterTx[DbT](tx, bucketName, key)
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return obj, nil
+}
+
+func boltGetterTx[DbT any](tx *bolt.Tx, bucketName []byte, key []byte) (*DbT, error) {
+	bucket, err := boltGetBucket(tx, bucketName)
+	if err != nil {
+		return nil, err
+	}
+
+	v := bucket.Get(key)
+	if v == nil {
+		return nil, ErrNotFound
+	}
+
 	var obj DbT
+	err = json.Unmarshal(v, &obj)
+	if err != nil {
+		return nil, err
+	}
+	return &obj, nil
+}
+
+func boltFilter[DbT any](db *bolt.DB, bucketName []byte, keep func(*DbT) bool) ([]DbT, error) {
+	results := []DbT{}
 
 	err := db.View(func(tx *bolt.Tx) error {
 		bucket, err := boltGetBucket(tx, bucketName)
 		if err != nil {
+			if IsErrNotFound(err) {
+				// Bucket hasn't been written to yet
+				return nil
+			}
 			return err
 		}
 
-		v := bucket.Get(key)
-		if v == nil {
-			return ErrNotFound
-		}
-
-		return json.Unmarshal(v, &obj)
+		return bucket.ForEach(func(k, v []byte) error {
+			var obj DbT
+			err := json.Unmarshal(v, &obj)
+			if err != nil {
+				return err
+			}
+			if keep(&obj) {
+				results = append(results, obj)
+			}
+			return nil
+		})
 	})
 
 	if err != nil {
 		return nil, err
 	}
 
-	return &obj, nil
+	return results, nil
 }
 
 func boltSaver[DbT any](db *bolt.DB, bucketName []byte, key []byte, obj *DbT) error {
@@ -217,7 +315,23 @@ func (b BoltDB) GetAccount(accountID []byte) (*DBAccount, error) {
 }
 func (b BoltDB) CreateAccount(account DBAccount, jwk *jose.JSONWebKey) error {
 	return b.db.Update(func(tx *bolt.Tx) error {
-		err := boltSaverTx[DBAccount](tx, accountsBucketName, []byte(account.ID), &account)
+		index, err := accountKeyIndex(account.Tenant, jwk)
+		if err != nil {
+			return err
+		}
+		thumbprints, err := boltGetBucket(tx, accountThumbprintsBucketName)
+		if err != nil {
+			return err
+		}
+		if thumbprints.Get(index) != nil {
+			return ErrAccountKeyInUse
+		}
+
+		err = boltSaverTx[DBAccount](tx, accountsBucketName, []byte(account.ID), &account)
+		if err != nil {
+			return err
+		}
+		err = thumbprints.Put(index, []byte(account.ID))
 		if err != nil {
 			return err
 		}
@@ -238,33 +352,466 @@ func (b BoltDB) CreateAccount(account DBAccount, jwk *jose.JSONWebKey) error {
 func (b BoltDB) UpdateAccount(accountID []byte, updateCallback func(*DBAccount) error) (*DBAccount, error) {
 	return boltUpdator[DBAccount](b.db, accountsBucketName, accountID, updateCallback)
 }
-func (b BoltDB) DeleteAccount(accountID []byte) error {
+func (b BoltDB) GetAccountByKey(tenant string, key *jose.JSONWebKey) (*DBAccount, error) {
+	index, err := accountKeyIndex(tenant, key)
+	if err != nil {
+		return nil, err
+	}
+
+	var account *DBAccount
+	err = b.db.View(func(tx *bolt.Tx) error {
+		bucket, err := boltGetBucket(tx, accountThumbprintsBucketName)
+		if err != nil {
+			return err
+		}
+		accountID := bucket.Get(index)
+		if accountID == nil {
+			return ErrNotFound
+		}
+		account, err = boltGetterTx[DBAccount](tx, accountsBucketName, accountID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// accountKeyIndex is the key an account is indexed under in the thumbprint index.
+// Tenants are separate directories, so the same key can have an account in each
+func accountKeyIndex(tenant string, key *jose.JSONWebKey) ([]byte, error) {
+	thumbprint, err := key.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(tenant + "\x00" + base64.RawURLEncoding.EncodeToString(thumbprint)), nil
+}
+
+func indexAccountKeyTx(tx *bolt.Tx, account *DBAccount, key *jose.JSONWebKey) error {
+	index, err := accountKeyIndex(account.Tenant, key)
+	if err != nil {
+		return err
+	}
+	bucket, err := boltGetBucket(tx, accountThumbprintsBucketName)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(index, []byte(account.ID))
+}
+
+// indexAccountKeys fills in the thumbprint index for accounts created before it was kept.
+// If several accounts in a tenant have the same key, one that hasn't been deactivated is preferred
+func (b *BoltDB) indexAccountKeys() error {
 	return b.db.Update(func(tx *bolt.Tx) error {
-		bucket, err := boltGetBucket(tx, accountsBucketName)
+		accounts := tx.Bucket(accountsBucketName)
+		keys := tx.Bucket(accountKeysBucketName)
+		if accounts == nil || keys == nil {
+			return nil
+		}
+		thumbprints, err := boltGetBucket(tx, accountThumbprintsBucketName)
 		if err != nil {
 			return err
 		}
-		return bucket.Delete(accountID)
+
+		// Keys can't be written while iterating with ForEach
+		toIndex := map[string]DBAccount{}
+		err = accounts.ForEach(func(k, v []byte) error {
+			var account DBAccount
+			if err := json.Unmarshal(v, &account); err != nil {
+				return err
+			}
+			keyJSON := keys.Get(k)
+			if keyJSON == nil {
+				return nil
+			}
+			var key jose.JSONWebKey
+			if err := key.UnmarshalJSON(keyJSON); err != nil {
+				return err
+			}
+			index, err := accountKeyIndex(account.Tenant, &key)
+			if err != nil {
+				return err
+			}
+			if thumbprints.Get(index) != nil {
+				return nil
+			}
+			if other, ok := toIndex[string(index)]; ok && other.Status != AccountStatusDeactivated {
+				return nil
+			}
+			toIndex[string(index)] = account
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for index, account := range toIndex {
+			if err = thumbprints.Put([]byte(index), []byte(account.ID)); err != nil {
+				return err
+			}
+		}
+		return nil
 	})
 }
 
 func (b BoltDB) GetOrder(orderID []byte) (*DBOrder, error) {
 	return boltGetter[DBOrder](b.db, ordersBucketName, orderID)
 }
-func (b BoltDB) CreateOrder(order DBOrder) error {
-	return boltSaver[DBOrder](b.db, ordersBucketName, []byte(order.ID), &order)
+func (b BoltDB) CreateOrder(order DBOrder, maxPending int, now int64) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if maxPending > 0 {
+			pending, nextExpiry, err := countPendingOrdersTx(tx, order.AccountID, now)
+			if err != nil {
+				return err
+			}
+			if pending >= maxPending {
+				return &PendingOrdersError{Pending: pending, NextExpiry: nextExpiry}
+			}
+		}
+
+		err := boltSaverTx[DBOrder](tx, ordersBucketName, []byte(order.ID), &order)
+		if err != nil {
+			return err
+		}
+		return indexPendingOrderTx(tx, &order)
+	})
 }
 func (b BoltDB) UpdateOrder(orderID []byte, updateCallback func(*DBOrder) error) (*DBOrder, error) {
-	return boltUpdator[DBOrder](b.db, ordersBucketName, orderID, updateCallback)
+	var order *DBOrder
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		order, err = boltGetterTx[DBOrder](tx, ordersBucketName, orderID)
+		if err != nil {
+			return err
+		}
+		if err = updateCallback(order); err != nil {
+			return err
+		}
+		if err = boltSaverTx(tx, ordersBucketName, orderID, order); err != nil {
+			return err
+		}
+		return indexPendingOrderTx(tx, order)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+func (b BoltDB) CountPendingOrders(accountID string, now int64) (int, int64, error) {
+	var pending int
+	var nextExpiry int64
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		pending, nextExpiry, err = countPendingOrdersTx(tx, accountID, now)
+		return err
+	})
+	return pending, nextExpiry, err
+}
+func (b BoltDB) GetOrdersWithStatus(status string) ([]DBOrder, error) {
+	return boltFilter[DBOrder](b.db, ordersBucketName, func(order *DBOrder) bool {
+		return order.Status == status
+	})
+}
+
+// pendingOrderKey is where an order's expiry is kept while it's pending or ready, after its account so they can be counted together
+func pendingOrderKey(accountID string, orderID string) []byte {
+	return []byte(accountID + "\x00" + orderID)
+}
+
+func orderIsPending(order *DBOrder) bool {
+	return order.Status == "pending" || order.Status == "ready"
+}
+
+// indexPendingOrderTx keeps the order in the pending order index while it's pending or ready, with its current expiry
+func indexPendingOrderTx(tx *bolt.Tx, order *DBOrder) error {
+	bucket, err := boltGetBucket(tx, pendingOrdersBucketName)
+	if err != nil {
+		return err
+	}
+	key := pendingOrderKey(order.AccountID, order.ID)
+	if !orderIsPending(order) {
+		return bucket.Delete(key)
+	}
+	return bucket.Put(key, binary.BigEndian.AppendUint64(nil, uint64(order.Expires)))
+}
+
+// countPendingOrdersTx counts the account's pending and ready orders that haven't expired by now, returning the earliest
+// any of them expires. Orders left pending past their expiry are dropped from the index if the transaction can write
+func countPendingOrdersTx(tx *bolt.Tx, accountID string, now int64) (int, int64, error) {
+	bucket := tx.Bucket(pendingOrdersBucketName)
+	if bucket == nil {
+		return 0, 0, nil
+	}
+
+	pending := 0
+	var nextExpiry int64
+	// Keys can't be deleted while iterating with a cursor
+	var expired [][]byte
+	prefix := pendingOrderKey(accountID, "")
+	c := bucket.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		expires := int64(binary.BigEndian.Uint64(v))
+		if expires <= now {
+			expired = append(expired, append([]byte{}, k...))
+			continue
+		}
+		pending++
+		if nextExpiry == 0 || expires < nextExpiry {
+			nextExpiry = expires
+		}
+	}
+
+	if tx.Writable() {
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+	return pending, nextExpiry, nil
+}
+
+// indexPendingOrders builds the pending order index from the orders, for databases made before it existed
+func (b *BoltDB) indexPendingOrders() error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		orders := tx.Bucket(ordersBucketName)
+		if orders == nil || tx.Bucket(pendingOrdersBucketName) != nil {
+			return nil
+		}
+
+		// Keys can't be written while iterating with ForEach
+		var toIndex []DBOrder
+		err := orders.ForEach(func(k, v []byte) error {
+			var order DBOrder
+			if err := json.Unmarshal(v, &order); err != nil {
+				return err
+			}
+			if orderIsPending(&order) {
+				toIndex = append(toIndex, order)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if _, err = boltGetBucket(tx, pendingOrdersBucketName); err != nil {
+			return err
+		}
+		for i := range toIndex {
+			if err := indexPendingOrderTx(tx, &toIndex[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
 func (b *BoltDB) CreateCertificate(cert DBCertificate) error {
-	return boltSaver[DBCertificate](b.db, certificatesBucketName, []byte(cert.ID), &cert)
+	return b.db.Update(func(tx *bolt.Tx) error {
+		err := boltSaverTx[DBCertificate](tx, certificatesBucketName, []byte(cert.ID), &cert)
+		if err != nil {
+			return err
+		}
+		return indexCertificateTx(tx, &cert)
+	})
+}
+func (b *BoltDB) UpdateCertificate(certID []byte, updateCallback func(*DBCertificate) error) (*DBCertificate, error) {
+	return boltUpdator[DBCertificate](b.db, certificatesBucketName, certID, updateCallback)
 }
+func (b *BoltDB) GetCertificateBySerial(serial string) (*DBCertificate, error) {
+	var certID []byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket, err := boltGetBucket(tx, certificateSerialsBucketName)
+		if err != nil {
+			return err
+		}
+		if v := bucket.Get([]byte(serial)); v != nil {
+			certID = append([]byte{}, v...)
+			return nil
+		}
+		return ErrNotFound
+	})
+	if err != nil {
+		return nil, err
+	}
+	return b.GetCertificate(certID)
+}
+func (b *BoltDB) FindCertificates(accountID string, publicKeySHA256 string, nameSet string) ([]DBCertificate, error) {
+	certs := []DBCertificate{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		reuse := tx.Bucket(certificateReuseBucketName)
+		if reuse == nil {
+			return nil
+		}
+		certBucket := tx.Bucket(certificatesBucketName)
+		if certBucket == nil {
+			return nil
+		}
+
+		prefix := certificateReusePrefix(accountID, publicKeySHA256, nameSet)
+		c := reuse.Cursor()
+		for k, certID := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, certID = c.Next() {
+			v := certBucket.Get(certID)
+			if v == nil {
+				continue
+			}
+			var cert DBCertificate
+			if err := json.Unmarshal(v, &cert); err != nil {
+				return err
+			}
+			certs = append(certs, cert)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return certs, nil
+}
+func (b *BoltDB) CertificateIssuedFor(accountID string, name string) (bool, error) {
+	issued := false
+	err := b.db.View(func(tx *bolt.Tx) error {
+		names := tx.Bucket(certificateNamesBucketName)
+		if names == nil {
+			return nil
+		}
+		prefix := certificateNamePrefix(accountID, name)
+		k, _ := names.Cursor().Seek(prefix)
+		issued = k != nil && bytes.HasPrefix(k, prefix)
+		return nil
+	})
+	return issued, err
+}
+
 func (b *BoltDB) GetCertificate(certID []byte) (*DBCertificate, error) {
 	return boltGetter[DBCertificate](b.db, certificatesBucketName, certID)
 }
 
+// indexCertificateTx adds cert to the indexes certificates are looked up through
+func indexCertificateTx(tx *bolt.Tx, cert *DBCertificate) error {
+	if cert.Serial != "" {
+		bucket, err := boltGetBucket(tx, certificateSerialsBucketName)
+		if err != nil {
+			return err
+		}
+		if err = bucket.Put([]byte(cert.Serial), []byte(cert.ID)); err != nil {
+			return err
+		}
+	}
+	if cert.PublicKeySHA256 != "" {
+		bucket, err := boltGetBucket(tx, certificateReuseBucketName)
+		if err != nil {
+			return err
+		}
+		key := append(certificateReusePrefix(cert.AccountID, cert.PublicKeySHA256, cert.NameSet), cert.ID...)
+		if err = bucket.Put(key, []byte(cert.ID)); err != nil {
+			return err
+		}
+	}
+	if cert.NameSet != "" {
+		bucket, err := boltGetBucket(tx, certificateNamesBucketName)
+		if err != nil {
+			return err
+		}
+		for _, name := range strings.Split(cert.NameSet, ",") {
+			if err = bucket.Put(certificateNameKey(cert, name), []byte(cert.ID)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// certificateNamePrefix is what every name index key for the account and name starts with, before the certificate ID
+func certificateNamePrefix(accountID string, name string) []byte {
+	return []byte(accountID + "\x00" + name + "\x00")
+}
+
+func certificateNameKey(cert *DBCertificate, name string) []byte {
+	return append(certificateNamePrefix(cert.AccountID, name), cert.ID...)
+}
+
+// certificateReusePrefix is what every reuse index key for the account, key and names starts with, before the certificate ID
+func certificateReusePrefix(accountID string, publicKeySHA256 string, nameSet string) []byte {
+	return []byte(accountID + "\x00" + publicKeySHA256 + "\x00" + nameSet + "\x00")
+}
+
+// indexCertificates fills in the serial and indexes of certificates stored before they were kept
+func (b *BoltDB) indexCertificates() error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		certs := tx.Bucket(certificatesBucketName)
+		if certs == nil {
+			return nil
+		}
+		serials, err := boltGetBucket(tx, certificateSerialsBucketName)
+		if err != nil {
+			return err
+		}
+		reuse, err := boltGetBucket(tx, certificateReuseBucketName)
+		if err != nil {
+			return err
+		}
+		names, err := boltGetBucket(tx, certificateNamesBucketName)
+		if err != nil {
+			return err
+		}
+
+		// Keys can't be written while iterating with ForEach
+		var toIndex []DBCertificate
+		err = certs.ForEach(func(k, v []byte) error {
+			var cert DBCertificate
+			if err := json.Unmarshal(v, &cert); err != nil {
+				return err
+			}
+			serialIndexed := cert.Serial != "" && serials.Get([]byte(cert.Serial)) != nil
+			reuseIndexed := cert.PublicKeySHA256 == "" || reuse.Get(append(certificateReusePrefix(cert.AccountID, cert.PublicKeySHA256, cert.NameSet), cert.ID...)) != nil
+			namesIndexed := true
+			if cert.NameSet != "" {
+				for _, name := range strings.Split(cert.NameSet, ",") {
+					if names.Get(certificateNameKey(&cert, name)) == nil {
+						namesIndexed = false
+						break
+					}
+				}
+			}
+			if serialIndexed && reuseIndexed && namesIndexed {
+				return nil
+			}
+			if cert.Serial == "" {
+				leaf, err := parseLeaf(cert.Certificate)
+				if err == nil {
+					cert.Serial = CertificateSerial(leaf.SerialNumber)
+				}
+				// Otherwise nothing can be looked up by its serial, but it can still be fetched by ID
+			}
+			toIndex = append(toIndex, cert)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for i := range toIndex {
+			if err := boltSaverTx(tx, certificatesBucketName, []byte(toIndex[i].ID), &toIndex[i]); err != nil {
+				return err
+			}
+			if err := indexCertificateTx(tx, &toIndex[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func parseLeaf(certPEM []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, errors.New("no certificate in PEM bundle")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
 func (b *BoltDB) CreateAuthz(authz DBAuthz) error {
 	return boltSaver[DBAuthz](b.db, authzsBucketName, []byte(authz.ID), &authz)
 }
@@ -336,6 +883,107 @@ func (b *BoltDB) UnlockAuthz(authzID []byte) error {
 func (b *BoltDB) UpdateAuthz(authzID []byte, updateCallback func(authzToUpdate *DBAuthz) error) (*DBAuthz, error) {
 	return boltUpdator[DBAuthz](b.db, authzsBucketName, authzID, updateCallback)
 }
+func (b *BoltDB) GetAuthzsWithChallengeStatus(status string) ([]DBAuthz, error) {
+	return boltFilter[DBAuthz](b.db, authzsBucketName, func(authz *DBAuthz) bool {
+		for _, chall := range authz.Challenges {
+			if chall.Status == status {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (b *BoltDB) GetLocalCA() (*DBLocalCA, error) {
+	return boltGetter[DBLocalCA](b.db, globalKeyBucketName, localCAK)
+}
+func (b *BoltDB) SaveLocalCA(ca DBLocalCA) error {
+	return boltSaver[DBLocalCA](b.db, globalKeyBucketName, localCAK, &ca)
+}
+
+func (b *BoltDB) GetOwnCertificate() (*DBOwnCertificate, error) {
+	return boltGetter[DBOwnCertificate](b.db, globalKeyBucketName, ownCertificateK)
+}
+func (b *BoltDB) SaveOwnCertificate(cert DBOwnCertificate) error {
+	return boltSaver[DBOwnCertificate](b.db, globalKeyBucketName, ownCertificateK, &cert)
+}
+
+func (b *BoltDB) GetLocalCAIssuedCert(serial []byte) (*DBLocalCAIssuedCert, error) {
+	return boltGetter[DBLocalCAIssuedCert](b.db, localCAIssuedBucketName, serial)
+}
+func (b *BoltDB) CreateLocalCAIssuedCert(issued DBLocalCAIssuedCert) error {
+	return boltSaver[DBLocalCAIssuedCert](b.db, localCAIssuedBucketName, []byte(issued.Serial), &issued)
+}
+func (b *BoltDB) UpdateLocalCAIssuedCert(serial []byte, updateCallback func(*DBLocalCAIssuedCert) error) (*DBLocalCAIssuedCert, error) {
+	return boltUpdator[DBLocalCAIssuedCert](b.db, localCAIssuedBucketName, serial, updateCallback)
+}
+func (b *BoltDB) GetRevokedLocalCAIssuedCerts() ([]DBLocalCAIssuedCert, error) {
+	return boltFilter[DBLocalCAIssuedCert](b.db, localCAIssuedBucketName, func(issued *DBLocalCAIssuedCert) bool {
+		return issued.RevokedAt != nil
+	})
+}
+
+func (b *BoltDB) CreateIssuance(issuance DBIssuance) error {
+	return boltSaver[DBIssuance](b.db, upstreamIssuancesBucketName, issuanceKey(issuance.Upstream, issuance.Time, issuance.ID), &issuance)
+}
+func (b *BoltDB) GetIssuancesSince(upstream string, since int64) ([]DBIssuance, error) {
+	issuances := []DBIssuance{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(upstreamIssuancesBucketName)
+		if bucket == nil {
+			return nil
+		}
+
+		prefix := issuancePrefix(upstream)
+		c := bucket.Cursor()
+		for k, v := c.Seek(issuanceKey(upstream, since, "")); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var issuance DBIssuance
+			if err := json.Unmarshal(v, &issuance); err != nil {
+				return err
+			}
+			issuances = append(issuances, issuance)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return issuances, nil
+}
+func (b *BoltDB) DeleteIssuancesBefore(upstream string, before int64) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := boltGetBucket(tx, upstreamIssuancesBucketName)
+		if err != nil {
+			return err
+		}
+
+		// Keys can't be deleted while iterating with a cursor
+		var toDelete [][]byte
+		end := issuanceKey(upstream, before, "")
+		c := bucket.Cursor()
+		for k, _ := c.Seek(issuancePrefix(upstream)); k != nil && bytes.Compare(k, end) < 0; k, _ = c.Next() {
+			toDelete = append(toDelete, append([]byte{}, k...))
+		}
+
+		for _, k := range toDelete {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// issuancePrefix is what every issuance key for the upstream starts with, before the time and ID
+func issuancePrefix(upstream string) []byte {
+	return []byte(upstream + "\x00")
+}
+
+// issuanceKey orders issuances by upstream then time, so a window of them can be read without going through the rest
+func issuanceKey(upstream string, t int64, id string) []byte {
+	key := binary.BigEndian.AppendUint64(issuancePrefix(upstream), uint64(t))
+	return append(key, id...)
+}
 
 func NewBoltDb(path string) (DB, error) {
 	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
@@ -343,7 +991,119 @@ func NewBoltDb(path string) (DB, error) {
 		return nil, err
 	}
 
-	return &BoltDB{
+	b := &BoltDB{
 		db: db,
-	}, nil
+	}
+	if err = b.indexCertificates(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to index certificates: %w", err)
+	}
+	if err = b.indexAccountKeys(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to index account keys: %w", err)
+	}
+	if err = b.indexPendingOrders(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to index pending orders: %w", err)
+	}
+	return b, nil
+}
+
+func (b *BoltDB) Close() error {
+	return b.db.Close()
+}
+
+func (b *BoltDB) CheckWritable() error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := boltGetBucket(tx, healthBucketName)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(lastCheckK, []byte(time.Now().UTC().Format(time.RFC3339)))
+	})
+}
+
+func (b *BoltDB) GetApproval(approvalID []byte) (*DBApproval, error) {
+	return boltGetter[DBApproval](b.db, approvalsBucketName, approvalID)
+}
+func (b *BoltDB) CreateApproval(approval DBApproval) error {
+	return boltSaver[DBApproval](b.db, approvalsBucketName, []byte(approval.ID), &approval)
+}
+func (b *BoltDB) UpdateApproval(approvalID []byte, updateCallback func(*DBApproval) error) (*DBApproval, error) {
+	return boltUpdator[DBApproval](b.db, approvalsBucketName, approvalID, updateCallback)
+}
+func (b *BoltDB) FindApprovals(keep func(*DBApproval) bool) ([]DBApproval, error) {
+	return boltFilter[DBApproval](b.db, approvalsBucketName, keep)
+}
+func (b *BoltDB) RequestApproval(approval DBApproval, now int64) (*DBApproval, bool, error) {
+	var found *DBApproval
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := boltGetBucket(tx, approvalsBucketName)
+		if err != nil {
+			return err
+		}
+
+		expired := []DBApproval{}
+		err = bucket.ForEach(func(k, v []byte) error {
+			var existing DBApproval
+			if err := json.Unmarshal(v, &existing); err != nil {
+				return err
+			}
+			if existing.AccountID != approval.AccountID || existing.Identifier != approval.Identifier {
+				return nil
+			}
+			switch {
+			case existing.Status == ApprovalStatusPending && now >= existing.ExpiresAt:
+				existing.Status = ApprovalStatusExpired
+				expired = append(expired, existing)
+			case existing.Status == ApprovalStatusPending || existing.Status == ApprovalStatusApproved:
+				found = &existing
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// The bucket can't be written to while it's being iterated over
+		for i := range expired {
+			if err = boltSaverTx(tx, approvalsBucketName, []byte(expired[i].ID), &expired[i]); err != nil {
+				return err
+			}
+		}
+
+		if found == nil {
+			return boltSaverTx(tx, approvalsBucketName, []byte(approval.ID), &approval)
+		}
+		if found.Status == ApprovalStatusPending {
+			found.OrderIDs = append(found.OrderIDs, approval.OrderIDs...)
+			return boltSaverTx(tx, approvalsBucketName, []byte(found.ID), found)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if found == nil {
+		return &approval, true, nil
+	}
+	return found, false, nil
+}
+
+func (b *BoltDB) CreateDNSRecord(record DBDNSRecord) error {
+	return boltSaver[DBDNSRecord](b.db, dnsRecordsBucketName, []byte(record.ID), &record)
+}
+func (b *BoltDB) GetDNSRecords() ([]DBDNSRecord, error) {
+	return boltFilter[DBDNSRecord](b.db, dnsRecordsBucketName, func(*DBDNSRecord) bool { return true })
+}
+func (b *BoltDB) UpdateDNSRecord(recordID []byte, updateCallback func(*DBDNSRecord) error) (*DBDNSRecord, error) {
+	return boltUpdator[DBDNSRecord](b.db, dnsRecordsBucketName, recordID, updateCallback)
+}
+func (b *BoltDB) DeleteDNSRecord(recordID []byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := boltGetBucket(tx, dnsRecordsBucketName)
+		if err != nil {
+			return err
+		}
+		return bucket.Delete(recordID)
+	})
 }
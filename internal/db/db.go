@@ -1,9 +1,16 @@
 package db
 
-import "github.com/go-jose/go-jose/v3"
+import (
+	"math/big"
+
+	"github.com/go-jose/go-jose/v3"
+)
 
 type DB interface {
 	Seed() error
+	Close() error
+	// CheckWritable makes a small write, returning an error if the database can't be written to
+	CheckWritable() error
 
 	SaveGlobalKey(privateKey []byte) error
 	GetGlobalKey() ([]byte, error)
@@ -14,21 +21,64 @@ type DB interface {
 	GetAccount(accountID []byte) (*DBAccount, error)
 	CreateAccount(acc DBAccount, key *jose.JSONWebKey) error
 	UpdateAccount(accountID []byte, updateCallback func(*DBAccount) error) (*DBAccount, error)
-	DeleteAccount(accountID []byte) error
+	// GetAccountByKey finds the tenant's account with key, deactivated or not
+	GetAccountByKey(tenant string, key *jose.JSONWebKey) (*DBAccount, error)
 
 	GetOrder(orderID []byte) (*DBOrder, error)
-	CreateOrder(DBOrder) error
+	// CreateOrder saves a new order. If maxPending is above zero and the account already has that many pending or ready orders
+	// that haven't expired by now, it returns a *PendingOrdersError instead. The check and save are one transaction
+	CreateOrder(order DBOrder, maxPending int, now int64) error
 	UpdateOrder(orderID []byte, updateCallback func(*DBOrder) error) (*DBOrder, error)
+	// CountPendingOrders counts the account's pending or ready orders that haven't expired by now, and when the first expires
+	CountPendingOrders(accountID string, now int64) (int, int64, error)
+	GetOrdersWithStatus(status string) ([]DBOrder, error)
 
 	GetCertificate(certID []byte) (*DBCertificate, error)
+	// GetCertificateBySerial finds a certificate by its leaf's serial number, as hex
+	GetCertificateBySerial(serial string) (*DBCertificate, error)
 	CreateCertificate(DBCertificate) error
+	UpdateCertificate(certID []byte, updateCallback func(*DBCertificate) error) (*DBCertificate, error)
+	FindCertificates(accountID string, publicKeySHA256 string, nameSet string) ([]DBCertificate, error)
 
 	GetAuthz(authzID []byte) (*DBAuthz, error)
 	CreateAuthz(DBAuthz) error
 	UpdateAuthz(authzID []byte, updateCallback func(authzToUpdate *DBAuthz) error) (*DBAuthz, error)
+	// GetAuthzsWithChallengeStatus finds the authzs with a challenge in status
+	GetAuthzsWithChallengeStatus(status string) ([]DBAuthz, error)
 
 	TryTakeAuthzLock(authzID []byte) (bool, error)
 	UnlockAuthz(authzID []byte) error
+
+	GetLocalCA() (*DBLocalCA, error)
+	SaveLocalCA(DBLocalCA) error
+
+	GetOwnCertificate() (*DBOwnCertificate, error)
+	SaveOwnCertificate(DBOwnCertificate) error
+
+	GetLocalCAIssuedCert(serial []byte) (*DBLocalCAIssuedCert, error)
+	CreateLocalCAIssuedCert(DBLocalCAIssuedCert) error
+	UpdateLocalCAIssuedCert(serial []byte, updateCallback func(*DBLocalCAIssuedCert) error) (*DBLocalCAIssuedCert, error)
+	GetRevokedLocalCAIssuedCerts() ([]DBLocalCAIssuedCert, error)
+
+	CreateIssuance(DBIssuance) error
+	GetIssuancesSince(upstream string, since int64) ([]DBIssuance, error)
+	DeleteIssuancesBefore(upstream string, before int64) error
+
+	CertificateIssuedFor(accountID string, name string) (bool, error)
+
+	GetApproval(approvalID []byte) (*DBApproval, error)
+	CreateApproval(DBApproval) error
+	UpdateApproval(approvalID []byte, updateCallback func(*DBApproval) error) (*DBApproval, error)
+	FindApprovals(keep func(*DBApproval) bool) ([]DBApproval, error)
+	// RequestApproval finds the account's pending or approved approval for approval.Identifier, adding approval's orders to it
+	// if it's pending, and saves approval if there isn't one. Pending approvals found past their expiry are expired.
+	// It's done in one transaction, so orders made at the same time share an approval. The bool is true if approval was saved
+	RequestApproval(approval DBApproval, now int64) (*DBApproval, bool, error)
+
+	CreateDNSRecord(DBDNSRecord) error
+	GetDNSRecords() ([]DBDNSRecord, error)
+	UpdateDNSRecord(recordID []byte, updateCallback func(*DBDNSRecord) error) (*DBDNSRecord, error)
+	DeleteDNSRecord(recordID []byte) error
 }
 
 type DBAccount struct {
@@ -37,6 +87,14 @@ type DBAccount struct {
 	Contact              []string `json:"contact"`
 	TermsOfServiceAgreed bool     `json:"termsOfServiceAgreed"`
 	Orders               []string `json:"orders"`
+	// Name of the tenant whose directory the account was created through, empty for the default
+	Tenant string `json:"tenant,omitempty"`
+	// Key ID of the external account the account was bound to, if any
+	EABKeyID string `json:"eab_key_id,omitempty"`
+	// Subject of the client certificate the account is bound to, or its SANs if it has no subject, if client certificates are required
+	ClientCertSubject string `json:"client_cert_subject,omitempty"`
+	// Unix time the account was deactivated. Deactivated accounts are kept, along with their key, so they can still be audited
+	DeactivatedAt *int64 `json:"deactivated_at,omitempty"`
 }
 
 const AccountStatusDeactivated = "deactivated"
@@ -54,9 +112,19 @@ type DBOrder struct {
 	Identifiers   []DBOrderIdentifier `json:"identifiers"`
 	CertificateID string              `json:"certificate_id"`
 
-	ErrorID string `json:"error_id"`
+	ErrorID string     `json:"error_id"`
+	Error   *DBProblem `json:"error,omitempty"`
+	// Unix time the upstream asked us to wait until before retrying, if it failed the order with one
+	RetryAfter *int64 `json:"retry_after,omitempty"`
 
 	AuthzIDs []string `json:"authz_ids"`
+
+	// Approvals the order needed before its challenges could be validated
+	ApprovalIDs []string `json:"approval_ids,omitempty"`
+	// Challenges the client asked to be validated while approval was pending, validated once it's given
+	HeldChallengeIDs []string `json:"held_challenge_ids,omitempty"`
+	// DER CSR the order was finalized with, kept while it's processing so issuance cut short by a restart can be resumed
+	CSR []byte `json:"csr,omitempty"`
 }
 
 type DBOrderIdentifier struct {
@@ -70,6 +138,23 @@ type DBCertificate struct {
 	AccountID string `json:"account_id"`
 
 	Certificate []byte `json:"certificate"`
+	// The leaf's serial number, as hex
+	Serial string `json:"serial,omitempty"`
+
+	// What the certificate was issued for, so it can be reused for an identical request
+	PublicKeySHA256 string `json:"public_key_sha256,omitempty"`
+	NameSet         string `json:"name_set,omitempty"`
+	NotBefore       int64  `json:"not_before,omitempty"`
+	NotAfter        int64  `json:"not_after,omitempty"`
+
+	// Set once the certificate's been revoked with the issuer, whichever it was
+	RevokedAt        *int64 `json:"revoked_at,omitempty"`
+	RevocationReason int    `json:"revocation_reason,omitempty"`
+}
+
+// CertificateSerial is how serial numbers are stored and looked up
+func CertificateSerial(serial *big.Int) string {
+	return serial.Text(16)
 }
 
 type DBAuthz struct {
@@ -87,9 +172,103 @@ type DBAuthz struct {
 }
 
 type DBAuthzChallenge struct {
-	ID            string `json:"id"`
-	Type          string `json:"type"`
-	Token         string `json:"token"`
-	Status        string `json:"status"`
-	ValidatedTime *int64 `json:"validated_time"`
+	ID            string     `json:"id"`
+	Type          string     `json:"type"`
+	Token         string     `json:"token"`
+	Status        string     `json:"status"`
+	ValidatedTime *int64     `json:"validated_time"`
+	Error         *DBProblem `json:"error,omitempty"`
+}
+
+// DBProblem is a stored RFC7807 problem document, explaining why an order or challenge failed
+type DBProblem struct {
+	Type        string             `json:"type"`
+	Detail      string             `json:"detail"`
+	Status      int                `json:"status,omitempty"`
+	Identifier  *DBOrderIdentifier `json:"identifier,omitempty"`
+	Subproblems []DBProblem        `json:"subproblems,omitempty"`
+}
+
+// DBLocalCA holds the DER-encoded root and intermediate of the built-in CA
+type DBLocalCA struct {
+	RootCert         []byte `json:"root_cert"`
+	RootKey          []byte `json:"root_key"`
+	IntermediateCert []byte `json:"intermediate_cert"`
+	IntermediateKey  []byte `json:"intermediate_key"`
+}
+
+// DBOwnCertificate is the certificate ACMESpider serves, and its key, both PEM encoded
+type DBOwnCertificate struct {
+	Certificate []byte   `json:"certificate"`
+	Key         []byte   `json:"key"`
+	Names       []string `json:"names"`
+}
+
+// DBLocalCAIssuedCert tracks a certificate issued by the built-in CA, keyed by its serial as CertificateSerial gives it
+type DBLocalCAIssuedCert struct {
+	Serial        string `json:"serial"`
+	CertificateID string `json:"certificate_id"`
+	NotAfter      int64  `json:"not_after"`
+
+	RevokedAt        *int64 `json:"revoked_at,omitempty"`
+	RevocationReason int    `json:"revocation_reason"`
+}
+
+// DBIssuance records a certificate obtained from the upstream CA, so its rate limits can be budgeted for
+type DBIssuance struct {
+	ID      string `json:"id"`
+	OrderID string `json:"order_id"`
+	Time    int64  `json:"time"`
+
+	// Distinct registered domains (eTLD+1) the certificate covers
+	RegisteredDomains []string `json:"registered_domains"`
+	// The certificate's names, lowercased, sorted and comma separated
+	NameSet string `json:"name_set"`
+	// Tenant the order was placed through
+	Tenant string `json:"tenant,omitempty"`
+	// Upstream the certificate came from, empty for the server's default upstream
+	Upstream string `json:"upstream,omitempty"`
+}
+
+const (
+	ApprovalStatusPending  = "pending"
+	ApprovalStatusApproved = "approved"
+	ApprovalStatusDenied   = "denied"
+	ApprovalStatusExpired  = "expired"
+)
+
+// DBApproval is an operator's decision on an account getting a certificate for a name for the first time
+type DBApproval struct {
+	ID         string `json:"id"`
+	AccountID  string `json:"account_id"`
+	Identifier string `json:"identifier"`
+	// Orders waiting on the decision
+	OrderIDs []string `json:"order_ids"`
+
+	Status      string `json:"status"`
+	RequestedAt int64  `json:"requested_at"`
+	ExpiresAt   int64  `json:"expires_at"`
+
+	DecidedAt int64  `json:"decided_at,omitempty"`
+	DecidedBy string `json:"decided_by,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// DBDNSRecord is a DNS-01 TXT record presented through a DNS provider, kept until it's been cleaned up
+type DBDNSRecord struct {
+	ID string `json:"id"`
+	// Name of the lego DNS provider the record was presented with
+	Provider string `json:"provider"`
+
+	// What the provider was given, which it needs again to clean up
+	Domain  string `json:"domain"`
+	Token   string `json:"token"`
+	KeyAuth string `json:"key_auth"`
+
+	// Where the record is and what it holds, for removing it by hand
+	FQDN        string `json:"fqdn"`
+	Value       string `json:"value"`
+	PresentedAt int64  `json:"presented_at"`
+	// Failed attempts to clean up the record after it was orphaned
+	CleanUpAttempts int `json:"clean_up_attempts,omitempty"`
 }
@@ -1,5 +1,7 @@
 package dtos
 
+import "encoding/json"
+
 const (
 	AccountStatusDeactivated = "deactivated"
 	AccountStatusValid       = "valid"
@@ -7,9 +9,11 @@ const (
 )
 
 type AccountRequestDTO struct {
-	Status               string   `json:"status"`
-	Contact              []string `json:"contact"`
-	TermsOfServiceAgreed bool     `json:"termsOfServiceAgreed"`
+	Status                 string          `json:"status"`
+	Contact                []string        `json:"contact"`
+	TermsOfServiceAgreed   bool            `json:"termsOfServiceAgreed"`
+	ExternalAccountBinding json.RawMessage `json:"externalAccountBinding,omitempty"`
+	OnlyReturnExisting     bool            `json:"onlyReturnExisting,omitempty"`
 }
 
 type AccountResponseDTO struct {
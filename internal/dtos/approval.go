@@ -0,0 +1,30 @@
+package dtos
+
+type ApprovalDTO struct {
+	ID         string   `json:"id"`
+	AccountID  string   `json:"accountId"`
+	Identifier string   `json:"identifier"`
+	OrderIDs   []string `json:"orderIds"`
+
+	Status      string `json:"status"`
+	RequestedAt string `json:"requestedAt"`
+	Expires     string `json:"expires"`
+
+	DecidedAt string `json:"decidedAt,omitempty"`
+	DecidedBy string `json:"decidedBy,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+type ApprovalListResponseDTO struct {
+	Approvals []ApprovalDTO `json:"approvals"`
+}
+
+type ApprovalDecisionRequestDTO struct {
+	Reason string `json:"reason"`
+}
+
+// ApprovalNotificationDTO is POSTed to the approval webhook when an order is held for approval
+type ApprovalNotificationDTO struct {
+	Event    string      `json:"event"`
+	Approval ApprovalDTO `json:"approval"`
+}
@@ -32,9 +32,10 @@ type AuthzIdentifierDTO struct {
 }
 
 type AuthzChallengeDTO struct {
-	URL           string `json:"url"`
-	Type          string `json:"type"`
-	Status        string `json:"status"`
-	Token         string `json:"token"`
-	ValidatedTime string `json:"validated,omitempty"`
+	URL           string      `json:"url"`
+	Type          string      `json:"type"`
+	Status        string      `json:"status"`
+	Token         string      `json:"token"`
+	ValidatedTime string      `json:"validated,omitempty"`
+	Error         *ProblemDTO `json:"error,omitempty"`
 }
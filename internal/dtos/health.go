@@ -0,0 +1,17 @@
+package dtos
+
+const (
+	HealthStatusOK   = "ok"
+	HealthStatusFail = "fail"
+)
+
+type HealthReportDTO struct {
+	Status string                    `json:"status"`
+	Checks map[string]HealthCheckDTO `json:"checks,omitempty"`
+}
+
+type HealthCheckDTO struct {
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+	CheckedAt string `json:"checkedAt"`
+}
@@ -0,0 +1,17 @@
+package dtos
+
+type RateBudgetResponseDTO struct {
+	Window            string               `json:"window"`
+	RegisteredDomains []RateBudgetUsageDTO `json:"registeredDomains"`
+	NameSet           *RateBudgetUsageDTO  `json:"nameSet,omitempty"`
+}
+
+type RateBudgetUsageDTO struct {
+	Name     string `json:"name"`
+	Issued   int    `json:"issued"`
+	InFlight int    `json:"inFlight"`
+	// Limit and Remaining are left out if there's no limit
+	Limit     int    `json:"limit,omitempty"`
+	Remaining *int   `json:"remaining,omitempty"`
+	NextFreed string `json:"nextFreed,omitempty"`
+}
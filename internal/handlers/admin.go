@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lachlan2k/acmespider/internal/acme_controller"
+	"github.com/lachlan2k/acmespider/internal/db"
+	"github.com/lachlan2k/acmespider/internal/dtos"
+)
+
+const adminApproverKey = "admin_approver"
+
+// AdminHandlers serve the operator API under /admin, authenticated with bearer tokens
+type AdminHandlers struct {
+	AcmeCtrl *acme_controller.ACMEController
+	// Named tenants' controllers, which decide approvals for their accounts' orders
+	TenantCtrls map[string]*acme_controller.ACMEController
+	// Maps each token to the name of the operator it belongs to, which is recorded against their decisions
+	Tokens map[string]string
+}
+
+// RequireTokenMw rejects requests without a known bearer token, and remembers whose token it was
+func (h AdminHandlers) RequireTokenMw(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, ok := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+		if !ok || token == "" {
+			return echo.NewHTTPError(http.StatusUnauthorized, "bearer token required")
+		}
+
+		// Every token is compared, so the time taken doesn't give away which ones are close
+		approver := ""
+		for knownToken, name := range h.Tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(knownToken)) == 1 {
+				approver = name
+			}
+		}
+		if approver == "" {
+			return echo.NewHTTPError(http.StatusUnauthorized, "invalid token")
+		}
+
+		c.Set(adminApproverKey, approver)
+		addLogField(c, "admin", approver)
+		return next(c)
+	}
+}
+
+// ctrl returns the ACME controller, logging with the request's logger
+func (h AdminHandlers) ctrl(c echo.Context) *acme_controller.ACMEController {
+	return h.AcmeCtrl.WithLogger(Logger(c))
+}
+
+// approvalCtrl returns the controller of the tenant whose account an approval is for, as its orders are that controller's to carry on
+func (h AdminHandlers) approvalCtrl(c echo.Context) (*acme_controller.ACMEController, error) {
+	tenant, err := h.AcmeCtrl.ApprovalTenant(c.Param("id"))
+	if err != nil {
+		return nil, err
+	}
+	if ctrl, ok := h.TenantCtrls[tenant]; ok {
+		return ctrl.WithLogger(Logger(c)), nil
+	}
+	return h.ctrl(c), nil
+}
+
+func (h AdminHandlers) ListApprovals(c echo.Context) error {
+	status := c.QueryParam("status")
+	switch status {
+	case "", db.ApprovalStatusPending, db.ApprovalStatusApproved, db.ApprovalStatusDenied, db.ApprovalStatusExpired:
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "unknown status")
+	}
+
+	approvals, err := h.ctrl(c).ListApprovals(status)
+	if err != nil {
+		return err
+	}
+
+	resp := dtos.ApprovalListResponseDTO{Approvals: make([]dtos.ApprovalDTO, len(approvals))}
+	for i := range approvals {
+		resp.Approvals[i] = acme_controller.ApprovalToDTO(&approvals[i])
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (h AdminHandlers) GetApproval(c echo.Context) error {
+	approval, err := h.ctrl(c).GetApproval(c.Param("id"))
+	if err != nil {
+		return approvalError(err)
+	}
+	return c.JSON(http.StatusOK, acme_controller.ApprovalToDTO(approval))
+}
+
+func (h AdminHandlers) Approve(c echo.Context) error {
+	ctrl, err := h.approvalCtrl(c)
+	if err != nil {
+		return approvalError(err)
+	}
+	return h.decide(c, ctrl.Approve)
+}
+
+func (h AdminHandlers) Deny(c echo.Context) error {
+	ctrl, err := h.approvalCtrl(c)
+	if err != nil {
+		return approvalError(err)
+	}
+	return h.decide(c, ctrl.Deny)
+}
+
+func (h AdminHandlers) decide(c echo.Context, decision func(approvalID string, approver string, reason string) (*db.DBApproval, error)) error {
+	var req dtos.ApprovalDecisionRequestDTO
+	// The body is optional
+	if c.Request().ContentLength != 0 {
+		err := c.Bind(&req)
+		if err != nil {
+			return err
+		}
+	}
+
+	approver, _ := c.Get(adminApproverKey).(string)
+	approval, err := decision(c.Param("id"), approver, req.Reason)
+	if err != nil {
+		return approvalError(err)
+	}
+
+	Logger(c).WithField("approval_id", approval.ID).WithField("decided_by", approver).Debug("Approval decided through admin API")
+	return c.JSON(http.StatusOK, acme_controller.ApprovalToDTO(approval))
+}
+
+func approvalError(err error) error {
+	switch {
+	case errors.Is(err, acme_controller.ErrApprovalNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	case errors.Is(err, acme_controller.ErrApprovalDecided):
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	}
+	return err
+}
@@ -36,8 +36,8 @@ func (h Handlers) dbOrderToDTO(order *db.DBOrder) dtos.OrderResponseDTO {
 		naft = time64ToString(*order.NotAfter)
 	}
 
-	var errProblem *dtos.ProblemDTO = nil
-	if order.ErrorID != "" {
+	errProblem := h.dbProblemToDTO(order.Error)
+	if errProblem == nil && order.ErrorID != "" {
 		errProblem = &dtos.ProblemDTO{
 			Type:       "urn:ietf:params:acme:error:serverInternal",
 			HTTPStatus: http.StatusInternalServerError,
@@ -93,6 +93,7 @@ func (h Handlers) dbAuthzToDTO(authz *db.DBAuthz) dtos.AuthzDTO {
 			Status:        chall.Status,
 			Token:         chall.Token,
 			ValidatedTime: valTime,
+			Error:         h.dbProblemToDTO(chall.Error),
 		}
 	}
 
@@ -116,5 +117,28 @@ func (h Handlers) dbChallengeToDTO(chall *db.DBAuthzChallenge) dtos.AuthzChallen
 		Status:        chall.Status,
 		Token:         chall.Token,
 		ValidatedTime: valTime,
+		Error:         h.dbProblemToDTO(chall.Error),
 	}
 }
+
+func (h Handlers) dbProblemToDTO(prob *db.DBProblem) *dtos.ProblemDTO {
+	if prob == nil {
+		return nil
+	}
+
+	dto := &dtos.ProblemDTO{
+		Type:       prob.Type,
+		Detail:     prob.Detail,
+		HTTPStatus: prob.Status,
+	}
+	if prob.Identifier != nil {
+		dto.Identifier = &dtos.IdentifierForProblemDTO{
+			Type:  prob.Identifier.Type,
+			Value: prob.Identifier.Value,
+		}
+	}
+	for i := range prob.Subproblems {
+		dto.Subproblems = append(dto.Subproblems, *h.dbProblemToDTO(&prob.Subproblems[i]))
+	}
+	return dto
+}
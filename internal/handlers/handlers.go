@@ -1,17 +1,21 @@
 package handlers
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/lachlan2k/acmespider/internal/acme_controller"
+	"github.com/lachlan2k/acmespider/internal/db"
 	"github.com/lachlan2k/acmespider/internal/dtos"
 	"github.com/lachlan2k/acmespider/internal/links"
 	"github.com/lachlan2k/acmespider/internal/nonce"
-	"github.com/sirupsen/logrus"
 )
 
 type Handlers struct {
@@ -22,7 +26,7 @@ type Handlers struct {
 
 func (h Handlers) addLink(c echo.Context, url string, rel string) {
 	headers := c.Response().Header()
-	headers.Set("Link", fmt.Sprintf("<%s>;rel=%q", url, rel))
+	headers.Add("Link", fmt.Sprintf("<%s>;rel=%q", url, rel))
 }
 
 func (h Handlers) GetNonce(c echo.Context) error {
@@ -59,15 +63,19 @@ func (h Handlers) NewAccount(c echo.Context) error {
 		return acme_controller.MalformedProblem("JWK not provided")
 	}
 
-	newAcc, err := h.AcmeCtrl.NewAccount(*payload, *jwk)
+	newAcc, existing, err := h.ctrl(c).NewAccount(*payload, *jwk, clientCertSubject(c), net.ParseIP(c.RealIP()))
 	if err != nil {
 		return err
 	}
 
-	logrus.WithField("response", h.dbAccountToDTO(newAcc)).Debug("New account created")
-
+	addLogField(c, "account_id", newAcc.ID)
 	c.Response().Header().Set("Location", h.LinkCtrl.AccountPath(newAcc.ID).Abs())
 
+	if existing {
+		return c.JSON(http.StatusOK, h.dbAccountToDTO(newAcc))
+	}
+	Logger(c).WithField("response", h.dbAccountToDTO(newAcc)).Debug("New account created")
+
 	return c.JSON(http.StatusCreated, h.dbAccountToDTO(newAcc))
 }
 
@@ -87,7 +95,7 @@ func (h Handlers) GetOrUpdateAccount(c echo.Context) error {
 
 	if len(payload) == 0 {
 		// POST-as-GET
-		acc, err := h.AcmeCtrl.GetAccount(accountID, []byte(accIDParam))
+		acc, err := h.ctrl(c).GetAccount(accountID, []byte(accIDParam))
 		if err != nil {
 			return err
 		}
@@ -100,7 +108,7 @@ func (h Handlers) GetOrUpdateAccount(c echo.Context) error {
 		return acme_controller.MalformedProblem("Invalid JSON2")
 	}
 
-	acc, err := h.AcmeCtrl.UpdateAccount(accountID, []byte(accIDParam), updateBody)
+	acc, err := h.ctrl(c).UpdateAccount(accountID, []byte(accIDParam), updateBody)
 	if err != nil {
 		return err
 	}
@@ -116,6 +124,9 @@ func (h Handlers) ErrorHandler(app *echo.Echo) echo.HTTPErrorHandler {
 			return
 		}
 
+		if retryAfter := probErr.RetryAfter(); !retryAfter.IsZero() {
+			setRetryAfterHeader(c, retryAfter)
+		}
 		c.JSON(probErr.HTTPStatus, probErr)
 	}
 }
@@ -135,12 +146,12 @@ func (h Handlers) NewOrder(c echo.Context) error {
 		return acme_controller.InternalErrorProblem(err)
 	}
 
-	newOrder, err := h.AcmeCtrl.NewOrder(*newOrderPayload, accountID)
+	newOrder, err := h.ctrl(c).NewOrder(*newOrderPayload, accountID, net.ParseIP(c.RealIP()))
 	if err != nil {
 		return err
 	}
 
-	logrus.WithField("orderID", newOrder.ID).WithField("accountID", string(accountID)).Debug("New order made")
+	Logger(c).WithField("orderID", newOrder.ID).Debug("New order made")
 
 	c.Response().Header().Set("Location", h.LinkCtrl.OrderPath(newOrder.ID).Abs())
 
@@ -157,11 +168,12 @@ func (h Handlers) GetOrder(c echo.Context) error {
 		return acme_controller.InternalErrorProblem(err)
 	}
 
-	order, err := h.AcmeCtrl.GetOrder([]byte(orderID), accountID)
+	order, err := h.ctrl(c).GetOrder([]byte(orderID), accountID)
 	if err != nil {
 		return err
 	}
 
+	setRetryAfter(c, order)
 	return c.JSON(http.StatusOK, h.dbOrderToDTO(order))
 }
 
@@ -175,7 +187,7 @@ func (h Handlers) GetOrdersByAccountID(c echo.Context) error {
 		return acme_controller.InternalErrorProblem(err)
 	}
 
-	orders, err := h.AcmeCtrl.GetOrdersByAccountID([]byte(paramAccountID), accountID)
+	orders, err := h.ctrl(c).GetOrdersByAccountID([]byte(paramAccountID), accountID)
 	if err != nil {
 		return err
 	}
@@ -201,16 +213,17 @@ func (h Handlers) FinalizeOrder(c echo.Context) error {
 		return acme_controller.InternalErrorProblem(err)
 	}
 
-	logrus.WithField("orderID", orderID).WithField("accountID", string(accountID)).Debugf("Order finalize request made")
+	Logger(c).WithField("orderID", orderID).Debugf("Order finalize request made")
 
-	updatedOrder, err := h.AcmeCtrl.FinalizeOrder([]byte(orderID), *payload, accountID)
+	updatedOrder, err := h.ctrl(c).FinalizeOrder([]byte(orderID), *payload, accountID, net.ParseIP(c.RealIP()))
 	if err != nil {
 		return err
 	}
 
-	logrus.WithField("orderID", orderID).WithField("accountID", string(accountID)).Debugf("Order finalize request returned")
+	Logger(c).WithField("orderID", orderID).Debugf("Order finalize request returned")
 
 	c.Response().Header().Set("Location", h.LinkCtrl.OrderPath(updatedOrder.ID).Abs())
+	setRetryAfter(c, updatedOrder)
 
 	return c.JSON(http.StatusOK, h.dbOrderToDTO(updatedOrder))
 }
@@ -226,7 +239,7 @@ func (h Handlers) GetAuthorization(c echo.Context) error {
 		return acme_controller.InternalErrorProblem(err)
 	}
 
-	authz, err := h.AcmeCtrl.GetAuthorization([]byte(authzID), accountID)
+	authz, err := h.ctrl(c).GetAuthorization([]byte(authzID), accountID)
 	if err != nil {
 		return err
 	}
@@ -260,13 +273,18 @@ func (h Handlers) InitiateChallenge(c echo.Context) error {
 		return acme_controller.InternalErrorProblem(err)
 	}
 
-	logrus.WithField("challID", challID).WithField("accountID", string(accountID)).Debug("Challenge initiated")
+	Logger(c).WithField("challID", challID).Debug("Challenge initiated")
 
-	latestChall, err := h.AcmeCtrl.InitiateChallenge([]byte(challID), accountID)
+	latestChall, err := h.ctrl(c).InitiateChallenge([]byte(challID), accountID)
 	if err != nil {
 		return err
 	}
 
+	// Clients poll the authorization while the challenge is processing, found by its "up" link
+	// ref: https://datatracker.ietf.org/doc/html/rfc8555#section-7.5.1
+	// The challenge ID is the authz ID followed by a two character index
+	h.addLink(c, h.LinkCtrl.AuthzPath(challID[:len(challID)-2]).Abs(), "up")
+
 	return c.JSON(http.StatusOK, h.dbChallengeToDTO(latestChall))
 }
 
@@ -280,7 +298,7 @@ func (h Handlers) GetCertificate(c echo.Context) error {
 		return acme_controller.MalformedProblem("Empty certificate ID")
 	}
 
-	pemOutput, err := h.AcmeCtrl.GetCertificate(accountID, []byte(certID))
+	pemOutput, err := h.ctrl(c).GetCertificate(accountID, []byte(certID))
 	if err != nil {
 		return err
 	}
@@ -288,6 +306,43 @@ func (h Handlers) GetCertificate(c echo.Context) error {
 	return c.Blob(http.StatusOK, "application/pem-certificate-chain", pemOutput)
 }
 
+// RevokeCert revokes a certificate, signed by either the account it was issued to or the certificate's key
 func (h Handlers) RevokeCert(c echo.Context) error {
-	return echo.ErrNotImplemented
+	payload, err := getPayloadBoundBody[dtos.RevokeCertRequestDTO](c)
+	if err != nil {
+		return err
+	}
+	certDER, err := base64.RawURLEncoding.DecodeString(payload.CertificateB64)
+	if err != nil {
+		return acme_controller.MalformedProblem("Certificate was not base64url encoded")
+	}
+
+	protected, err := getProtectedHeader(c)
+	if err != nil {
+		return acme_controller.InternalErrorProblem(err)
+	}
+	// Only set when the request was signed by an account
+	accountID, _ := getAccountID(c)
+
+	err = h.ctrl(c).RevokeCertificate(certDER, payload.Reason, accountID, protected.JSONWebKey)
+	if err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// setRetryAfter passes on how long the upstream asked to wait, if it failed the order and the time hasn't passed yet
+func setRetryAfter(c echo.Context, order *db.DBOrder) {
+	if order.RetryAfter == nil {
+		return
+	}
+	setRetryAfterHeader(c, time.Unix(*order.RetryAfter, 0))
+}
+
+func setRetryAfterHeader(c echo.Context, retryAfter time.Time) {
+	wait := time.Until(retryAfter)
+	if wait <= 0 {
+		return
+	}
+	c.Response().Header().Set("Retry-After", strconv.Itoa(int(wait.Round(time.Second).Seconds())))
 }
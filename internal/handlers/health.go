@@ -0,0 +1,28 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lachlan2k/acmespider/internal/dtos"
+	"github.com/lachlan2k/acmespider/internal/health"
+)
+
+// HealthHandlers serve /healthz and /readyz for orchestrators and load balancers
+type HealthHandlers struct {
+	Ready *health.Checker
+}
+
+// Healthz only shows the process is up and serving
+func (h HealthHandlers) Healthz(c echo.Context) error {
+	return c.JSON(http.StatusOK, dtos.HealthReportDTO{Status: dtos.HealthStatusOK})
+}
+
+// Readyz shows whether ACMESpider can issue, with each dependency's check
+func (h HealthHandlers) Readyz(c echo.Context) error {
+	report := h.Ready.Run(c.Request().Context())
+	if report.Status != dtos.HealthStatusOK {
+		return c.JSON(http.StatusServiceUnavailable, report)
+	}
+	return c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lachlan2k/acmespider/internal/acme_controller"
+)
+
+// OCSP requests larger than this aren't something a sane client would send
+const maxOCSPRequestSize = 10 * 1024
+
+func (h Handlers) GetLocalCARoot(c echo.Context) error {
+	root, err := h.ctrl(c).GetLocalCARoot()
+	if err != nil {
+		return err
+	}
+	return c.Blob(http.StatusOK, "application/pem-certificate-chain", root)
+}
+
+func (h Handlers) GetLocalCACRL(c echo.Context) error {
+	crl, err := h.ctrl(c).GetLocalCACRL()
+	if err != nil {
+		return err
+	}
+	return c.Blob(http.StatusOK, "application/pkix-crl", crl)
+}
+
+func (h Handlers) LocalCAOCSP(c echo.Context) error {
+	// RFC6960 A.1: GET requests carry the base64 (then URL-encoded) request in the path, POSTs carry it as the body
+	var requestDER []byte
+	switch c.Request().Method {
+	case http.MethodGet:
+		unescaped, err := url.PathUnescape(strings.TrimPrefix(c.Param("*"), "/"))
+		if err != nil {
+			return acme_controller.MalformedProblem("Invalid OCSP request encoding")
+		}
+		decoded, err := base64.StdEncoding.DecodeString(unescaped)
+		if err != nil {
+			return acme_controller.MalformedProblem("Invalid OCSP request encoding")
+		}
+		requestDER = decoded
+
+	case http.MethodPost:
+		body, err := io.ReadAll(io.LimitReader(c.Request().Body, maxOCSPRequestSize))
+		if err != nil {
+			return acme_controller.MalformedProblem("Request body could not be read")
+		}
+		requestDER = body
+
+	default:
+		return acme_controller.MethodNotAllowed()
+	}
+
+	resp, err := h.ctrl(c).GetLocalCAOCSPResponse(requestDER)
+	if err != nil {
+		return err
+	}
+	return c.Blob(http.StatusOK, "application/ocsp-response", resp)
+}
@@ -9,7 +9,6 @@ import (
 	"github.com/go-jose/go-jose/v3"
 	"github.com/labstack/echo/v4"
 	"github.com/lachlan2k/acmespider/internal/acme_controller"
-	log "github.com/sirupsen/logrus"
 )
 
 const payloadBodyCtxKey = "payloadBody"
@@ -89,12 +88,17 @@ func (h Handlers) validateJWSAndExtractPayload(next echo.HandlerFunc, c echo.Con
 		return acme_controller.UnsupportedMediaTypeProblem("")
 	}
 
-	requestBody, err := io.ReadAll(c.Request().Body)
+	// Read one byte past the limit, to tell a body that's exactly the limit from one that's over it
+	maxBodyBytes := h.AcmeCtrl.MaxBodyBytes()
+	requestBody, err := io.ReadAll(io.LimitReader(c.Request().Body, maxBodyBytes+1))
 
 	if err != nil {
-		log.WithError(err).Debug("failed to read request body")
+		Logger(c).WithError(err).Debug("failed to read request body")
 		return acme_controller.MalformedProblem("Request body could not be read")
 	}
+	if int64(len(requestBody)) > maxBodyBytes {
+		return acme_controller.RequestTooLargeProblem(maxBodyBytes)
+	}
 
 	jws, sig, err := extractJWS(requestBody)
 	if err != nil {
@@ -128,7 +132,7 @@ func (h Handlers) validateJWSAndExtractPayload(next echo.HandlerFunc, c echo.Con
 	if jwk == nil {
 		jwk, accountID, err = h.lookupKID(protected.KeyID)
 		if jwk == nil || err != nil {
-			log.WithError(err).WithField("kid", protected.KeyID).Debug("KID lookup is not tied to a valid key")
+			Logger(c).WithError(err).WithField("kid", protected.KeyID).Debug("KID lookup is not tied to a valid key")
 			return acme_controller.UnauthorizedProblem("")
 		}
 	}
@@ -142,13 +146,25 @@ func (h Handlers) validateJWSAndExtractPayload(next echo.HandlerFunc, c echo.Con
 		}
 	}
 
-	// 4. Consume the nonce and check its okay
+	if accountID != nil {
+		if err := h.ctrl(c).CheckAccountActive(accountID); err != nil {
+			return err
+		}
+		if err := h.ctrl(c).CheckClientCert(accountID, clientCertSubject(c)); err != nil {
+			return err
+		}
+	}
+
+	// 4. Consume the nonce and check its okay. Clients retry badNonce with the fresh nonce every response carries
+	if protected.Nonce == "" {
+		return acme_controller.BadNonceProblem("JWS header did not contain a nonce")
+	}
 	nonceOk, nonceErr := h.NonceCtrl.ValidateAndConsume(protected.Nonce)
 	if nonceErr != nil {
-		log.WithError(err).Debugf("failed to validate nonce: %v", nonceErr)
+		Logger(c).WithError(nonceErr).Debug("failed to validate nonce")
 	}
 	if !nonceOk || nonceErr != nil {
-		return acme_controller.MalformedProblem("nonce was invalid")
+		return acme_controller.BadNonceProblem("Nonce was invalid, expired or already used")
 	}
 
 	// 5. Ensure the URL in the protected headers matches the URL requested
@@ -164,6 +180,13 @@ func (h Handlers) validateJWSAndExtractPayload(next echo.HandlerFunc, c echo.Con
 	c.Set(payloadBodyCtxKey, payload)
 	c.Set(protectedHeaderCtxKey, &protected)
 	c.Set(accountIDCtxKey, accountID)
+	if accountID != nil {
+		// Only now is the request known not to be a replay, so it's safe to bind the account to its certificate
+		if err := h.ctrl(c).BindClientCert(accountID, clientCertSubject(c)); err != nil {
+			return err
+		}
+		addLogField(c, "account_id", string(accountID))
+	}
 
 	return next(c)
 }
@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"crypto/x509"
+	"sort"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lachlan2k/acmespider/internal/acme_controller"
+)
+
+const clientCertSubjectCtxKey = "clientCertSubject"
+
+// RequireClientCertMw turns away requests without a client certificate, when they're required.
+// The TLS handshake has already checked any certificate given chains to the trust bundle
+func (h Handlers) RequireClientCertMw(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !h.AcmeCtrl.ClientCertRequired() {
+			return next(c)
+		}
+
+		state := c.Request().TLS
+		if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+			return acme_controller.UnauthorizedProblem("A client certificate is required")
+		}
+		subject := clientCertIdentity(state.VerifiedChains[0][0])
+		if subject == "" {
+			return acme_controller.UnauthorizedProblem("Client certificate has no subject or subject alternative names to bind the account to")
+		}
+		c.Set(clientCertSubjectCtxKey, subject)
+		addLogField(c, "client_subject", subject)
+		return next(c)
+	}
+}
+
+// clientCertIdentity is what accounts are bound to: the certificate's subject, or its SANs if the subject is empty,
+// as is common for device certificates. It's empty if the certificate has neither
+func clientCertIdentity(cert *x509.Certificate) string {
+	if subject := cert.Subject.String(); subject != "" {
+		return subject
+	}
+
+	sans := []string{}
+	for _, name := range cert.DNSNames {
+		sans = append(sans, "DNS:"+strings.ToLower(name))
+	}
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, "IP:"+ip.String())
+	}
+	for _, email := range cert.EmailAddresses {
+		sans = append(sans, "email:"+email)
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, "URI:"+uri.String())
+	}
+	if len(sans) == 0 {
+		return ""
+	}
+	// Sorted, so the same names in another order are the same identity
+	sort.Strings(sans)
+	return "SAN:" + strings.Join(sans, ",")
+}
+
+// clientCertSubject is what the request's client certificate binds accounts to, or empty if they aren't required
+func clientCertSubject(c echo.Context) string {
+	subject, _ := c.Get(clientCertSubjectCtxKey).(string)
+	return subject
+}
@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/lachlan2k/acmespider/internal/acme_controller"
+	"github.com/sirupsen/logrus"
+)
+
+const loggerCtxKey = "logger"
+
+// RequestIDMw gives each request an ID, returned in X-Request-Id, and a logger that includes it.
+// IDs are always our own, so clients can't make their requests' logs look like someone else's
+func RequestIDMw(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id, err := acme_controller.GenerateID()
+		if err != nil {
+			return acme_controller.InternalErrorProblem(err)
+		}
+		c.Response().Header().Set(echo.HeaderXRequestID, id)
+		c.Set(loggerCtxKey, logrus.WithField("request_id", id))
+		return next(c)
+	}
+}
+
+// Logger returns the request's logger, carrying its ID and, once authenticated, its account
+func Logger(c echo.Context) *logrus.Entry {
+	if logger, ok := c.Get(loggerCtxKey).(*logrus.Entry); ok {
+		return logger
+	}
+	return logrus.NewEntry(logrus.StandardLogger())
+}
+
+func addLogField(c echo.Context, key string, value any) {
+	c.Set(loggerCtxKey, Logger(c).WithField(key, value))
+}
+
+// ctrl returns the ACME controller, logging with the request's logger
+func (h Handlers) ctrl(c echo.Context) *acme_controller.ACMEController {
+	return h.AcmeCtrl.WithLogger(Logger(c))
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/lachlan2k/acmespider/internal/acme_controller"
 )
 
+// AddNonceMw gives every response a fresh nonce, including errors, so clients always have one to retry with
 func (h Handlers) AddNonceMw(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		err := h.AddNonce(c)
@@ -0,0 +1,17 @@
+package handlers
+
+import (
+	"net"
+
+	"github.com/labstack/echo/v4"
+)
+
+// RateLimitMw turns away clients sending too many requests, before any work is done for them
+func (h Handlers) RateLimitMw(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if err := h.ctrl(c).CheckRequestRate(net.ParseIP(c.RealIP())); err != nil {
+			return err
+		}
+		return next(c)
+	}
+}
@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lachlan2k/acmespider/internal/acme_controller"
+	"github.com/lachlan2k/acmespider/internal/dtos"
+)
+
+// GetRateBudget reports how much of the upstream rate limit budget is left, to accounts in the tenant, with a POST-as-GET.
+// The optional names query parameter (comma separated) also reports on that exact set of names
+func (h Handlers) GetRateBudget(c echo.Context) error {
+	var names []string
+	for _, name := range strings.Split(c.QueryParam("names"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+
+	report, err := h.ctrl(c).RateBudget(names)
+	if err != nil {
+		return err
+	}
+
+	resp := dtos.RateBudgetResponseDTO{
+		Window:            report.Window.String(),
+		RegisteredDomains: make([]dtos.RateBudgetUsageDTO, len(report.RegisteredDomains)),
+	}
+	for i, usage := range report.RegisteredDomains {
+		resp.RegisteredDomains[i] = budgetUsageToDTO(usage)
+	}
+	if report.NameSet != nil {
+		nameSet := budgetUsageToDTO(*report.NameSet)
+		resp.NameSet = &nameSet
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+func budgetUsageToDTO(usage acme_controller.BudgetUsage) dtos.RateBudgetUsageDTO {
+	dto := dtos.RateBudgetUsageDTO{
+		Name:     usage.Name,
+		Issued:   usage.Issued,
+		InFlight: usage.InFlight,
+		Limit:    usage.Limit,
+	}
+	if usage.Limit > 0 {
+		remaining := usage.Limit - usage.Issued - usage.InFlight
+		if remaining < 0 {
+			remaining = 0
+		}
+		dto.Remaining = &remaining
+	}
+	if !usage.NextFreed.IsZero() {
+		dto.NextFreed = dtos.TimeMarshalDTO(usage.NextFreed)
+	}
+	return dto
+}
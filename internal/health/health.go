@@ -0,0 +1,123 @@
+// Package health runs the readiness checks behind /readyz
+package health
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/lachlan2k/acmespider/internal/dtos"
+)
+
+// Check is one dependency ACMESpider needs to be able to issue
+type Check struct {
+	Name string
+	// How long a result is reused for, so frequent probes don't hammer the dependency. Zero runs the check every time
+	CacheFor time.Duration
+	// Run returns an error if the dependency isn't usable. It doesn't have to give up when ctx is done,
+	// as the check is reported as timed out regardless
+	Run func(ctx context.Context) error
+}
+
+type result struct {
+	err       error
+	checkedAt time.Time
+}
+
+// Checker runs checks concurrently, each with a timeout
+type Checker struct {
+	checks  []Check
+	timeout time.Duration
+
+	lock    sync.Mutex
+	results map[string]result
+	// Checks currently running, so concurrent probes share a run
+	running map[string]chan struct{}
+}
+
+func NewChecker(timeout time.Duration, checks ...Check) *Checker {
+	return &Checker{
+		checks:  checks,
+		timeout: timeout,
+		results: map[string]result{},
+		running: map[string]chan struct{}{},
+	}
+}
+
+// Add adds a check, and must be called before the checker is used
+func (c *Checker) Add(check Check) {
+	c.checks = append(c.checks, check)
+}
+
+// Run runs every check, reporting ok only if they all pass
+func (c *Checker) Run(ctx context.Context) dtos.HealthReportDTO {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	results := make([]result, len(c.checks))
+	var wg sync.WaitGroup
+	for i := range c.checks {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = c.run(ctx, c.checks[i])
+		}(i)
+	}
+	wg.Wait()
+
+	report := dtos.HealthReportDTO{
+		Status: dtos.HealthStatusOK,
+		Checks: map[string]dtos.HealthCheckDTO{},
+	}
+	for i, check := range c.checks {
+		checkReport := dtos.HealthCheckDTO{
+			Status:    dtos.HealthStatusOK,
+			CheckedAt: results[i].checkedAt.UTC().Format(time.RFC3339),
+		}
+		if results[i].err != nil {
+			checkReport.Status = dtos.HealthStatusFail
+			checkReport.Error = results[i].err.Error()
+			report.Status = dtos.HealthStatusFail
+		}
+		report.Checks[check.Name] = checkReport
+	}
+	return report
+}
+
+// run returns the check's cached result if it's fresh enough, and otherwise runs it
+func (c *Checker) run(ctx context.Context, check Check) result {
+	c.lock.Lock()
+	cached, ok := c.results[check.Name]
+	if ok && time.Since(cached.checkedAt) < check.CacheFor {
+		c.lock.Unlock()
+		return cached
+	}
+	done, alreadyRunning := c.running[check.Name]
+	if !alreadyRunning {
+		done = make(chan struct{})
+		c.running[check.Name] = done
+	}
+	c.lock.Unlock()
+
+	if !alreadyRunning {
+		// The check carries on in the background if it times out, and its result is kept for next time
+		go func() {
+			err := check.Run(context.Background())
+			c.lock.Lock()
+			defer c.lock.Unlock()
+			c.results[check.Name] = result{err: err, checkedAt: time.Now()}
+			delete(c.running, check.Name)
+			close(done)
+		}()
+	}
+
+	select {
+	case <-done:
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		return c.results[check.Name]
+	case <-ctx.Done():
+		return result{err: errors.New("timed out"), checkedAt: time.Now()}
+	}
+}
@@ -0,0 +1,67 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lachlan2k/acmespider/internal/dtos"
+)
+
+func TestRun(t *testing.T) {
+	var runs atomic.Int32
+	block := make(chan struct{})
+	defer close(block)
+
+	checker := NewChecker(100*time.Millisecond,
+		Check{Name: "ok", Run: func(ctx context.Context) error { return nil }},
+		Check{Name: "broken", Run: func(ctx context.Context) error { return errors.New("no route to host") }},
+		Check{Name: "cached", CacheFor: time.Hour, Run: func(ctx context.Context) error {
+			runs.Add(1)
+			return nil
+		}},
+		Check{Name: "hung", Run: func(ctx context.Context) error {
+			<-block
+			return nil
+		}},
+	)
+
+	start := time.Now()
+	report := checker.Run(context.Background())
+	if time.Since(start) > time.Second {
+		t.Fatalf("a hung check held up the report")
+	}
+
+	if report.Status != dtos.HealthStatusFail {
+		t.Fatalf("expected failing checks to fail the report, got %s", report.Status)
+	}
+	expected := map[string]string{
+		"ok":     "",
+		"broken": "no route to host",
+		"cached": "",
+		"hung":   "timed out",
+	}
+	for name, expectedErr := range expected {
+		check, ok := report.Checks[name]
+		if !ok {
+			t.Fatalf("check %s missing from report", name)
+		}
+		if check.Error != expectedErr || (check.Status == dtos.HealthStatusOK) != (expectedErr == "") {
+			t.Errorf("expected %s to have error %q, got %+v", name, expectedErr, check)
+		}
+	}
+
+	checker.Run(context.Background())
+	if runs.Load() != 1 {
+		t.Fatalf("expected cached check to run once, ran %d times", runs.Load())
+	}
+}
+
+func TestAllPassing(t *testing.T) {
+	checker := NewChecker(time.Second, Check{Name: "ok", Run: func(ctx context.Context) error { return nil }})
+	if report := checker.Run(context.Background()); report.Status != dtos.HealthStatusOK {
+		t.Fatalf("expected ok, got %+v", report)
+	}
+}
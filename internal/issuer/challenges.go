@@ -0,0 +1,186 @@
+package issuer
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/go-acme/lego/v4/acme"
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/challenge/dns01"
+)
+
+// ChallengeTracker is a http.RoundTripper that remembers why upstream challenges failed, for each call obtaining a certificate.
+// lego returns challenge failures in an unexported map of identifier to error, so they're picked up as they happen instead:
+// from the authorizations and challenges the upstream responds with, and from the DNS-01 pre-check.
+// lego's requests can't be told apart by who made them, so each call claims its identifiers until it's done,
+// and concurrent calls for the same identifier take turns
+type ChallengeTracker struct {
+	inner http.RoundTripper
+
+	lock     sync.Mutex
+	released *sync.Cond
+	// The session that's claimed each identifier
+	sessions map[string]*challengeSession
+	// Authorization and challenge URLs, mapped to the session and identifier they're for
+	urls map[string]trackedURL
+}
+
+type trackedURL struct {
+	session *challengeSession
+	domain  string
+}
+
+// challengeSession is one call obtaining a certificate, and the failures seen for its identifiers
+type challengeSession struct {
+	domains  []string
+	urls     []string
+	failures map[string]Subproblem
+}
+
+func NewChallengeTracker(inner http.RoundTripper) *ChallengeTracker {
+	if inner == nil {
+		inner = http.DefaultTransport
+	}
+	t := &ChallengeTracker{inner: inner, sessions: map[string]*challengeSession{}, urls: map[string]trackedURL{}}
+	t.released = sync.NewCond(&t.lock)
+	return t
+}
+
+func (t *ChallengeTracker) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.inner.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		return resp, err
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	t.observe(req.URL.String(), body)
+	return resp, nil
+}
+
+// begin claims domains for a call obtaining a certificate, waiting for any other call using them to finish first
+func (t *ChallengeTracker) begin(domains []string) *challengeSession {
+	if t == nil {
+		return nil
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for t.anyClaimedLocked(domains) {
+		t.released.Wait()
+	}
+	s := &challengeSession{domains: domains, failures: map[string]Subproblem{}}
+	for _, domain := range domains {
+		t.sessions[domain] = s
+	}
+	return s
+}
+
+func (t *ChallengeTracker) anyClaimedLocked(domains []string) bool {
+	for _, domain := range domains {
+		if _, ok := t.sessions[domain]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// end releases a session's domains, returning the failures seen for them
+func (t *ChallengeTracker) end(s *challengeSession) []Subproblem {
+	if t == nil || s == nil {
+		return nil
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for _, domain := range s.domains {
+		if t.sessions[domain] == s {
+			delete(t.sessions, domain)
+		}
+	}
+	for _, url := range s.urls {
+		delete(t.urls, url)
+	}
+	t.released.Broadcast()
+
+	subs := []Subproblem{}
+	for _, sub := range s.failures {
+		subs = append(subs, sub)
+	}
+	return subs
+}
+
+// observe records what an upstream response says about an identifier's challenges, if it's an authorization or challenge
+func (t *ChallengeTracker) observe(url string, body []byte) {
+	var authz acme.Authorization
+	if json.Unmarshal(body, &authz) != nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if authz.Identifier.Value != "" {
+		domain := challenge.GetTargetedDomain(authz)
+		s, ok := t.sessions[domain]
+		if !ok {
+			return
+		}
+		t.trackURLLocked(s, url, domain)
+		for _, chall := range authz.Challenges {
+			t.trackURLLocked(s, chall.URL, domain)
+			if chall.Error != nil {
+				s.record(domain, chall.Error.Type, chall.Error.Detail)
+			}
+		}
+		return
+	}
+
+	var chall acme.Challenge
+	if json.Unmarshal(body, &chall) != nil || chall.Error == nil {
+		return
+	}
+	if tracked, ok := t.urls[url]; ok {
+		tracked.session.record(tracked.domain, chall.Error.Type, chall.Error.Detail)
+	}
+}
+
+func (t *ChallengeTracker) trackURLLocked(s *challengeSession, url string, domain string) {
+	if _, ok := t.urls[url]; !ok {
+		s.urls = append(s.urls, url)
+	}
+	t.urls[url] = trackedURL{session: s, domain: domain}
+}
+
+func (s *challengeSession) record(domain string, problemType string, detail string) {
+	s.failures[domain] = Subproblem{Type: problemType, Detail: detail, Identifier: domain}
+}
+
+// WrapPreCheck records identifiers whose DNS-01 record the pre-check gave up waiting for
+func (t *ChallengeTracker) WrapPreCheck(check dns01.WrapPreCheckFunc) dns01.WrapPreCheckFunc {
+	return func(domain, fqdn, value string, next dns01.PreCheckFunc) (bool, error) {
+		ok, err := check(domain, fqdn, value, next)
+
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		s, claimed := t.sessions[domain]
+		if !claimed {
+			return ok, err
+		}
+		if err != nil {
+			s.record(domain, ProblemDNS, "The upstream DNS-01 record did not propagate in time")
+		} else if ok {
+			delete(s.failures, domain)
+		}
+		return ok, err
+	}
+}
@@ -0,0 +1,143 @@
+package issuer
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime/debug"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/acme"
+	"github.com/go-acme/lego/v4/challenge/dns01"
+)
+
+// The tracker stands in for the per-domain errors lego keeps to itself, so relies on how this version of lego
+// fetches authorizations and posts challenges. Check TestE2EUpstreamChallengeFailure still passes before changing it
+const trackedLegoVersion = "v4.14.2"
+
+func TestChallengeTrackerLegoVersion(t *testing.T) {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		t.Skip("no build info")
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == "github.com/go-acme/lego/v4" {
+			if dep.Version != trackedLegoVersion {
+				t.Fatalf("ChallengeTracker was written against lego %s, but %s is in use", trackedLegoVersion, dep.Version)
+			}
+			return
+		}
+	}
+	t.Fatal("lego isn't a dependency")
+}
+
+func TestChallengeTracker(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/authz/1":
+			json.NewEncoder(w).Encode(acme.Authorization{
+				Status:     "pending",
+				Identifier: acme.Identifier{Type: "dns", Value: "a.test"},
+				Wildcard:   true,
+				Challenges: []acme.Challenge{{Type: "dns-01", Status: "pending", URL: srv.URL + "/chall/1"}},
+			})
+		case "/chall/1":
+			json.NewEncoder(w).Encode(acme.Challenge{
+				Type:   "dns-01",
+				Status: "invalid",
+				URL:    srv.URL + "/chall/1",
+				Error:  &acme.ProblemDetails{Type: ProblemCAA, Detail: "CAA forbids issuance"},
+			})
+		case "/authz/2":
+			json.NewEncoder(w).Encode(acme.Authorization{
+				Status:     "invalid",
+				Identifier: acme.Identifier{Type: "dns", Value: "b.test"},
+				Challenges: []acme.Challenge{{Type: "dns-01", Status: "invalid", URL: srv.URL + "/chall/2", Error: &acme.ProblemDetails{Type: ProblemRejectedIdentifier}}},
+			})
+		}
+	}))
+	defer srv.Close()
+
+	tracker := NewChallengeTracker(nil)
+	client := &http.Client{Transport: tracker}
+	session := tracker.begin([]string{"*.a.test", "b.test", "c.test", "d.test"})
+	for _, path := range []string{"/authz/1", "/chall/1", "/authz/2"} {
+		resp, err := client.Post(srv.URL+path, "application/jose+json", nil)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		// The body is still there for lego to read
+		var body map[string]interface{}
+		if err = json.NewDecoder(resp.Body).Decode(&body); err != nil || body["status"] == nil {
+			t.Fatalf("response body wasn't passed on: %v %v", body, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	precheckFailed := false
+	precheck := tracker.WrapPreCheck(func(domain, fqdn, value string, check dns01.PreCheckFunc) (bool, error) {
+		if precheckFailed {
+			return false, errors.New("didn't propagate")
+		}
+		return true, nil
+	})
+	precheckFailed = true
+	precheck("c.test", "_acme-challenge.c.test.", "value", nil)
+	precheck("d.test", "_acme-challenge.d.test.", "value", nil)
+	precheckFailed = false
+	// Propagating on a later check means it didn't fail after all
+	precheck("d.test", "_acme-challenge.d.test.", "value", nil)
+
+	subs := tracker.end(session)
+	expected := map[string]string{"*.a.test": ProblemCAA, "b.test": ProblemRejectedIdentifier, "c.test": ProblemDNS}
+	if len(subs) != len(expected) {
+		t.Fatalf("expected %d failures, got %+v", len(expected), subs)
+	}
+	for _, sub := range subs {
+		if expected[sub.Identifier] != sub.Type {
+			t.Fatalf("expected %s for %s, got %+v", expected[sub.Identifier], sub.Identifier, sub)
+		}
+	}
+
+	// Failures seen once the call's over don't carry over to the next
+	resp, err := client.Post(srv.URL+"/authz/2", "application/jose+json", nil)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if subs = tracker.end(tracker.begin([]string{"b.test"})); len(subs) != 0 {
+		t.Fatalf("failures were returned to another call: %+v", subs)
+	}
+}
+
+func TestChallengeTrackerConcurrentCalls(t *testing.T) {
+	tracker := NewChallengeTracker(nil)
+	first := tracker.begin([]string{"a.test", "b.test"})
+
+	// A second call for one of the same names waits for the first to finish
+	began := make(chan *challengeSession)
+	go func() {
+		began <- tracker.begin([]string{"b.test"})
+	}()
+	select {
+	case <-began:
+		t.Fatal("second call began while the first still had its names")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	tracker.observe("https://upstream.test/authz/1", []byte(`{"status":"invalid","identifier":{"type":"dns","value":"b.test"},"challenges":[{"type":"dns-01","url":"https://upstream.test/chall/1","error":{"type":"`+ProblemCAA+`"}}]}`))
+	if subs := tracker.end(first); len(subs) != 1 || subs[0].Identifier != "b.test" {
+		t.Fatalf("expected the first call to get its failure, got %+v", subs)
+	}
+
+	second := <-began
+	if subs := tracker.end(second); len(subs) != 0 {
+		t.Fatalf("the second call got the first's failures: %+v", subs)
+	}
+}
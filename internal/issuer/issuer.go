@@ -0,0 +1,124 @@
+package issuer
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"time"
+)
+
+// The upstream issuers certificates can be obtained from, as they're named in settings
+const (
+	UpstreamIssuerACME   = "acme"
+	UpstreamIssuerVault  = "vault"
+	UpstreamIssuerStepCA = "stepca"
+)
+
+// Issuer is a backend that can sign certificates for orders that have passed validation
+type Issuer interface {
+	// ObtainForCSR returns a PEM bundle, leaf first, for the CSR
+	ObtainForCSR(req ObtainRequest) ([]byte, error)
+	// Revoke revokes a certificate previously obtained from this issuer, with an RFC5280 reason code
+	Revoke(cert *x509.Certificate, reason uint) error
+	// RenewalInfo suggests when a certificate obtained from this issuer should be renewed
+	RenewalInfo(cert *x509.Certificate, issuerCert *x509.Certificate) (*RenewalInfo, error)
+	// Health returns an error if the issuer can't currently issue
+	Health() error
+}
+
+// RateLimitedIssuer is implemented by issuers whose CA limits certificates per registered domain and per exact set of names,
+// the way Let's Encrypt does. Only certificates from these count against the rate limit budget
+type RateLimitedIssuer interface {
+	Issuer
+	LimitsIssuance() bool
+}
+
+// LimitsIssuance reports whether i's CA has Let's Encrypt style issuance limits
+func LimitsIssuance(i Issuer) bool {
+	limited, ok := i.(RateLimitedIssuer)
+	return ok && limited.LimitsIssuance()
+}
+
+// LifetimeIssuer is implemented by issuers that know how long the certificates they pick the lifetime of are valid for
+type LifetimeIssuer interface {
+	Issuer
+	DefaultLifetime() time.Duration
+}
+
+// DefaultLifetime returns the lifetime i gives certificates when the request doesn't set NotAfter, or zero if it isn't known
+func DefaultLifetime(i Issuer) time.Duration {
+	lifetime, ok := i.(LifetimeIssuer)
+	if !ok {
+		return 0
+	}
+	return lifetime.DefaultLifetime()
+}
+
+// WithDefaultLifetime declares how long i's certificates last when it picks their lifetime,
+// for upstreams that don't say themselves. i is returned as is if lifetime is zero
+func WithDefaultLifetime(i Issuer, lifetime time.Duration) Issuer {
+	if lifetime == 0 {
+		return i
+	}
+	return lifetimeIssuer{Issuer: i, lifetime: lifetime}
+}
+
+type lifetimeIssuer struct {
+	Issuer
+	lifetime time.Duration
+}
+
+func (l lifetimeIssuer) DefaultLifetime() time.Duration {
+	return l.lifetime
+}
+
+func (l lifetimeIssuer) LimitsIssuance() bool {
+	return LimitsIssuance(l.Issuer)
+}
+
+type ObtainRequest struct {
+	CSR *x509.CertificateRequest
+	// Zero values mean the issuer should pick
+	NotBefore time.Time
+	NotAfter  time.Time
+	// ID the certificate will be stored under, for issuers that keep their own records
+	CertificateID string
+}
+
+type RenewalInfo struct {
+	WindowStart    time.Time
+	WindowEnd      time.Time
+	ExplanationURL string
+}
+
+var ErrNotSupported = errors.New("not supported by this issuer")
+
+// DefaultRenewalInfo is the fallback for issuers that can't provide a renewal window:
+// the window opens 2/3 of the way through the certificate's lifetime and closes 5/6 of the way through
+func DefaultRenewalInfo(cert *x509.Certificate) *RenewalInfo {
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	return &RenewalInfo{
+		WindowStart: cert.NotBefore.Add(lifetime * 2 / 3),
+		WindowEnd:   cert.NotBefore.Add(lifetime * 5 / 6),
+	}
+}
+
+// PEMBundle joins PEM certificates into a single bundle, making sure each ends with a newline
+func PEMBundle(certs ...string) []byte {
+	bundle := []byte{}
+	for _, cert := range certs {
+		if cert == "" {
+			continue
+		}
+		bundle = append(bundle, []byte(cert)...)
+		if bundle[len(bundle)-1] != '\n' {
+			bundle = append(bundle, '\n')
+		}
+	}
+	return bundle
+}
+
+// CSRToPEM encodes a parsed CSR back into PEM, for issuers with PEM-based APIs
+func CSRToPEM(csr *x509.CertificateRequest) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr.Raw}))
+}
@@ -0,0 +1,127 @@
+package issuer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// testCA stands in for whatever CA sits behind the stand-in API servers
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate ca key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatalf("failed to create ca cert: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse ca cert: %v", err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) pem() string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}))
+}
+
+func (ca *testCA) sign(t *testing.T, csrPEM string, notAfter time.Time) string {
+	block, _ := pem.Decode([]byte(csrPEM))
+	if block == nil {
+		t.Fatalf("csr was not PEM")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		t.Fatalf("failed to parse csr: %v", err)
+	}
+	if notAfter.IsZero() {
+		notAfter = time.Now().Add(time.Hour)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(0x1234),
+		Subject:      csr.Subject,
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     notAfter,
+	}, ca.cert, csr.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("failed to sign: %v", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func newTestCSR(t *testing.T, names ...string) *x509.CertificateRequest {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: names[0]},
+		DNSNames: names,
+	}, key)
+	if err != nil {
+		t.Fatalf("failed to create csr: %v", err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatalf("failed to parse csr: %v", err)
+	}
+	return csr
+}
+
+// checkBundle parses a bundle and checks it's the leaf for name followed by the CA
+func checkBundle(t *testing.T, bundle []byte, ca *testCA, name string) *x509.Certificate {
+	leafBlock, rest := pem.Decode(bundle)
+	if leafBlock == nil {
+		t.Fatalf("bundle didn't contain a leaf")
+	}
+	caBlock, _ := pem.Decode(rest)
+	if caBlock == nil {
+		t.Fatalf("bundle didn't contain the CA")
+	}
+
+	leaf, err := x509.ParseCertificate(leafBlock.Bytes)
+	if err != nil {
+		t.Fatalf("failed to parse leaf: %v", err)
+	}
+	if len(leaf.DNSNames) != 1 || leaf.DNSNames[0] != name {
+		t.Fatalf("leaf had names %v, expected %s", leaf.DNSNames, name)
+	}
+	if err = leaf.CheckSignatureFrom(ca.cert); err != nil {
+		t.Fatalf("leaf not signed by ca: %v", err)
+	}
+	if string(caBlock.Bytes) != string(ca.cert.Raw) {
+		t.Fatalf("second cert in bundle was not the ca")
+	}
+	return leaf
+}
+
+func TestDefaultRenewalInfo(t *testing.T) {
+	start := time.Now()
+	info := DefaultRenewalInfo(&x509.Certificate{NotBefore: start, NotAfter: start.Add(90 * time.Hour)})
+	if !info.WindowStart.Equal(start.Add(60*time.Hour)) || !info.WindowEnd.Equal(start.Add(75*time.Hour)) {
+		t.Fatalf("unexpected renewal window %s - %s", info.WindowStart, info.WindowEnd)
+	}
+}
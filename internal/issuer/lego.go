@@ -0,0 +1,152 @@
+package issuer
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-acme/lego/v4/acme"
+	"github.com/go-acme/lego/v4/acme/api"
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/go-acme/lego/v4/lego"
+)
+
+// LegoIssuer obtains certificates from an upstream ACME CA, completing DNS-01 challenges with whichever provider the client was set up with
+type LegoIssuer struct {
+	client       *lego.Client
+	directoryURL string
+	httpClient   *http.Client
+	retryAfter   *RetryAfterTracker
+	challenges   *ChallengeTracker
+}
+
+// NewLegoIssuer wraps a lego client. If retryAfter was installed as the client's transport, upstream Retry-After headers are passed on in Problems.
+// Likewise if challenges was installed in the transport and DNS-01 pre-check, challenge failures are passed on as Subproblems
+func NewLegoIssuer(client *lego.Client, directoryURL string, retryAfter *RetryAfterTracker, challenges *ChallengeTracker) *LegoIssuer {
+	return &LegoIssuer{
+		client:       client,
+		directoryURL: directoryURL,
+		httpClient:   &http.Client{Timeout: 30 * time.Second},
+		retryAfter:   retryAfter,
+		challenges:   challenges,
+	}
+}
+
+func (l *LegoIssuer) ObtainForCSR(req ObtainRequest) ([]byte, error) {
+	// Only failures seen while obtaining this certificate are passed on
+	session := l.challenges.begin(certcrypto.ExtractDomainsCSR(req.CSR))
+	obtainResult, err := l.client.Certificate.ObtainForCSR(certificate.ObtainForCSRRequest{
+		CSR:       req.CSR,
+		NotBefore: req.NotBefore,
+		NotAfter:  req.NotAfter,
+		Bundle:    true,
+		// TODO what to do with the other params in this struct?
+	})
+	subs := l.challenges.end(session)
+	if err != nil {
+		return nil, l.toProblem(err, subs)
+	}
+	return obtainResult.Certificate, nil
+}
+
+// toProblem turns lego errors carrying ACME problems into a Problem, returning anything else unchanged.
+// Challenge failures, which lego doesn't return in a usable form, come from the challenge tracker as subs
+func (l *LegoIssuer) toProblem(err error, subs []Subproblem) error {
+	if len(subs) > 0 {
+		prob := &Problem{
+			Type:        ProblemCompound,
+			Detail:      fmt.Sprintf("Upstream validation failed for %d identifiers", len(subs)),
+			Status:      http.StatusForbidden,
+			Subproblems: subs,
+		}
+		sort.Slice(prob.Subproblems, func(i, j int) bool {
+			return prob.Subproblems[i].Identifier < prob.Subproblems[j].Identifier
+		})
+		if len(prob.Subproblems) == 1 {
+			prob.Type = prob.Subproblems[0].Type
+			prob.Detail = fmt.Sprintf("Upstream validation failed for %s", prob.Subproblems[0].Identifier)
+		}
+		return prob
+	}
+
+	var acmeProb *acme.ProblemDetails
+	if errors.As(err, &acmeProb) {
+		prob := &Problem{
+			Type:       acmeProb.Type,
+			Detail:     acmeProb.Detail,
+			Status:     acmeProb.HTTPStatus,
+			RetryAfter: l.retryAfter.take(acmeProb.URL),
+		}
+		for _, sub := range acmeProb.SubProblems {
+			prob.Subproblems = append(prob.Subproblems, Subproblem{
+				Type:       sub.Type,
+				Detail:     sub.Detail,
+				Identifier: sub.Identifier.Value,
+			})
+		}
+		return prob
+	}
+
+	return err
+}
+
+// LimitsIssuance is true as public ACME CAs limit issuance, and the budget doesn't get in the way of private ones that don't
+func (l *LegoIssuer) LimitsIssuance() bool {
+	return true
+}
+
+func (l *LegoIssuer) Revoke(cert *x509.Certificate, reason uint) error {
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	return l.client.Certificate.RevokeWithReason(certPEM, &reason)
+}
+
+func (l *LegoIssuer) RenewalInfo(cert *x509.Certificate, issuerCert *x509.Certificate) (*RenewalInfo, error) {
+	info, err := l.client.Certificate.GetRenewalInfo(certificate.RenewalInfoRequest{
+		Cert:     cert,
+		Issuer:   issuerCert,
+		HashName: "SHA-256",
+	})
+	if err != nil {
+		if errors.Is(err, api.ErrNoARI) {
+			return DefaultRenewalInfo(cert), nil
+		}
+		return nil, err
+	}
+
+	return &RenewalInfo{
+		WindowStart:    info.SuggestedWindow.Start,
+		WindowEnd:      info.SuggestedWindow.End,
+		ExplanationURL: info.ExplanationURL,
+	}, nil
+}
+
+func (l *LegoIssuer) Health() error {
+	resp, err := l.httpClient.Get(l.directoryURL)
+	if err != nil {
+		return fmt.Errorf("failed to reach ACME directory: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("ACME directory returned status %d", resp.StatusCode)
+	}
+
+	var directory struct {
+		NewNonce string `json:"newNonce"`
+		NewOrder string `json:"newOrder"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&directory)
+	if err != nil {
+		return fmt.Errorf("ACME directory was not valid JSON: %v", err)
+	}
+	if directory.NewNonce == "" || directory.NewOrder == "" {
+		return errors.New("ACME directory is missing newNonce or newOrder")
+	}
+	return nil
+}
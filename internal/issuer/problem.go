@@ -0,0 +1,115 @@
+package issuer
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	problemNS = "urn:ietf:params:acme:error:"
+
+	ProblemRateLimited           = problemNS + "rateLimited"
+	ProblemCAA                   = problemNS + "caa"
+	ProblemRejectedIdentifier    = problemNS + "rejectedIdentifier"
+	ProblemUnsupportedIdentifier = problemNS + "unsupportedIdentifier"
+	ProblemBadCSR                = problemNS + "badCSR"
+	ProblemDNS                   = problemNS + "dns"
+	ProblemServerInternal        = problemNS + "serverInternal"
+	ProblemCompound              = problemNS + "compound"
+)
+
+// Problem is a failure the upstream described with an ACME problem type, which may be worth passing on to the client
+type Problem struct {
+	Type        string
+	Detail      string
+	Status      int
+	Subproblems []Subproblem
+	// Zero if the upstream didn't say
+	RetryAfter time.Time
+}
+
+// Subproblem is a problem with a single DNS identifier
+type Subproblem struct {
+	Type       string
+	Detail     string
+	Identifier string
+}
+
+func (p *Problem) Error() string {
+	msg := fmt.Sprintf("upstream problem %s: %s", p.Type, p.Detail)
+	for _, sub := range p.Subproblems {
+		msg += fmt.Sprintf(", %s (%s): %s", sub.Identifier, sub.Type, sub.Detail)
+	}
+	return msg
+}
+
+// parseRetryAfter handles both forms of Retry-After, returning zero if it's missing or invalid
+func parseRetryAfter(value string, now time.Time) time.Time {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return now.Add(time.Duration(seconds) * time.Second)
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return t
+	}
+	return time.Time{}
+}
+
+// RetryAfterTracker is a http.RoundTripper that remembers Retry-After headers on error responses.
+// lego doesn't expose response headers alongside its errors, but does record the URL they came from
+type RetryAfterTracker struct {
+	inner http.RoundTripper
+
+	lock  sync.Mutex
+	byURL map[string]time.Time
+}
+
+func NewRetryAfterTracker(inner http.RoundTripper) *RetryAfterTracker {
+	if inner == nil {
+		inner = http.DefaultTransport
+	}
+	return &RetryAfterTracker{inner: inner, byURL: map[string]time.Time{}}
+}
+
+func (t *RetryAfterTracker) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.inner.RoundTrip(req)
+	if err != nil || resp.StatusCode < 400 {
+		return resp, err
+	}
+
+	now := time.Now()
+	if retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"), now); !retryAfter.IsZero() {
+		t.lock.Lock()
+		for url, seen := range t.byURL {
+			if seen.Before(now) {
+				delete(t.byURL, url)
+			}
+		}
+		t.byURL[req.URL.String()] = retryAfter
+		t.lock.Unlock()
+	}
+	return resp, err
+}
+
+// take returns and forgets the Retry-After last seen from url, if it hasn't already passed
+func (t *RetryAfterTracker) take(url string) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	retryAfter, ok := t.byURL[url]
+	delete(t.byURL, url)
+	if !ok || retryAfter.Before(time.Now()) {
+		return time.Time{}
+	}
+	return retryAfter
+}
@@ -0,0 +1,125 @@
+package issuer
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/acme"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		value string
+		want  time.Time
+	}{
+		{value: "120", want: now.Add(2 * time.Minute)},
+		{value: " 0 ", want: now},
+		{value: "Thu, 01 Jan 2026 01:00:00 GMT", want: now.Add(time.Hour)},
+		{value: ""},
+		{value: "-5"},
+		{value: "soon"},
+	}
+
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.value, now); !got.Equal(tt.want) {
+			t.Errorf("parseRetryAfter(%q) = %s, expected %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestRetryAfterTracker(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "60")
+		if r.URL.Path == "/ok" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	tracker := NewRetryAfterTracker(nil)
+	client := &http.Client{Transport: tracker}
+	for _, path := range []string{"/ok", "/limited"} {
+		resp, err := client.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	if got := tracker.take(srv.URL + "/ok"); !got.IsZero() {
+		t.Fatalf("Retry-After on a successful response was recorded: %s", got)
+	}
+	got := tracker.take(srv.URL + "/limited")
+	if wait := time.Until(got); wait < 50*time.Second || wait > time.Minute {
+		t.Fatalf("expected Retry-After about a minute away, got %s", got)
+	}
+	if got := tracker.take(srv.URL + "/limited"); !got.IsZero() {
+		t.Fatal("Retry-After was returned twice")
+	}
+
+	var nilTracker *RetryAfterTracker
+	if !nilTracker.take("anything").IsZero() {
+		t.Fatal("nil tracker returned a Retry-After")
+	}
+}
+
+func TestLegoProblems(t *testing.T) {
+	l := NewLegoIssuer(nil, "", nil, NewChallengeTracker(nil))
+
+	var prob *Problem
+	subs := []Subproblem{{Type: ProblemCAA, Identifier: "b.test"}}
+	if !errors.As(l.toProblem(errors.New("one or more domains had a problem"), subs), &prob) {
+		t.Fatal("single domain failure wasn't converted to a problem")
+	}
+	if prob.Type != ProblemCAA || len(prob.Subproblems) != 1 || prob.Subproblems[0].Identifier != "b.test" {
+		t.Fatalf("unexpected problem for a single domain %+v", prob)
+	}
+
+	subs = []Subproblem{{Type: ProblemCAA, Identifier: "b.test"}, {Type: ProblemDNS, Identifier: "a.test"}}
+	if !errors.As(l.toProblem(errors.New("one or more domains had a problem"), subs), &prob) {
+		t.Fatal("multiple domain failure wasn't converted to a problem")
+	}
+	if prob.Type != ProblemCompound || len(prob.Subproblems) != 2 || prob.Subproblems[0].Identifier != "a.test" {
+		t.Fatalf("expected a compound problem with two sorted subproblems, got %+v", prob)
+	}
+
+	wrapped := fmt.Errorf("finalize: %w", &acme.ProblemDetails{Type: ProblemRateLimited, Detail: "slow down", HTTPStatus: http.StatusTooManyRequests})
+	if !errors.As(l.toProblem(wrapped, nil), &prob) || prob.Type != ProblemRateLimited || prob.Detail != "slow down" {
+		t.Fatalf("expected wrapped ACME problem to be passed through, got %+v", prob)
+	}
+
+	other := errors.New("connection refused")
+	if l.toProblem(other, nil) != other {
+		t.Fatal("error without a problem was changed")
+	}
+}
+
+func TestVaultRateLimited(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	v, err := NewVaultIssuer(VaultConfig{Addr: srv.URL, Token: testVaultToken, Role: "internal"})
+	if err != nil {
+		t.Fatalf("failed to create vault issuer: %v", err)
+	}
+
+	_, err = v.ObtainForCSR(ObtainRequest{CSR: newTestCSR(t, "wiki.internal.example.com")})
+	var prob *Problem
+	if !errors.As(err, &prob) || prob.Type != ProblemRateLimited {
+		t.Fatalf("expected a rateLimited problem, got %v", err)
+	}
+	if wait := time.Until(prob.RetryAfter); wait < 20*time.Second || wait > 30*time.Second {
+		t.Fatalf("expected Retry-After about 30s away, got %s", prob.RetryAfter)
+	}
+}
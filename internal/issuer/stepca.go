@@ -0,0 +1,261 @@
+package issuer
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+	"github.com/google/uuid"
+)
+
+const stepCATokenLifetime = 5 * time.Minute
+
+type StepCAConfig struct {
+	// URL of the CA, e.g. https://ca.internal.example.com
+	URL string
+	// Name of the JWK provisioner tokens are issued for
+	ProvisionerName string
+	// Private key of the JWK provisioner, see LoadStepCAProvisionerKey
+	ProvisionerKey *jose.JSONWebKey
+	// Optional, system roots are used if nil
+	RootCAs *x509.CertPool
+}
+
+// StepCAIssuer signs certificates with a step-ca-compatible CA, authenticating with one-time tokens from a JWK provisioner
+type StepCAIssuer struct {
+	conf       StepCAConfig
+	signer     jose.Signer
+	httpClient *http.Client
+}
+
+// LoadStepCAProvisionerKey parses a provisioner private key as written by `step crypto jwk create`.
+// If password is set, the key is expected to be a JWE encrypted with it (step's default)
+func LoadStepCAProvisionerKey(data []byte, password string) (*jose.JSONWebKey, error) {
+	if password != "" {
+		encrypted, err := jose.ParseEncrypted(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse encrypted provisioner key: %v", err)
+		}
+		data, err = encrypted.Decrypt([]byte(password))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt provisioner key: %v", err)
+		}
+	}
+
+	var key jose.JSONWebKey
+	err := json.Unmarshal(data, &key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse provisioner key: %v", err)
+	}
+	if key.IsPublic() {
+		return nil, errors.New("provisioner key is a public key, a private key is required")
+	}
+	return &key, nil
+}
+
+func NewStepCAIssuer(conf StepCAConfig) (*StepCAIssuer, error) {
+	if conf.URL == "" || conf.ProvisionerName == "" || conf.ProvisionerKey == nil {
+		return nil, errors.New("step-ca issuer requires a URL, provisioner name and provisioner key")
+	}
+	conf.URL = strings.TrimSuffix(conf.URL, "/")
+
+	alg := jose.SignatureAlgorithm(conf.ProvisionerKey.Algorithm)
+	if alg == "" {
+		alg = jose.ES256
+	}
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: alg, Key: conf.ProvisionerKey},
+		(&jose.SignerOptions{}).WithType("JWT"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create signer from provisioner key: %v", err)
+	}
+
+	return &StepCAIssuer{
+		conf:   conf,
+		signer: signer,
+		httpClient: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: conf.RootCAs},
+			},
+		},
+	}, nil
+}
+
+type stepCATokenClaims struct {
+	jwt.Claims
+	SANs []string `json:"sans,omitempty"`
+}
+
+func (s *StepCAIssuer) token(subject string, path string, sans []string) (string, error) {
+	now := time.Now()
+	claims := stepCATokenClaims{
+		Claims: jwt.Claims{
+			ID:        uuid.NewString(),
+			Issuer:    s.conf.ProvisionerName,
+			Subject:   subject,
+			Audience:  jwt.Audience{s.conf.URL + path},
+			NotBefore: jwt.NewNumericDate(now),
+			IssuedAt:  jwt.NewNumericDate(now),
+			Expiry:    jwt.NewNumericDate(now.Add(stepCATokenLifetime)),
+		},
+		SANs: sans,
+	}
+	return jwt.Signed(s.signer).Claims(claims).CompactSerialize()
+}
+
+type stepCASignRequest struct {
+	CSR       string `json:"csr"`
+	OTT       string `json:"ott"`
+	NotBefore string `json:"notBefore,omitempty"`
+	NotAfter  string `json:"notAfter,omitempty"`
+}
+
+type stepCASignResponse struct {
+	Certificate string   `json:"crt"`
+	CA          string   `json:"ca"`
+	CertChain   []string `json:"certChain"`
+}
+
+type stepCARevokeRequest struct {
+	Serial     string `json:"serial"`
+	OTT        string `json:"ott"`
+	ReasonCode uint   `json:"reasonCode"`
+	Passive    bool   `json:"passive"`
+}
+
+type stepCAErrorResponse struct {
+	Message string `json:"message"`
+}
+
+func (s *StepCAIssuer) do(method string, path string, body interface{}, out interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequest(method, s.conf.URL+path, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("step-ca request to %s failed: %v", path, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("failed to read step-ca response from %s: %v", path, err)
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return &Problem{
+			Type:       ProblemRateLimited,
+			Detail:     fmt.Sprintf("step-ca is rate limiting requests to %s", path),
+			Status:     http.StatusTooManyRequests,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var stepErr stepCAErrorResponse
+		if json.Unmarshal(respBody, &stepErr) == nil && stepErr.Message != "" {
+			return fmt.Errorf("step-ca returned status %d from %s: %s", resp.StatusCode, path, stepErr.Message)
+		}
+		return fmt.Errorf("step-ca returned status %d from %s", resp.StatusCode, path)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(respBody, out)
+}
+
+func (s *StepCAIssuer) ObtainForCSR(req ObtainRequest) ([]byte, error) {
+	subject := req.CSR.Subject.CommonName
+	if subject == "" && len(req.CSR.DNSNames) > 0 {
+		subject = req.CSR.DNSNames[0]
+	}
+
+	ott, err := s.token(subject, "/1.0/sign", req.CSR.DNSNames)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create step-ca token: %v", err)
+	}
+
+	signReq := stepCASignRequest{
+		CSR: CSRToPEM(req.CSR),
+		OTT: ott,
+	}
+	if !req.NotBefore.IsZero() {
+		signReq.NotBefore = req.NotBefore.UTC().Format(time.RFC3339)
+	}
+	if !req.NotAfter.IsZero() {
+		signReq.NotAfter = req.NotAfter.UTC().Format(time.RFC3339)
+	}
+
+	var signResp stepCASignResponse
+	err = s.do(http.MethodPost, "/1.0/sign", signReq, &signResp)
+	if err != nil {
+		return nil, err
+	}
+
+	// certChain includes the leaf, ca/crt are kept for older versions
+	if len(signResp.CertChain) > 0 {
+		return PEMBundle(signResp.CertChain...), nil
+	}
+	if signResp.Certificate == "" {
+		return nil, errors.New("step-ca sign response did not contain a certificate")
+	}
+	return PEMBundle(signResp.Certificate, signResp.CA), nil
+}
+
+func (s *StepCAIssuer) Revoke(cert *x509.Certificate, reason uint) error {
+	serial := cert.SerialNumber.String()
+	ott, err := s.token(serial, "/1.0/revoke", nil)
+	if err != nil {
+		return fmt.Errorf("failed to create step-ca token: %v", err)
+	}
+
+	return s.do(http.MethodPost, "/1.0/revoke", stepCARevokeRequest{
+		Serial:     serial,
+		OTT:        ott,
+		ReasonCode: reason,
+		Passive:    true,
+	}, nil)
+}
+
+func (s *StepCAIssuer) RenewalInfo(cert *x509.Certificate, issuerCert *x509.Certificate) (*RenewalInfo, error) {
+	return DefaultRenewalInfo(cert), nil
+}
+
+func (s *StepCAIssuer) Health() error {
+	var health struct {
+		Status string `json:"status"`
+	}
+	err := s.do(http.MethodGet, "/health", nil, &health)
+	if err != nil {
+		return err
+	}
+	if health.Status != "ok" {
+		return fmt.Errorf("step-ca health status was %q", health.Status)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package issuer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+)
+
+const testProvisioner = "acmespider"
+
+// newStepCAStandIn serves the subset of step-ca's API that StepCAIssuer uses, checking tokens against the provisioner's public key
+func newStepCAStandIn(t *testing.T, ca *testCA, provisionerKey jose.JSONWebKey) (*httptest.Server, *[]stepCARevokeRequest) {
+	revoked := []stepCARevokeRequest{}
+	mux := http.NewServeMux()
+	var srv *httptest.Server
+
+	checkToken := func(w http.ResponseWriter, ott string, path string) *stepCATokenClaims {
+		tok, err := jwt.ParseSigned(ott)
+		if err != nil || len(tok.Headers) != 1 || tok.Headers[0].KeyID != provisionerKey.KeyID {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(stepCAErrorResponse{Message: "bad token"})
+			return nil
+		}
+		var claims stepCATokenClaims
+		if err = tok.Claims(provisionerKey.Public(), &claims); err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(stepCAErrorResponse{Message: "bad token signature"})
+			return nil
+		}
+		err = claims.Validate(jwt.Expected{Issuer: testProvisioner, Audience: jwt.Audience{srv.URL + path}, Time: time.Now()})
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(stepCAErrorResponse{Message: err.Error()})
+			return nil
+		}
+		return &claims
+	}
+
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":"ok"}`))
+	})
+	mux.HandleFunc("/1.0/sign", func(w http.ResponseWriter, r *http.Request) {
+		var req stepCASignRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		claims := checkToken(w, req.OTT, "/1.0/sign")
+		if claims == nil {
+			return
+		}
+		if len(claims.SANs) != 1 || claims.SANs[0] != claims.Subject {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var notAfter time.Time
+		if req.NotAfter != "" {
+			notAfter, _ = time.Parse(time.RFC3339, req.NotAfter)
+		}
+		crt := ca.sign(t, req.CSR, notAfter)
+		json.NewEncoder(w).Encode(stepCASignResponse{
+			Certificate: crt,
+			CA:          ca.pem(),
+			CertChain:   []string{crt, ca.pem()},
+		})
+	})
+	mux.HandleFunc("/1.0/revoke", func(w http.ResponseWriter, r *http.Request) {
+		var req stepCARevokeRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		claims := checkToken(w, req.OTT, "/1.0/revoke")
+		if claims == nil {
+			return
+		}
+		if claims.Subject != req.Serial {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		revoked = append(revoked, req)
+		w.Write([]byte(`{"status":"ok"}`))
+	})
+
+	srv = httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv, &revoked
+}
+
+func TestStepCAIssuer(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate provisioner key: %v", err)
+	}
+	provisionerKey := jose.JSONWebKey{Key: ecKey, KeyID: "provisioner-kid", Algorithm: string(jose.ES256)}
+
+	// Round trip through the same encrypted format step uses on disk
+	keyJSON, _ := provisionerKey.MarshalJSON()
+	encrypter, err := jose.NewEncrypter(jose.A128GCM, jose.Recipient{Algorithm: jose.PBES2_HS256_A128KW, Key: []byte("hunter2")}, nil)
+	if err != nil {
+		t.Fatalf("failed to create encrypter: %v", err)
+	}
+	encrypted, _ := encrypter.Encrypt(keyJSON)
+	serialised, _ := encrypted.CompactSerialize()
+	loadedKey, err := LoadStepCAProvisionerKey([]byte(serialised), "hunter2")
+	if err != nil {
+		t.Fatalf("failed to load encrypted provisioner key: %v", err)
+	}
+
+	ca := newTestCA(t)
+	srv, revoked := newStepCAStandIn(t, ca, provisionerKey)
+
+	s, err := NewStepCAIssuer(StepCAConfig{
+		URL:             srv.URL,
+		ProvisionerName: testProvisioner,
+		ProvisionerKey:  loadedKey,
+	})
+	if err != nil {
+		t.Fatalf("failed to create step-ca issuer: %v", err)
+	}
+
+	if err = s.Health(); err != nil {
+		t.Fatalf("step-ca issuer unhealthy: %v", err)
+	}
+
+	notAfter := time.Now().Add(2 * time.Hour).Truncate(time.Second)
+	bundle, err := s.ObtainForCSR(ObtainRequest{CSR: newTestCSR(t, "wiki.internal.example.com"), NotAfter: notAfter})
+	if err != nil {
+		t.Fatalf("failed to obtain: %v", err)
+	}
+	leaf := checkBundle(t, bundle, ca, "wiki.internal.example.com")
+	if !leaf.NotAfter.Equal(notAfter) {
+		t.Fatalf("notAfter was %s, expected %s", leaf.NotAfter, notAfter)
+	}
+
+	if err = s.Revoke(leaf, 1); err != nil {
+		t.Fatalf("failed to revoke: %v", err)
+	}
+	if len(*revoked) != 1 || (*revoked)[0].Serial != "4660" || (*revoked)[0].ReasonCode != 1 {
+		t.Fatalf("unexpected revocations %v", *revoked)
+	}
+
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	wrongKey, _ := NewStepCAIssuer(StepCAConfig{
+		URL:             srv.URL,
+		ProvisionerName: testProvisioner,
+		ProvisionerKey:  &jose.JSONWebKey{Key: otherKey, KeyID: "provisioner-kid", Algorithm: string(jose.ES256)},
+	})
+	_, err = wrongKey.ObtainForCSR(ObtainRequest{CSR: newTestCSR(t, "wiki.internal.example.com")})
+	if err == nil {
+		t.Fatal("step-ca stand-in accepted a token signed by the wrong key")
+	}
+}
@@ -0,0 +1,197 @@
+package issuer
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Vault's sign endpoint can only set NotBefore relative to now, so anything further out than this is rejected
+const vaultNotBeforeTolerance = time.Minute
+
+type VaultConfig struct {
+	// Address of the Vault server, e.g. https://vault.internal.example.com:8200
+	Addr  string
+	Token string
+	// Mount path of the PKI secrets engine, defaults to "pki"
+	Mount string
+	// Role to sign with
+	Role string
+	// Optional, system roots are used if nil
+	RootCAs *x509.CertPool
+}
+
+// VaultIssuer signs certificates with a Vault-compatible PKI secrets engine
+type VaultIssuer struct {
+	conf       VaultConfig
+	httpClient *http.Client
+}
+
+func NewVaultIssuer(conf VaultConfig) (*VaultIssuer, error) {
+	if conf.Addr == "" || conf.Role == "" {
+		return nil, errors.New("vault issuer requires an address and a role")
+	}
+	if conf.Mount == "" {
+		conf.Mount = "pki"
+	}
+	conf.Addr = strings.TrimSuffix(conf.Addr, "/")
+	conf.Mount = strings.Trim(conf.Mount, "/")
+
+	return &VaultIssuer{
+		conf: conf,
+		httpClient: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: conf.RootCAs},
+			},
+		},
+	}, nil
+}
+
+type vaultSignRequest struct {
+	CSR      string `json:"csr"`
+	NotAfter string `json:"not_after,omitempty"`
+}
+
+type vaultSignResponse struct {
+	Data struct {
+		Certificate string   `json:"certificate"`
+		IssuingCA   string   `json:"issuing_ca"`
+		CAChain     []string `json:"ca_chain"`
+	} `json:"data"`
+}
+
+type vaultRevokeRequest struct {
+	SerialNumber string `json:"serial_number"`
+}
+
+type vaultErrorResponse struct {
+	Errors []string `json:"errors"`
+}
+
+func (v *VaultIssuer) do(method string, path string, body interface{}, out interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequest(method, v.conf.Addr+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", v.conf.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := v.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("vault request to %s failed: %v", path, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("failed to read vault response from %s: %v", path, err)
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return &Problem{
+			Type:       ProblemRateLimited,
+			Detail:     fmt.Sprintf("Vault is rate limiting requests to %s", path),
+			Status:     http.StatusTooManyRequests,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var vaultErr vaultErrorResponse
+		if json.Unmarshal(respBody, &vaultErr) == nil && len(vaultErr.Errors) > 0 {
+			return fmt.Errorf("vault returned status %d from %s: %s", resp.StatusCode, path, strings.Join(vaultErr.Errors, "; "))
+		}
+		return fmt.Errorf("vault returned status %d from %s", resp.StatusCode, path)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(respBody, out)
+}
+
+func (v *VaultIssuer) ObtainForCSR(req ObtainRequest) ([]byte, error) {
+	if !req.NotBefore.IsZero() && req.NotBefore.After(time.Now().Add(vaultNotBeforeTolerance)) {
+		return nil, errors.New("vault issuer can't honour a notBefore in the future")
+	}
+
+	signReq := vaultSignRequest{
+		CSR: CSRToPEM(req.CSR),
+	}
+	if !req.NotAfter.IsZero() {
+		signReq.NotAfter = req.NotAfter.UTC().Format(time.RFC3339)
+	}
+
+	var signResp vaultSignResponse
+	err := v.do(http.MethodPost, "/v1/"+v.conf.Mount+"/sign/"+v.conf.Role, signReq, &signResp)
+	if err != nil {
+		return nil, err
+	}
+	if signResp.Data.Certificate == "" {
+		return nil, errors.New("vault sign response did not contain a certificate")
+	}
+
+	// ca_chain is only returned by newer versions, and includes the issuing CA
+	if len(signResp.Data.CAChain) > 0 {
+		return PEMBundle(append([]string{signResp.Data.Certificate}, signResp.Data.CAChain...)...), nil
+	}
+	return PEMBundle(signResp.Data.Certificate, signResp.Data.IssuingCA), nil
+}
+
+// Revoke revokes by serial. Vault doesn't record revocation reasons, so reason is ignored
+func (v *VaultIssuer) Revoke(cert *x509.Certificate, reason uint) error {
+	return v.do(http.MethodPost, "/v1/"+v.conf.Mount+"/revoke", vaultRevokeRequest{
+		SerialNumber: vaultSerial(cert),
+	}, nil)
+}
+
+func (v *VaultIssuer) RenewalInfo(cert *x509.Certificate, issuerCert *x509.Certificate) (*RenewalInfo, error) {
+	return DefaultRenewalInfo(cert), nil
+}
+
+func (v *VaultIssuer) Health() error {
+	// standbyok has standbys answer 200 rather than 429, which is fine for our purposes as they forward requests.
+	// Anything else, sealed or uninitialised included, is unhealthy
+	req, err := http.NewRequest(http.MethodGet, v.conf.Addr+"/v1/sys/health?standbyok=true", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := v.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach vault: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("vault health returned status %d", resp.StatusCode)
+	}
+
+	return v.do(http.MethodGet, "/v1/"+v.conf.Mount+"/roles/"+v.conf.Role, nil, nil)
+}
+
+// vaultSerial formats a serial the way Vault does, as colon-separated hex bytes
+func vaultSerial(cert *x509.Certificate) string {
+	serialBytes := cert.SerialNumber.Bytes()
+	parts := make([]string, len(serialBytes))
+	for i, b := range serialBytes {
+		parts[i] = fmt.Sprintf("%02x", b)
+	}
+	return strings.Join(parts, ":")
+}
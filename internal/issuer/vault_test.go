@@ -0,0 +1,112 @@
+package issuer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const testVaultToken = "s.testtoken"
+
+// newVaultStandIn serves the subset of Vault's API that VaultIssuer uses
+func newVaultStandIn(t *testing.T, ca *testCA) (*httptest.Server, *[]string) {
+	revoked := []string{}
+	mux := http.NewServeMux()
+
+	requireToken := func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Header.Get("X-Vault-Token") != testVaultToken {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(vaultErrorResponse{Errors: []string{"permission denied"}})
+			return false
+		}
+		return true
+	}
+
+	mux.HandleFunc("/v1/sys/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/v1/pki/roles/internal", func(w http.ResponseWriter, r *http.Request) {
+		if requireToken(w, r) {
+			w.Write([]byte(`{"data":{}}`))
+		}
+	})
+	mux.HandleFunc("/v1/pki/sign/internal", func(w http.ResponseWriter, r *http.Request) {
+		if !requireToken(w, r) {
+			return
+		}
+		var req vaultSignRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var notAfter time.Time
+		if req.NotAfter != "" {
+			notAfter, _ = time.Parse(time.RFC3339, req.NotAfter)
+		}
+
+		var resp vaultSignResponse
+		resp.Data.Certificate = ca.sign(t, req.CSR, notAfter)
+		resp.Data.IssuingCA = ca.pem()
+		json.NewEncoder(w).Encode(resp)
+	})
+	mux.HandleFunc("/v1/pki/revoke", func(w http.ResponseWriter, r *http.Request) {
+		if !requireToken(w, r) {
+			return
+		}
+		var req vaultRevokeRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		revoked = append(revoked, req.SerialNumber)
+		w.Write([]byte(`{"data":{}}`))
+	})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv, &revoked
+}
+
+func TestVaultIssuer(t *testing.T) {
+	ca := newTestCA(t)
+	srv, revoked := newVaultStandIn(t, ca)
+
+	v, err := NewVaultIssuer(VaultConfig{
+		Addr:  srv.URL,
+		Token: testVaultToken,
+		Role:  "internal",
+	})
+	if err != nil {
+		t.Fatalf("failed to create vault issuer: %v", err)
+	}
+
+	if err = v.Health(); err != nil {
+		t.Fatalf("vault issuer unhealthy: %v", err)
+	}
+
+	notAfter := time.Now().Add(2 * time.Hour).Truncate(time.Second)
+	bundle, err := v.ObtainForCSR(ObtainRequest{CSR: newTestCSR(t, "wiki.internal.example.com"), NotAfter: notAfter})
+	if err != nil {
+		t.Fatalf("failed to obtain: %v", err)
+	}
+	leaf := checkBundle(t, bundle, ca, "wiki.internal.example.com")
+	if !leaf.NotAfter.Equal(notAfter) {
+		t.Fatalf("notAfter was %s, expected %s", leaf.NotAfter, notAfter)
+	}
+
+	_, err = v.ObtainForCSR(ObtainRequest{CSR: newTestCSR(t, "wiki.internal.example.com"), NotBefore: time.Now().Add(time.Hour)})
+	if err == nil {
+		t.Fatal("vault issuer accepted a future notBefore")
+	}
+
+	if err = v.Revoke(leaf, 0); err != nil {
+		t.Fatalf("failed to revoke: %v", err)
+	}
+	if len(*revoked) != 1 || (*revoked)[0] != "12:34" {
+		t.Fatalf("expected serial 12:34 to be revoked, got %v", *revoked)
+	}
+
+	badToken, _ := NewVaultIssuer(VaultConfig{Addr: srv.URL, Token: "wrong", Role: "internal"})
+	if err = badToken.Health(); err == nil {
+		t.Fatal("vault issuer with a bad token was considered healthy")
+	}
+}
@@ -21,10 +21,13 @@ func (l Path) Relative() string {
 
 type LinkController struct {
 	BaseURL string
+	// Name of the tenant whose directory BaseURL points at, if it isn't the default's
+	Tenant string
 
-	MetaTosURL  string
-	MetaCAAs    []string
-	MetaWebsite string
+	MetaTosURL                  string
+	MetaCAAs                    []string
+	MetaWebsite                 string
+	MetaExternalAccountRequired bool
 }
 
 func (l LinkController) Path(relative string) Path {
@@ -39,7 +42,11 @@ func (l LinkController) Path(relative string) Path {
 }
 
 func (l LinkController) CompareURL(requestPath string, toCompare string) bool {
-	baseWithoutAcme := strings.TrimSuffix(l.BaseURL, "/acme")
+	acmeRoot := "/acme"
+	if l.Tenant != "" {
+		acmeRoot += "/" + l.Tenant
+	}
+	baseWithoutAcme := strings.TrimSuffix(l.BaseURL, acmeRoot)
 	return (baseWithoutAcme + requestPath) == toCompare
 }
 
@@ -99,6 +106,22 @@ func (l LinkController) RevokeCertPath() Path {
 	return l.Path("revoke-cert")
 }
 
+func (l LinkController) LocalCARootPath() Path {
+	return l.Path("ca/root")
+}
+
+func (l LinkController) LocalCACRLPath() Path {
+	return l.Path("ca/crl")
+}
+
+func (l LinkController) LocalCAOCSPPath() Path {
+	return l.Path("ca/ocsp")
+}
+
+func (l LinkController) RateBudgetPath() Path {
+	return l.Path("rate-budget")
+}
+
 func (l LinkController) AccountIDParam() string {
 	return "accID"
 }
@@ -128,9 +151,10 @@ func (l LinkController) GenerateDirectory() dtos.DirectoryListResponseDTO {
 		RevokeCert: l.RevokeCertPath().Abs(),
 		KeyChange:  l.AccountKeyChangePath().Abs(),
 		Meta: dtos.DirectoryMetaResponseDTO{
-			TOS:           l.MetaTosURL,
-			Website:       l.MetaWebsite,
-			CAAIdentities: l.MetaCAAs,
+			TOS:                     l.MetaTosURL,
+			Website:                 l.MetaWebsite,
+			CAAIdentities:           l.MetaCAAs,
+			ExternalAccountRequired: l.MetaExternalAccountRequired,
 		},
 	}
 }
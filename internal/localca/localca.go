@@ -0,0 +1,332 @@
+package localca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/lachlan2k/acmespider/internal/db"
+	"github.com/lachlan2k/acmespider/internal/issuer"
+	log "github.com/sirupsen/logrus"
+)
+
+const rootLifetime = 10 * 365 * 24 * time.Hour
+const intermediateLifetime = 5 * 365 * 24 * time.Hour
+
+var ErrAlreadyRevoked = errors.New("certificate already revoked")
+
+// DefaultCertLifetime is used when an order doesn't specify NotAfter
+const DefaultCertLifetime = 30 * 24 * time.Hour
+
+type Config struct {
+	// Domains that should be issued by the local CA rather than upstream.
+	// An entry of "lan" matches "lan", "printer.lan" and "*.printer.lan"
+	Domains      []string
+	CertLifetime time.Duration
+
+	CRLURL  string
+	OCSPURL string
+}
+
+type CA struct {
+	db   db.DB
+	conf Config
+
+	root            *x509.Certificate
+	intermediate    *x509.Certificate
+	intermediateKey crypto.Signer
+}
+
+// New loads the CA from the DB, or generates and stores a new root and intermediate if there isn't one yet
+func New(database db.DB, conf Config) (*CA, error) {
+	if conf.CertLifetime == 0 {
+		conf.CertLifetime = DefaultCertLifetime
+	}
+
+	domains := make([]string, len(conf.Domains))
+	for i, domain := range conf.Domains {
+		domains[i] = strings.ToLower(strings.Trim(strings.TrimPrefix(strings.TrimSpace(domain), "*."), "."))
+	}
+	conf.Domains = domains
+
+	stored, err := database.GetLocalCA()
+	if err != nil {
+		if !db.IsErrNotFound(err) {
+			return nil, err
+		}
+
+		log.Info("Generating local CA root and intermediate...")
+		stored, err = generate()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate local CA: %v", err)
+		}
+
+		err = database.SaveLocalCA(*stored)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	root, err := x509.ParseCertificate(stored.RootCert)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse local CA root: %v", err)
+	}
+	intermediate, err := x509.ParseCertificate(stored.IntermediateCert)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse local CA intermediate: %v", err)
+	}
+	intermediateKey, err := x509.ParseECPrivateKey(stored.IntermediateKey)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse local CA intermediate key: %v", err)
+	}
+
+	return &CA{
+		db:              database,
+		conf:            conf,
+		root:            root,
+		intermediate:    intermediate,
+		intermediateKey: intermediateKey,
+	}, nil
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func generate() (*db.DBLocalCA, error) {
+	rootKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	intermediateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	rootSerial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	rootTemplate := &x509.Certificate{
+		SerialNumber:          rootSerial,
+		Subject:               pkix.Name{CommonName: "ACMESpider Local Root CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(rootLifetime),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	rootDER, err := x509.CreateCertificate(rand.Reader, rootTemplate, rootTemplate, rootKey.Public(), rootKey)
+	if err != nil {
+		return nil, err
+	}
+	root, err := x509.ParseCertificate(rootDER)
+	if err != nil {
+		return nil, err
+	}
+
+	intermediateSerial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	intermediateTemplate := &x509.Certificate{
+		SerialNumber:          intermediateSerial,
+		Subject:               pkix.Name{CommonName: "ACMESpider Local Intermediate CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(intermediateLifetime),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	intermediateDER, err := x509.CreateCertificate(rand.Reader, intermediateTemplate, root, intermediateKey.Public(), rootKey)
+	if err != nil {
+		return nil, err
+	}
+
+	marshalledRootKey, err := x509.MarshalECPrivateKey(rootKey)
+	if err != nil {
+		return nil, err
+	}
+	marshalledIntermediateKey, err := x509.MarshalECPrivateKey(intermediateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &db.DBLocalCA{
+		RootCert:         rootDER,
+		RootKey:          marshalledRootKey,
+		IntermediateCert: intermediateDER,
+		IntermediateKey:  marshalledIntermediateKey,
+	}, nil
+}
+
+// Handles returns true if the name falls under one of the CA's configured domains
+func (ca *CA) Handles(name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(name, "*."), "."))
+	for _, domain := range ca.conf.Domains {
+		if domain == "" {
+			continue
+		}
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultLifetime is the configured certificate lifetime, used when an order doesn't specify NotAfter
+func (ca *CA) DefaultLifetime() time.Duration {
+	return ca.conf.CertLifetime
+}
+
+// RootPEM returns the PEM-encoded root, for distribution to clients that need to trust the CA
+func (ca *CA) RootPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.root.Raw})
+}
+
+// ObtainForCSR signs a leaf certificate for the CSR, and returns the leaf and intermediate as a PEM bundle
+// NotBefore and NotAfter are honoured if non-zero, otherwise the certificate is valid from now for the configured lifetime
+func (ca *CA) ObtainForCSR(req issuer.ObtainRequest) ([]byte, error) {
+	csr := req.CSR
+	nbf := req.NotBefore
+	naft := req.NotAfter
+
+	err := csr.CheckSignature()
+	if err != nil {
+		return nil, fmt.Errorf("csr signature invalid: %v", err)
+	}
+
+	names := csr.DNSNames
+	if len(names) == 0 && csr.Subject.CommonName != "" {
+		names = []string{csr.Subject.CommonName}
+	}
+	if len(names) == 0 {
+		return nil, errors.New("csr did not contain any names")
+	}
+	for _, name := range names {
+		if !ca.Handles(name) {
+			return nil, fmt.Errorf("%s is not a local CA domain", name)
+		}
+	}
+
+	now := time.Now()
+	if nbf.IsZero() {
+		// Allow for a little clock skew on clients
+		nbf = now.Add(-time.Minute)
+	}
+	if naft.IsZero() {
+		naft = nbf.Add(ca.conf.CertLifetime)
+	}
+	if !naft.After(nbf) {
+		return nil, fmt.Errorf("notAfter (%s) must be after notBefore (%s)", naft, nbf)
+	}
+	if naft.After(ca.intermediate.NotAfter) {
+		return nil, fmt.Errorf("notAfter (%s) is after the local CA intermediate expires (%s)", naft, ca.intermediate.NotAfter)
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	keyUsage := x509.KeyUsageDigitalSignature
+	if _, isRSA := csr.PublicKey.(*rsa.PublicKey); isRSA {
+		keyUsage |= x509.KeyUsageKeyEncipherment
+	}
+
+	commonName := csr.Subject.CommonName
+	if commonName == "" {
+		commonName = names[0]
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		DNSNames:              names,
+		NotBefore:             nbf,
+		NotAfter:              naft,
+		KeyUsage:              keyUsage,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	if ca.conf.OCSPURL != "" {
+		template.OCSPServer = []string{ca.conf.OCSPURL}
+	}
+	if ca.conf.CRLURL != "" {
+		template.CRLDistributionPoints = []string{ca.conf.CRLURL}
+	}
+
+	leafDER, err := x509.CreateCertificate(rand.Reader, template, ca.intermediate, csr.PublicKey, ca.intermediateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ca.db.CreateLocalCAIssuedCert(db.DBLocalCAIssuedCert{
+		Serial:        db.CertificateSerial(serial),
+		CertificateID: req.CertificateID,
+		NotAfter:      naft.Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	bundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leafDER})
+	bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.intermediate.Raw})...)
+	return bundle, nil
+}
+
+// Revoke marks a certificate issued by this CA as revoked, so it appears on the CRL and in OCSP responses
+func (ca *CA) Revoke(cert *x509.Certificate, reason uint) error {
+	_, err := ca.db.UpdateLocalCAIssuedCert([]byte(db.CertificateSerial(cert.SerialNumber)), func(issued *db.DBLocalCAIssuedCert) error {
+		if issued.RevokedAt != nil {
+			return ErrAlreadyRevoked
+		}
+		now := time.Now().Unix()
+		issued.RevokedAt = &now
+		issued.RevocationReason = int(reason)
+		return nil
+	})
+	return err
+}
+
+// IsRevoked reports whether cert was issued by this CA and has since been revoked
+func (ca *CA) IsRevoked(cert *x509.Certificate) (bool, error) {
+	issued, err := ca.db.GetLocalCAIssuedCert([]byte(db.CertificateSerial(cert.SerialNumber)))
+	if err != nil {
+		if db.IsErrNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return issued.RevokedAt != nil, nil
+}
+
+func (ca *CA) RenewalInfo(cert *x509.Certificate, issuerCert *x509.Certificate) (*issuer.RenewalInfo, error) {
+	return issuer.DefaultRenewalInfo(cert), nil
+}
+
+// Health checks the CA's key material is still in the DB, and that the intermediate has a useful amount of life left
+func (ca *CA) Health() error {
+	_, err := ca.db.GetLocalCA()
+	if err != nil {
+		return fmt.Errorf("failed to read local CA from db: %v", err)
+	}
+	if time.Until(ca.intermediate.NotAfter) < ca.conf.CertLifetime {
+		return fmt.Errorf("local CA intermediate expires at %s, which is sooner than the certificate lifetime", ca.intermediate.NotAfter)
+	}
+	return nil
+}
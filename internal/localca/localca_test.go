@@ -0,0 +1,211 @@
+package localca
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/lachlan2k/acmespider/internal/db"
+	"github.com/lachlan2k/acmespider/internal/issuer"
+	"golang.org/x/crypto/ocsp"
+)
+
+func newTestCA(t *testing.T) *CA {
+	database, err := db.NewBoltDb(path.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+
+	ca, err := New(database, Config{
+		Domains: []string{"lan", ".corp"},
+		CRLURL:  "http://acmespider.test/acme/ca/crl",
+		OCSPURL: "http://acmespider.test/acme/ca/ocsp",
+	})
+	if err != nil {
+		t.Fatalf("failed to create local CA: %v", err)
+	}
+	return ca
+}
+
+func newTestCSR(t *testing.T, names ...string) *x509.CertificateRequest {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: names[0]},
+		DNSNames: names,
+	}, key)
+	if err != nil {
+		t.Fatalf("failed to create csr: %v", err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatalf("failed to parse csr: %v", err)
+	}
+	return csr
+}
+
+func parseBundle(t *testing.T, bundle []byte) []*x509.Certificate {
+	certs := []*x509.Certificate{}
+	for {
+		var block *pem.Block
+		block, bundle = pem.Decode(bundle)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatalf("failed to parse cert in bundle: %v", err)
+		}
+		certs = append(certs, cert)
+	}
+	return certs
+}
+
+func TestHandles(t *testing.T) {
+	ca := newTestCA(t)
+
+	cases := map[string]bool{
+		"printer.lan":      true,
+		"lan":              true,
+		"*.corp":           true,
+		"a.b.corp":         true,
+		"PRINTER.LAN.":     true,
+		"example.com":      false,
+		"notlan":           false,
+		"printer.lan.com":  false,
+		"wiki.example.com": false,
+	}
+	for name, want := range cases {
+		if got := ca.Handles(name); got != want {
+			t.Errorf("Handles(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestIssueHonoursValidity(t *testing.T) {
+	ca := newTestCA(t)
+
+	nbf := time.Now().Add(time.Hour).Truncate(time.Second)
+	naft := nbf.Add(48 * time.Hour)
+
+	bundle, err := ca.ObtainForCSR(issuer.ObtainRequest{
+		CSR:           newTestCSR(t, "printer.lan"),
+		CertificateID: "cert-id",
+		NotBefore:     nbf,
+		NotAfter:      naft,
+	})
+	if err != nil {
+		t.Fatalf("failed to issue: %v", err)
+	}
+
+	certs := parseBundle(t, bundle)
+	if len(certs) != 2 {
+		t.Fatalf("expected leaf and intermediate in bundle, got %d certs", len(certs))
+	}
+
+	leaf := certs[0]
+	if !leaf.NotBefore.Equal(nbf) || !leaf.NotAfter.Equal(naft) {
+		t.Fatalf("leaf validity was %s - %s, expected %s - %s", leaf.NotBefore, leaf.NotAfter, nbf, naft)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.RootPEM())
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(certs[1])
+	_, err = leaf.Verify(x509.VerifyOptions{
+		DNSName:       "printer.lan",
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   nbf.Add(time.Minute),
+	})
+	if err != nil {
+		t.Fatalf("leaf didn't verify against local root: %v", err)
+	}
+
+	_, err = ca.ObtainForCSR(issuer.ObtainRequest{CSR: newTestCSR(t, "printer.lan", "wiki.example.com")})
+	if err == nil {
+		t.Fatal("local CA issued for a name outside its domains")
+	}
+}
+
+func TestRevocation(t *testing.T) {
+	ca := newTestCA(t)
+
+	bundle, err := ca.ObtainForCSR(issuer.ObtainRequest{CSR: newTestCSR(t, "printer.lan"), CertificateID: "cert-id"})
+	if err != nil {
+		t.Fatalf("failed to issue: %v", err)
+	}
+	leaf := parseBundle(t, bundle)[0]
+
+	ocspStatus := func() int {
+		req, err := ocsp.CreateRequest(leaf, ca.intermediate, nil)
+		if err != nil {
+			t.Fatalf("failed to create ocsp request: %v", err)
+		}
+		respDER, err := ca.OCSPResponse(req)
+		if err != nil {
+			t.Fatalf("failed to get ocsp response: %v", err)
+		}
+		resp, err := ocsp.ParseResponseForCert(respDER, leaf, ca.intermediate)
+		if err != nil {
+			t.Fatalf("failed to parse ocsp response: %v", err)
+		}
+		return resp.Status
+	}
+
+	if status := ocspStatus(); status != ocsp.Good {
+		t.Fatalf("expected ocsp status good before revocation, got %d", status)
+	}
+
+	// The same serial from another issuer isn't ours to vouch for
+	req, err := ocsp.CreateRequest(leaf, ca.root, nil)
+	if err != nil {
+		t.Fatalf("failed to create ocsp request: %v", err)
+	}
+	respDER, err := ca.OCSPResponse(req)
+	if err != nil {
+		t.Fatalf("failed to get ocsp response: %v", err)
+	}
+	resp, err := ocsp.ParseResponse(respDER, ca.intermediate)
+	if err != nil {
+		t.Fatalf("failed to parse ocsp response: %v", err)
+	}
+	if resp.Status != ocsp.Unknown {
+		t.Fatalf("expected ocsp status unknown for another issuer, got %d", resp.Status)
+	}
+
+	err = ca.Revoke(leaf, ocsp.KeyCompromise)
+	if err != nil {
+		t.Fatalf("failed to revoke: %v", err)
+	}
+	if err = ca.Revoke(leaf, ocsp.KeyCompromise); err == nil {
+		t.Fatal("revoking twice should fail")
+	}
+
+	if status := ocspStatus(); status != ocsp.Revoked {
+		t.Fatalf("expected ocsp status revoked, got %d", status)
+	}
+
+	crlDER, err := ca.CRL()
+	if err != nil {
+		t.Fatalf("failed to generate crl: %v", err)
+	}
+	crl, err := x509.ParseRevocationList(crlDER)
+	if err != nil {
+		t.Fatalf("failed to parse crl: %v", err)
+	}
+	if err = crl.CheckSignatureFrom(ca.intermediate); err != nil {
+		t.Fatalf("crl signature invalid: %v", err)
+	}
+	if len(crl.RevokedCertificates) != 1 || crl.RevokedCertificates[0].SerialNumber.Cmp(leaf.SerialNumber) != 0 {
+		t.Fatalf("expected crl to contain exactly the revoked leaf, got %v", crl.RevokedCertificates)
+	}
+}
@@ -0,0 +1,130 @@
+package localca
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/lachlan2k/acmespider/internal/db"
+	"golang.org/x/crypto/ocsp"
+)
+
+const crlValidity = 24 * time.Hour
+const ocspValidity = time.Hour
+
+var oidCRLReason = asn1.ObjectIdentifier{2, 5, 29, 21}
+
+var ErrMalformedOCSPRequest = errors.New("malformed ocsp request")
+
+// CRL returns a freshly signed DER-encoded CRL covering every revoked certificate that hasn't expired yet
+func (ca *CA) CRL() ([]byte, error) {
+	revoked, err := ca.db.GetRevokedLocalCAIssuedCerts()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	entries := []pkix.RevokedCertificate{}
+	for _, issued := range revoked {
+		if time.Unix(issued.NotAfter, 0).Before(now) {
+			continue
+		}
+
+		serial, err := parseSerialKey(issued.Serial)
+		if err != nil {
+			return nil, err
+		}
+
+		entry := pkix.RevokedCertificate{
+			SerialNumber:   serial,
+			RevocationTime: time.Unix(*issued.RevokedAt, 0),
+		}
+		if issued.RevocationReason != ocsp.Unspecified {
+			reasonBytes, err := asn1.Marshal(asn1.Enumerated(issued.RevocationReason))
+			if err != nil {
+				return nil, err
+			}
+			entry.Extensions = []pkix.Extension{{Id: oidCRLReason, Value: reasonBytes}}
+		}
+		entries = append(entries, entry)
+	}
+
+	return x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:              big.NewInt(now.UnixNano()),
+		ThisUpdate:          now,
+		NextUpdate:          now.Add(crlValidity),
+		RevokedCertificates: entries,
+	}, ca.intermediate, ca.intermediateKey)
+}
+
+// OCSPResponse answers a DER-encoded OCSP request, signed directly by the intermediate
+func (ca *CA) OCSPResponse(requestDER []byte) ([]byte, error) {
+	req, err := ocsp.ParseRequest(requestDER)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedOCSPRequest, err)
+	}
+
+	now := time.Now()
+	template := ocsp.Response{
+		SerialNumber: req.SerialNumber,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(ocspValidity),
+		Status:       ocsp.Unknown,
+	}
+
+	// Serials are only ours to answer for if the request's about a certificate from our intermediate
+	if !ca.issuedByIntermediate(req) {
+		return ocsp.CreateResponse(ca.intermediate, ca.intermediate, template, ca.intermediateKey)
+	}
+
+	issued, err := ca.db.GetLocalCAIssuedCert([]byte(db.CertificateSerial(req.SerialNumber)))
+	if err != nil && !db.IsErrNotFound(err) {
+		return nil, err
+	}
+	if issued != nil {
+		template.Status = ocsp.Good
+		if issued.RevokedAt != nil {
+			template.Status = ocsp.Revoked
+			template.RevokedAt = time.Unix(*issued.RevokedAt, 0)
+			template.RevocationReason = issued.RevocationReason
+		}
+	}
+
+	return ocsp.CreateResponse(ca.intermediate, ca.intermediate, template, ca.intermediateKey)
+}
+
+// issuedByIntermediate checks the issuer name and key hashes in an OCSP request are the intermediate's. RFC6960 4.1.1
+func (ca *CA) issuedByIntermediate(req *ocsp.Request) bool {
+	if !req.HashAlgorithm.Available() {
+		return false
+	}
+
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(ca.intermediate.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return false
+	}
+
+	nameHash := req.HashAlgorithm.New()
+	nameHash.Write(ca.intermediate.RawSubject)
+	keyHash := req.HashAlgorithm.New()
+	keyHash.Write(spki.PublicKey.RightAlign())
+
+	return bytes.Equal(nameHash.Sum(nil), req.IssuerNameHash) && bytes.Equal(keyHash.Sum(nil), req.IssuerKeyHash)
+}
+
+func parseSerialKey(key string) (*big.Int, error) {
+	serial, ok := new(big.Int).SetString(key, 16)
+	if !ok {
+		return nil, fmt.Errorf("invalid stored serial %q", key)
+	}
+	return serial, nil
+}
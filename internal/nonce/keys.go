@@ -0,0 +1,118 @@
+package nonce
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Nonces start with the ID of the key they were sealed with, in the clear so the right key can be picked to open them
+const keyIDSize = 4
+
+type nonceKey struct {
+	id      uint32
+	secret  []byte
+	created time.Time
+	// When a newer key replaced it, zero while it's current. It's accepted for a lifetime after, then dropped
+	retired time.Time
+	aead    cipher.AEAD
+}
+
+// keySet is replaced as a whole when keys rotate, so it can be read without locking
+type keySet struct {
+	current *nonceKey
+	byID    map[uint32]*nonceKey
+}
+
+func newNonceKey(id uint32, created time.Time) (*nonceKey, error) {
+	secret := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce key: %w", err)
+	}
+	return loadNonceKey(id, secret, created, time.Time{})
+}
+
+func loadNonceKey(id uint32, secret []byte, created time.Time, retired time.Time) (*nonceKey, error) {
+	aead, err := chacha20poly1305.NewX(secret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load nonce key %d: %w", id, err)
+	}
+	return &nonceKey{id: id, secret: secret, created: created, retired: retired, aead: aead}, nil
+}
+
+// seal encrypts plaintext, authenticating the key ID along with it
+func (k *nonceKey) seal(plaintext []byte) ([]byte, error) {
+	nonceSize := k.aead.NonceSize()
+	out := make([]byte, keyIDSize+nonceSize, keyIDSize+nonceSize+len(plaintext)+k.aead.Overhead())
+	binary.BigEndian.PutUint32(out, k.id)
+	cryptNonce := out[keyIDSize:]
+	if _, err := rand.Read(cryptNonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce for nonce encryption: %w", err)
+	}
+	return k.aead.Seal(out, cryptNonce, plaintext, out[:keyIDSize]), nil
+}
+
+func (k *nonceKey) open(sealed []byte) ([]byte, error) {
+	nonceSize := k.aead.NonceSize()
+	if len(sealed) < keyIDSize+nonceSize {
+		return nil, fmt.Errorf("message too small (size %d, expected at least %d)", len(sealed), keyIDSize+nonceSize)
+	}
+	return k.aead.Open(nil, sealed[keyIDSize:keyIDSize+nonceSize], sealed[keyIDSize+nonceSize:], sealed[:keyIDSize])
+}
+
+// currentKey returns the key to seal new nonces with, rotating it first if it's due
+func (ctrl *InMemController) currentKey(now time.Time) (*nonceKey, error) {
+	keys := ctrl.keys.Load()
+	if now.Sub(keys.current.created) < ctrl.conf.KeyRotation {
+		return keys.current, nil
+	}
+
+	ctrl.keysLock.Lock()
+	defer ctrl.keysLock.Unlock()
+	// Someone else may have rotated it while we waited
+	keys = ctrl.keys.Load()
+	if now.Sub(keys.current.created) < ctrl.conf.KeyRotation {
+		return keys.current, nil
+	}
+
+	if err := ctrl.rotate(now); err != nil {
+		return nil, err
+	}
+	if ctrl.conf.KeyFile != "" {
+		if err := ctrl.saveState(false); err != nil {
+			// Still usable until we restart, when nonces sealed with the new key won't be accepted
+			log.WithError(err).Error("Failed to save rotated nonce key")
+		}
+	}
+	return ctrl.keys.Load().current, nil
+}
+
+// rotate makes a new current key, keeping the previous one for a lifetime and dropping any older ones. keysLock must be held
+func (ctrl *InMemController) rotate(now time.Time) error {
+	old := ctrl.keys.Load()
+	key, err := newNonceKey(old.current.id+1, now)
+	if err != nil {
+		return err
+	}
+
+	next := &keySet{current: key, byID: map[uint32]*nonceKey{key.id: key}}
+	for id, k := range old.byID {
+		if k == old.current {
+			retired := *k
+			retired.retired = now
+			next.byID[id] = &retired
+			continue
+		}
+		if now.Sub(k.retired) < ctrl.conf.Lifetime {
+			next.byID[id] = k
+		}
+	}
+	ctrl.keys.Store(next)
+	log.WithField("key_id", key.id).Debug("Rotated nonce key")
+	return nil
+}
@@ -0,0 +1,39 @@
+package nonce
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeyRotation(t *testing.T) {
+	ctrl, clock := newTestCtrl(t, Config{Lifetime: time.Minute, KeyRotation: time.Hour})
+
+	firstKey := ctrl.keys.Load().current.id
+	clock.advance(time.Hour - 30*time.Second)
+	beforeRotation := mustGen(t, ctrl)
+
+	clock.advance(40 * time.Second)
+	afterRotation := mustGen(t, ctrl)
+	if ctrl.keys.Load().current.id == firstKey {
+		t.Fatal("expected the key to be rotated")
+	}
+
+	// Nonces sealed with the previous key are still accepted until they expire
+	clock.advance(10 * time.Second)
+	if valid, err := ctrl.ValidateAndConsume(beforeRotation); !valid {
+		t.Fatalf("nonce from before the rotation was rejected: %v", err)
+	}
+	if valid, err := ctrl.ValidateAndConsume(afterRotation); !valid {
+		t.Fatalf("nonce from after the rotation was rejected: %v", err)
+	}
+
+	// Once it's been retired for a lifetime, the next rotation drops it
+	clock.advance(2 * time.Hour)
+	mustGen(t, ctrl)
+	if _, ok := ctrl.keys.Load().byID[firstKey]; ok {
+		t.Fatal("expected the retired key to be dropped")
+	}
+	if len(ctrl.keys.Load().byID) != 2 {
+		t.Fatalf("expected only the current and previous keys to be kept, got %d", len(ctrl.keys.Load().byID))
+	}
+}
@@ -1,16 +1,15 @@
 package nonce
 
 import (
-	"crypto/cipher"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"golang.org/x/crypto/chacha20poly1305"
-
 	log "github.com/sirupsen/logrus"
 )
 
@@ -19,143 +18,185 @@ type NonceController interface {
 	ValidateAndConsume(nonce string) (bool, error)
 }
 
-type InMemController struct {
-	lock         sync.Mutex
-	usedMap      []bool
-	innerCounter uint16
-	outerCounter uint32
-	maxLifetime  time.Duration
-	aead         cipher.AEAD
+// Config sets how long nonces last and how many can be used within that time
+type Config struct {
+	// How long a nonce can be used for after it's issued
+	Lifetime time.Duration
+	// Most used nonces remembered at once. Beyond this, the oldest outstanding nonces stop being accepted early,
+	// rather than risking them being replayed
+	Capacity int
+	// How often a new key is made. The previous key is still accepted for another Lifetime, so nonces issued just before don't fail
+	KeyRotation time.Duration
+	// If set, keys are kept in this file, so nonces handed out before a restart are still accepted after it.
+	// Which nonces have been used is saved there on Close, or if it wasn't, nonces from before the restart aren't accepted
+	KeyFile string
 }
 
-type nonceData struct {
-	t            uint64
-	innerCounter uint16
-	outerCounter uint32
+const (
+	defaultLifetime    = 5 * time.Minute
+	defaultCapacity    = 1 << 20
+	defaultKeyRotation = 24 * time.Hour
+
+	// Used nonces are grouped by when they were issued, so a whole group can be forgotten once it's expired
+	replayBuckets = 16
+	replayShards  = 32
+	// Nonces issued this far in the future are accepted, in case the clock has stepped back
+	maxClockSkew = 5 * time.Second
+)
+
+func DefaultConfig() Config {
+	return Config{
+		Lifetime:    defaultLifetime,
+		Capacity:    defaultCapacity,
+		KeyRotation: defaultKeyRotation,
+	}
 }
 
-const nonceDataSize = 8 + 2 + 4
-const maxStoredNonces = uint16(65535)
+var (
+	errExpired = errors.New("nonce has expired")
+	errReplay  = errors.New("nonce has already been used")
+)
+
+// InMemController hands out nonces that carry when they were issued, encrypted so they can't be forged.
+// Generating one takes no locks. Used nonces are remembered until they'd have expired anyway
+type InMemController struct {
+	conf Config
+	now  func() time.Time
+
+	keys     atomic.Pointer[keySet]
+	keysLock sync.Mutex
+	// Unique within this run, starting somewhere random so a restart doesn't reuse the IDs of nonces still outstanding
+	nextID atomic.Uint64
+
+	replay *replaySet
+}
 
+// NewInMemCtrl creates a controller with the default config and a key that only lasts as long as the process
 func NewInMemCtrl() NonceController {
-	key := make([]byte, 32)
-	_, err := rand.Read(key)
+	ctrl, err := New(DefaultConfig())
 	if err != nil {
-		log.WithError(err).Fatal("failed to generate key for nonce controller")
+		log.WithError(err).Fatal("failed to create nonce controller")
 	}
+	return ctrl
+}
 
-	aead, err := chacha20poly1305.NewX(key)
-	if err != nil {
-		log.WithError(err).Fatal("failed to make chacha")
+func New(conf Config) (*InMemController, error) {
+	if conf.Lifetime <= 0 {
+		conf.Lifetime = defaultLifetime
 	}
-
-	return &InMemController{
-		usedMap:     make([]bool, maxStoredNonces),
-		aead:        aead,
-		maxLifetime: time.Minute,
+	if conf.Capacity <= 0 {
+		conf.Capacity = defaultCapacity
 	}
-}
-
-func (ctrl *InMemController) enc(data nonceData) ([]byte, error) {
-	msgBuff := make([]byte, nonceDataSize)
-	binary.LittleEndian.PutUint64(msgBuff, data.t)
-	binary.LittleEndian.PutUint16(msgBuff[8:], data.innerCounter)
-	binary.LittleEndian.PutUint32(msgBuff[10:], data.outerCounter)
-
-	cryptNonce := make([]byte, ctrl.aead.NonceSize(), ctrl.aead.NonceSize()+len(msgBuff)+ctrl.aead.Overhead())
-	_, err := rand.Read(cryptNonce)
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate nonce for nonce encryption: %w", err)
+	if conf.KeyRotation <= 0 {
+		conf.KeyRotation = defaultKeyRotation
 	}
 
-	return ctrl.aead.Seal(cryptNonce, cryptNonce, msgBuff, nil), nil
-}
+	ctrl := &InMemController{
+		conf:   conf,
+		now:    time.Now,
+		replay: newReplaySet(conf.Lifetime, conf.Capacity),
+	}
 
-func (ctrl *InMemController) dec(encMsg []byte) (nonceData, error) {
-	if len(encMsg) < ctrl.aead.NonceSize() {
-		return nonceData{}, fmt.Errorf("failed to decrypt nonce data, message too small (size %d, expected %d)", len(encMsg), ctrl.aead.NonceSize())
+	var start [8]byte
+	if _, err := rand.Read(start[:]); err != nil {
+		return nil, fmt.Errorf("failed to pick starting nonce ID: %w", err)
 	}
+	ctrl.nextID.Store(binary.LittleEndian.Uint64(start[:]))
 
-	cryptNonce, ciphertext := encMsg[:ctrl.aead.NonceSize()], encMsg[ctrl.aead.NonceSize():]
-	plaintext, err := ctrl.aead.Open(nil, cryptNonce, ciphertext, nil)
-	if err != nil {
-		return nonceData{}, fmt.Errorf("failed to decrypt nonce data: %w", err)
+	if conf.KeyFile != "" {
+		if err := ctrl.loadState(); err != nil {
+			return nil, err
+		}
+		return ctrl, nil
 	}
 
-	if len(plaintext) != nonceDataSize {
-		return nonceData{}, fmt.Errorf("decrypted nonce was %d bytes, expected %d", len(plaintext), nonceDataSize)
+	key, err := newNonceKey(1, ctrl.now())
+	if err != nil {
+		return nil, err
 	}
+	ctrl.keys.Store(&keySet{current: key, byID: map[uint32]*nonceKey{key.id: key}})
+	return ctrl, nil
+}
 
-	return nonceData{
-		t:            binary.LittleEndian.Uint64(plaintext[0:8]),
-		innerCounter: binary.LittleEndian.Uint16(plaintext[8:10]),
-		outerCounter: binary.LittleEndian.Uint32(plaintext[10:]),
-	}, nil
+// nonceData is what's sealed inside each nonce
+type nonceData struct {
+	issuedMs int64
+	id       uint64
 }
 
+const nonceDataSize = 8 + 8
+
 func (ctrl *InMemController) Gen() (string, error) {
-	ctrl.lock.Lock()
-	defer ctrl.lock.Unlock()
-
-	encNonce, err := ctrl.enc(nonceData{
-		t:            uint64(time.Now().Unix()),
-		innerCounter: ctrl.innerCounter,
-		outerCounter: ctrl.outerCounter,
-	})
+	now := ctrl.now()
+	key, err := ctrl.currentKey(now)
 	if err != nil {
 		return "", err
 	}
 
-	ctrl.usedMap[ctrl.innerCounter] = false
-
-	ctrl.innerCounter++
+	plaintext := make([]byte, nonceDataSize)
+	binary.LittleEndian.PutUint64(plaintext, uint64(now.UnixMilli()))
+	binary.LittleEndian.PutUint64(plaintext[8:], ctrl.nextID.Add(1))
 
-	if ctrl.innerCounter >= maxStoredNonces {
-		ctrl.innerCounter = 0
-		ctrl.outerCounter++
+	sealed, err := key.seal(plaintext)
+	if err != nil {
+		return "", err
 	}
-
-	return base64.RawURLEncoding.EncodeToString(encNonce), nil
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
 }
 
-func (ctrl *InMemController) ValidateAndConsume(nonce string) (bool, error) {
-	ctrl.lock.Lock()
-	defer ctrl.lock.Unlock()
-
-	encNonce, err := base64.RawURLEncoding.DecodeString(nonce)
+func (ctrl *InMemController) open(nonce string) (nonceData, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(nonce)
 	if err != nil {
-		return false, fmt.Errorf("failed to b64 decode nonce: %w", err)
+		return nonceData{}, fmt.Errorf("failed to b64 decode nonce: %w", err)
+	}
+	if len(sealed) < keyIDSize {
+		return nonceData{}, fmt.Errorf("nonce was %d bytes, too short to be one of ours", len(sealed))
 	}
 
-	d, err := ctrl.dec(encNonce)
+	keyID := binary.BigEndian.Uint32(sealed)
+	key := ctrl.keys.Load().byID[keyID]
+	if key == nil {
+		return nonceData{}, fmt.Errorf("nonce was sealed with key %d, which is unknown or retired", keyID)
+	}
+	plaintext, err := key.open(sealed)
 	if err != nil {
-		return false, fmt.Errorf("failed to decrypt nonce: %w", err)
+		return nonceData{}, fmt.Errorf("failed to decrypt nonce: %w", err)
 	}
-
-	now := time.Now()
-	expiry := time.Unix(int64(d.t), 0).Add(ctrl.maxLifetime)
-	if now.After(expiry) {
-		// Expired nonce
-		return false, fmt.Errorf("nonce expired %f seconds ago", now.Sub(expiry).Seconds())
+	if len(plaintext) != nonceDataSize {
+		return nonceData{}, fmt.Errorf("decrypted nonce was %d bytes, expected %d", len(plaintext), nonceDataSize)
 	}
 
-	// The two conditions that are valid are:
-	// 1) The outer counter matches. That means the current innerCounter and lower of the usedMap belong to this rotation
-	// 2) The outer counter is -1 of the current. That means values in usedMap that are >innerCounter belong to the last outer cycle
-	// this gives us something resembling a circular buffer
-	validThisLoop := d.outerCounter == ctrl.outerCounter && d.innerCounter <= ctrl.innerCounter
-	validLastLoop := d.outerCounter == ctrl.outerCounter-1 && d.innerCounter > ctrl.innerCounter
+	return nonceData{
+		issuedMs: int64(binary.LittleEndian.Uint64(plaintext)),
+		id:       binary.LittleEndian.Uint64(plaintext[8:]),
+	}, nil
+}
 
-	if !(validThisLoop || validLastLoop) {
-		return false, fmt.Errorf("nonce counter invalid (outer %d vs %d, inner %d vs %d)", d.outerCounter, ctrl.outerCounter, d.innerCounter, ctrl.innerCounter)
+func (ctrl *InMemController) ValidateAndConsume(nonce string) (bool, error) {
+	d, err := ctrl.open(nonce)
+	if err != nil {
+		return false, err
 	}
 
-	if ctrl.usedMap[d.innerCounter] {
-		// already used
-		return false, fmt.Errorf("nonce %d already used", d.innerCounter)
+	now := ctrl.now()
+	issued := time.UnixMilli(d.issuedMs)
+	if issued.After(now.Add(maxClockSkew)) {
+		return false, fmt.Errorf("nonce was issued %s in the future", issued.Sub(now))
+	}
+	if expiry := issued.Add(ctrl.conf.Lifetime); now.After(expiry) {
+		return false, fmt.Errorf("%w, %f seconds ago", errExpired, now.Sub(expiry).Seconds())
 	}
 
-	// Not used yet, mark as used and return true
-	ctrl.usedMap[d.innerCounter] = true
+	if err = ctrl.replay.consume(d, now); err != nil {
+		return false, err
+	}
 	return true, nil
 }
+
+// Close saves the keys and which nonces have been used, if they're kept in a file, so they're still accepted after a restart
+func (ctrl *InMemController) Close() error {
+	if ctrl.conf.KeyFile == "" {
+		return nil
+	}
+	return ctrl.saveState(true)
+}
@@ -1,7 +1,10 @@
 package nonce
 
 import (
+	"encoding/base64"
 	"regexp"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -71,19 +74,20 @@ func TestNonceValidation(t *testing.T) {
 		t.Fatalf("nonce %s was allowed to be valid twice after generating many nonces, (err %v)", nonce, err)
 	}
 
+	// Handing out lots of nonces doesn't stop earlier unused ones from working
 	nonce, _ = ctrl.Gen()
 	for i := 0; i < 65535*2; i++ {
 		ctrl.Gen()
 	}
 
-	valid, _ = ctrl.ValidateAndConsume(nonce)
-	if valid {
-		t.Fatalf("nonce %s was considred valid, despite the fact the circular buffer should have rolled over (err %v)", nonce, err)
+	valid, err = ctrl.ValidateAndConsume(nonce)
+	if !valid {
+		t.Fatalf("nonce %s was considered invalid after generating many nonces, but it was never used (err %v)", nonce, err)
 	}
 
 	memCtrl, ok := ctrl.(*InMemController)
 	if ok {
-		memCtrl.maxLifetime = time.Second
+		memCtrl.conf.Lifetime = time.Second
 		nonce, _ = ctrl.Gen()
 		time.Sleep(time.Second)
 		valid, _ = ctrl.ValidateAndConsume(nonce)
@@ -92,3 +96,193 @@ func TestNonceValidation(t *testing.T) {
 		}
 	}
 }
+
+// fakeClock lets tests move time forward without waiting
+type fakeClock struct {
+	lock sync.Mutex
+	t    time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.t = c.t.Add(d)
+}
+
+func newTestCtrl(t testing.TB, conf Config) (*InMemController, *fakeClock) {
+	clock := &fakeClock{t: time.Now()}
+	ctrl, err := New(conf)
+	if err != nil {
+		t.Fatalf("failed to create nonce controller: %v", err)
+	}
+	ctrl.now = clock.now
+	return ctrl, clock
+}
+
+func mustGen(t testing.TB, ctrl NonceController) string {
+	nonce, err := ctrl.Gen()
+	if err != nil {
+		t.Fatalf("error when generating nonce: %v", err)
+	}
+	return nonce
+}
+
+func TestNonceLifetime(t *testing.T) {
+	ctrl, clock := newTestCtrl(t, Config{Lifetime: time.Minute})
+
+	fresh := mustGen(t, ctrl)
+	old := mustGen(t, ctrl)
+	clock.advance(50 * time.Second)
+	if valid, err := ctrl.ValidateAndConsume(fresh); !valid {
+		t.Fatalf("nonce was rejected within its lifetime: %v", err)
+	}
+	clock.advance(20 * time.Second)
+	if valid, _ := ctrl.ValidateAndConsume(old); valid {
+		t.Fatal("nonce was accepted after its lifetime")
+	}
+
+	// Long after, buckets have been reused for newer nonces, and the old ones still can't be replayed
+	for i := 0; i < replayBuckets*3; i++ {
+		clock.advance(5 * time.Second)
+		n := mustGen(t, ctrl)
+		if valid, err := ctrl.ValidateAndConsume(n); !valid {
+			t.Fatalf("fresh nonce was rejected: %v", err)
+		}
+		if valid, _ := ctrl.ValidateAndConsume(n); valid {
+			t.Fatal("nonce was accepted twice")
+		}
+	}
+	if valid, _ := ctrl.ValidateAndConsume(fresh); valid {
+		t.Fatal("used nonce was accepted again after its bucket was reused")
+	}
+}
+
+func TestNonceTampering(t *testing.T) {
+	ctrl, _ := newTestCtrl(t, Config{})
+	other, _ := newTestCtrl(t, Config{})
+
+	for _, nonce := range []string{"", "!!!", "AAAA", mustGen(t, other)} {
+		if valid, _ := ctrl.ValidateAndConsume(nonce); valid {
+			t.Fatalf("nonce %q wasn't ours, but was accepted", nonce)
+		}
+	}
+
+	nonce := mustGen(t, ctrl)
+	sealed, _ := base64.RawURLEncoding.DecodeString(nonce)
+	sealed[len(sealed)-1] ^= 1
+	if valid, _ := ctrl.ValidateAndConsume(base64.RawURLEncoding.EncodeToString(sealed)); valid {
+		t.Fatal("tampered nonce was accepted")
+	}
+}
+
+func TestNonceCapacity(t *testing.T) {
+	ctrl, clock := newTestCtrl(t, Config{Lifetime: time.Minute, Capacity: 100})
+
+	old := mustGen(t, ctrl)
+	for i := 0; i < 60; i++ {
+		if valid, err := ctrl.ValidateAndConsume(mustGen(t, ctrl)); !valid {
+			t.Fatalf("nonce %d was rejected: %v", i, err)
+		}
+	}
+	clock.advance(30 * time.Second)
+	// Used nonces filling the replay set beyond capacity push out the oldest bucket
+	for i := 0; i < 50; i++ {
+		if valid, err := ctrl.ValidateAndConsume(mustGen(t, ctrl)); !valid {
+			t.Fatalf("nonce %d was rejected: %v", i, err)
+		}
+	}
+
+	if valid, _ := ctrl.ValidateAndConsume(old); valid {
+		t.Fatal("nonce from a forgotten bucket was accepted, so it could have been replayed")
+	}
+	if count := ctrl.replay.count.Load(); count > 100 {
+		t.Fatalf("replay set grew past its capacity to %d", count)
+	}
+	if valid, err := ctrl.ValidateAndConsume(mustGen(t, ctrl)); !valid {
+		t.Fatalf("new nonce was rejected once room was made: %v", err)
+	}
+}
+
+func TestNonceConcurrentUse(t *testing.T) {
+	ctrl, _ := newTestCtrl(t, Config{})
+
+	const workers = 16
+	const perWorker = 2000
+	nonces := make(chan string, workers*perWorker)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				nonce, err := ctrl.Gen()
+				if err != nil {
+					t.Errorf("error when generating nonce: %v", err)
+					return
+				}
+				nonces <- nonce
+			}
+		}()
+	}
+	wg.Wait()
+	close(nonces)
+
+	seen := map[string]bool{}
+	all := []string{}
+	for nonce := range nonces {
+		if seen[nonce] {
+			t.Fatalf("nonce %s was handed out twice", nonce)
+		}
+		seen[nonce] = true
+		all = append(all, nonce)
+	}
+
+	// Every nonce is raced for by two goroutines, and only one may win
+	var accepted atomic.Int64
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := range all {
+				// Half the workers go forwards and half backwards, so they meet on every nonce
+				if w%2 == 1 {
+					i = len(all) - 1 - i
+				}
+				if valid, _ := ctrl.ValidateAndConsume(all[i]); valid {
+					accepted.Add(1)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if int(accepted.Load()) != len(all) {
+		t.Fatalf("expected each of %d nonces to be accepted exactly once, %d were accepted", len(all), accepted.Load())
+	}
+}
+
+func BenchmarkGen(b *testing.B) {
+	ctrl, _ := newTestCtrl(b, Config{})
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			mustGen(b, ctrl)
+		}
+	})
+}
+
+func BenchmarkGenAndConsume(b *testing.B) {
+	ctrl, _ := newTestCtrl(b, Config{})
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if valid, err := ctrl.ValidateAndConsume(mustGen(b, ctrl)); !valid {
+				b.Fatalf("nonce was rejected: %v", err)
+			}
+		}
+	})
+}
@@ -0,0 +1,205 @@
+package nonce
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// replaySet remembers which nonces have been used. Nonces are bucketed by when they were issued, and each bucket is split
+// into shards with their own lock, so consuming nonces mostly doesn't contend. Once a bucket is older than the lifetime,
+// every nonce in it has expired, so it's reused for a newer one
+type replaySet struct {
+	widthMs  int64
+	lifetime time.Duration
+	capacity int64
+
+	// Held for reading while consuming, and for writing to reuse or empty buckets
+	lock    sync.RWMutex
+	buckets []replayBucket
+	count   atomic.Int64
+	// Nonces issued before this (unix milliseconds) aren't accepted, as whether they've been used was forgotten
+	floorMs atomic.Int64
+}
+
+type replayBucket struct {
+	// Which slice of time this bucket holds, issued time divided by the width
+	num    int64
+	shards [replayShards]replayShard
+}
+
+type replayShard struct {
+	lock sync.Mutex
+	used map[uint64]struct{}
+}
+
+func newReplaySet(lifetime time.Duration, capacity int) *replaySet {
+	widthMs := lifetime.Milliseconds() / replayBuckets
+	if widthMs < 1 {
+		widthMs = 1
+	}
+	return &replaySet{
+		widthMs:  widthMs,
+		lifetime: lifetime,
+		capacity: int64(capacity),
+		// Enough to cover the lifetime, plus the bucket only partly in it and those nonces from the future can be in,
+		// so a bucket is only reused once everything in it has expired
+		buckets: make([]replayBucket, replayBuckets+2+int(maxClockSkew.Milliseconds()/widthMs)),
+	}
+}
+
+// consume marks d as used, failing if it already was, or if it can't be known whether it was
+func (r *replaySet) consume(d nonceData, now time.Time) error {
+	num := d.issuedMs / r.widthMs
+	shardIdx := d.id % replayShards
+
+	for {
+		r.lock.RLock()
+		if d.issuedMs < r.floorMs.Load() {
+			r.lock.RUnlock()
+			return fmt.Errorf("%w, it was issued before used nonces were last forgotten", errExpired)
+		}
+
+		b := &r.buckets[num%int64(len(r.buckets))]
+		if b.num > num {
+			r.lock.RUnlock()
+			return errExpired
+		}
+		if b.num < num {
+			// Still holding an older slice of time, which will have expired by now
+			r.lock.RUnlock()
+			r.lock.Lock()
+			if b.num < num {
+				r.reset(b, num)
+			}
+			r.lock.Unlock()
+			continue
+		}
+
+		shard := &b.shards[shardIdx]
+		shard.lock.Lock()
+		_, used := shard.used[d.id]
+		if !used {
+			if shard.used == nil {
+				shard.used = map[uint64]struct{}{}
+			}
+			shard.used[d.id] = struct{}{}
+		}
+		shard.lock.Unlock()
+		r.lock.RUnlock()
+
+		if used {
+			return errReplay
+		}
+		if r.count.Add(1) > r.capacity {
+			r.makeRoom(now)
+		}
+		return nil
+	}
+}
+
+// reset empties b for reuse by bucket num. The lock must be held for writing
+func (r *replaySet) reset(b *replayBucket, num int64) {
+	for i := range b.shards {
+		r.count.Add(-int64(len(b.shards[i].used)))
+		b.shards[i].used = nil
+	}
+	b.num = num
+}
+
+// makeRoom empties expired buckets, then if that's not enough, the oldest ones, no longer accepting the nonces in them.
+// The bucket nonces are being issued into now is kept regardless, or every nonce just handed out would stop working
+func (r *replaySet) makeRoom(now time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	currentNum := now.UnixMilli() / r.widthMs
+
+	expiredBefore := (now.Add(-r.lifetime).UnixMilli() - r.widthMs) / r.widthMs
+	for i := range r.buckets {
+		if r.buckets[i].num < expiredBefore {
+			r.reset(&r.buckets[i], r.buckets[i].num)
+		}
+	}
+
+	for r.count.Load() > r.capacity {
+		var oldest *replayBucket
+		for i := range r.buckets {
+			b := &r.buckets[i]
+			if b.num < currentNum && bucketLen(b) > 0 && (oldest == nil || b.num < oldest.num) {
+				oldest = b
+			}
+		}
+		if oldest == nil {
+			return
+		}
+		floorMs := (oldest.num + 1) * r.widthMs
+		r.reset(oldest, oldest.num)
+		r.floorMs.Store(floorMs)
+		log.WithField("capacity", r.capacity).WithField("issued_before", time.UnixMilli(floorMs)).
+			Warn("Too many nonces used within their lifetime, no longer accepting the oldest")
+	}
+}
+
+func bucketLen(b *replayBucket) int {
+	n := 0
+	for i := range b.shards {
+		n += len(b.shards[i].used)
+	}
+	return n
+}
+
+// usedSnapshot is a bucket's used nonces, as saved across restarts
+type usedSnapshot struct {
+	Bucket int64    `json:"bucket"`
+	IDs    []uint64 `json:"ids"`
+}
+
+func (r *replaySet) snapshot() []usedSnapshot {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	snaps := []usedSnapshot{}
+	for i := range r.buckets {
+		b := &r.buckets[i]
+		snap := usedSnapshot{Bucket: b.num}
+		for j := range b.shards {
+			for id := range b.shards[j].used {
+				snap.IDs = append(snap.IDs, id)
+			}
+		}
+		if len(snap.IDs) > 0 {
+			snaps = append(snaps, snap)
+		}
+	}
+	return snaps
+}
+
+func (r *replaySet) restore(snaps []usedSnapshot, floorMs int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.floorMs.Store(floorMs)
+	for _, snap := range snaps {
+		b := &r.buckets[snap.Bucket%int64(len(r.buckets))]
+		if b.num > snap.Bucket {
+			continue
+		}
+		if b.num < snap.Bucket {
+			r.reset(b, snap.Bucket)
+		}
+		for _, id := range snap.IDs {
+			shard := &b.shards[id%replayShards]
+			if shard.used == nil {
+				shard.used = map[uint64]struct{}{}
+			}
+			if _, ok := shard.used[id]; !ok {
+				shard.used[id] = struct{}{}
+				r.count.Add(1)
+			}
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package nonce
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// persistedState is the key file's contents
+type persistedState struct {
+	Keys []persistedKey `json:"keys"`
+	// Only saved on Close. If it's missing, we didn't shut down cleanly, so don't know which nonces were used
+	Used *persistedUsed `json:"used,omitempty"`
+}
+
+type persistedKey struct {
+	ID      uint32    `json:"id"`
+	Secret  []byte    `json:"secret"`
+	Created time.Time `json:"created"`
+	Retired time.Time `json:"retired,omitempty"`
+}
+
+type persistedUsed struct {
+	SavedAt time.Time `json:"saved_at"`
+	// Bucket numbers only mean the same thing if the lifetime hasn't changed
+	BucketWidthMs int64          `json:"bucket_width_ms"`
+	FloorMs       int64          `json:"floor_ms"`
+	Buckets       []usedSnapshot `json:"buckets"`
+}
+
+func (ctrl *InMemController) loadState() error {
+	now := ctrl.now()
+
+	data, err := os.ReadFile(ctrl.conf.KeyFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		key, err := newNonceKey(1, now)
+		if err != nil {
+			return err
+		}
+		ctrl.keys.Store(&keySet{current: key, byID: map[uint32]*nonceKey{key.id: key}})
+		return ctrl.saveState(false)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read nonce keys: %w", err)
+	}
+
+	var state persistedState
+	if err = json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("failed to parse nonce keys from %s: %w", ctrl.conf.KeyFile, err)
+	}
+
+	keys := &keySet{byID: map[uint32]*nonceKey{}}
+	for _, persisted := range state.Keys {
+		if !persisted.Retired.IsZero() && now.Sub(persisted.Retired) >= ctrl.conf.Lifetime {
+			continue
+		}
+		key, err := loadNonceKey(persisted.ID, persisted.Secret, persisted.Created, persisted.Retired)
+		if err != nil {
+			return err
+		}
+		keys.byID[key.id] = key
+		if key.retired.IsZero() && (keys.current == nil || key.id > keys.current.id) {
+			keys.current = key
+		}
+	}
+	if keys.current == nil {
+		var lastID uint32
+		for id := range keys.byID {
+			if id > lastID {
+				lastID = id
+			}
+		}
+		if keys.current, err = newNonceKey(lastID+1, now); err != nil {
+			return err
+		}
+		keys.byID[keys.current.id] = keys.current
+	}
+	ctrl.keys.Store(keys)
+
+	if state.Used != nil && state.Used.BucketWidthMs == ctrl.replay.widthMs {
+		ctrl.replay.restore(state.Used.Buckets, state.Used.FloorMs)
+		log.WithField("saved_at", state.Used.SavedAt).Debug("Restored used nonces")
+	} else {
+		// Any nonce from before now might have been used, so none of them can be accepted
+		ctrl.replay.floorMs.Store(now.UnixMilli())
+		log.Info("Nonces handed out before the last shutdown won't be accepted, as which were used wasn't saved")
+	}
+
+	// Until we're closed cleanly, it's as if we crashed
+	return ctrl.saveState(false)
+}
+
+// saveState writes the keys, and which nonces have been used if this is the final save before shutting down
+func (ctrl *InMemController) saveState(final bool) error {
+	state := persistedState{Keys: []persistedKey{}}
+	for _, key := range ctrl.keys.Load().byID {
+		state.Keys = append(state.Keys, persistedKey{ID: key.id, Secret: key.secret, Created: key.created, Retired: key.retired})
+	}
+	if final {
+		state.Used = &persistedUsed{
+			SavedAt:       ctrl.now(),
+			BucketWidthMs: ctrl.replay.widthMs,
+			FloorMs:       ctrl.replay.floorMs.Load(),
+			Buckets:       ctrl.replay.snapshot(),
+		}
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	// Written alongside then renamed over, so a crash mid-write doesn't lose the keys
+	tmp, err := os.CreateTemp(filepath.Dir(ctrl.conf.KeyFile), filepath.Base(ctrl.conf.KeyFile)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to save nonce keys: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save nonce keys: %w", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save nonce keys: %w", err)
+	}
+	if err = os.Rename(tmp.Name(), ctrl.conf.KeyFile); err != nil {
+		return fmt.Errorf("failed to save nonce keys: %w", err)
+	}
+	return nil
+}
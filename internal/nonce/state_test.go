@@ -0,0 +1,47 @@
+package nonce
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPersistentKeys(t *testing.T) {
+	conf := Config{Lifetime: time.Minute, KeyFile: filepath.Join(t.TempDir(), "nonce-keys.json")}
+
+	ctrl, clock := newTestCtrl(t, conf)
+	used := mustGen(t, ctrl)
+	unused := mustGen(t, ctrl)
+	if valid, err := ctrl.ValidateAndConsume(used); !valid {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(conf.KeyFile); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("expected the key file to be saved privately, got %v, %v", info, err)
+	}
+	if err := ctrl.Close(); err != nil {
+		t.Fatalf("failed to save nonce state: %v", err)
+	}
+
+	// After a clean restart, outstanding nonces still work, and used ones still can't be replayed
+	restarted, _ := newTestCtrl(t, conf)
+	restarted.now = clock.now
+	if valid, _ := restarted.ValidateAndConsume(used); valid {
+		t.Fatal("nonce used before the restart was accepted again")
+	}
+	if valid, err := restarted.ValidateAndConsume(unused); !valid {
+		t.Fatalf("nonce handed out before the restart was rejected: %v", err)
+	}
+
+	// Without a clean shutdown, which nonces were used isn't known, so none from before are accepted
+	outstanding := mustGen(t, restarted)
+	clock.advance(time.Second)
+	crashed, _ := newTestCtrl(t, conf)
+	crashed.now = clock.now
+	if valid, _ := crashed.ValidateAndConsume(outstanding); valid {
+		t.Fatal("nonce from before a crash was accepted")
+	}
+	if valid, err := crashed.ValidateAndConsume(mustGen(t, crashed)); !valid {
+		t.Fatalf("new nonce was rejected after a crash: %v", err)
+	}
+}
@@ -0,0 +1,98 @@
+package policy
+
+import (
+	"context"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+// reloadDelay lets an editor finish writing before the file is read
+const reloadDelay = 100 * time.Millisecond
+
+// Engine holds the policy loaded from a file, and swaps in a new one when the file changes
+type Engine struct {
+	path    string
+	current atomic.Pointer[Policy]
+}
+
+// NewEngine loads the policy at path, which must be valid
+func NewEngine(path string) (*Engine, error) {
+	e := &Engine{path: path}
+	err := e.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *Engine) Evaluate(in Input) Decision {
+	return e.current.Load().Evaluate(in)
+}
+
+func (e *Engine) UsesValidity() bool {
+	return e.current.Load().UsesValidity()
+}
+
+// Reload reads the policy file again. If it's invalid, the current policy is kept
+func (e *Engine) Reload() error {
+	p, err := Load(e.path)
+	if err != nil {
+		return err
+	}
+	e.current.Store(p)
+	return nil
+}
+
+// Watch reloads the policy whenever its file changes, until ctx is done.
+// The directory is watched rather than the file, so editors that replace the file on save are noticed
+func (e *Engine) Watch(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	err = watcher.Add(filepath.Dir(e.path))
+	if err != nil {
+		watcher.Close()
+		return err
+	}
+
+	go func() {
+		defer watcher.Close()
+
+		name := filepath.Clean(e.path)
+		var reload <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) == name && event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+					reload = time.After(reloadDelay)
+				}
+
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.WithError(err).Warn("Error watching issuance policy file")
+
+			case <-reload:
+				reload = nil
+				if err := e.Reload(); err != nil {
+					log.WithError(err).Error("Failed to reload issuance policy, keeping the previous one")
+					continue
+				}
+				log.WithField("path", e.path).Info("Reloaded issuance policy")
+			}
+		}
+	}()
+	return nil
+}
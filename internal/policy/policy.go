@@ -0,0 +1,316 @@
+package policy
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	StageOrder    = "order"
+	StageFinalize = "finalize"
+
+	EffectAllow = "allow"
+	EffectDeny  = "deny"
+)
+
+// What a denial was down to, decided by the variables the rule looks at
+const (
+	// The names or validity asked for, also used when no rule matched
+	CauseIdentifiers = "identifiers"
+	// Who's asking, their account or source IP
+	CauseRequester = "requester"
+	// The CSR's key or names
+	CauseCSR = "csr"
+)
+
+// File is the policy file's layout
+type File struct {
+	// Effect when no rule matches, allow if empty
+	Default string `yaml:"default"`
+	Rules   []Rule `yaml:"rules"`
+}
+
+// Rule is a CEL expression which, when true, decides the request with its effect. Rules are tried in order
+type Rule struct {
+	Name   string `yaml:"name"`
+	When   string `yaml:"when"`
+	Effect string `yaml:"effect"`
+	// Given to the client when the rule denies a request
+	Message string `yaml:"message"`
+}
+
+// Input is what rules are evaluated against.
+// At the order stage there is no CSR yet, so its properties are empty
+type Input struct {
+	Stage string
+
+	AccountID string
+	Tenant    string
+	Contacts  []string
+	EABKeyID  string
+
+	SourceIP    net.IP
+	Identifiers []string
+
+	// Zero if the order didn't ask for them. Without a NotAfter, the end of the issuer's default lifetime is used if it's known
+	NotBefore time.Time
+	NotAfter  time.Time
+
+	CSR *x509.CertificateRequest
+}
+
+type Decision struct {
+	Allowed bool
+	// Name of the rule that decided, empty if it was the default
+	Rule    string
+	Message string
+	// Set for denials
+	Cause string
+}
+
+type compiledRule struct {
+	Rule
+	program cel.Program
+	cause   string
+}
+
+// Policy is a compiled policy file
+type Policy struct {
+	defaultAllow bool
+	rules        []compiledRule
+	usesValidity bool
+}
+
+func newEnv() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Variable("stage", cel.StringType),
+		cel.Variable("account", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("sourceIP", cel.StringType),
+		cel.Variable("identifiers", cel.ListType(cel.StringType)),
+		cel.Variable("validity", cel.DurationType),
+		cel.Variable("csr", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Function("inCIDR",
+			cel.Overload("inCIDR_string_string", []*cel.Type{cel.StringType, cel.StringType}, cel.BoolType,
+				cel.BinaryBinding(inCIDR),
+			),
+		),
+	)
+}
+
+func inCIDR(ipVal ref.Val, cidrVal ref.Val) ref.Val {
+	ipStr, ok := ipVal.Value().(string)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(ipVal)
+	}
+	cidrStr, ok := cidrVal.Value().(string)
+	if !ok {
+		return types.MaybeNoSuchOverloadErr(cidrVal)
+	}
+
+	_, n, err := net.ParseCIDR(cidrStr)
+	if err != nil {
+		return types.NewErr("invalid CIDR %q", cidrStr)
+	}
+	ip := net.ParseIP(ipStr)
+	return types.Bool(ip != nil && n.Contains(ip))
+}
+
+// Compile checks and compiles every rule in a policy file
+func Compile(f File) (*Policy, error) {
+	env, err := newEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Policy{}
+	switch f.Default {
+	case "", EffectAllow:
+		p.defaultAllow = true
+	case EffectDeny:
+	default:
+		return nil, fmt.Errorf("default must be %q or %q, not %q", EffectAllow, EffectDeny, f.Default)
+	}
+
+	for i, rule := range f.Rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule %d", i)
+		}
+		if rule.Effect != EffectAllow && rule.Effect != EffectDeny {
+			return nil, fmt.Errorf("%s: effect must be %q or %q, not %q", rule.Name, EffectAllow, EffectDeny, rule.Effect)
+		}
+
+		ast, iss := env.Compile(rule.When)
+		if iss.Err() != nil {
+			return nil, fmt.Errorf("%s: %v", rule.Name, iss.Err())
+		}
+		if !ast.OutputType().IsExactType(cel.BoolType) {
+			return nil, fmt.Errorf("%s: expression must be a bool, not %s", rule.Name, ast.OutputType())
+		}
+		program, err := env.Program(ast)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", rule.Name, err)
+		}
+		p.rules = append(p.rules, compiledRule{Rule: rule, program: program, cause: ruleCause(ast)})
+		p.usesValidity = p.usesValidity || referencesVar(ast, "validity")
+	}
+
+	return p, nil
+}
+
+// ruleCause works out what a rule denies requests over from the variables it uses.
+// A rule about the CSR is down to the CSR, and one about the names asked for is down to them even if it also looks at who's asking
+func ruleCause(ast *cel.Ast) string {
+	vars := map[string]bool{}
+	for _, ref := range ast.NativeRep().ReferenceMap() {
+		vars[ref.Name] = true
+	}
+
+	switch {
+	case vars["csr"]:
+		return CauseCSR
+	case vars["identifiers"] || vars["validity"]:
+		return CauseIdentifiers
+	case vars["account"] || vars["sourceIP"]:
+		return CauseRequester
+	}
+	return CauseIdentifiers
+}
+
+func referencesVar(ast *cel.Ast, name string) bool {
+	for _, ref := range ast.NativeRep().ReferenceMap() {
+		if ref.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// UsesValidity reports whether any rule looks at the certificate's validity, which needs NotAfter to be known
+func (p *Policy) UsesValidity() bool {
+	return p.usesValidity
+}
+
+// Load reads and compiles a policy file
+func Load(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var f File
+	err = yaml.Unmarshal(data, &f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+
+	p, err := Compile(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy in %s: %v", path, err)
+	}
+	return p, nil
+}
+
+// Evaluate decides a request with the first rule that matches it.
+// A rule that fails to evaluate denies the request, so a mistake in the policy can't let everything through
+func (p *Policy) Evaluate(in Input) Decision {
+	vars := activation(in)
+	for _, rule := range p.rules {
+		out, _, err := rule.program.Eval(vars)
+		if err != nil {
+			return Decision{Rule: rule.Name, Message: fmt.Sprintf("Issuance policy rule %s failed to evaluate: %v", rule.Name, err), Cause: rule.cause}
+		}
+		if out != types.True {
+			continue
+		}
+
+		decision := Decision{Allowed: rule.Effect == EffectAllow, Rule: rule.Name, Message: rule.Message}
+		if !decision.Allowed {
+			decision.Cause = rule.cause
+			if decision.Message == "" {
+				decision.Message = fmt.Sprintf("Denied by issuance policy rule %s", rule.Name)
+			}
+		}
+		return decision
+	}
+
+	if p.defaultAllow {
+		return Decision{Allowed: true}
+	}
+	return Decision{Message: "No issuance policy rule allows this request", Cause: CauseIdentifiers}
+}
+
+func activation(in Input) map[string]any {
+	contacts := in.Contacts
+	if contacts == nil {
+		contacts = []string{}
+	}
+	identifiers := in.Identifiers
+	if identifiers == nil {
+		identifiers = []string{}
+	}
+
+	sourceIP := ""
+	if in.SourceIP != nil {
+		sourceIP = in.SourceIP.String()
+	}
+
+	// Zero if nobody knows the end yet, as the issuer picks it
+	var validity time.Duration
+	if !in.NotAfter.IsZero() {
+		start := in.NotBefore
+		if start.IsZero() {
+			start = time.Now()
+		}
+		validity = in.NotAfter.Sub(start)
+	}
+
+	keyType, keyBits := csrKey(in.CSR)
+	names := []string{}
+	if in.CSR != nil {
+		names = append(names, in.CSR.DNSNames...)
+	}
+
+	return map[string]any{
+		"stage": in.Stage,
+		"account": map[string]any{
+			"id":       in.AccountID,
+			"tenant":   in.Tenant,
+			"contacts": contacts,
+			"eabKeyID": in.EABKeyID,
+		},
+		"sourceIP":    sourceIP,
+		"identifiers": identifiers,
+		"validity":    validity,
+		"csr": map[string]any{
+			"keyType": keyType,
+			"keyBits": keyBits,
+			"names":   names,
+		},
+	}
+}
+
+func csrKey(csr *x509.CertificateRequest) (string, int64) {
+	if csr == nil {
+		return "", 0
+	}
+	switch key := csr.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return "RSA", int64(key.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ECDSA", int64(key.Curve.Params().BitSize)
+	case ed25519.PublicKey:
+		return "Ed25519", 256
+	}
+	return "unknown", 0
+}
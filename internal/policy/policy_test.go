@@ -0,0 +1,221 @@
+package policy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const dbTeamPolicy = `
+default: deny
+rules:
+  - name: no-small-rsa
+    effect: deny
+    when: stage == "finalize" && csr.keyType == "RSA" && csr.keyBits < 3072
+    message: RSA keys must be at least 3072 bits
+  - name: db-team
+    effect: allow
+    when: >
+      inCIDR(sourceIP, "10.20.0.0/16") &&
+      identifiers.all(id, id.endsWith(".db.internal.example.com")) &&
+      size(identifiers) <= 5 &&
+      validity <= duration("720h")
+`
+
+func writePolicy(t *testing.T, path string, contents string) {
+	err := os.WriteFile(path, []byte(contents), 0o600)
+	if err != nil {
+		t.Fatalf("failed to write policy: %v", err)
+	}
+}
+
+func newTestCSR(t *testing.T, key any) *x509.CertificateRequest {
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{"pg1.db.internal.example.com"}}, key)
+	if err != nil {
+		t.Fatalf("failed to create CSR: %v", err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatalf("failed to parse CSR: %v", err)
+	}
+	return csr
+}
+
+func TestEvaluate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	writePolicy(t, path, dbTeamPolicy)
+	p, err := Load(path)
+	if err != nil {
+		t.Fatalf("failed to load policy: %v", err)
+	}
+
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	now := time.Now()
+	allowed := Input{
+		Stage:       StageOrder,
+		SourceIP:    net.ParseIP("10.20.3.4"),
+		Identifiers: []string{"pg1.db.internal.example.com", "pg2.db.internal.example.com"},
+	}
+
+	tests := []struct {
+		name    string
+		edit    func(in *Input)
+		allowed bool
+		rule    string
+	}{
+		{name: "allowed", edit: func(in *Input) {}, allowed: true, rule: "db-team"},
+		{name: "other network", edit: func(in *Input) { in.SourceIP = net.ParseIP("10.30.3.4") }},
+		{name: "other names", edit: func(in *Input) { in.Identifiers = append(in.Identifiers, "wiki.internal.example.com") }},
+		{name: "too many names", edit: func(in *Input) {
+			in.Identifiers = []string{"a.db.internal.example.com", "b.db.internal.example.com", "c.db.internal.example.com", "d.db.internal.example.com", "e.db.internal.example.com", "f.db.internal.example.com"}
+		}},
+		{name: "short lifetime", edit: func(in *Input) { in.NotAfter = now.Add(24 * time.Hour) }, allowed: true, rule: "db-team"},
+		{name: "long lifetime", edit: func(in *Input) { in.NotBefore, in.NotAfter = now, now.Add(90*24*time.Hour) }},
+		{name: "finalize with EC key", edit: func(in *Input) { in.Stage, in.CSR = StageFinalize, newTestCSR(t, ecKey) }, allowed: true, rule: "db-team"},
+		{name: "finalize with small RSA key", edit: func(in *Input) { in.Stage, in.CSR = StageFinalize, newTestCSR(t, rsaKey) }, rule: "no-small-rsa"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := allowed
+			in.Identifiers = append([]string{}, allowed.Identifiers...)
+			tt.edit(&in)
+
+			decision := p.Evaluate(in)
+			if decision.Allowed != tt.allowed || decision.Rule != tt.rule {
+				t.Fatalf("expected allowed=%v by %q, got %+v", tt.allowed, tt.rule, decision)
+			}
+			if !decision.Allowed && decision.Message == "" {
+				t.Fatal("denial had no message")
+			}
+		})
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := map[string]File{
+		"syntax":         {Rules: []Rule{{When: "identifiers.all(", Effect: EffectAllow}}},
+		"unknown var":    {Rules: []Rule{{When: "hostname == 'a'", Effect: EffectAllow}}},
+		"not a bool":     {Rules: []Rule{{When: "size(identifiers)", Effect: EffectAllow}}},
+		"bad effect":     {Rules: []Rule{{When: "true", Effect: "maybe"}}},
+		"bad default":    {Default: "maybe"},
+		"missing effect": {Rules: []Rule{{When: "true"}}},
+	}
+	for name, f := range tests {
+		if _, err := Compile(f); err == nil {
+			t.Errorf("%s: expected compile error", name)
+		}
+	}
+}
+
+func TestDenialCause(t *testing.T) {
+	p, err := Compile(File{Default: EffectDeny, Rules: []Rule{
+		{Name: "small-rsa", When: `csr.keyType == "RSA" && csr.keyBits < 3072`, Effect: EffectDeny},
+		{Name: "guest-network", When: `inCIDR(sourceIP, "10.99.0.0/16")`, Effect: EffectDeny},
+		{Name: "lab-long-lived", When: `account.tenant == "lab" && validity > duration("720h")`, Effect: EffectDeny},
+		{Name: "internal", When: `identifiers.all(id, id.endsWith(".internal.example.com"))`, Effect: EffectAllow},
+	}})
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	now := time.Now()
+	tests := map[string]struct {
+		in    Input
+		cause string
+	}{
+		"csr":       {Input{Stage: StageFinalize, CSR: newTestCSR(t, rsaKey)}, CauseCSR},
+		"requester": {Input{Stage: StageOrder, SourceIP: net.ParseIP("10.99.0.1")}, CauseRequester},
+		"validity":  {Input{Stage: StageOrder, Tenant: "lab", NotAfter: now.Add(90 * 24 * time.Hour)}, CauseIdentifiers},
+		"default":   {Input{Stage: StageOrder, Identifiers: []string{"wiki.example.net"}}, CauseIdentifiers},
+	}
+	for name, tt := range tests {
+		if decision := p.Evaluate(tt.in); decision.Allowed || decision.Cause != tt.cause {
+			t.Errorf("%s: expected a denial caused by %s, got %+v", name, tt.cause, decision)
+		}
+	}
+}
+
+func TestUsesValidity(t *testing.T) {
+	tests := map[string]struct {
+		when string
+		uses bool
+	}{
+		"validity":   {`validity > duration("720h")`, true},
+		"nested":     {`identifiers.exists(id, id.endsWith(".lab")) && validity > duration("24h")`, true},
+		"identifier": {`identifiers.all(id, id.endsWith(".internal.example.com"))`, false},
+	}
+	for name, tt := range tests {
+		p, err := Compile(File{Rules: []Rule{{When: tt.when, Effect: EffectDeny}}})
+		if err != nil {
+			t.Fatalf("%s: failed to compile: %v", name, err)
+		}
+		if p.UsesValidity() != tt.uses {
+			t.Errorf("%s: expected UsesValidity to be %v", name, tt.uses)
+		}
+	}
+}
+
+func TestEvaluateErrorDenies(t *testing.T) {
+	p, err := Compile(File{Rules: []Rule{{Name: "broken", When: `inCIDR(sourceIP, "not a cidr")`, Effect: EffectAllow}}})
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	if decision := p.Evaluate(Input{Stage: StageOrder, SourceIP: net.ParseIP("10.0.0.1")}); decision.Allowed {
+		t.Fatal("rule that failed to evaluate allowed the request")
+	}
+}
+
+func TestEngineReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	writePolicy(t, path, "default: allow\n")
+
+	e, err := NewEngine(path)
+	if err != nil {
+		t.Fatalf("failed to create engine: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err = e.Watch(ctx); err != nil {
+		t.Fatalf("failed to watch policy: %v", err)
+	}
+
+	in := Input{Stage: StageOrder, Identifiers: []string{"wiki.internal.example.com"}}
+	waitFor := func(allowed bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for e.Evaluate(in).Allowed != allowed {
+			if time.Now().After(deadline) {
+				t.Fatalf("policy wasn't reloaded, expected allowed=%v", allowed)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	waitFor(true)
+
+	writePolicy(t, path, "default: deny\n")
+	waitFor(false)
+
+	// A broken policy leaves the last good one in place
+	writePolicy(t, path, "rules: [")
+	time.Sleep(4 * reloadDelay)
+	waitFor(false)
+
+	// Replaced rather than written in place, like most editors do
+	tmp := path + ".tmp"
+	writePolicy(t, tmp, "default: allow\n")
+	if err = os.Rename(tmp, path); err != nil {
+		t.Fatalf("failed to replace policy: %v", err)
+	}
+	waitFor(true)
+}
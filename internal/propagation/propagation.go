@@ -0,0 +1,268 @@
+// Package propagation waits for DNS-01 TXT records to be visible before a CA is asked to check them
+package propagation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// Following CNAMEs stops after this many, in case of loops
+const maxCNAMEs = 8
+
+type Config struct {
+	// Recursive resolvers, used to find the zone's authoritative nameservers, and checked instead if those can't be found
+	Resolvers []string
+	// Delay before the first check, doubling after each until MaxInterval
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	// How long to wait for the record before giving up
+	Timeout time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Resolvers:       []string{"1.1.1.1:53", "8.8.8.8:53"},
+		InitialInterval: 2 * time.Second,
+		MaxInterval:     30 * time.Second,
+		Timeout:         5 * time.Minute,
+	}
+}
+
+func (conf Config) withDefaults() Config {
+	defaults := DefaultConfig()
+	if len(conf.Resolvers) == 0 {
+		conf.Resolvers = defaults.Resolvers
+	}
+	if conf.InitialInterval == 0 {
+		conf.InitialInterval = defaults.InitialInterval
+	}
+	if conf.MaxInterval == 0 {
+		conf.MaxInterval = defaults.MaxInterval
+	}
+	if conf.Timeout == 0 {
+		conf.Timeout = defaults.Timeout
+	}
+	return conf
+}
+
+// Checker checks TXT records with the zone's authoritative nameservers, as that's where the CA will look
+type Checker struct {
+	conf   Config
+	client *dns.Client
+	// Port authoritative nameservers are queried on, only changed by tests
+	port string
+}
+
+func NewChecker(conf Config) *Checker {
+	conf = conf.withDefaults()
+	// Copied, so the caller's list isn't changed underneath it
+	resolvers := make([]string, len(conf.Resolvers))
+	for i, resolver := range conf.Resolvers {
+		resolvers[i] = resolver
+		if _, _, err := net.SplitHostPort(resolver); err != nil {
+			resolvers[i] = net.JoinHostPort(resolver, "53")
+		}
+	}
+	conf.Resolvers = resolvers
+	return &Checker{
+		conf:   conf,
+		client: &dns.Client{Timeout: 10 * time.Second},
+		port:   "53",
+	}
+}
+
+// Timeout is how long Wait waits for a record
+func (c *Checker) Timeout() time.Duration {
+	return c.conf.Timeout
+}
+
+// Wait returns once every authoritative nameserver for fqdn has the TXT value, checking with increasing intervals.
+// It returns an error if that doesn't happen within the timeout
+func (c *Checker) Wait(ctx context.Context, fqdn string, value string) error {
+	ctx, cancel := context.WithTimeout(ctx, c.conf.Timeout)
+	defer cancel()
+
+	logger := log.WithField("fqdn", fqdn)
+	logger.Debug("Waiting for DNS record to propagate")
+
+	interval := c.conf.InitialInterval
+	var lastErr error
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.Canceled) {
+				return fmt.Errorf("stopped waiting for TXT record %s: %w", fqdn, ctx.Err())
+			}
+			if lastErr == nil {
+				lastErr = errors.New("record not found")
+			}
+			return fmt.Errorf("TXT record %s didn't propagate within %s: %w", fqdn, c.conf.Timeout, lastErr)
+		case <-time.After(interval):
+		}
+
+		lastErr = c.Check(ctx, fqdn, value)
+		if lastErr == nil {
+			logger.WithField("attempt", attempt).Debug("DNS record propagated")
+			return nil
+		}
+		logger.WithError(lastErr).WithField("attempt", attempt).Debug("DNS record hasn't propagated yet")
+
+		interval *= 2
+		if interval > c.conf.MaxInterval {
+			interval = c.conf.MaxInterval
+		}
+	}
+}
+
+// Check checks once whether every authoritative nameserver for fqdn has the TXT value, following CNAMEs.
+// If the nameservers can't be found, the recursive resolvers are checked instead
+func (c *Checker) Check(ctx context.Context, fqdn string, value string) error {
+	fqdn = dns.Fqdn(fqdn)
+	for i := 0; i < maxCNAMEs; i++ {
+		nameservers, err := c.authoritativeNameservers(ctx, fqdn)
+		if err != nil {
+			log.WithError(err).WithField("fqdn", fqdn).Debug("Couldn't find authoritative nameservers, checking with recursive resolvers")
+			return c.checkNameservers(ctx, fqdn, value, c.conf.Resolvers, true)
+		}
+
+		target, err := c.cnameTarget(ctx, fqdn, nameservers[0])
+		if err != nil {
+			return err
+		}
+		if target == "" {
+			return c.checkNameservers(ctx, fqdn, value, nameservers, false)
+		}
+		fqdn = target
+	}
+	return fmt.Errorf("followed more than %d CNAMEs", maxCNAMEs)
+}
+
+// LegoPreCheck lets the checker replace lego's own propagation check, giving up early once ctx is done.
+// On timeout, lego's wait has also run out, so it gives up with the error rather than checking again
+func (c *Checker) LegoPreCheck(ctx context.Context) dns01.WrapPreCheckFunc {
+	return func(domain, fqdn, value string, _ dns01.PreCheckFunc) (bool, error) {
+		err := c.Wait(ctx, fqdn, value)
+		return err == nil, err
+	}
+}
+
+// authoritativeNameservers finds the addresses of the nameservers for fqdn's zone
+func (c *Checker) authoritativeNameservers(ctx context.Context, fqdn string) ([]string, error) {
+	zone, err := dns01.FindZoneByFqdnCustom(fqdn, c.conf.Resolvers)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.query(ctx, zone, dns.TypeNS, c.conf.Resolvers, true)
+	if err != nil {
+		return nil, err
+	}
+	addrs := []string{}
+	for _, rr := range resp.Answer {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		nsAddrs, err := c.lookupAddrs(ctx, ns.Ns)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve nameserver %s: %w", ns.Ns, err)
+		}
+		// One address per nameserver is enough, they're the same server
+		addrs = append(addrs, net.JoinHostPort(nsAddrs[0], c.port))
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no nameservers found for zone %s", zone)
+	}
+	return addrs, nil
+}
+
+func (c *Checker) lookupAddrs(ctx context.Context, name string) ([]string, error) {
+	addrs := []string{}
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		resp, err := c.query(ctx, name, qtype, c.conf.Resolvers, true)
+		if err != nil {
+			continue
+		}
+		for _, rr := range resp.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				addrs = append(addrs, rr.A.String())
+			case *dns.AAAA:
+				addrs = append(addrs, rr.AAAA.String())
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("no addresses")
+	}
+	return addrs, nil
+}
+
+// cnameTarget returns where fqdn is a CNAME to, or "" if it isn't one
+func (c *Checker) cnameTarget(ctx context.Context, fqdn string, nameserver string) (string, error) {
+	resp, err := c.query(ctx, fqdn, dns.TypeCNAME, []string{nameserver}, false)
+	if err != nil {
+		return "", err
+	}
+	for _, rr := range resp.Answer {
+		if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, fqdn) {
+			return cname.Target, nil
+		}
+	}
+	return "", nil
+}
+
+// checkNameservers returns nil only if every nameserver has the TXT value for fqdn
+func (c *Checker) checkNameservers(ctx context.Context, fqdn string, value string, nameservers []string, recursive bool) error {
+	for _, ns := range nameservers {
+		resp, err := c.query(ctx, fqdn, dns.TypeTXT, []string{ns}, recursive)
+		if err != nil {
+			return err
+		}
+		found := false
+		for _, rr := range resp.Answer {
+			if txt, ok := rr.(*dns.TXT); ok && strings.Join(txt.Txt, "") == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s doesn't have the TXT record for %s yet", ns, fqdn)
+		}
+	}
+	return nil
+}
+
+// query asks each nameserver in turn until one answers
+func (c *Checker) query(ctx context.Context, name string, qtype uint16, nameservers []string, recursive bool) (*dns.Msg, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+	msg.RecursionDesired = recursive
+
+	var lastErr error
+	for _, ns := range nameservers {
+		resp, _, err := c.client.ExchangeContext(ctx, msg, ns)
+		if err == nil && resp.Truncated {
+			tcp := &dns.Client{Net: "tcp", Timeout: c.client.Timeout}
+			resp, _, err = tcp.ExchangeContext(ctx, msg, ns)
+		}
+		if err != nil {
+			lastErr = fmt.Errorf("querying %s: %w", ns, err)
+			continue
+		}
+		if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+			lastErr = fmt.Errorf("%s answered %s for %s", ns, dns.RcodeToString[resp.Rcode], name)
+			continue
+		}
+		return resp, nil
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,218 @@
+package propagation
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fakeDNS plays both the recursive resolver and the authoritative nameservers for example.test and other.test.
+// Recursive queries only see records once they're "cached", so tests can tell which was asked
+type fakeDNS struct {
+	mu        sync.Mutex
+	txt       map[string]string
+	cachedTXT map[string]string
+	cnames    map[string]string
+	// Without zones, SOA queries fail, as if the resolver couldn't find the zone
+	zones map[string]bool
+}
+
+func newFakeDNS(t *testing.T) (*fakeDNS, string) {
+	f := &fakeDNS{
+		txt:       map[string]string{},
+		cachedTXT: map[string]string{},
+		cnames:    map[string]string{},
+		zones:     map[string]bool{"example.test.": true, "other.test.": true},
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: conn, Handler: f}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+
+	return f, conn.LocalAddr().String()
+}
+
+func (f *fakeDNS) setTXT(name string, value string, cached bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.txt[name] = value
+	if cached {
+		f.cachedTXT[name] = value
+	}
+}
+
+func (f *fakeDNS) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	q := req.Question[0]
+	name := strings.ToLower(q.Name)
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: 60}
+
+	if target, ok := f.cnames[name]; ok {
+		resp.Answer = append(resp.Answer, &dns.CNAME{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60}, Target: target})
+		w.WriteMsg(resp)
+		return
+	}
+
+	switch q.Qtype {
+	case dns.TypeSOA:
+		if f.zones[name] {
+			resp.Answer = append(resp.Answer, &dns.SOA{Hdr: hdr, Ns: "ns1." + name, Mbox: "hostmaster." + name, Serial: 1, Refresh: 60, Retry: 60, Expire: 60, Minttl: 60})
+		}
+	case dns.TypeNS:
+		if f.zones[name] {
+			resp.Answer = append(resp.Answer, &dns.NS{Hdr: hdr, Ns: "ns1." + name}, &dns.NS{Hdr: hdr, Ns: "ns2." + name})
+		}
+	case dns.TypeA:
+		if strings.HasPrefix(name, "ns") {
+			resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr, A: net.ParseIP("127.0.0.1")})
+		}
+	case dns.TypeTXT:
+		records := f.txt
+		if req.RecursionDesired {
+			records = f.cachedTXT
+		}
+		if value, ok := records[name]; ok {
+			resp.Answer = append(resp.Answer, &dns.TXT{Hdr: hdr, Txt: []string{value}})
+		}
+	}
+	w.WriteMsg(resp)
+}
+
+func newTestChecker(addr string, timeout time.Duration) *Checker {
+	c := NewChecker(Config{
+		Resolvers:       []string{addr},
+		InitialInterval: 10 * time.Millisecond,
+		MaxInterval:     50 * time.Millisecond,
+		Timeout:         timeout,
+	})
+	_, c.port, _ = net.SplitHostPort(addr)
+	return c
+}
+
+func TestWaitChecksAuthoritativeNameservers(t *testing.T) {
+	f, addr := newFakeDNS(t)
+	c := newTestChecker(addr, 5*time.Second)
+
+	// Resolvers would still have the old answer cached, but the CA asks the nameservers
+	f.setTXT("_acme-challenge.auth.example.test.", "token", false)
+	if err := c.Wait(context.Background(), "_acme-challenge.auth.example.test.", "token"); err != nil {
+		t.Fatalf("expected record on the nameservers to count as propagated, got %v", err)
+	}
+}
+
+func TestWaitBacksOffUntilRecordAppears(t *testing.T) {
+	f, addr := newFakeDNS(t)
+	c := newTestChecker(addr, 5*time.Second)
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		f.setTXT("_acme-challenge.late.example.test.", "token", false)
+	}()
+
+	start := time.Now()
+	if err := c.Wait(context.Background(), "_acme-challenge.late.example.test.", "token"); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("expected the record to be found soon after appearing, took %s", elapsed)
+	}
+}
+
+func TestWaitFollowsCNAME(t *testing.T) {
+	f, addr := newFakeDNS(t)
+	c := newTestChecker(addr, 5*time.Second)
+
+	f.mu.Lock()
+	f.cnames["_acme-challenge.cname.example.test."] = "_acme-challenge.delegated.other.test."
+	f.mu.Unlock()
+
+	// A record at the original name isn't what the CA will see
+	f.setTXT("_acme-challenge.cname.example.test.", "token", false)
+	if err := c.Check(context.Background(), "_acme-challenge.cname.example.test.", "token"); err == nil {
+		t.Fatal("expected the record to be looked for at the CNAME's target")
+	}
+
+	f.setTXT("_acme-challenge.delegated.other.test.", "token", false)
+	if err := c.Check(context.Background(), "_acme-challenge.cname.example.test.", "token"); err != nil {
+		t.Fatalf("expected the record at the CNAME's target to be found, got %v", err)
+	}
+}
+
+func TestWaitFallsBackToResolvers(t *testing.T) {
+	f, addr := newFakeDNS(t)
+	c := newTestChecker(addr, 5*time.Second)
+
+	f.mu.Lock()
+	f.zones = map[string]bool{}
+	f.mu.Unlock()
+
+	f.setTXT("_acme-challenge.nozone.example.test.", "token", false)
+	if err := c.Check(context.Background(), "_acme-challenge.nozone.example.test.", "token"); err == nil {
+		t.Fatal("expected the uncached record not to be found by the resolvers")
+	}
+
+	f.setTXT("_acme-challenge.nozone.example.test.", "token", true)
+	if err := c.Check(context.Background(), "_acme-challenge.nozone.example.test.", "token"); err != nil {
+		t.Fatalf("expected the resolvers to find the cached record, got %v", err)
+	}
+}
+
+func TestWaitTimesOut(t *testing.T) {
+	f, addr := newFakeDNS(t)
+	c := newTestChecker(addr, 200*time.Millisecond)
+
+	f.setTXT("_acme-challenge.stale.example.test.", "old", false)
+	err := c.Wait(context.Background(), "_acme-challenge.stale.example.test.", "token")
+	if err == nil {
+		t.Fatal("expected an error when the record never propagates")
+	}
+	if !strings.Contains(err.Error(), "_acme-challenge.stale.example.test.") || !strings.Contains(err.Error(), "doesn't have the TXT record") {
+		t.Fatalf("expected the error to name the record and why, got %v", err)
+	}
+
+	// lego only stops checking once its own timeout is up, so it reports the error
+	done, err := c.LegoPreCheck(context.Background())("stale.example.test", "_acme-challenge.stale.example.test.", "token", nil)
+	if done || err == nil {
+		t.Fatalf("expected lego to be told the check failed, got %v, %v", done, err)
+	}
+}
+
+func TestLegoPreCheckStopsWithContext(t *testing.T) {
+	f, addr := newFakeDNS(t)
+	c := newTestChecker(addr, time.Minute)
+	f.setTXT("_acme-challenge.stale.example.test.", "old", false)
+
+	// Shutting down doesn't wait out the propagation timeout
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	done, err := c.LegoPreCheck(ctx)("stale.example.test", "_acme-challenge.stale.example.test.", "token", nil)
+	if done || !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the check to be cancelled, got %v, %v", done, err)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Fatalf("took %s to stop", time.Since(start))
+	}
+}
+
+func TestNewCheckerCopiesResolvers(t *testing.T) {
+	resolvers := []string{"1.1.1.1", "9.9.9.9:5353"}
+	NewChecker(Config{Resolvers: resolvers})
+	if resolvers[0] != "1.1.1.1" || resolvers[1] != "9.9.9.9:5353" {
+		t.Fatalf("expected the caller's resolvers to be left alone, got %v", resolvers)
+	}
+}
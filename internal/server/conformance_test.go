@@ -0,0 +1,150 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/lachlan2k/acmespider/internal/dtos"
+)
+
+// signedEndpoint is an ACME endpoint taking JWS-signed requests, along with a request a client could send it
+type signedEndpoint struct {
+	name    string
+	url     string
+	key     *ecdsa.PrivateKey
+	kid     string
+	payload []byte
+}
+
+// conformanceEndpoints returns every signed endpoint, for an account that's already been issued a certificate
+func (h *testHarness) conformanceEndpoints() []signedEndpoint {
+	client, user := h.newClient()
+	res, err := client.Certificate.Obtain(certificate.ObtainRequest{Domains: []string{"wiki.internal.test"}})
+	if err != nil {
+		h.t.Fatalf("failed to obtain certificate: %v", err)
+	}
+	order := h.onlyOrder(user)
+	authz, err := h.db.GetAuthz([]byte(order.AuthzIDs[0]))
+	if err != nil {
+		h.t.Fatalf("failed to get authz: %v", err)
+	}
+	accountID := user.reg.URI[strings.LastIndex(user.reg.URI, "/")+1:]
+
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	revoke, _ := json.Marshal(dtos.RevokeCertRequestDTO{CertificateB64: base64.RawURLEncoding.EncodeToString([]byte("not a certificate"))})
+	postAsGet := []byte{}
+
+	return []signedEndpoint{
+		{"new-account", h.links.NewAccountPath().Abs(), newKey, "", []byte(`{"termsOfServiceAgreed":true}`)},
+		{"account", user.reg.URI, user.key, user.reg.URI, []byte(`{}`)},
+		{"key-change", h.links.AccountKeyChangePath().Abs(), user.key, user.reg.URI, []byte(`{}`)},
+		{"new-order", h.links.NewOrderPath().Abs(), user.key, user.reg.URI, []byte(`{"identifiers":[{"type":"dns","value":"wiki.internal.test"}]}`)},
+		{"order", h.links.OrderPath(order.ID).Abs(), user.key, user.reg.URI, postAsGet},
+		{"account-orders", h.links.AccountOrdersPath(accountID).Abs(), user.key, user.reg.URI, postAsGet},
+		{"finalize", h.links.FinalizeOrderPath(order.ID).Abs(), user.key, user.reg.URI, []byte(`{"csr":"AAAA"}`)},
+		{"authz", h.links.AuthzPath(authz.ID).Abs(), user.key, user.reg.URI, postAsGet},
+		{"challenge", h.links.ChallengePath(authz.Challenges[0].ID).Abs(), user.key, user.reg.URI, []byte(`{}`)},
+		{"certificate", res.CertURL, user.key, user.reg.URI, postAsGet},
+		{"revoke-cert", h.links.RevokeCertPath().Abs(), user.key, user.reg.URI, revoke},
+		{"rate-budget", h.links.RateBudgetPath().Abs(), user.key, user.reg.URI, postAsGet},
+	}
+}
+
+// expectNonce checks a response carries a fresh nonce, returning it
+func (h *testHarness) expectNonce(what string, resp *http.Response) string {
+	h.t.Helper()
+
+	n := resp.Header.Get("Replay-Nonce")
+	if n == "" {
+		h.t.Fatalf("%s: response had no Replay-Nonce", what)
+	}
+	if resp.Header.Get("Cache-Control") != "no-store" {
+		h.t.Fatalf("%s: expected Cache-Control no-store, got %q", what, resp.Header.Get("Cache-Control"))
+	}
+	return n
+}
+
+func TestConformanceBadNonce(t *testing.T) {
+	h := newTestHarness(t, harnessOptions{})
+
+	for _, e := range h.conformanceEndpoints() {
+		// A nonce we never issued
+		resp, body := h.post(e.key, e.kid, e.url, "bm90LWEtbm9uY2U", e.payload)
+		h.expectProblem(resp, body, http.StatusBadRequest, "badNonce")
+		retryNonce := h.expectNonce(e.name+" bogus nonce", resp)
+
+		resp, body = h.post(e.key, e.kid, e.url, "", e.payload)
+		h.expectProblem(resp, body, http.StatusBadRequest, "badNonce")
+		h.expectNonce(e.name+" missing nonce", resp)
+
+		// Retrying with the nonce from the error gets past the nonce check, whatever the endpoint makes of the request
+		resp, body = h.post(e.key, e.kid, e.url, retryNonce, e.payload)
+		var problem dtos.ProblemDTO
+		if json.Unmarshal(body, &problem) == nil && problem.Type == "urn:ietf:params:acme:error:badNonce" {
+			t.Fatalf("%s: retrying with the nonce from the error was rejected: %s", e.name, problem.Detail)
+		}
+		if n := h.expectNonce(e.name+" retry", resp); n == retryNonce {
+			t.Fatalf("%s: response handed out the nonce that was just used", e.name)
+		}
+
+		resp, body = h.post(e.key, e.kid, e.url, retryNonce, e.payload)
+		h.expectProblem(resp, body, http.StatusBadRequest, "badNonce")
+		h.expectNonce(e.name+" replayed nonce", resp)
+	}
+}
+
+func TestConformanceNonceOnEveryResponse(t *testing.T) {
+	h := newTestHarness(t, harnessOptions{})
+
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		req, _ := http.NewRequest(method, h.links.DirectoryPath().Abs(), nil)
+		resp, _ := h.do(req)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s directory: got %d", method, resp.StatusCode)
+		}
+		h.expectNonce(method+" directory", resp)
+	}
+
+	// RFC 8555 7.2: 200 for HEAD, 204 for GET
+	for method, status := range map[string]int{http.MethodHead: http.StatusOK, http.MethodGet: http.StatusNoContent} {
+		req, _ := http.NewRequest(method, h.links.NewNoncePath().Abs(), nil)
+		resp, _ := h.do(req)
+		if resp.StatusCode != status {
+			t.Fatalf("%s new-nonce: expected %d, got %d", method, status, resp.StatusCode)
+		}
+		h.expectNonce(method+" new-nonce", resp)
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, h.links.Path("/no-such-thing").Abs(), nil)
+	resp, _ := h.do(req)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown path, got %d", resp.StatusCode)
+	}
+	h.expectNonce("unknown path", resp)
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	req = h.signedRequest(h.links.NewAccountPath().Abs(), key, "", h.links.NewAccountPath().Abs(), h.freshNonce(), []byte(`{"termsOfServiceAgreed":true}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, body := h.do(req)
+	h.expectProblem(resp, body, http.StatusUnsupportedMediaType, "malformed")
+	h.expectNonce("wrong content type", resp)
+}
+
+func TestConformanceClientRetriesBadNonce(t *testing.T) {
+	h := newTestHarness(t, harnessOptions{})
+	client, _ := h.newClient()
+
+	// As if every nonce the client was holding had gone stale
+	h.nonces.rejectNext(3)
+	_, err := client.Certificate.Obtain(certificate.ObtainRequest{Domains: []string{"wiki.internal.test"}})
+	if err != nil {
+		t.Fatalf("client didn't recover from badNonce: %v", err)
+	}
+}
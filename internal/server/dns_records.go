@@ -0,0 +1,223 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/lachlan2k/acmespider/internal/db"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	dnsRecordReconcileInterval = 15 * time.Minute
+	// Orphaned records that still can't be cleaned up after this many tries are forgotten, with a warning to remove them by hand
+	maxDNSRecordCleanUpAttempts = 10
+)
+
+// statefulDNSProviders are the lego DNS providers that remember the IDs of the records they present, in memory,
+// and can only clean up records they presented themselves. Records they left behind before a restart are removed by hand
+var statefulDNSProviders = map[string]bool{
+	"allinkl": true, "arvancloud": true, "auroradns": true, "brandit": true, "cloudflare": true, "cloudru": true, "derak": true,
+	"digitalocean": true, "easydns": true, "hostingde": true, "hosttech": true, "infoblox": true, "infomaniak": true, "liara": true,
+	"liquidweb": true, "luadns": true, "netlify": true, "njalla": true, "nodion": true, "ovh": true, "plesk": true, "porkbun": true,
+	"safedns": true, "simply": true, "variomedia": true, "vercel": true, "websupport": true, "yandex360": true,
+}
+
+// dnsRecordTracker records every TXT record presented through the DNS providers, so records left behind by a crash,
+// or by a clean up that failed, are removed later. Records presented by this process that haven't been cleaned up yet
+// belong to an upstream order still being validated. Any other tracked record is orphaned
+type dnsRecordTracker struct {
+	db db.DB
+
+	lock      sync.Mutex
+	providers map[string]challenge.Provider
+	inUse     map[string]bool
+	// Records this process presented, which the provider that presented them can still clean up, even if it keeps state
+	presented map[string]bool
+	// Overrides statefulDNSProviders, for tests
+	stateful map[string]bool
+}
+
+func newDNSRecordTracker(boltDb db.DB) *dnsRecordTracker {
+	return &dnsRecordTracker{
+		db:        boltDb,
+		providers: map[string]challenge.Provider{},
+		inUse:     map[string]bool{},
+		presented: map[string]bool{},
+		stateful:  statefulDNSProviders,
+	}
+}
+
+// wrap returns a provider that tracks the records prov presents. name is the lego name of the provider,
+// which orphaned records are cleaned up with
+func (t *dnsRecordTracker) wrap(name string, prov challenge.Provider) challenge.Provider {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if _, exists := t.providers[name]; !exists {
+		t.providers[name] = prov
+	}
+	return trackedDNSProvider{tracker: t, name: name, provider: prov}
+}
+
+func dnsRecordID(provider string, domain string, keyAuth string) string {
+	sum := sha256.Sum256([]byte(provider + "\x00" + domain + "\x00" + keyAuth))
+	return hex.EncodeToString(sum[:])
+}
+
+type trackedDNSProvider struct {
+	tracker  *dnsRecordTracker
+	name     string
+	provider challenge.Provider
+}
+
+func (p trackedDNSProvider) Present(domain, token, keyAuth string) error {
+	info := dns01.GetChallengeInfo(domain, keyAuth)
+	record := db.DBDNSRecord{
+		ID:          dnsRecordID(p.name, domain, keyAuth),
+		Provider:    p.name,
+		Domain:      domain,
+		Token:       token,
+		KeyAuth:     keyAuth,
+		FQDN:        info.EffectiveFQDN,
+		Value:       info.Value,
+		PresentedAt: time.Now().Unix(),
+	}
+
+	p.tracker.lock.Lock()
+	p.tracker.inUse[record.ID] = true
+	p.tracker.presented[record.ID] = true
+	p.tracker.lock.Unlock()
+
+	// Saved first, so the record is known about even if we crash while presenting it
+	if err := p.tracker.db.CreateDNSRecord(record); err != nil {
+		p.tracker.release(record.ID)
+		return err
+	}
+
+	err := p.provider.Present(domain, token, keyAuth)
+	if err != nil {
+		// The provider didn't create it, so there's nothing to clean up
+		p.tracker.release(record.ID)
+		p.tracker.forget(record.ID)
+		if err := p.tracker.db.DeleteDNSRecord([]byte(record.ID)); err != nil {
+			log.WithError(err).WithField("fqdn", record.FQDN).Error("Failed to forget TXT record that couldn't be presented")
+		}
+	}
+	return err
+}
+
+func (p trackedDNSProvider) CleanUp(domain, token, keyAuth string) error {
+	id := dnsRecordID(p.name, domain, keyAuth)
+	// Whether or not this works, the record's no longer needed. If it's still there, it's orphaned
+	defer p.tracker.release(id)
+
+	err := p.provider.CleanUp(domain, token, keyAuth)
+	if err != nil {
+		return err
+	}
+	p.tracker.forget(id)
+	return p.tracker.db.DeleteDNSRecord([]byte(id))
+}
+
+// Timeout keeps lego waiting as long as the provider asks
+func (p trackedDNSProvider) Timeout() (timeout, interval time.Duration) {
+	if providerTimeout, ok := p.provider.(challenge.ProviderTimeout); ok {
+		return providerTimeout.Timeout()
+	}
+	return dns01.DefaultPropagationTimeout, dns01.DefaultPollingInterval
+}
+
+func (t *dnsRecordTracker) release(id string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.inUse, id)
+}
+
+func (t *dnsRecordTracker) forget(id string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.presented, id)
+}
+
+// reconcile cleans up every orphaned record
+func (t *dnsRecordTracker) reconcile() {
+	records, err := t.db.GetDNSRecords()
+	if err != nil {
+		log.WithError(err).Error("Failed to load tracked TXT records")
+		return
+	}
+
+	for _, record := range records {
+		t.lock.Lock()
+		inUse := t.inUse[record.ID]
+		presented := t.presented[record.ID]
+		prov := t.providers[record.Provider]
+		t.lock.Unlock()
+		if inUse {
+			continue
+		}
+
+		logger := log.WithField("fqdn", record.FQDN).WithField("value", record.Value).WithField("provider", record.Provider)
+		if prov == nil {
+			logger.Warn("Orphaned TXT record was presented with a DNS provider that's no longer configured, remove it by hand")
+			continue
+		}
+		if !presented && t.stateful[record.Provider] {
+			logger.Warn("Orphaned TXT record was left by an earlier run, and its DNS provider can only clean up records it presented itself, remove it by hand")
+			if err := t.db.DeleteDNSRecord([]byte(record.ID)); err != nil {
+				logger.WithError(err).Error("Failed to forget TXT record")
+			}
+			continue
+		}
+
+		err := prov.CleanUp(record.Domain, record.Token, record.KeyAuth)
+		if err == nil {
+			t.forget(record.ID)
+			logger.WithField("presented_at", time.Unix(record.PresentedAt, 0)).Info("Removed orphaned TXT record")
+			if err := t.db.DeleteDNSRecord([]byte(record.ID)); err != nil {
+				logger.WithError(err).Error("Failed to forget removed TXT record")
+			}
+			continue
+		}
+
+		if record.CleanUpAttempts+1 >= maxDNSRecordCleanUpAttempts {
+			logger.WithError(err).Warnf("Giving up on removing orphaned TXT record after %d attempts, remove it by hand", maxDNSRecordCleanUpAttempts)
+			t.forget(record.ID)
+			if err := t.db.DeleteDNSRecord([]byte(record.ID)); err != nil {
+				logger.WithError(err).Error("Failed to forget TXT record")
+			}
+			continue
+		}
+		logger.WithError(err).Warn("Failed to remove orphaned TXT record, will retry")
+		_, err = t.db.UpdateDNSRecord([]byte(record.ID), func(r *db.DBDNSRecord) error {
+			r.CleanUpAttempts++
+			return nil
+		})
+		if err != nil {
+			logger.WithError(err).Error("Failed to update TXT record")
+		}
+	}
+}
+
+// run reconciles straight away, for records left behind by the last run, then periodically until ctx is done.
+// The returned channel is closed once it's stopped, after which the database can be closed
+func (t *dnsRecordTracker) run(ctx context.Context, interval time.Duration) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			t.reconcile()
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+	return done
+}
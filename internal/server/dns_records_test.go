@@ -0,0 +1,168 @@
+package server
+
+import (
+	"errors"
+	"path"
+	"testing"
+
+	"github.com/lachlan2k/acmespider/internal/db"
+)
+
+// stuckDNSProvider presents records, but can't clean them up
+type stuckDNSProvider struct {
+	*fakeDNSProvider
+}
+
+func (p stuckDNSProvider) CleanUp(domain, token, keyAuth string) error {
+	return errors.New("permission denied")
+}
+
+// statefulDNSProvider remembers which tokens it presented, the way providers keeping record IDs in memory do,
+// and can only clean those up. The first clean up fails
+type statefulDNSProvider struct {
+	*fakeDNSProvider
+	presented   map[string]bool
+	cleanUps    int
+	failCleanUp bool
+}
+
+func newStatefulDNSProvider(dns *fakeDNSProvider) *statefulDNSProvider {
+	return &statefulDNSProvider{fakeDNSProvider: dns, presented: map[string]bool{}, failCleanUp: true}
+}
+
+func (p *statefulDNSProvider) Present(domain, token, keyAuth string) error {
+	p.presented[token] = true
+	return p.fakeDNSProvider.Present(domain, token, keyAuth)
+}
+
+func (p *statefulDNSProvider) CleanUp(domain, token, keyAuth string) error {
+	p.cleanUps++
+	if !p.presented[token] {
+		return errors.New("unknown record ID")
+	}
+	if p.failCleanUp {
+		p.failCleanUp = false
+		return errors.New("timed out")
+	}
+	delete(p.presented, token)
+	return p.fakeDNSProvider.CleanUp(domain, token, keyAuth)
+}
+
+func newTestDB(t *testing.T) db.DB {
+	boltDb, err := db.NewBoltDb(path.Join(t.TempDir(), "acmespider.db"))
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	t.Cleanup(func() { boltDb.Close() })
+	return boltDb
+}
+
+func TestDNSRecordReconcileAfterRestart(t *testing.T) {
+	boltDb := newTestDB(t)
+	dns := newFakeDNSProvider()
+
+	// Presented, then the order's still being validated when the reconciler runs
+	tracker := newDNSRecordTracker(boltDb)
+	if err := tracker.wrap("fake", dns).Present("wiki.internal.test", "token", "token.thumbprint"); err != nil {
+		t.Fatal(err)
+	}
+	tracker.reconcile()
+	if _, ok := dns.lookup("_acme-challenge.wiki.internal.test."); !ok {
+		t.Fatal("record in use was cleaned up")
+	}
+
+	// Then we crash, and start again
+	restarted := newDNSRecordTracker(boltDb)
+	restarted.wrap("fake", dns)
+	restarted.reconcile()
+
+	if _, ok := dns.lookup("_acme-challenge.wiki.internal.test."); ok {
+		t.Fatal("orphaned record wasn't cleaned up")
+	}
+	if tracked, err := boltDb.GetDNSRecords(); err != nil || len(tracked) != 0 {
+		t.Fatalf("expected orphaned record to be forgotten, got %v, %v", tracked, err)
+	}
+}
+
+func TestDNSRecordReconcileFailedCleanUp(t *testing.T) {
+	boltDb := newTestDB(t)
+	dns := stuckDNSProvider{newFakeDNSProvider()}
+	tracker := newDNSRecordTracker(boltDb)
+	prov := tracker.wrap("stuck", dns)
+
+	if err := prov.Present("wiki.internal.test", "token", "token.thumbprint"); err != nil {
+		t.Fatal(err)
+	}
+	if err := prov.CleanUp("wiki.internal.test", "token", "token.thumbprint"); err == nil {
+		t.Fatal("expected clean up to fail")
+	}
+
+	for i := 1; i < maxDNSRecordCleanUpAttempts; i++ {
+		tracker.reconcile()
+		tracked, err := boltDb.GetDNSRecords()
+		if err != nil || len(tracked) != 1 || tracked[0].CleanUpAttempts != i {
+			t.Fatalf("expected record to be kept for another attempt after %d, got %+v, %v", i, tracked, err)
+		}
+	}
+
+	tracker.reconcile()
+	if tracked, err := boltDb.GetDNSRecords(); err != nil || len(tracked) != 0 {
+		t.Fatalf("expected record to be given up on, got %+v, %v", tracked, err)
+	}
+}
+
+func TestDNSRecordReconcileUnknownProvider(t *testing.T) {
+	boltDb := newTestDB(t)
+	if err := newDNSRecordTracker(boltDb).wrap("old", newFakeDNSProvider()).Present("wiki.internal.test", "token", "token.thumbprint"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The provider's since been changed, so the record can't be cleaned up, but isn't forgotten either
+	tracker := newDNSRecordTracker(boltDb)
+	tracker.wrap("new", newFakeDNSProvider())
+	tracker.reconcile()
+
+	if tracked, err := boltDb.GetDNSRecords(); err != nil || len(tracked) != 1 || tracked[0].Provider != "old" {
+		t.Fatalf("expected record to be kept, got %+v, %v", tracked, err)
+	}
+}
+
+func TestDNSRecordReconcileStatefulProvider(t *testing.T) {
+	boltDb := newTestDB(t)
+	dns := newFakeDNSProvider()
+	tracker := newDNSRecordTracker(boltDb)
+	tracker.stateful = map[string]bool{"stateful": true}
+	prov := tracker.wrap("stateful", newStatefulDNSProvider(dns))
+
+	// A failed clean up is retried by the provider that presented the record, which still knows about it
+	if err := prov.Present("wiki.internal.test", "token", "token.thumbprint"); err != nil {
+		t.Fatal(err)
+	}
+	if err := prov.CleanUp("wiki.internal.test", "token", "token.thumbprint"); err == nil {
+		t.Fatal("expected clean up to fail")
+	}
+	tracker.reconcile()
+	if _, ok := dns.lookup("_acme-challenge.wiki.internal.test."); ok {
+		t.Fatal("orphaned record wasn't cleaned up")
+	}
+	if tracked, err := boltDb.GetDNSRecords(); err != nil || len(tracked) != 0 {
+		t.Fatalf("expected removed record to be forgotten, got %+v, %v", tracked, err)
+	}
+
+	// After a restart the new provider doesn't know about the record, so it's left to be removed by hand
+	if err := prov.Present("printer.internal.test", "other-token", "other-token.thumbprint"); err != nil {
+		t.Fatal(err)
+	}
+	restarted := newDNSRecordTracker(boltDb)
+	restarted.stateful = map[string]bool{"stateful": true}
+	fresh := newStatefulDNSProvider(dns)
+	restarted.wrap("stateful", fresh)
+	restarted.reconcile()
+
+	if fresh.cleanUps != 0 {
+		t.Fatalf("expected no clean up with a provider that didn't present the record, got %d", fresh.cleanUps)
+	}
+	if tracked, err := boltDb.GetDNSRecords(); err != nil || len(tracked) != 0 {
+		t.Fatalf("expected record to be left for removing by hand, got %+v, %v", tracked, err)
+	}
+}
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-acme/lego/v4/acme"
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/go-acme/lego/v4/lego"
+	dnsProviders "github.com/go-acme/lego/v4/providers/dns"
+	"github.com/lachlan2k/acmespider/internal/acme_controller"
+	"github.com/lachlan2k/acmespider/internal/db"
+	"github.com/lachlan2k/acmespider/internal/issuer"
+)
+
+// DoctorOptions are what the doctor checks beyond the config itself
+type DoctorOptions struct {
+	// An internal name to try reaching over HTTP-01, if any
+	HTTP01Name string
+	// How long to wait for the test TXT record to be visible to every public resolver
+	PropagationTimeout time.Duration
+}
+
+// doctor runs checks one after another, printing each result with what to do about failures
+type doctor struct {
+	out    io.Writer
+	failed bool
+}
+
+func (d *doctor) ok(format string, args ...any) {
+	fmt.Fprintf(d.out, "[ ok ] %s\n", fmt.Sprintf(format, args...))
+}
+
+func (d *doctor) skip(format string, args ...any) {
+	fmt.Fprintf(d.out, "[skip] %s\n", fmt.Sprintf(format, args...))
+}
+
+// fail prints a failed check, then the hint indented beneath it
+func (d *doctor) fail(hint string, format string, args ...any) {
+	d.failed = true
+	fmt.Fprintf(d.out, "[FAIL] %s\n", fmt.Sprintf(format, args...))
+	if hint == "" {
+		return
+	}
+	for _, line := range strings.Split(hint, "\n") {
+		fmt.Fprintf(d.out, "       %s\n", line)
+	}
+}
+
+// Doctor checks a deployment's DNS provider, public resolvers, upstream and HTTP-01 reachability,
+// printing what it finds to out. It returns false if anything failed
+func Doctor(conf Config, opts DoctorOptions, out io.Writer) bool {
+	d := &doctor{out: out}
+	if conf.UpstreamIssuer != issuer.UpstreamIssuerACME {
+		return d.run(conf, opts, nil, nil)
+	}
+	prov, err := dnsProviders.NewDNSChallengeProviderByName(conf.DNSProvider)
+	return d.run(conf, opts, prov, err)
+}
+
+// run does the checks with the DNS provider already set up, or failed to be, if one's needed
+func (d *doctor) run(conf Config, opts DoctorOptions, prov challenge.Provider, provErr error) bool {
+	if prov != nil || provErr != nil {
+		d.checkDNSProvider(conf, opts, prov, provErr)
+	} else {
+		d.skip("DNS provider: not used, as the upstream isn't ACME")
+	}
+
+	d.checkUpstream(conf)
+
+	if opts.HTTP01Name != "" {
+		d.checkHTTP01(conf, opts.HTTP01Name)
+	} else {
+		d.skip("HTTP-01: give an internal name with --http01-name to check ACMESpider can reach it")
+	}
+
+	return !d.failed
+}
+
+func (d *doctor) checkDNSProvider(conf Config, opts DoctorOptions, prov challenge.Provider, provErr error) {
+	if provErr != nil {
+		d.fail(
+			fmt.Sprintf("Set ACMESPIDER_DNS_PROVIDER and the provider's credentials, see https://go-acme.github.io/lego/dns/%s/", conf.DNSProvider),
+			"DNS provider %q: %v", conf.DNSProvider, provErr,
+		)
+		return
+	}
+	d.ok("DNS provider %s is configured", conf.DNSProvider)
+
+	token, err := acme_controller.GenerateChallengeToken()
+	if err != nil {
+		d.fail("", "Generating test record: %v", err)
+		return
+	}
+	domain := "acmespider-doctor." + conf.Hostname
+	info := dns01.GetChallengeInfo(domain, token)
+
+	if err = prov.Present(domain, token, token); err != nil {
+		d.fail(
+			fmt.Sprintf("Check the credentials can edit TXT records in the zone containing %s.\nMany providers need API tokens scoped to the zone, with DNS edit permission", conf.Hostname),
+			"Creating TXT record %s: %v", info.EffectiveFQDN, err,
+		)
+		return
+	}
+	d.ok("Created TXT record %s", info.EffectiveFQDN)
+
+	d.checkPropagation(conf, opts, prov, info)
+
+	if err = prov.CleanUp(domain, token, token); err != nil {
+		d.fail(
+			fmt.Sprintf("Remove the TXT record %s by hand, and check the credentials can delete records", info.EffectiveFQDN),
+			"Removing TXT record %s: %v", info.EffectiveFQDN, err,
+		)
+		return
+	}
+	d.ok("Removed TXT record %s", info.EffectiveFQDN)
+}
+
+// checkPropagation waits for the test record to reach the zone's nameservers, the same way the server does before
+// asking the upstream to validate a DNS-01 challenge
+func (d *doctor) checkPropagation(conf Config, opts DoctorOptions, prov challenge.Provider, info dns01.ChallengeInfo) {
+	conf.DNSPropagationTimeout = opts.PropagationTimeout
+	checker := newPropagationChecker(conf, prov)
+
+	start := time.Now()
+	if err := checker.Wait(context.Background(), info.EffectiveFQDN, info.Value); err != nil {
+		d.fail(
+			fmt.Sprintf("Check the zone's nameservers are %s's, and that records aren't cached for long.\nIf %s can't be reached from here, change ACMESPIDER_PUBLIC_RESOLVERS", conf.DNSProvider, strings.Join(conf.PublicDNSResolvers, ", ")),
+			"%v", err,
+		)
+		return
+	}
+	d.ok("TXT record %s propagated after %s", info.EffectiveFQDN, time.Since(start).Round(time.Second))
+}
+
+func (d *doctor) checkUpstream(conf Config) {
+	if conf.UpstreamIssuer != issuer.UpstreamIssuerACME {
+		upstream, err := makeUpstreamIssuer(conf, nil)
+		if err != nil {
+			d.fail("Check the upstream issuer's settings", "Upstream %s: %v", conf.UpstreamIssuer, err)
+			return
+		}
+		if err = upstream.Health(); err != nil {
+			d.fail("Check the upstream's address and credentials, and that it's reachable from here", "Upstream %s: %v", conf.UpstreamIssuer, err)
+			return
+		}
+		d.ok("Upstream %s is healthy", conf.UpstreamIssuer)
+		return
+	}
+
+	key, err := doctorAccountKey(conf)
+	if err != nil {
+		d.skip("Upstream account: %v", err)
+	}
+
+	// Without our account key, a throwaway one checks the directory at least
+	user := &MyUser{Email: conf.Email, key: key}
+	if key == nil {
+		if user.key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			d.fail("", "Generating key: %v", err)
+			return
+		}
+	}
+	legoConfig := lego.NewConfig(user)
+	legoConfig.CADirURL = conf.CADirectory
+	legoClient, err := lego.NewClient(legoConfig)
+	if err != nil {
+		d.fail("Check ACMESPIDER_ACME_CA_DIRECTORY, and that it's reachable from here", "Upstream ACME directory %s: %v", conf.CADirectory, err)
+		return
+	}
+	d.ok("Upstream ACME directory %s is reachable", conf.CADirectory)
+
+	if key == nil {
+		return
+	}
+	reg, err := legoClient.Registration.ResolveAccountByKey()
+	if err != nil {
+		d.fail("The account is registered again on the next start, as long as ACMESPIDER_ACME_TOS_ACCEPT is set", "Upstream account: %v", err)
+		return
+	}
+	if reg.Body.Status != acme.StatusValid {
+		d.fail("The upstream CA no longer accepts the account. Move the storage directory aside to register a new one, which also forgets ACME clients' accounts", "Upstream account %s is %s", reg.URI, reg.Body.Status)
+		return
+	}
+	d.ok("Upstream account %s is valid", reg.URI)
+}
+
+// doctorAccountKey loads the upstream account key, if there's one yet. The database can't be opened while the server is running
+func doctorAccountKey(conf Config) (*ecdsa.PrivateKey, error) {
+	dbPath := path.Join(conf.StoragePath, "acmespider.db")
+	if _, err := os.Stat(dbPath); errors.Is(err, os.ErrNotExist) {
+		return nil, errors.New("not registered yet, which happens on the first start")
+	}
+
+	boltDb, err := db.NewBoltDb(dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open %s, it's probably in use by the server. Its /readyz checks the account instead", dbPath)
+	}
+	defer boltDb.Close()
+
+	marshalled, err := boltDb.GetGlobalKey()
+	if db.IsErrNotFound(err) {
+		return nil, errors.New("not registered yet, which happens on the first start")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseECPrivateKey(marshalled)
+}
+
+// checkHTTP01 resolves and connects to name the way validation does. The host won't know the test token,
+// so any response from it is a success
+func (d *doctor) checkHTTP01(conf Config, name string) {
+	validator := acme_controller.NewHTTP01Validator(conf.HTTP01)
+
+	token, err := acme_controller.GenerateChallengeToken()
+	if err != nil {
+		d.fail("", "Generating token: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	prob := validator.Validate(ctx, name, token, token)
+	switch {
+	case prob == nil:
+		d.ok("HTTP-01: reached %s", name)
+	case prob.IsDNSProblem():
+		d.fail("Check ACMESPIDER_INTERNAL_RESOLVERS can resolve the name, or give its address in ACMESPIDER_HTTP01_HOSTS", "HTTP-01: %s", prob.Detail)
+	case prob.IsConnectionProblem():
+		d.fail(fmt.Sprintf("Check %s serves HTTP on port 80, and firewalls allow connections from ACMESpider", name), "HTTP-01: %s", prob.Detail)
+	default:
+		d.ok("HTTP-01: reached %s, which answered as expected for an unknown token (%s)", name, prob.Detail)
+	}
+}
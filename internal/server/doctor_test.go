@@ -0,0 +1,149 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/lachlan2k/acmespider/internal/acme_controller"
+	"github.com/lachlan2k/acmespider/internal/issuer"
+	"github.com/miekg/dns"
+)
+
+// newFakePublicDNS serves the TXT records in prov, the way public resolvers would once they've propagated
+func newFakePublicDNS(t *testing.T, prov *fakeDNSProvider) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen for fake dns: %v", err)
+	}
+
+	srv := &dns.Server{
+		PacketConn: conn,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			m.Rcode = dns.RcodeNameError
+			for _, q := range r.Question {
+				value, ok := prov.lookup(q.Name)
+				if !ok || q.Qtype != dns.TypeTXT {
+					continue
+				}
+				m.Rcode = dns.RcodeSuccess
+				m.Answer = append(m.Answer, &dns.TXT{
+					Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+					Txt: []string{value},
+				})
+			}
+			w.WriteMsg(m)
+		}),
+	}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+
+	return conn.LocalAddr().String()
+}
+
+func newDoctorConfig(t *testing.T, prov *fakeDNSProvider) Config {
+	upstream := newFakeUpstream(t, prov)
+	responder := httptest.NewServer(&challengeResponder{keyAuths: map[string]string{}})
+	t.Cleanup(responder.Close)
+	responderAddr := responder.Listener.Addr().String()
+
+	internalDNS := newFakeInternalDNS(t, defaultDNSRecords)
+	return Config{
+		Hostname:           "acmespider.internal.test",
+		StoragePath:        t.TempDir(),
+		UpstreamIssuer:     issuer.UpstreamIssuerACME,
+		CADirectory:        upstream.directoryURL(),
+		DNSProvider:        "fake",
+		PublicDNSResolvers: []string{newFakePublicDNS(t, prov)},
+		HTTP01: acme_controller.HTTP01Config{
+			Resolvers: []string{internalDNS},
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, responderAddr)
+			},
+		},
+	}
+}
+
+func TestDoctor(t *testing.T) {
+	prov := newFakeDNSProvider()
+	conf := newDoctorConfig(t, prov)
+
+	var out bytes.Buffer
+	d := &doctor{out: &out}
+	passed := d.run(conf, DoctorOptions{HTTP01Name: "printer.lan", PropagationTimeout: 10 * time.Second}, prov, nil)
+	if !passed {
+		t.Fatalf("expected every check to pass:\n%s", out.String())
+	}
+
+	for _, expected := range []string{
+		"[ ok ] Created TXT record _acme-challenge.acmespider-doctor.acmespider.internal.test.",
+		"propagated after",
+		"[ ok ] Removed TXT record",
+		"[skip] Upstream account: not registered yet",
+		"[ ok ] Upstream ACME directory",
+		"[ ok ] HTTP-01: reached printer.lan",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected output to contain %q:\n%s", expected, out.String())
+		}
+	}
+	prov.lock.Lock()
+	defer prov.lock.Unlock()
+	if len(prov.records) != 0 {
+		t.Errorf("test record left behind: %v", prov.records)
+	}
+}
+
+// invisibleDNSProvider accepts records that never show up in DNS
+type invisibleDNSProvider struct{}
+
+func (invisibleDNSProvider) Present(domain, token, keyAuth string) error { return nil }
+func (invisibleDNSProvider) CleanUp(domain, token, keyAuth string) error { return nil }
+
+func TestDoctorFailures(t *testing.T) {
+	conf := newDoctorConfig(t, newFakeDNSProvider())
+
+	tests := map[string]struct {
+		prov     challenge.Provider
+		provErr  error
+		opts     DoctorOptions
+		expected []string
+	}{
+		"no provider": {
+			provErr:  errors.New("unrecognized DNS provider: fake"),
+			expected: []string{`[FAIL] DNS provider "fake": unrecognized DNS provider`, "https://go-acme.github.io/lego/dns/fake/"},
+		},
+		"not propagated": {
+			prov:     invisibleDNSProvider{},
+			opts:     DoctorOptions{PropagationTimeout: 100 * time.Millisecond},
+			expected: []string{"didn't propagate within 100ms", "change ACMESPIDER_PUBLIC_RESOLVERS"},
+		},
+		"unresolvable name": {
+			opts:     DoctorOptions{HTTP01Name: "nowhere.lan"},
+			expected: []string{"[FAIL] HTTP-01: Failed to resolve nowhere.lan", "ACMESPIDER_HTTP01_HOSTS"},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var out bytes.Buffer
+			d := &doctor{out: &out}
+			if d.run(conf, tt.opts, tt.prov, tt.provErr) {
+				t.Fatalf("expected a failure:\n%s", out.String())
+			}
+			for _, expected := range tt.expected {
+				if !strings.Contains(out.String(), expected) {
+					t.Errorf("expected output to contain %q:\n%s", expected, out.String())
+				}
+			}
+		})
+	}
+}
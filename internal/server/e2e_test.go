@@ -0,0 +1,1482 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/go-acme/lego/v4/registration"
+	"github.com/lachlan2k/acmespider/internal/acme_controller"
+	"github.com/lachlan2k/acmespider/internal/db"
+	"github.com/lachlan2k/acmespider/internal/dtos"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"golang.org/x/crypto/ocsp"
+)
+
+// parseChain splits a PEM bundle into certificates
+func parseChain(t *testing.T, bundle []byte) []*x509.Certificate {
+	certs := []*x509.Certificate{}
+	for {
+		var block *pem.Block
+		block, bundle = pem.Decode(bundle)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatalf("failed to parse certificate in chain: %v", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		t.Fatalf("chain contained no certificates")
+	}
+	return certs
+}
+
+func TestE2EIssueFromUpstream(t *testing.T) {
+	h := newTestHarness(t, harnessOptions{})
+	client, _ := h.newClient()
+
+	res, err := client.Certificate.Obtain(certificate.ObtainRequest{
+		Domains: []string{"wiki.internal.test"},
+		Bundle:  true,
+	})
+	if err != nil {
+		t.Fatalf("failed to obtain certificate: %v", err)
+	}
+
+	chain := parseChain(t, res.Certificate)
+	leaf := chain[0]
+	if len(leaf.DNSNames) != 1 || leaf.DNSNames[0] != "wiki.internal.test" {
+		t.Fatalf("leaf had names %v", leaf.DNSNames)
+	}
+	if err = leaf.CheckSignatureFrom(h.upstream.caCert); err != nil {
+		t.Fatalf("leaf wasn't issued by the upstream: %v", err)
+	}
+
+	h.dns.lock.Lock()
+	defer h.dns.lock.Unlock()
+	if len(h.dns.records) != 0 {
+		t.Fatalf("upstream DNS records left behind: %v", h.dns.records)
+	}
+	if len(h.dns.cleaned) != 1 || h.dns.cleaned[0] != "_acme-challenge.wiki.internal.test." {
+		t.Fatalf("unexpected DNS cleanups %v", h.dns.cleaned)
+	}
+	if tracked, err := h.db.GetDNSRecords(); err != nil || len(tracked) != 0 {
+		t.Fatalf("expected cleaned up DNS records to be forgotten, got %v, %v", tracked, err)
+	}
+}
+
+func TestE2EIssueFromLocalCA(t *testing.T) {
+	h := newTestHarness(t, harnessOptions{localCADomains: []string{"lan"}})
+	client, _ := h.newClient()
+
+	res, err := client.Certificate.Obtain(certificate.ObtainRequest{
+		Domains: []string{"printer.lan"},
+		Bundle:  true,
+	})
+	if err != nil {
+		t.Fatalf("failed to obtain certificate: %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(h.localCA.RootPEM()) {
+		t.Fatal("failed to load local CA root")
+	}
+	chain := parseChain(t, res.Certificate)
+	intermediates := x509.NewCertPool()
+	for _, c := range chain[1:] {
+		intermediates.AddCert(c)
+	}
+	_, err = chain[0].Verify(x509.VerifyOptions{DNSName: "printer.lan", Roots: roots, Intermediates: intermediates})
+	if err != nil {
+		t.Fatalf("leaf didn't chain to the local CA: %v", err)
+	}
+
+	if len(h.upstream.orders) != 0 {
+		t.Fatalf("local CA order went to the upstream")
+	}
+}
+
+func TestE2EInvalidChallenge(t *testing.T) {
+	h := newTestHarness(t, harnessOptions{})
+	client, user := h.newClient()
+
+	h.responder.override = "not-the-key-authorization"
+	_, err := client.Certificate.Obtain(certificate.ObtainRequest{
+		Domains: []string{"wiki.internal.test"},
+	})
+	if err == nil {
+		t.Fatal("obtained a certificate despite a failed challenge")
+	}
+	// The reason makes it all the way back to the client
+	if !strings.Contains(err.Error(), "incorrectResponse") || !strings.Contains(err.Error(), "wrong token") {
+		t.Fatalf("client wasn't told why the challenge failed: %v", err)
+	}
+	if len(h.upstream.orders) != 0 {
+		t.Fatalf("order with a failed challenge went to the upstream")
+	}
+
+	order := h.onlyOrder(user)
+	if order.Status != "invalid" || order.Error == nil {
+		t.Fatalf("expected order to be invalid with an error, got %s %v", order.Status, order.Error)
+	}
+	if len(order.Error.Subproblems) != 1 {
+		t.Fatalf("expected one subproblem, got %v", order.Error.Subproblems)
+	}
+	sub := order.Error.Subproblems[0]
+	if sub.Type != "urn:ietf:params:acme:error:incorrectResponse" || sub.Identifier == nil || sub.Identifier.Value != "wiki.internal.test" {
+		t.Fatalf("unexpected subproblem %+v", sub)
+	}
+}
+
+func TestE2EUpstreamFailure(t *testing.T) {
+	h := newTestHarness(t, harnessOptions{})
+	client, user := h.newClient()
+
+	h.upstream.failFinalizeWith = "rateLimited"
+	h.upstream.retryAfter = "3600"
+	_, err := client.Certificate.Obtain(certificate.ObtainRequest{
+		Domains: []string{"wiki.internal.test"},
+	})
+	if err == nil {
+		t.Fatal("obtained a certificate despite the upstream failing")
+	}
+	if !strings.Contains(err.Error(), "rateLimited") {
+		t.Fatalf("client wasn't told the upstream rate limited the order: %v", err)
+	}
+
+	order := h.onlyOrder(user)
+	if order.Error == nil || order.Error.Type != "urn:ietf:params:acme:error:rateLimited" {
+		t.Fatalf("expected order error to be rateLimited, got %+v", order.Error)
+	}
+
+	resp, _ := h.post(user.key, user.reg.URI, h.links.OrderPath(order.ID).Abs(), h.freshNonce(), []byte{})
+	retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || retryAfter < 3500 || retryAfter > 3600 {
+		t.Fatalf("expected upstream Retry-After to be passed on, got %q", resp.Header.Get("Retry-After"))
+	}
+}
+
+func TestE2EUpstreamChallengeFailure(t *testing.T) {
+	h := newTestHarness(t, harnessOptions{})
+	client, user := h.newClient()
+
+	h.upstream.failChallengeWith = map[string]string{"printer.lan": "caa", "wiki.internal.test": "unauthorized"}
+	_, err := client.Certificate.Obtain(certificate.ObtainRequest{
+		Domains: []string{"wiki.internal.test", "printer.lan"},
+	})
+	if err == nil {
+		t.Fatal("obtained a certificate despite upstream challenges failing")
+	}
+
+	order := h.onlyOrder(user)
+	if order.Error == nil || order.Error.Type != "urn:ietf:params:acme:error:compound" || len(order.Error.Subproblems) != 2 {
+		t.Fatalf("expected a compound order error with two subproblems, got %+v", order.Error)
+	}
+	// Sorted by identifier, only the CAA failure is worth showing the client
+	caa, hidden := order.Error.Subproblems[0], order.Error.Subproblems[1]
+	if caa.Type != "urn:ietf:params:acme:error:caa" || caa.Identifier == nil || caa.Identifier.Value != "printer.lan" {
+		t.Fatalf("unexpected subproblem %+v", caa)
+	}
+	if hidden.Type != "urn:ietf:params:acme:error:serverInternal" || strings.Contains(hidden.Detail, "challenge failed by test") {
+		t.Fatalf("upstream detail wasn't hidden: %+v", hidden)
+	}
+}
+
+func TestE2ERateLimitBudget(t *testing.T) {
+	h := newTestHarness(t, harnessOptions{
+		rateLimits: acme_controller.RateLimitConfig{CertsPerNameSet: 1, CertsPerRegisteredDomain: 5},
+		dnsRecords: map[string]string{"docs.internal.test": "127.0.0.1"},
+	})
+	client, user := h.newClient()
+
+	_, err := client.Certificate.Obtain(certificate.ObtainRequest{Domains: []string{"wiki.internal.test"}})
+	if err != nil {
+		t.Fatalf("failed to obtain certificate: %v", err)
+	}
+
+	h.upstream.lock.Lock()
+	upstreamOrders := len(h.upstream.orders)
+	h.upstream.lock.Unlock()
+	_, err = client.Certificate.Obtain(certificate.ObtainRequest{Domains: []string{"wiki.internal.test"}})
+	if err == nil || !strings.Contains(err.Error(), "rateLimited") {
+		t.Fatalf("expected a duplicate certificate to be rate limited, got %v", err)
+	}
+	if len(h.upstream.orders) != upstreamOrders {
+		t.Fatal("rate limited order went to the upstream")
+	}
+
+	// A different set of names under the same registered domain still fits
+	_, err = client.Certificate.Obtain(certificate.ObtainRequest{Domains: []string{"wiki.internal.test", "docs.internal.test"}})
+	if err != nil {
+		t.Fatalf("failed to obtain certificate for a new name set: %v", err)
+	}
+
+	// Only accounts can see the budget
+	req, _ := http.NewRequest(http.MethodGet, h.links.RateBudgetPath().Abs(), nil)
+	if resp, _ := h.do(req); resp.StatusCode == http.StatusOK {
+		t.Fatalf("expected the budget not to be readable without an account, got %d", resp.StatusCode)
+	}
+
+	resp, body := h.post(user.key, user.reg.URI, h.links.RateBudgetPath().Abs()+"?names=WIKI.internal.test", h.freshNonce(), []byte{})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("failed to get rate budget: %d %s", resp.StatusCode, body)
+	}
+	var budget dtos.RateBudgetResponseDTO
+	json.Unmarshal(body, &budget)
+	if len(budget.RegisteredDomains) != 1 || budget.RegisteredDomains[0].Name != "internal.test" || *budget.RegisteredDomains[0].Remaining != 3 {
+		t.Fatalf("unexpected registered domain budget %+v", budget.RegisteredDomains)
+	}
+	if budget.NameSet == nil || budget.NameSet.Issued != 1 || *budget.NameSet.Remaining != 0 {
+		t.Fatalf("unexpected name set budget %+v", budget.NameSet)
+	}
+}
+
+func TestE2ERequestRateLimit(t *testing.T) {
+	h := newTestHarness(t, harnessOptions{abuse: acme_controller.AbuseConfig{RequestsPerSecond: 0.1, RequestBurst: 3}})
+
+	for i := 0; i < 3; i++ {
+		h.freshNonce()
+	}
+	req, _ := http.NewRequest(http.MethodGet, h.links.DirectoryPath().Abs(), nil)
+	resp, body := h.do(req)
+	h.expectProblem(resp, body, http.StatusTooManyRequests, "rateLimited")
+	if retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After")); err != nil || retryAfter < 1 || retryAfter > 10 {
+		t.Fatalf("expected Retry-After to be when the next request is allowed, got %q", resp.Header.Get("Retry-After"))
+	}
+	if resp.Header.Get("Replay-Nonce") == "" {
+		t.Fatal("rate limited response had no Replay-Nonce")
+	}
+
+	// Health checks aren't counted
+	req, _ = http.NewRequest(http.MethodGet, h.srv.URL+"/healthz", nil)
+	if resp, _ = h.do(req); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected healthz to be left alone, got %d", resp.StatusCode)
+	}
+}
+
+func TestE2EAbuseLimits(t *testing.T) {
+	h := newTestHarness(t, harnessOptions{
+		abuse: acme_controller.AbuseConfig{
+			MaxBodyBytes:           4096,
+			AccountsPerNetwork:     2,
+			MaxPendingOrders:       1,
+			MaxIdentifiersPerOrder: 2,
+		},
+		tenants: []acme_controller.TenantConfig{{Name: "lab"}},
+	})
+	_, user := h.newClient()
+	newOrder := func(names ...string) (*http.Response, []byte) {
+		identifiers := []dtos.OrderIdentifierDTO{}
+		for _, name := range names {
+			identifiers = append(identifiers, dtos.OrderIdentifierDTO{Type: "dns", Value: name})
+		}
+		payload, _ := json.Marshal(dtos.OrderCreateRequestDTO{Identifiers: identifiers})
+		return h.post(user.key, user.reg.URI, h.links.NewOrderPath().Abs(), h.freshNonce(), payload)
+	}
+
+	resp, body := h.post(user.key, user.reg.URI, h.links.NewOrderPath().Abs(), h.freshNonce(), []byte(strings.Repeat(" ", 8192)))
+	h.expectProblem(resp, body, http.StatusRequestEntityTooLarge, "malformed")
+
+	resp, body = newOrder("wiki.internal.test", "printer.lan", "docs.internal.test")
+	h.expectProblem(resp, body, http.StatusBadRequest, "malformed")
+
+	if resp, body = newOrder("wiki.internal.test"); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected first order to be created, got %d %s", resp.StatusCode, body)
+	}
+	resp, body = newOrder("printer.lan")
+	h.expectProblem(resp, body, http.StatusTooManyRequests, "rateLimited")
+	if resp.Header.Get("Retry-After") == "" {
+		t.Fatal("expected Retry-After for when the pending order expires")
+	}
+
+	// The harness's account was the first from 127.0.0.0/24
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	resp, _ = h.post(key, "", h.links.NewAccountPath().Abs(), h.freshNonce(), []byte(`{"termsOfServiceAgreed":true}`))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected second account to be created, got %d", resp.StatusCode)
+	}
+	key, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	resp, body = h.post(key, "", h.links.NewAccountPath().Abs(), h.freshNonce(), []byte(`{"termsOfServiceAgreed":true}`))
+	h.expectProblem(resp, body, http.StatusTooManyRequests, "rateLimited")
+	if retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After")); err != nil || retryAfter < 3500 {
+		t.Fatalf("expected Retry-After to be when the window frees up, got %q", resp.Header.Get("Retry-After"))
+	}
+
+	// Going through another tenant's directory doesn't get the network a fresh allowance
+	lab := h.tenantLinks["lab"]
+	resp, body = h.post(key, "", lab.NewAccountPath().Abs(), h.freshNonce(), []byte(`{"termsOfServiceAgreed":true}`))
+	h.expectProblem(resp, body, http.StatusTooManyRequests, "rateLimited")
+}
+
+func TestE2ECertificateReuse(t *testing.T) {
+	h := newTestHarness(t, harnessOptions{certReuse: acme_controller.CertReuseConfig{Enabled: true}})
+	client, _ := h.newClient()
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	obtain := func(key *ecdsa.PrivateKey) *x509.Certificate {
+		res, err := client.Certificate.Obtain(certificate.ObtainRequest{Domains: []string{"wiki.internal.test"}, PrivateKey: key})
+		if err != nil {
+			t.Fatalf("failed to obtain certificate: %v", err)
+		}
+		return parseChain(t, res.Certificate)[0]
+	}
+
+	first := obtain(key)
+	h.upstream.lock.Lock()
+	upstreamOrders := len(h.upstream.orders)
+	h.upstream.lock.Unlock()
+
+	again := obtain(key)
+	if again.SerialNumber.Cmp(first.SerialNumber) != 0 {
+		t.Fatal("same key and names got a new certificate")
+	}
+	if len(h.upstream.orders) != upstreamOrders {
+		t.Fatal("reused certificate was ordered from the upstream anyway")
+	}
+
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if obtain(otherKey).SerialNumber.Cmp(first.SerialNumber) == 0 {
+		t.Fatal("certificate was reused for a different key")
+	}
+
+	// Once revoked with the upstream, it's not handed out again
+	if err := client.Certificate.Revoke(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: first.Raw})); err != nil {
+		t.Fatalf("failed to revoke certificate: %v", err)
+	}
+	if obtain(key).SerialNumber.Cmp(first.SerialNumber) == 0 {
+		t.Fatal("revoked certificate was reused")
+	}
+}
+
+func TestE2ETenants(t *testing.T) {
+	eabKey := []byte("platform-team-eab-hmac-key-32byt")
+	h := newTestHarness(t, harnessOptions{tenants: []acme_controller.TenantConfig{
+		{Name: "platform", RequireEAB: true, EABKeys: map[string][]byte{"platform-team": eabKey}},
+		{Name: "ot", AllowedDomains: []string{"lan"}},
+	}})
+	ot := h.tenantLinks["ot"]
+	accountID := func(user *testUser) string {
+		return user.reg.URI[strings.LastIndex(user.reg.URI, "/")+1:]
+	}
+
+	// The OT directory only issues for its own names
+	otClient, otUser := h.newUnregisteredClient(ot)
+	var err error
+	otUser.reg, err = otClient.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+	if err != nil {
+		t.Fatalf("failed to register with the ot tenant: %v", err)
+	}
+	if !strings.HasPrefix(otUser.reg.URI, ot.BaseURL+"/") {
+		t.Fatalf("ot account %s isn't under the tenant's directory", otUser.reg.URI)
+	}
+	if _, err = otClient.Certificate.Obtain(certificate.ObtainRequest{Domains: []string{"printer.lan"}}); err != nil {
+		t.Fatalf("failed to obtain certificate from the ot tenant: %v", err)
+	}
+	_, err = otClient.Certificate.Obtain(certificate.ObtainRequest{Domains: []string{"wiki.internal.test"}})
+	if err == nil || !strings.Contains(err.Error(), "rejectedIdentifier") {
+		t.Fatalf("expected the ot tenant to reject a name outside its policy, got %v", err)
+	}
+
+	// Accounts can't be used through another tenant's directory, even with the KID rewritten to match
+	_, defaultUser := h.newClient()
+	order := []byte(`{"identifiers":[{"type":"dns","value":"printer.lan"}]}`)
+	resp, body := h.post(defaultUser.key, ot.AccountPath(accountID(defaultUser)).Abs(), ot.NewOrderPath().Abs(), h.freshNonce(), order)
+	h.expectProblem(resp, body, http.StatusForbidden, "unauthorized")
+	resp, body = h.post(otUser.key, h.links.AccountPath(accountID(otUser)).Abs(), h.links.NewOrderPath().Abs(), h.freshNonce(), order)
+	h.expectProblem(resp, body, http.StatusForbidden, "unauthorized")
+
+	// The platform directory requires external account binding
+	platform := h.tenantLinks["platform"]
+	req, _ := http.NewRequest(http.MethodGet, platform.DirectoryPath().Abs(), nil)
+	resp, body = h.do(req)
+	var dir dtos.DirectoryListResponseDTO
+	if err = json.Unmarshal(body, &dir); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("failed to get platform directory: %d %s", resp.StatusCode, string(body))
+	}
+	if !dir.Meta.ExternalAccountRequired {
+		t.Fatal("platform directory doesn't advertise that external account binding is required")
+	}
+
+	platformClient, platformUser := h.newUnregisteredClient(platform)
+	_, err = platformClient.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+	if err == nil || !strings.Contains(err.Error(), "externalAccountRequired") {
+		t.Fatalf("expected registration without EAB to be refused, got %v", err)
+	}
+	_, err = platformClient.Registration.RegisterWithExternalAccountBinding(registration.RegisterEABOptions{
+		TermsOfServiceAgreed: true,
+		Kid:                  "platform-team",
+		HmacEncoded:          base64.RawURLEncoding.EncodeToString([]byte("not-the-platform-team-hmac-key!!")),
+	})
+	if err == nil {
+		t.Fatal("registration with the wrong EAB key was accepted")
+	}
+	platformUser.reg, err = platformClient.Registration.RegisterWithExternalAccountBinding(registration.RegisterEABOptions{
+		TermsOfServiceAgreed: true,
+		Kid:                  "platform-team",
+		HmacEncoded:          base64.RawURLEncoding.EncodeToString(eabKey),
+	})
+	if err != nil {
+		t.Fatalf("failed to register with EAB: %v", err)
+	}
+	if _, err = platformClient.Certificate.Obtain(certificate.ObtainRequest{Domains: []string{"wiki.internal.test"}}); err != nil {
+		t.Fatalf("failed to obtain certificate from the platform tenant: %v", err)
+	}
+
+	account, err := h.db.GetAccount([]byte(accountID(platformUser)))
+	if err != nil {
+		t.Fatalf("failed to get account: %v", err)
+	}
+	if account.Tenant != "platform" || account.EABKeyID != "platform-team" {
+		t.Fatalf("expected account bound to platform-team in the platform tenant, got %q %q", account.Tenant, account.EABKeyID)
+	}
+}
+
+func TestE2EIssuancePolicy(t *testing.T) {
+	h := newTestHarness(t, harnessOptions{policy: `
+rules:
+  - name: no-lan
+    effect: deny
+    when: identifiers.exists(id, id.endsWith(".lan"))
+    message: .lan names aren't issued here
+  - name: ec-only
+    effect: deny
+    when: stage == "finalize" && csr.keyType != "ECDSA"
+`})
+	client, _ := h.newClient()
+
+	_, err := client.Certificate.Obtain(certificate.ObtainRequest{Domains: []string{"printer.lan"}})
+	if err == nil || !strings.Contains(err.Error(), "rejectedIdentifier") || !strings.Contains(err.Error(), ".lan names aren't issued here") {
+		t.Fatalf("expected order to be rejected by policy, got %v", err)
+	}
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, err = client.Certificate.Obtain(certificate.ObtainRequest{Domains: []string{"wiki.internal.test"}, PrivateKey: rsaKey})
+	if err == nil || !strings.Contains(err.Error(), "badCSR") || !strings.Contains(err.Error(), "ec-only") {
+		t.Fatalf("expected finalize to be rejected by policy, got %v", err)
+	}
+
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if _, err = client.Certificate.Obtain(certificate.ObtainRequest{Domains: []string{"wiki.internal.test"}, PrivateKey: ecKey}); err != nil {
+		t.Fatalf("failed to obtain certificate allowed by policy: %v", err)
+	}
+}
+
+func TestE2EIssuancePolicyIssuerLifetime(t *testing.T) {
+	policy := `
+rules:
+  - name: ten-days
+    effect: deny
+    when: identifiers.exists(id, id.endsWith(".short.internal.test")) && validity > duration("240h")
+    message: certificates here last at most 10 days
+`
+	dnsRecords := map[string]string{"ca.short.internal.test": "127.0.0.1", "wiki.short.internal.test": "127.0.0.1"}
+	h := newTestHarness(t, harnessOptions{
+		localCADomains: []string{"ca.short.internal.test"},
+		dnsRecords:     dnsRecords,
+		policy:         policy,
+	})
+	client, user := h.newClient()
+
+	// The local CA's 30 day lifetime is known up front, so the order is turned away
+	_, err := client.Certificate.Obtain(certificate.ObtainRequest{Domains: []string{"ca.short.internal.test"}})
+	if err == nil || !strings.Contains(err.Error(), "rejectedIdentifier") || !strings.Contains(err.Error(), "at most 10 days") {
+		t.Fatalf("expected order to be rejected by policy, got %v", err)
+	}
+
+	// The upstream's lifetime isn't known, so the order is turned away before anything is issued
+	_, err = client.Certificate.Obtain(certificate.ObtainRequest{Domains: []string{"wiki.short.internal.test"}})
+	if err == nil || !strings.Contains(err.Error(), "rejectedIdentifier") || !strings.Contains(err.Error(), "must set notAfter") {
+		t.Fatalf("expected upstream order to be rejected by policy, got %v", err)
+	}
+	if len(h.upstream.certs) != 0 {
+		t.Fatalf("expected nothing to be issued upstream, got %d certificates", len(h.upstream.certs))
+	}
+	account, err := h.db.GetAccount([]byte(user.reg.URI[strings.LastIndex(user.reg.URI, "/")+1:]))
+	if err != nil || len(account.Orders) != 0 {
+		t.Fatalf("expected no orders to be created, got %v %v", account, err)
+	}
+
+	// Once the upstream's lifetime is declared the policy can judge it
+	h = newTestHarness(t, harnessOptions{dnsRecords: dnsRecords, policy: policy, upstreamCertLifetime: 90 * 24 * time.Hour})
+	client, _ = h.newClient()
+	_, err = client.Certificate.Obtain(certificate.ObtainRequest{Domains: []string{"wiki.short.internal.test"}})
+	if err == nil || !strings.Contains(err.Error(), "at most 10 days") {
+		t.Fatalf("expected upstream order to be rejected by policy, got %v", err)
+	}
+	h = newTestHarness(t, harnessOptions{dnsRecords: dnsRecords, policy: policy, upstreamCertLifetime: 7 * 24 * time.Hour})
+	client, _ = h.newClient()
+	if _, err = client.Certificate.Obtain(certificate.ObtainRequest{Domains: []string{"wiki.short.internal.test"}}); err != nil {
+		t.Fatalf("failed to obtain certificate within the policy's lifetime: %v", err)
+	}
+}
+
+func TestE2EManualApproval(t *testing.T) {
+	notifications := make(chan dtos.ApprovalNotificationDTO, 4)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var notification dtos.ApprovalNotificationDTO
+		json.NewDecoder(r.Body).Decode(&notification)
+		notifications <- notification
+	}))
+	defer webhook.Close()
+
+	h := newTestHarness(t, harnessOptions{
+		dnsRecords:  map[string]string{"photos.internal.test": "127.0.0.1"},
+		approvals:   acme_controller.ApprovalConfig{Domains: []string{"internal.test"}, WebhookURL: webhook.URL},
+		adminTokens: map[string]string{"s3cret": "alice"},
+	})
+	client, _ := h.newClient()
+
+	obtain := func(name string) <-chan error {
+		result := make(chan error, 1)
+		go func() {
+			_, err := client.Certificate.Obtain(certificate.ObtainRequest{Domains: []string{name}})
+			result <- err
+		}()
+		return result
+	}
+	awaitNotification := func(name string) dtos.ApprovalDTO {
+		t.Helper()
+		select {
+		case notification := <-notifications:
+			if notification.Event != "approval_requested" || notification.Approval.Identifier != name || notification.Approval.Status != db.ApprovalStatusPending {
+				t.Fatalf("unexpected notification %+v", notification)
+			}
+			return notification.Approval
+		case <-time.After(10 * time.Second):
+			t.Fatalf("no notification for %s", name)
+		}
+		return dtos.ApprovalDTO{}
+	}
+
+	// Names outside the sensitive zones go straight through
+	if _, err := client.Certificate.Obtain(certificate.ObtainRequest{Domains: []string{"printer.lan"}}); err != nil {
+		t.Fatalf("failed to obtain certificate not needing approval: %v", err)
+	}
+
+	result := obtain("wiki.internal.test")
+	approval := awaitNotification("wiki.internal.test")
+
+	if resp, _ := h.admin(http.MethodGet, "/approvals", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected admin API to need a token, got %d", resp.StatusCode)
+	}
+	if resp, _ := h.admin(http.MethodGet, "/approvals", "wrong"); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected admin API to reject unknown token, got %d", resp.StatusCode)
+	}
+
+	resp, body := h.admin(http.MethodGet, "/approvals?status=pending", "s3cret")
+	var list dtos.ApprovalListResponseDTO
+	if resp.StatusCode != http.StatusOK || json.Unmarshal(body, &list) != nil || len(list.Approvals) != 1 || list.Approvals[0].ID != approval.ID {
+		t.Fatalf("expected the pending approval to be listed, got %d %s", resp.StatusCode, body)
+	}
+
+	// The order is held until approved
+	select {
+	case err := <-result:
+		t.Fatalf("order finished before it was approved: %v", err)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	resp, body = h.admin(http.MethodPost, "/approvals/"+approval.ID+"/approve", "s3cret")
+	var decided dtos.ApprovalDTO
+	if resp.StatusCode != http.StatusOK || json.Unmarshal(body, &decided) != nil {
+		t.Fatalf("failed to approve: %d %s", resp.StatusCode, body)
+	}
+	if decided.Status != db.ApprovalStatusApproved || decided.DecidedBy != "alice" || decided.DecidedAt == "" {
+		t.Fatalf("approval didn't record the decision: %+v", decided)
+	}
+	if err := <-result; err != nil {
+		t.Fatalf("failed to obtain approved certificate: %v", err)
+	}
+
+	if resp, _ = h.admin(http.MethodPost, "/approvals/"+approval.ID+"/deny", "s3cret"); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected deciding twice to conflict, got %d", resp.StatusCode)
+	}
+
+	// Once the account has had a certificate for the name, it doesn't need approval again
+	if _, err := client.Certificate.Obtain(certificate.ObtainRequest{Domains: []string{"wiki.internal.test"}}); err != nil {
+		t.Fatalf("failed to renew approved certificate: %v", err)
+	}
+
+	result = obtain("photos.internal.test")
+	approval = awaitNotification("photos.internal.test")
+	// Deny once the client is waiting on its held challenge
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		// The approval is requested just before the order is saved
+		order, err := h.db.GetOrder([]byte(approval.OrderIDs[0]))
+		if err != nil && !db.IsErrNotFound(err) {
+			t.Fatalf("failed to get held order: %v", err)
+		}
+		if order != nil && len(order.HeldChallengeIDs) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("challenge was never held")
+		}
+	}
+	req, _ := http.NewRequest(http.MethodPost, h.srv.URL+"/admin/approvals/"+approval.ID+"/deny", strings.NewReader(`{"reason":"not a team we issue for"}`))
+	req.Header.Set("Authorization", "Bearer s3cret")
+	req.Header.Set("Content-Type", "application/json")
+	if resp, body = h.do(req); resp.StatusCode != http.StatusOK {
+		t.Fatalf("failed to deny: %d %s", resp.StatusCode, body)
+	}
+	err := <-result
+	if err == nil || !strings.Contains(err.Error(), "rejectedIdentifier") || !strings.Contains(err.Error(), "not a team we issue for") {
+		t.Fatalf("expected denied order to fail with the reason, got %v", err)
+	}
+
+	if resp, _ = h.admin(http.MethodGet, "/approvals/nope", "s3cret"); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected unknown approval to 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestE2EManualApprovalTenant(t *testing.T) {
+	notifications := make(chan dtos.ApprovalNotificationDTO, 4)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var notification dtos.ApprovalNotificationDTO
+		json.NewDecoder(r.Body).Decode(&notification)
+		notifications <- notification
+	}))
+	defer webhook.Close()
+
+	h := newTestHarness(t, harnessOptions{
+		tenants:     []acme_controller.TenantConfig{{Name: "ot"}},
+		approvals:   acme_controller.ApprovalConfig{Domains: []string{"internal.test"}, WebhookURL: webhook.URL},
+		adminTokens: map[string]string{"s3cret": "alice"},
+	})
+	ot := h.tenantLinks["ot"]
+	client, user := h.newUnregisteredClient(ot)
+	var err error
+	if user.reg, err = client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true}); err != nil {
+		t.Fatalf("failed to register with the ot tenant: %v", err)
+	}
+
+	// Orders made at the same time for the same name share one approval, and the webhook only hears about it once
+	results := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			resp, _ := h.post(user.key, user.reg.URI, ot.NewOrderPath().Abs(), h.freshNonce(), []byte(`{"identifiers":[{"type":"dns","value":"wiki.internal.test"}]}`))
+			results <- resp.StatusCode
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if status := <-results; status != http.StatusCreated {
+			t.Fatalf("failed to create order: %d", status)
+		}
+	}
+	var approval dtos.ApprovalDTO
+	select {
+	case notification := <-notifications:
+		approval = notification.Approval
+	case <-time.After(10 * time.Second):
+		t.Fatal("no notification for the orders")
+	}
+	select {
+	case notification := <-notifications:
+		t.Fatalf("expected a single notification, also got %+v", notification)
+	case <-time.After(500 * time.Millisecond):
+	}
+	resp, body := h.admin(http.MethodGet, "/approvals?status=pending", "s3cret")
+	var list dtos.ApprovalListResponseDTO
+	if resp.StatusCode != http.StatusOK || json.Unmarshal(body, &list) != nil || len(list.Approvals) != 1 || len(list.Approvals[0].OrderIDs) != 2 {
+		t.Fatalf("expected one pending approval for both orders, got %d %s", resp.StatusCode, body)
+	}
+
+	// The tenant's orders carry on once approved
+	if resp, body = h.admin(http.MethodPost, "/approvals/"+approval.ID+"/approve", "s3cret"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("failed to approve: %d %s", resp.StatusCode, body)
+	}
+	if _, err = client.Certificate.Obtain(certificate.ObtainRequest{Domains: []string{"wiki.internal.test"}}); err != nil {
+		t.Fatalf("failed to obtain approved certificate from the tenant: %v", err)
+	}
+}
+
+func TestE2EGracefulShutdown(t *testing.T) {
+	h := newTestHarness(t, harnessOptions{})
+	client, _ := h.newClient()
+
+	if _, err := client.Certificate.Obtain(certificate.ObtainRequest{Domains: []string{"printer.lan"}}); err != nil {
+		t.Fatalf("failed to obtain certificate: %v", err)
+	}
+	// Finished work isn't waited on
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := h.work.Wait(ctx, h.db); err != nil || ctx.Err() != nil {
+		t.Fatalf("expected nothing to wait for, got %v", err)
+	}
+
+	stall := make(chan struct{}, 1)
+	h.responder.lock.Lock()
+	h.responder.stall = stall
+	h.responder.lock.Unlock()
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := client.Certificate.Obtain(certificate.ObtainRequest{Domains: []string{"wiki.internal.test"}})
+		result <- err
+	}()
+	select {
+	case <-stall:
+	case <-time.After(10 * time.Second):
+		t.Fatal("validation never started")
+	}
+
+	h.work.Drain()
+	_, err := client.Certificate.Obtain(certificate.ObtainRequest{Domains: []string{"printer.lan"}})
+	if err == nil || !strings.Contains(err.Error(), "503") || !strings.Contains(err.Error(), "shutting down") {
+		t.Fatalf("expected new orders to be refused while draining, got %v", err)
+	}
+
+	// The stalled validation is cancelled once the deadline passes, and left processing with its authz unlocked
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err = h.work.Wait(ctx, h.db); err != nil {
+		t.Fatalf("expected cancelled validation to finish up, got %v", err)
+	}
+	authzs, err := h.db.GetAuthzsWithChallengeStatus(dtos.ChallengeStatusProcessing)
+	if err != nil || len(authzs) != 1 {
+		t.Fatalf("expected the validation to be left processing, got %v %v", authzs, err)
+	}
+	if authzs[0].Status != dtos.AuthzStatusPending || authzs[0].Locked {
+		t.Fatalf("expected a pending, unlocked authz, got %s locked=%v", authzs[0].Status, authzs[0].Locked)
+	}
+
+	// After a restart, the validation carries on
+	h.responder.lock.Lock()
+	h.responder.stall = nil
+	h.responder.lock.Unlock()
+	h.work = acme_controller.NewWorkTracker()
+	if err = h.newHandlers(acme_controller.TenantConfig{}, h.links).AcmeCtrl.ResumeValidations(); err != nil {
+		t.Fatalf("failed to resume validations: %v", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err = h.work.Wait(ctx, h.db); err != nil {
+		t.Fatalf("resumed validation didn't finish: %v", err)
+	}
+	authz, err := h.db.GetAuthz([]byte(authzs[0].ID))
+	if err != nil || authz.Status != dtos.AuthzStatusValid {
+		t.Fatalf("expected the resumed validation to succeed, got %v %v", authz, err)
+	}
+
+	// The client polled through it all, and only gets turned away when finalizing with the old server
+	select {
+	case err = <-result:
+		if err == nil || !strings.Contains(err.Error(), "shutting down") {
+			t.Fatalf("expected the old server to refuse to finalize, got %v", err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("in-flight order never finished")
+	}
+}
+
+func TestE2EResumeIssuance(t *testing.T) {
+	h := newTestHarness(t, harnessOptions{})
+	client, user := h.newClient()
+
+	if _, err := client.Certificate.Obtain(certificate.ObtainRequest{Domains: []string{"wiki.internal.test"}}); err != nil {
+		t.Fatalf("failed to obtain certificate: %v", err)
+	}
+	order := h.onlyOrder(user)
+	cert, err := h.db.GetCertificate([]byte(order.CertificateID))
+	if err != nil {
+		t.Fatalf("failed to get certificate: %v", err)
+	}
+	if order.CSR != nil {
+		t.Fatal("expected the CSR to be dropped once the order was issued")
+	}
+
+	// Crash while the certificate was being issued, with the order left processing
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	csr, _ := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: parseChain(t, cert.Certificate)[0].DNSNames}, key)
+	_, err = h.db.UpdateOrder([]byte(order.ID), func(orderToUpdate *db.DBOrder) error {
+		orderToUpdate.Status = dtos.OrderStatusProcessing
+		orderToUpdate.CertificateID = ""
+		orderToUpdate.CSR = csr
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to update order: %v", err)
+	}
+
+	h.work = acme_controller.NewWorkTracker()
+	if err = h.newHandlers(acme_controller.TenantConfig{}, h.links).AcmeCtrl.ResumeIssuance(); err != nil {
+		t.Fatalf("failed to resume issuance: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err = h.work.Wait(ctx, h.db); err != nil {
+		t.Fatalf("resumed issuance didn't finish: %v", err)
+	}
+	resumed := h.onlyOrder(user)
+	if resumed.Status != dtos.OrderStatusValid || resumed.CertificateID == "" || resumed.CertificateID == order.CertificateID {
+		t.Fatalf("expected the resumed order to be issued a new certificate, got %s %q", resumed.Status, resumed.CertificateID)
+	}
+}
+
+func TestE2ERequestLogging(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(log.LevelHooks{})
+
+	h := newTestHarness(t, harnessOptions{})
+	client, user := h.newClient()
+	accountID := strings.TrimPrefix(user.reg.URI, h.links.AccountPath("").Abs())
+
+	req, _ := http.NewRequest(http.MethodGet, h.links.DirectoryPath().Abs(), nil)
+	resp, _ := h.do(req)
+	if resp.Header.Get("X-Request-Id") == "" {
+		t.Fatal("expected responses to carry a request ID")
+	}
+
+	if _, err := client.Certificate.Obtain(certificate.ObtainRequest{Domains: []string{"wiki.internal.test"}}); err != nil {
+		t.Fatalf("failed to obtain certificate: %v", err)
+	}
+
+	// Lines logged by background validation and issuance carry the ID of the request that started them
+	requestURIs := map[string]string{}
+	background := map[string]*log.Entry{}
+	for _, entry := range hook.AllEntries() {
+		switch entry.Message {
+		case "request":
+			if entry.Data["account_id"] != nil && entry.Data["account_id"] != accountID {
+				t.Fatalf("request logged with the wrong account: %v", entry.Data)
+			}
+			requestURIs[entry.Data["request_id"].(string)], _ = entry.Data["URI"].(string)
+		case "HTTP-01 challenge validated", "Certificate issued":
+			background[entry.Message] = entry
+		}
+	}
+
+	for message, startedBy := range map[string]string{"HTTP-01 challenge validated": "/chall/", "Certificate issued": "/finalize"} {
+		entry := background[message]
+		if entry == nil {
+			t.Fatalf("%q wasn't logged", message)
+		}
+		if entry.Data["account_id"] != accountID {
+			t.Errorf("expected %q to be logged with the account, got %v", message, entry.Data)
+		}
+		requestID, _ := entry.Data["request_id"].(string)
+		if !strings.Contains(requestURIs[requestID], startedBy) {
+			t.Errorf("expected %q to be logged with the ID of a %s request, got %v", message, startedBy, entry.Data)
+		}
+	}
+}
+
+func TestE2EHealth(t *testing.T) {
+	h := newTestHarness(t, harnessOptions{})
+
+	get := func(path string) (*http.Response, dtos.HealthReportDTO) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, h.srv.URL+path, nil)
+		resp, body := h.do(req)
+		var report dtos.HealthReportDTO
+		if err := json.Unmarshal(body, &report); err != nil {
+			t.Fatalf("%s returned invalid JSON %s", path, body)
+		}
+		return resp, report
+	}
+
+	if resp, report := get("/healthz"); resp.StatusCode != http.StatusOK || report.Status != dtos.HealthStatusOK {
+		t.Fatalf("expected healthz to be ok, got %d %+v", resp.StatusCode, report)
+	}
+
+	resp, report := get("/readyz")
+	if resp.StatusCode != http.StatusOK || report.Status != dtos.HealthStatusOK {
+		t.Fatalf("expected readyz to be ok, got %d %+v", resp.StatusCode, report)
+	}
+	for _, name := range []string{"accepting_work", "database", "upstream"} {
+		if report.Checks[name].Status != dtos.HealthStatusOK {
+			t.Errorf("expected %s check to pass, got %+v", name, report.Checks)
+		}
+	}
+
+	// Load balancers should stop sending new work once shutdown starts
+	h.work.Drain()
+	resp, report = get("/readyz")
+	if resp.StatusCode != http.StatusServiceUnavailable || report.Checks["accepting_work"].Error != "shutting down" {
+		t.Fatalf("expected readyz to fail while draining, got %d %+v", resp.StatusCode, report)
+	}
+	if resp, _ = get("/healthz"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected healthz to stay ok while draining, got %d", resp.StatusCode)
+	}
+}
+
+func TestE2EExpiredNonce(t *testing.T) {
+	h := newTestHarness(t, harnessOptions{})
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	n := h.freshNonce()
+	h.nonces.expire(n)
+
+	resp, body := h.post(key, "", h.links.NewAccountPath().Abs(), n, []byte(`{"termsOfServiceAgreed":true}`))
+	h.expectProblem(resp, body, http.StatusBadRequest, "badNonce")
+
+	// A good nonce still works
+	resp, _ = h.post(key, "", h.links.NewAccountPath().Abs(), h.freshNonce(), []byte(`{"termsOfServiceAgreed":true}`))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected account to be created, got %d", resp.StatusCode)
+	}
+}
+
+func TestE2EReplayedNonce(t *testing.T) {
+	h := newTestHarness(t, harnessOptions{})
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	n := h.freshNonce()
+
+	resp, _ := h.post(key, "", h.links.NewAccountPath().Abs(), n, []byte(`{"termsOfServiceAgreed":true}`))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected account to be created, got %d", resp.StatusCode)
+	}
+
+	resp, body := h.post(key, "", h.links.NewAccountPath().Abs(), n, []byte(`{"termsOfServiceAgreed":true}`))
+	h.expectProblem(resp, body, http.StatusBadRequest, "badNonce")
+}
+
+func TestE2EWrongURL(t *testing.T) {
+	h := newTestHarness(t, harnessOptions{})
+	_, user := h.newClient()
+
+	// Sent to new-order, but signed for new-account
+	resp, body := h.postTo(h.links.NewOrderPath().Abs(), user.key, user.reg.URI, h.links.NewAccountPath().Abs(), h.freshNonce(),
+		[]byte(`{"identifiers":[{"type":"dns","value":"wiki.internal.test"}]}`))
+	h.expectProblem(resp, body, http.StatusBadRequest, "malformed")
+}
+
+func TestE2ESourceIPBinding(t *testing.T) {
+	h := newTestHarness(t, harnessOptions{
+		dnsRecords:      map[string]string{"photos.internal.test": "10.0.0.5"},
+		sourceIPBinding: true,
+	})
+	client, _ := h.newClient()
+
+	_, err := client.Certificate.Obtain(certificate.ObtainRequest{Domains: []string{"wiki.internal.test"}})
+	if err != nil {
+		t.Fatalf("failed to obtain certificate for a name resolving to the requester: %v", err)
+	}
+
+	for _, names := range [][]string{{"photos.internal.test"}, {"missing.internal.test"}, {"wiki.internal.test", "photos.internal.test"}} {
+		_, err = client.Certificate.Obtain(certificate.ObtainRequest{Domains: names})
+		if err == nil {
+			t.Fatalf("obtained a certificate for %v, which doesn't resolve to the requester", names)
+		}
+	}
+}
+
+func TestE2ESourceIPBindingBehindProxy(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	h := newTestHarness(t, harnessOptions{
+		dnsRecords:      map[string]string{"photos.internal.test": "10.0.0.5"},
+		sourceIPBinding: true,
+		trustedProxies:  []*net.IPNet{loopback},
+	})
+	_, user := h.newClient()
+
+	newOrder := func(forwardedFor string) (*http.Response, []byte) {
+		req := h.signedRequest(h.links.NewOrderPath().Abs(), user.key, user.reg.URI, h.links.NewOrderPath().Abs(), h.freshNonce(),
+			[]byte(`{"identifiers":[{"type":"dns","value":"photos.internal.test"}]}`))
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		return h.do(req)
+	}
+
+	resp, body := newOrder("")
+	h.expectProblem(resp, body, http.StatusForbidden, "unauthorized")
+
+	resp, body = newOrder("10.0.0.9")
+	h.expectProblem(resp, body, http.StatusForbidden, "unauthorized")
+
+	// Anything left of the first untrusted hop is client controlled, so doesn't count
+	resp, body = newOrder("10.0.0.5, 10.0.0.9")
+	h.expectProblem(resp, body, http.StatusForbidden, "unauthorized")
+
+	resp, _ = newOrder("10.0.0.5")
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected order to be created for forwarded address, got %d", resp.StatusCode)
+	}
+}
+
+// newClientCA returns a CA pool and a function issuing client certificates from it
+func newClientCA(t *testing.T) (*x509.CertPool, func(name string) tls.Certificate) {
+	pool, issueFor := newClientCAWith(t)
+	issue := func(name string) tls.Certificate {
+		return issueFor(pkix.Name{CommonName: name}, nil)
+	}
+	return pool, issue
+}
+
+// newClientCAWith is newClientCA, issuing certificates with any subject and SANs
+func newClientCAWith(t *testing.T) (*x509.CertPool, func(subject pkix.Name, dnsNames []string) tls.Certificate) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Client CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, _ := x509.ParseCertificate(caDER)
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+
+	serial := int64(1)
+	issue := func(subject pkix.Name, dnsNames []string) tls.Certificate {
+		serial++
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      subject,
+			DNSNames:     dnsNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, caCert, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+	return pool, issue
+}
+
+func TestE2EClientCertificates(t *testing.T) {
+	clientCAs, issue := newClientCA(t)
+	h := newTestHarness(t, harnessOptions{clientCAs: clientCAs})
+
+	// Trusts the test server, presenting cert if one's given
+	clientWith := func(cert *tls.Certificate) *http.Client {
+		transport := h.srv.Client().Transport.(*http.Transport).Clone()
+		if cert != nil {
+			transport.TLSClientConfig.Certificates = []tls.Certificate{*cert}
+		}
+		return &http.Client{Transport: transport}
+	}
+	deviceA, deviceB := issue("device-a"), issue("device-b")
+
+	// Without a certificate, the ACME API is off limits, but health checks aren't
+	req, _ := http.NewRequest(http.MethodGet, h.links.DirectoryPath().Abs(), nil)
+	resp, body := h.do(req)
+	h.expectProblem(resp, body, http.StatusForbidden, "unauthorized")
+	req, _ = http.NewRequest(http.MethodGet, h.srv.URL+"/healthz", nil)
+	if resp, _ = h.do(req); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected healthz to work without a client certificate, got %d", resp.StatusCode)
+	}
+
+	// Certificates from anywhere else don't get past the handshake
+	certPEM, keyPEM := selfSignedKeyPair(t, "device-a", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	rogue, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rogueClient := clientWith(nil)
+	// Go would only send a certificate from a CA the server asked for, so it's sent regardless
+	rogueClient.Transport.(*http.Transport).TLSClientConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return &rogue, nil
+	}
+	req, _ = http.NewRequest(http.MethodGet, h.links.DirectoryPath().Abs(), nil)
+	if _, err = rogueClient.Do(req); err == nil {
+		t.Fatal("expected a client certificate from an untrusted CA to be rejected")
+	}
+
+	client, user := h.newUnregisteredClientUsing(h.links, clientWith(&deviceA))
+	user.reg, err = client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+	if err != nil {
+		t.Fatalf("failed to register with a client certificate: %v", err)
+	}
+	_, err = client.Certificate.Obtain(certificate.ObtainRequest{Domains: []string{"wiki.internal.test"}})
+	if err != nil {
+		t.Fatalf("failed to obtain certificate with a client certificate: %v", err)
+	}
+
+	accountID := user.reg.URI[strings.LastIndex(user.reg.URI, "/")+1:]
+	account, err := h.db.GetAccount([]byte(accountID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.ClientCertSubject != "CN=device-a" {
+		t.Fatalf("expected account to be bound to device-a, got %q", account.ClientCertSubject)
+	}
+
+	// Another device holding the account key still can't use it
+	nonceReq, _ := http.NewRequest(http.MethodHead, h.links.NewNoncePath().Abs(), nil)
+	resp, _ = h.doWith(clientWith(&deviceB), nonceReq)
+	req = h.signedRequest(h.links.NewOrderPath().Abs(), user.key, user.reg.URI, h.links.NewOrderPath().Abs(), resp.Header.Get("Replay-Nonce"),
+		[]byte(`{"identifiers":[{"type":"dns","value":"wiki.internal.test"}]}`))
+	resp, body = h.doWith(clientWith(&deviceB), req)
+	h.expectProblem(resp, body, http.StatusForbidden, "unauthorized")
+
+	// Nor can it look the account up by key
+	resp, _ = h.doWith(clientWith(&deviceB), nonceReq)
+	req = h.signedRequest(h.links.NewAccountPath().Abs(), user.key, "", h.links.NewAccountPath().Abs(), resp.Header.Get("Replay-Nonce"),
+		[]byte(`{"onlyReturnExisting":true}`))
+	resp, body = h.doWith(clientWith(&deviceB), req)
+	h.expectProblem(resp, body, http.StatusForbidden, "unauthorized")
+}
+
+func TestE2EClientCertificateWithoutSubject(t *testing.T) {
+	clientCAs, issue := newClientCAWith(t)
+	h := newTestHarness(t, harnessOptions{clientCAs: clientCAs})
+
+	clientWith := func(cert tls.Certificate) *http.Client {
+		transport := h.srv.Client().Transport.(*http.Transport).Clone()
+		transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+		return &http.Client{Transport: transport}
+	}
+	// Device certificates often only have SANs
+	deviceA := clientWith(issue(pkix.Name{}, []string{"device-a.internal.test"}))
+	deviceB := clientWith(issue(pkix.Name{}, []string{"device-b.internal.test"}))
+
+	client, user := h.newUnregisteredClientUsing(h.links, deviceA)
+	var err error
+	user.reg, err = client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+	if err != nil {
+		t.Fatalf("failed to register with a client certificate: %v", err)
+	}
+	accountID := user.reg.URI[strings.LastIndex(user.reg.URI, "/")+1:]
+	account, err := h.db.GetAccount([]byte(accountID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.ClientCertSubject != "SAN:DNS:device-a.internal.test" {
+		t.Fatalf("expected account to be bound to device-a's SANs, got %q", account.ClientCertSubject)
+	}
+
+	// Another device without a subject still can't use it
+	nonceReq, _ := http.NewRequest(http.MethodHead, h.links.NewNoncePath().Abs(), nil)
+	resp, _ := h.doWith(deviceB, nonceReq)
+	req := h.signedRequest(h.links.NewOrderPath().Abs(), user.key, user.reg.URI, h.links.NewOrderPath().Abs(), resp.Header.Get("Replay-Nonce"),
+		[]byte(`{"identifiers":[{"type":"dns","value":"wiki.internal.test"}]}`))
+	resp, body := h.doWith(deviceB, req)
+	h.expectProblem(resp, body, http.StatusForbidden, "unauthorized")
+
+	// Certificates with nothing to bind to are turned away
+	req, _ = http.NewRequest(http.MethodGet, h.links.DirectoryPath().Abs(), nil)
+	resp, body = h.doWith(clientWith(issue(pkix.Name{}, nil)), req)
+	h.expectProblem(resp, body, http.StatusForbidden, "unauthorized")
+}
+
+func TestE2EClientCertificateReplayDoesNotBind(t *testing.T) {
+	clientCAs, issue := newClientCA(t)
+	h := newTestHarness(t, harnessOptions{clientCAs: clientCAs})
+
+	clientWith := func(cert tls.Certificate) *http.Client {
+		transport := h.srv.Client().Transport.(*http.Transport).Clone()
+		transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+		return &http.Client{Transport: transport}
+	}
+	deviceA, deviceB := clientWith(issue("device-a")), clientWith(issue("device-b"))
+	nonceFor := func(client *http.Client) string {
+		req, _ := http.NewRequest(http.MethodHead, h.links.NewNoncePath().Abs(), nil)
+		resp, _ := h.doWith(client, req)
+		return resp.Header.Get("Replay-Nonce")
+	}
+
+	client, user := h.newUnregisteredClientUsing(h.links, deviceA)
+	var err error
+	user.reg, err = client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+	if err != nil {
+		t.Fatalf("failed to register with a client certificate: %v", err)
+	}
+	accountID := []byte(user.reg.URI[strings.LastIndex(user.reg.URI, "/")+1:])
+
+	subject := func() string {
+		account, err := h.db.GetAccount(accountID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return account.ClientCertSubject
+	}
+
+	// A request the real device sent, to be captured and replayed from another one
+	used := nonceFor(deviceA)
+	resp, _ := h.doWith(deviceA, h.signedRequest(user.reg.URI, user.key, user.reg.URI, user.reg.URI, used, []byte(``)))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the account to be fetched, got %d", resp.StatusCode)
+	}
+
+	// As if the account was created before client certificates were required
+	_, err = h.db.UpdateAccount(accountID, func(acc *db.DBAccount) error {
+		acc.ClientCertSubject = ""
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replaying it doesn't bind the account to the other device
+	resp, body := h.doWith(deviceB, h.signedRequest(user.reg.URI, user.key, user.reg.URI, user.reg.URI, used, []byte(``)))
+	h.expectProblem(resp, body, http.StatusBadRequest, "badNonce")
+	if got := subject(); got != "" {
+		t.Fatalf("replayed request bound the account to %q", got)
+	}
+
+	// Nor does one sent somewhere other than where it was signed for
+	resp, body = h.doWith(deviceB, h.signedRequest(h.links.NewOrderPath().Abs(), user.key, user.reg.URI, user.reg.URI, nonceFor(deviceB), []byte(``)))
+	h.expectProblem(resp, body, http.StatusBadRequest, "malformed")
+	if got := subject(); got != "" {
+		t.Fatalf("request for the wrong URL bound the account to %q", got)
+	}
+
+	// The real device's next request binds it
+	resp, _ = h.doWith(deviceA, h.signedRequest(user.reg.URI, user.key, user.reg.URI, user.reg.URI, nonceFor(deviceA), []byte(``)))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the account to be fetched, got %d", resp.StatusCode)
+	}
+	if got := subject(); got != "CN=device-a" {
+		t.Fatalf("expected account to be bound to device-a, got %q", got)
+	}
+}
+
+func TestE2EAccountDeactivation(t *testing.T) {
+	for _, revoke := range []bool{false, true} {
+		h := newTestHarness(t, harnessOptions{
+			localCADomains: []string{"lan"},
+			deactivation:   acme_controller.DeactivationConfig{RevokeCertificates: revoke},
+		})
+		client, user := h.newClient()
+		accountID := user.reg.URI[strings.LastIndex(user.reg.URI, "/")+1:]
+
+		res, err := client.Certificate.Obtain(certificate.ObtainRequest{Domains: []string{"printer.lan"}})
+		if err != nil {
+			t.Fatalf("failed to obtain certificate: %v", err)
+		}
+		leaf := parseChain(t, res.Certificate)[0]
+
+		// An order left pending, for deactivation to clean up
+		resp, body := h.post(user.key, user.reg.URI, h.links.NewOrderPath().Abs(), h.freshNonce(),
+			[]byte(`{"identifiers":[{"type":"dns","value":"wiki.internal.test"}]}`))
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("failed to create order: %d %s", resp.StatusCode, body)
+		}
+		pendingID := resp.Header.Get("Location")[strings.LastIndex(resp.Header.Get("Location"), "/")+1:]
+
+		if err = client.Registration.DeleteRegistration(); err != nil {
+			t.Fatalf("failed to deactivate account: %v", err)
+		}
+
+		account, err := h.db.GetAccount([]byte(accountID))
+		if err != nil {
+			t.Fatalf("deactivated account wasn't kept: %v", err)
+		}
+		if account.Status != dtos.AccountStatusDeactivated || account.DeactivatedAt == nil {
+			t.Fatalf("expected account to be marked deactivated, got %+v", account)
+		}
+		if _, err = h.db.GetAccountKey([]byte(accountID)); err != nil {
+			t.Fatalf("deactivated account's key wasn't kept: %v", err)
+		}
+
+		pending, _ := h.db.GetOrder([]byte(pendingID))
+		if pending.Status != dtos.OrderStatusInvalid {
+			t.Fatalf("expected pending order to be invalid, got %s", pending.Status)
+		}
+		authz, _ := h.db.GetAuthz([]byte(pending.AuthzIDs[0]))
+		if authz.Status != dtos.AuthzStatusDeactivated {
+			t.Fatalf("expected pending authz to be deactivated, got %s", authz.Status)
+		}
+
+		for _, url := range []string{user.reg.URI, h.links.NewOrderPath().Abs()} {
+			resp, body = h.post(user.key, user.reg.URI, url, h.freshNonce(), []byte(`{"identifiers":[{"type":"dns","value":"wiki.internal.test"}]}`))
+			h.expectProblem(resp, body, http.StatusForbidden, "unauthorized")
+		}
+
+		// The key can't be used to sign up again. RFC8555 7.3.6
+		resp, body = h.post(user.key, "", h.links.NewAccountPath().Abs(), h.freshNonce(), []byte(`{"termsOfServiceAgreed":true}`))
+		h.expectProblem(resp, body, http.StatusForbidden, "unauthorized")
+
+		revoked, err := h.localCA.IsRevoked(leaf)
+		if err != nil {
+			t.Fatalf("failed to check revocation: %v", err)
+		}
+		if revoked != revoke {
+			t.Fatalf("expected certificate revoked to be %v, got %v", revoke, revoked)
+		}
+		stored, err := h.db.GetCertificateBySerial(db.CertificateSerial(leaf.SerialNumber))
+		if err != nil {
+			t.Fatalf("failed to get certificate: %v", err)
+		}
+		if (stored.RevokedAt != nil) != revoke {
+			t.Fatalf("expected the certificate recorded as revoked to be %v, got %v", revoke, stored.RevokedAt)
+		}
+	}
+}
+
+func TestE2ENewAccountExistingKey(t *testing.T) {
+	h := newTestHarness(t, harnessOptions{})
+	_, user := h.newClient()
+
+	// RFC8555 7.3.1: the existing account is returned rather than a second one created
+	resp, body := h.post(user.key, "", h.links.NewAccountPath().Abs(), h.freshNonce(), []byte(`{"termsOfServiceAgreed":true}`))
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Location") != user.reg.URI {
+		t.Fatalf("expected the existing account at %s, got %d %s %s", user.reg.URI, resp.StatusCode, resp.Header.Get("Location"), body)
+	}
+	resp, body = h.post(user.key, "", h.links.NewAccountPath().Abs(), h.freshNonce(), []byte(`{"onlyReturnExisting":true}`))
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Location") != user.reg.URI {
+		t.Fatalf("expected the existing account at %s, got %d %s %s", user.reg.URI, resp.StatusCode, resp.Header.Get("Location"), body)
+	}
+
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	resp, body = h.post(newKey, "", h.links.NewAccountPath().Abs(), h.freshNonce(), []byte(`{"onlyReturnExisting":true}`))
+	h.expectProblem(resp, body, http.StatusBadRequest, "accountDoesNotExist")
+}
+
+func TestE2EAccountDeactivationQueuedOrder(t *testing.T) {
+	h := newTestHarness(t, harnessOptions{
+		rateLimits: acme_controller.RateLimitConfig{CertsPerNameSet: 1, Window: 3 * time.Second, Queue: true},
+	})
+	client, user := h.newClient()
+
+	if _, err := client.Certificate.Obtain(certificate.ObtainRequest{Domains: []string{"wiki.internal.test"}}); err != nil {
+		t.Fatalf("failed to obtain certificate: %v", err)
+	}
+	h.upstream.lock.Lock()
+	upstreamOrders := len(h.upstream.orders)
+	h.upstream.lock.Unlock()
+
+	// The second certificate for the same names waits for the first to leave the window
+	result := make(chan error, 1)
+	go func() {
+		_, err := client.Certificate.Obtain(certificate.ObtainRequest{Domains: []string{"wiki.internal.test"}})
+		result <- err
+	}()
+	accountID := user.reg.URI[strings.LastIndex(user.reg.URI, "/")+1:]
+	queued := func() bool {
+		account, err := h.db.GetAccount([]byte(accountID))
+		if err != nil || len(account.Orders) != 2 {
+			return false
+		}
+		order, err := h.db.GetOrder([]byte(account.Orders[1]))
+		return err == nil && order.Status == dtos.OrderStatusProcessing
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for !queued() {
+		if time.Now().After(deadline) {
+			t.Fatal("second order was never queued")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	resp, body := h.post(user.key, user.reg.URI, user.reg.URI, h.freshNonce(), []byte(`{"status":"deactivated"}`))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("failed to deactivate account: %d %s", resp.StatusCode, body)
+	}
+
+	select {
+	case err := <-result:
+		if err == nil || !strings.Contains(err.Error(), "deactivated") {
+			t.Fatalf("expected the queued order to fail as the account was deactivated, got %v", err)
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatal("queued order never finished")
+	}
+	h.upstream.lock.Lock()
+	defer h.upstream.lock.Unlock()
+	if len(h.upstream.orders) != upstreamOrders {
+		t.Fatal("queued order of a deactivated account was issued")
+	}
+}
+
+func TestE2ERevokeCertificate(t *testing.T) {
+	h := newTestHarness(t, harnessOptions{localCADomains: []string{"lan"}})
+	client, _ := h.newClient()
+
+	res, err := client.Certificate.Obtain(certificate.ObtainRequest{Domains: []string{"printer.lan"}, Bundle: true})
+	if err != nil {
+		t.Fatalf("failed to obtain certificate: %v", err)
+	}
+	chain := parseChain(t, res.Certificate)
+	leaf, intermediate := chain[0], chain[1]
+	revokePayload, _ := json.Marshal(dtos.RevokeCertRequestDTO{CertificateB64: base64.RawURLEncoding.EncodeToString(leaf.Raw)})
+
+	// Neither another account nor some other key can revoke it
+	_, other := h.newClient()
+	resp, body := h.post(other.key, other.reg.URI, h.links.RevokeCertPath().Abs(), h.freshNonce(), revokePayload)
+	h.expectProblem(resp, body, http.StatusForbidden, "unauthorized")
+	resp, body = h.post(other.key, "", h.links.RevokeCertPath().Abs(), h.freshNonce(), revokePayload)
+	h.expectProblem(resp, body, http.StatusForbidden, "unauthorized")
+
+	reason := uint(ocsp.KeyCompromise)
+	if err = client.Certificate.RevokeWithReason(res.Certificate, &reason); err != nil {
+		t.Fatalf("failed to revoke certificate: %v", err)
+	}
+	if err = client.Certificate.Revoke(res.Certificate); err == nil || !strings.Contains(err.Error(), "alreadyRevoked") {
+		t.Fatalf("expected revoking again to fail with alreadyRevoked, got %v", err)
+	}
+
+	ocspReq, err := ocsp.CreateRequest(leaf, intermediate, nil)
+	if err != nil {
+		t.Fatalf("failed to create ocsp request: %v", err)
+	}
+	req, _ := http.NewRequest(http.MethodPost, h.links.LocalCAOCSPPath().Abs(), bytes.NewReader(ocspReq))
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	_, body = h.do(req)
+	ocspResp, err := ocsp.ParseResponseForCert(body, leaf, intermediate)
+	if err != nil {
+		t.Fatalf("failed to parse ocsp response: %v", err)
+	}
+	if ocspResp.Status != ocsp.Revoked || ocspResp.RevocationReason != ocsp.KeyCompromise {
+		t.Fatalf("expected ocsp to report revoked for key compromise, got status %d reason %d", ocspResp.Status, ocspResp.RevocationReason)
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, h.links.LocalCACRLPath().Abs(), nil)
+	_, body = h.do(req)
+	crl, err := x509.ParseRevocationList(body)
+	if err != nil {
+		t.Fatalf("failed to parse crl: %v", err)
+	}
+	if len(crl.RevokedCertificates) != 1 || crl.RevokedCertificates[0].SerialNumber.Cmp(leaf.SerialNumber) != 0 {
+		t.Fatalf("expected crl to list the revoked certificate, got %v", crl.RevokedCertificates)
+	}
+
+	// Upstream certificates are revoked with the upstream, here signed with the certificate's key rather than the account's
+	res, err = client.Certificate.Obtain(certificate.ObtainRequest{Domains: []string{"wiki.internal.test"}})
+	if err != nil {
+		t.Fatalf("failed to obtain certificate: %v", err)
+	}
+	leaf = parseChain(t, res.Certificate)[0]
+	certKey, err := certcrypto.ParsePEMPrivateKey(res.PrivateKey)
+	if err != nil {
+		t.Fatalf("failed to parse certificate key: %v", err)
+	}
+	revokePayload, _ = json.Marshal(dtos.RevokeCertRequestDTO{CertificateB64: base64.RawURLEncoding.EncodeToString(leaf.Raw)})
+	resp, body = h.post(certKey.(*ecdsa.PrivateKey), "", h.links.RevokeCertPath().Abs(), h.freshNonce(), revokePayload)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("failed to revoke with the certificate's key: %d %s", resp.StatusCode, body)
+	}
+	if _, ok := h.upstream.revoked[leaf.SerialNumber.String()]; !ok {
+		t.Fatal("upstream certificate wasn't revoked with the upstream")
+	}
+	dbCert, err := h.db.GetCertificateBySerial(db.CertificateSerial(leaf.SerialNumber))
+	if err != nil || dbCert.RevokedAt == nil {
+		t.Fatalf("expected revocation to be recorded, got %+v (%v)", dbCert, err)
+	}
+}
@@ -0,0 +1,443 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/go-jose/go-jose/v3"
+)
+
+// fakeDNSProvider is a lego DNS provider that keeps TXT records in memory, so the fake upstream can check them
+type fakeDNSProvider struct {
+	lock    sync.Mutex
+	records map[string]string
+	cleaned []string
+}
+
+func newFakeDNSProvider() *fakeDNSProvider {
+	return &fakeDNSProvider{records: map[string]string{}}
+}
+
+func (p *fakeDNSProvider) Present(domain, token, keyAuth string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	info := dns01.GetChallengeInfo(domain, keyAuth)
+	p.records[info.EffectiveFQDN] = info.Value
+	return nil
+}
+
+func (p *fakeDNSProvider) CleanUp(domain, token, keyAuth string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	info := dns01.GetChallengeInfo(domain, keyAuth)
+	delete(p.records, info.EffectiveFQDN)
+	p.cleaned = append(p.cleaned, info.EffectiveFQDN)
+	return nil
+}
+
+func (p *fakeDNSProvider) lookup(fqdn string) (string, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	v, ok := p.records[fqdn]
+	return v, ok
+}
+
+type fakeUpstreamChallenge struct {
+	Type   string                 `json:"type"`
+	URL    string                 `json:"url"`
+	Token  string                 `json:"token"`
+	Status string                 `json:"status"`
+	Error  map[string]interface{} `json:"error,omitempty"`
+}
+
+type fakeUpstreamAuthz struct {
+	Status     string                  `json:"status"`
+	Identifier map[string]string       `json:"identifier"`
+	Challenges []fakeUpstreamChallenge `json:"challenges"`
+
+	accountID string
+}
+
+type fakeUpstreamOrder struct {
+	Status         string              `json:"status"`
+	Expires        string              `json:"expires"`
+	Identifiers    []map[string]string `json:"identifiers"`
+	Authorizations []string            `json:"authorizations"`
+	Finalize       string              `json:"finalize"`
+	Certificate    string              `json:"certificate,omitempty"`
+
+	accountID string
+	authzIDs  []string
+}
+
+// fakeUpstream is a minimal in-process ACME CA which validates DNS-01 challenges against a fakeDNSProvider.
+// It doesn't verify JWS signatures, it's only here to give ACMESpider's lego client something to talk to
+type fakeUpstream struct {
+	t   *testing.T
+	srv *httptest.Server
+	dns *fakeDNSProvider
+
+	caCert *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+
+	lock     sync.Mutex
+	counter  int
+	accounts map[string]*jose.JSONWebKey
+	orders   map[string]*fakeUpstreamOrder
+	authzs   map[string]*fakeUpstreamAuthz
+	certs    map[string][]byte
+	// Reasons certificates were revoked with, by serial
+	revoked map[string]uint
+
+	// If set, finalize requests fail with this problem type
+	failFinalizeWith string
+	// Sent as the Retry-After header with failFinalizeWith
+	retryAfter string
+	// Challenges for these identifiers fail with the given problem type, whatever is in DNS
+	failChallengeWith map[string]string
+}
+
+func newFakeUpstream(t *testing.T, dns *fakeDNSProvider) *fakeUpstream {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate fake upstream key: %v", err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Fake Upstream CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatalf("failed to create fake upstream ca: %v", err)
+	}
+	caCert, _ := x509.ParseCertificate(caDER)
+
+	f := &fakeUpstream{
+		t:        t,
+		dns:      dns,
+		caCert:   caCert,
+		caKey:    caKey,
+		accounts: map[string]*jose.JSONWebKey{},
+		orders:   map[string]*fakeUpstreamOrder{},
+		authzs:   map[string]*fakeUpstreamAuthz{},
+		certs:    map[string][]byte{},
+		revoked:  map[string]uint{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/directory", f.directory)
+	mux.HandleFunc("/new-nonce", f.newNonce)
+	mux.HandleFunc("/new-account", f.jws(f.newAccount))
+	mux.HandleFunc("/new-order", f.jws(f.newOrder))
+	mux.HandleFunc("/order/", f.jws(f.getOrder))
+	mux.HandleFunc("/finalize/", f.jws(f.finalize))
+	mux.HandleFunc("/authz/", f.jws(f.getAuthz))
+	mux.HandleFunc("/chall/", f.jws(f.challenge))
+	mux.HandleFunc("/cert/", f.jws(f.getCert))
+	mux.HandleFunc("/revoke-cert", f.jws(f.revokeCert))
+
+	f.srv = httptest.NewServer(mux)
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+func (f *fakeUpstream) directoryURL() string {
+	return f.srv.URL + "/directory"
+}
+
+func (f *fakeUpstream) nextID() string {
+	f.counter++
+	return fmt.Sprint(f.counter)
+}
+
+func (f *fakeUpstream) problem(w http.ResponseWriter, status int, problemType string, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"type":   "urn:ietf:params:acme:error:" + problemType,
+		"detail": detail,
+		"status": status,
+	})
+}
+
+func (f *fakeUpstream) writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func (f *fakeUpstream) directory(w http.ResponseWriter, r *http.Request) {
+	f.writeJSON(w, http.StatusOK, map[string]string{
+		"newNonce":   f.srv.URL + "/new-nonce",
+		"newAccount": f.srv.URL + "/new-account",
+		"newOrder":   f.srv.URL + "/new-order",
+		"revokeCert": f.srv.URL + "/revoke-cert",
+		"keyChange":  f.srv.URL + "/key-change",
+	})
+}
+
+func (f *fakeUpstream) newNonce(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", base64.RawURLEncoding.EncodeToString([]byte(time.Now().String())))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type fakeUpstreamRequest struct {
+	w         http.ResponseWriter
+	r         *http.Request
+	payload   []byte
+	jwk       *jose.JSONWebKey
+	accountID string
+	// Last path segment, i.e. the ID of whatever object is being requested
+	id string
+}
+
+func (f *fakeUpstream) jws(handler func(req fakeUpstreamRequest)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", base64.RawURLEncoding.EncodeToString([]byte(time.Now().String())))
+
+		body, _ := io.ReadAll(r.Body)
+		parsed, err := jose.ParseSigned(string(body))
+		if err != nil || len(parsed.Signatures) != 1 {
+			f.problem(w, http.StatusBadRequest, "malformed", "invalid jws")
+			return
+		}
+
+		header := parsed.Signatures[0].Protected
+		req := fakeUpstreamRequest{
+			w:       w,
+			r:       r,
+			payload: parsed.UnsafePayloadWithoutVerification(),
+			jwk:     header.JSONWebKey,
+			id:      r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:],
+		}
+		if header.KeyID != "" {
+			req.accountID = strings.TrimPrefix(header.KeyID, f.srv.URL+"/account/")
+		}
+
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		handler(req)
+	}
+}
+
+func (f *fakeUpstream) newAccount(req fakeUpstreamRequest) {
+	if req.jwk == nil {
+		f.problem(req.w, http.StatusBadRequest, "malformed", "no jwk")
+		return
+	}
+	id := f.nextID()
+	f.accounts[id] = req.jwk
+	req.w.Header().Set("Location", f.srv.URL+"/account/"+id)
+	f.writeJSON(req.w, http.StatusCreated, map[string]interface{}{"status": "valid", "contact": []string{}})
+}
+
+func (f *fakeUpstream) orderResponse(id string) *fakeUpstreamOrder {
+	order := f.orders[id]
+
+	// Keep order status in step with its authzs
+	if order.Status == "pending" {
+		allValid := true
+		for _, authzID := range order.authzIDs {
+			if f.authzs[authzID].Status != "valid" {
+				allValid = false
+			}
+		}
+		if allValid {
+			order.Status = "ready"
+		}
+	}
+	return order
+}
+
+func (f *fakeUpstream) newOrder(req fakeUpstreamRequest) {
+	var payload struct {
+		Identifiers []map[string]string `json:"identifiers"`
+	}
+	json.Unmarshal(req.payload, &payload)
+
+	orderID := f.nextID()
+	order := &fakeUpstreamOrder{
+		Status:      "pending",
+		Expires:     time.Now().Add(time.Hour).Format(time.RFC3339),
+		Identifiers: payload.Identifiers,
+		Finalize:    f.srv.URL + "/finalize/" + orderID,
+		accountID:   req.accountID,
+	}
+
+	for _, identifier := range payload.Identifiers {
+		authzID := f.nextID()
+		f.authzs[authzID] = &fakeUpstreamAuthz{
+			Status:     "pending",
+			Identifier: identifier,
+			Challenges: []fakeUpstreamChallenge{{
+				Type:   "dns-01",
+				URL:    f.srv.URL + "/chall/" + authzID,
+				Token:  base64.RawURLEncoding.EncodeToString([]byte("token-" + authzID)),
+				Status: "pending",
+			}},
+			accountID: req.accountID,
+		}
+		order.authzIDs = append(order.authzIDs, authzID)
+		order.Authorizations = append(order.Authorizations, f.srv.URL+"/authz/"+authzID)
+	}
+
+	f.orders[orderID] = order
+	req.w.Header().Set("Location", f.srv.URL+"/order/"+orderID)
+	f.writeJSON(req.w, http.StatusCreated, order)
+}
+
+func (f *fakeUpstream) getOrder(req fakeUpstreamRequest) {
+	if f.orders[req.id] == nil {
+		f.problem(req.w, http.StatusNotFound, "malformed", "no such order")
+		return
+	}
+	f.writeJSON(req.w, http.StatusOK, f.orderResponse(req.id))
+}
+
+func (f *fakeUpstream) getAuthz(req fakeUpstreamRequest) {
+	authz := f.authzs[req.id]
+	if authz == nil {
+		f.problem(req.w, http.StatusNotFound, "malformed", "no such authz")
+		return
+	}
+	f.writeJSON(req.w, http.StatusOK, authz)
+}
+
+// challenge validates synchronously, so lego never has to poll
+func (f *fakeUpstream) challenge(req fakeUpstreamRequest) {
+	authz := f.authzs[req.id]
+	if authz == nil {
+		f.problem(req.w, http.StatusNotFound, "malformed", "no such challenge")
+		return
+	}
+	chall := &authz.Challenges[0]
+
+	thumbprint, _ := f.accounts[authz.accountID].Thumbprint(crypto.SHA256)
+	keyAuth := chall.Token + "." + base64.RawURLEncoding.EncodeToString(thumbprint)
+	expected := dns01.GetChallengeInfo(authz.Identifier["value"], keyAuth)
+
+	found, ok := f.dns.lookup(expected.EffectiveFQDN)
+	if problemType, fail := f.failChallengeWith[authz.Identifier["value"]]; fail {
+		chall.Status = "invalid"
+		chall.Error = map[string]interface{}{
+			"type":   "urn:ietf:params:acme:error:" + problemType,
+			"detail": "challenge failed by test",
+			"status": http.StatusForbidden,
+		}
+		authz.Status = "invalid"
+	} else if ok && found == expected.Value {
+		chall.Status = "valid"
+		authz.Status = "valid"
+	} else {
+		chall.Status = "invalid"
+		authz.Status = "invalid"
+	}
+
+	req.w.Header().Add("Link", fmt.Sprintf("<%s/authz/%s>;rel=\"up\"", f.srv.URL, req.id))
+	f.writeJSON(req.w, http.StatusOK, chall)
+}
+
+func (f *fakeUpstream) finalize(req fakeUpstreamRequest) {
+	order := f.orders[req.id]
+	if order == nil || f.orderResponse(req.id).Status != "ready" {
+		f.problem(req.w, http.StatusForbidden, "orderNotReady", "order not ready")
+		return
+	}
+	if f.failFinalizeWith != "" {
+		order.Status = "invalid"
+		if f.retryAfter != "" {
+			req.w.Header().Set("Retry-After", f.retryAfter)
+		}
+		f.problem(req.w, http.StatusForbidden, f.failFinalizeWith, "finalize failed by test")
+		return
+	}
+
+	var payload struct {
+		CSR string `json:"csr"`
+	}
+	json.Unmarshal(req.payload, &payload)
+	csrDER, _ := base64.RawURLEncoding.DecodeString(payload.CSR)
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		f.problem(req.w, http.StatusBadRequest, "badCSR", "invalid csr")
+		return
+	}
+
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	leafDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: csr.DNSNames[0]},
+		DNSNames:     csr.DNSNames,
+		IPAddresses:  csr.IPAddresses,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, f.caCert, csr.PublicKey, f.caKey)
+	if err != nil {
+		f.problem(req.w, http.StatusInternalServerError, "serverInternal", err.Error())
+		return
+	}
+
+	certID := f.nextID()
+	f.certs[certID] = append(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leafDER}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.caCert.Raw})...,
+	)
+
+	order.Status = "valid"
+	order.Certificate = f.srv.URL + "/cert/" + certID
+	req.w.Header().Set("Location", f.srv.URL+"/order/"+req.id)
+	f.writeJSON(req.w, http.StatusOK, order)
+}
+
+func (f *fakeUpstream) revokeCert(req fakeUpstreamRequest) {
+	var payload struct {
+		Certificate string `json:"certificate"`
+		Reason      uint   `json:"reason"`
+	}
+	json.Unmarshal(req.payload, &payload)
+	der, _ := base64.RawURLEncoding.DecodeString(payload.Certificate)
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		f.problem(req.w, http.StatusBadRequest, "malformed", "invalid certificate")
+		return
+	}
+	if _, ok := f.revoked[cert.SerialNumber.String()]; ok {
+		f.problem(req.w, http.StatusBadRequest, "alreadyRevoked", "certificate already revoked")
+		return
+	}
+	f.revoked[cert.SerialNumber.String()] = payload.Reason
+	req.w.WriteHeader(http.StatusOK)
+}
+
+func (f *fakeUpstream) getCert(req fakeUpstreamRequest) {
+	cert := f.certs[req.id]
+	if cert == nil {
+		f.problem(req.w, http.StatusNotFound, "malformed", "no such cert")
+		return
+	}
+	req.w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	req.w.Write(cert)
+}
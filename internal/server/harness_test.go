@@ -0,0 +1,544 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/go-acme/lego/v4/lego"
+	"github.com/go-acme/lego/v4/registration"
+	"github.com/go-jose/go-jose/v3"
+	"github.com/lachlan2k/acmespider/internal/acme_controller"
+	"github.com/lachlan2k/acmespider/internal/db"
+	"github.com/lachlan2k/acmespider/internal/dtos"
+	"github.com/lachlan2k/acmespider/internal/handlers"
+	"github.com/lachlan2k/acmespider/internal/issuer"
+	"github.com/lachlan2k/acmespider/internal/links"
+	"github.com/lachlan2k/acmespider/internal/localca"
+	"github.com/lachlan2k/acmespider/internal/nonce"
+	"github.com/lachlan2k/acmespider/internal/policy"
+	"github.com/miekg/dns"
+)
+
+// testNonceCtrl wraps the real nonce controller so tests can force nonces to be treated as expired
+type testNonceCtrl struct {
+	inner   nonce.NonceController
+	lock    sync.Mutex
+	expired map[string]bool
+	// How many more nonces to reject, whatever they are
+	rejecting int
+}
+
+func (n *testNonceCtrl) Gen() (string, error) {
+	return n.inner.Gen()
+}
+
+func (n *testNonceCtrl) ValidateAndConsume(nonceStr string) (bool, error) {
+	n.lock.Lock()
+	expired := n.expired[nonceStr] || n.rejecting > 0
+	if n.rejecting > 0 {
+		n.rejecting--
+	}
+	n.lock.Unlock()
+	if expired {
+		return false, nil
+	}
+	return n.inner.ValidateAndConsume(nonceStr)
+}
+
+// rejectNext treats the next count nonces as expired, as if they'd been held onto for too long
+func (n *testNonceCtrl) rejectNext(count int) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.rejecting = count
+}
+
+func (n *testNonceCtrl) expire(nonceStr string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.expired[nonceStr] = true
+}
+
+// challengeResponder plays the part of internal hosts answering HTTP-01 challenges.
+// It's a lego HTTP-01 provider, so a lego client can drive it directly
+type challengeResponder struct {
+	lock     sync.Mutex
+	keyAuths map[string]string
+	// If set, returned instead of the real key authorization
+	override string
+	// If set, each challenge request is announced on stall and then left hanging until the validator gives up
+	stall chan struct{}
+}
+
+func (c *challengeResponder) Present(domain, token, keyAuth string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.keyAuths[token] = keyAuth
+	return nil
+}
+
+func (c *challengeResponder) CleanUp(domain, token, keyAuth string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.keyAuths, token)
+	return nil
+}
+
+func (c *challengeResponder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.lock.Lock()
+	stall := c.stall
+	c.lock.Unlock()
+	if stall != nil {
+		stall <- struct{}{}
+		<-r.Context().Done()
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	token := strings.TrimPrefix(r.URL.Path, "/.well-known/acme-challenge/")
+	keyAuth, ok := c.keyAuths[token]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if c.override != "" {
+		keyAuth = c.override
+	}
+	w.Write([]byte(keyAuth))
+}
+
+type testHarness struct {
+	t *testing.T
+
+	srv   *httptest.Server
+	db    db.DB
+	links links.LinkController
+	// Links for each named tenant's directory
+	tenantLinks map[string]links.LinkController
+	nonces      *testNonceCtrl
+	upstream    *fakeUpstream
+	dns         *fakeDNSProvider
+	records     *dnsRecordTracker
+	localCA     *localca.CA
+	work        *acme_controller.WorkTracker
+	// Creates handlers the way the server does, using the harness's work tracker at the time
+	newHandlers func(tenant acme_controller.TenantConfig, l links.LinkController) handlers.Handlers
+
+	responder    *challengeResponder
+	responderSrv *httptest.Server
+}
+
+type harnessOptions struct {
+	// If set, the local CA is enabled for these domains
+	localCADomains []string
+	// A records served by the fake internal DNS server, on top of defaultDNSRecords
+	dnsRecords      map[string]string
+	sourceIPBinding bool
+	trustedProxies  []*net.IPNet
+	rateLimits      acme_controller.RateLimitConfig
+	abuse           acme_controller.AbuseConfig
+	certReuse       acme_controller.CertReuseConfig
+	deactivation    acme_controller.DeactivationConfig
+	// Issuance policy file contents, if any
+	policy string
+	// Declared lifetime of the fake upstream's certificates, if any
+	upstreamCertLifetime time.Duration
+	// Named tenants served alongside the default directory, all issuing from the fake upstream
+	tenants   []acme_controller.TenantConfig
+	approvals acme_controller.ApprovalConfig
+	// Admin API tokens, mapped to the operator's name
+	adminTokens map[string]string
+	// If set, ACMESpider's served over TLS, asking for client certificates from these CAs
+	clientCAs *x509.CertPool
+}
+
+// defaultDNSRecords are the names tests order certificates for. Every HTTP-01 connection ends up at the challenge responder regardless
+var defaultDNSRecords = map[string]string{
+	"wiki.internal.test": "127.0.0.1",
+	"printer.lan":        "127.0.0.1",
+}
+
+// newTestHarness starts ACMESpider in-process, issuing via a lego client talking to a fake upstream CA.
+// HTTP-01 validation for every name is routed to the harness's challenge responder
+func newTestHarness(t *testing.T, opts harnessOptions) *testHarness {
+	t.Setenv("LEGO_DISABLE_CNAME_SUPPORT", "true")
+
+	h := &testHarness{
+		t:         t,
+		dns:       newFakeDNSProvider(),
+		responder: &challengeResponder{keyAuths: map[string]string{}},
+		nonces:    &testNonceCtrl{inner: nonce.NewInMemCtrl(), expired: map[string]bool{}},
+		work:      acme_controller.NewWorkTracker(),
+	}
+	h.upstream = newFakeUpstream(t, h.dns)
+
+	h.responderSrv = httptest.NewServer(h.responder)
+	t.Cleanup(h.responderSrv.Close)
+
+	var app http.Handler
+	h.srv = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.ServeHTTP(w, r)
+	}))
+	if opts.clientCAs != nil {
+		h.srv.TLS = &tls.Config{ClientCAs: opts.clientCAs, ClientAuth: tls.VerifyClientCertIfGiven}
+		h.srv.StartTLS()
+	} else {
+		h.srv.Start()
+	}
+	t.Cleanup(h.srv.Close)
+
+	var err error
+	h.db, err = db.NewBoltDb(path.Join(t.TempDir(), "acmespider.db"))
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	h.records = newDNSRecordTracker(h.db)
+
+	h.links = links.LinkController{BaseURL: h.srv.URL + "/acme"}
+
+	if len(opts.localCADomains) > 0 {
+		h.localCA, err = localca.New(h.db, localca.Config{
+			Domains: opts.localCADomains,
+			CRLURL:  h.links.LocalCACRLPath().Abs(),
+			OCSPURL: h.links.LocalCAOCSPPath().Abs(),
+		})
+		if err != nil {
+			t.Fatalf("failed to set up local CA: %v", err)
+		}
+	}
+
+	upstream := issuer.WithDefaultLifetime(h.newUpstreamIssuer(), opts.upstreamCertLifetime)
+	records := map[string]string{}
+	for name, addr := range defaultDNSRecords {
+		records[name] = addr
+	}
+	for name, addr := range opts.dnsRecords {
+		records[name] = addr
+	}
+	internalDNS := newFakeInternalDNS(t, records)
+
+	responderAddr := h.responderSrv.Listener.Addr().String()
+	var policyEngine *policy.Engine
+	if opts.policy != "" {
+		policyPath := path.Join(t.TempDir(), "policy.yaml")
+		if err = os.WriteFile(policyPath, []byte(opts.policy), 0o600); err != nil {
+			t.Fatalf("failed to write policy: %v", err)
+		}
+		if policyEngine, err = policy.NewEngine(policyPath); err != nil {
+			t.Fatalf("failed to load policy: %v", err)
+		}
+	}
+
+	// Every tenant uses the one fake upstream, so they share its budget
+	budget := acme_controller.NewUpstreamBudget("", opts.rateLimits)
+	abuse := acme_controller.NewAbuseLimiter(opts.abuse)
+	newHandlers := func(tenant acme_controller.TenantConfig, l links.LinkController) handlers.Handlers {
+		l.MetaExternalAccountRequired = tenant.RequireEAB
+		acmeCtrl := acme_controller.New(h.db, upstream, h.localCA, l)
+		acmeCtrl.SetTenantConfig(tenant)
+		acmeCtrl.SetHTTP01Config(acme_controller.HTTP01Config{
+			Resolvers: []string{internalDNS},
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, responderAddr)
+			},
+			AttemptSchedule: []time.Duration{0, 100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond},
+		})
+		acmeCtrl.SetSourceIPConfig(acme_controller.SourceIPConfig{
+			Enabled:       opts.sourceIPBinding,
+			Resolvers:     []string{internalDNS},
+			LookupTimeout: time.Second,
+		})
+		acmeCtrl.SetUpstreamBudget(budget)
+		acmeCtrl.SetAbuseLimiter(abuse)
+		acmeCtrl.SetCertReuseConfig(opts.certReuse)
+		acmeCtrl.SetDeactivationConfig(opts.deactivation)
+		acmeCtrl.SetPolicy(policyEngine)
+		acmeCtrl.SetApprovalConfig(opts.approvals)
+		acmeCtrl.SetWorkTracker(h.work)
+		acmeCtrl.SetClientCertConfig(acme_controller.ClientCertConfig{Required: opts.clientCAs != nil})
+
+		return handlers.Handlers{
+			AcmeCtrl:  acmeCtrl,
+			NonceCtrl: h.nonces,
+			LinkCtrl:  l,
+		}
+	}
+
+	h.newHandlers = newHandlers
+
+	h.tenantLinks = map[string]links.LinkController{}
+	tenants := map[string]handlers.Handlers{}
+	for _, tenant := range opts.tenants {
+		h.tenantLinks[tenant.Name] = links.LinkController{BaseURL: h.links.BaseURL + "/" + tenant.Name, Tenant: tenant.Name}
+		tenants[tenant.Name] = newHandlers(tenant, h.tenantLinks[tenant.Name])
+	}
+
+	defaultHandlers := newHandlers(acme_controller.TenantConfig{}, h.links)
+	admin := handlers.AdminHandlers{AcmeCtrl: defaultHandlers.AcmeCtrl, TenantCtrls: map[string]*acme_controller.ACMEController{}, Tokens: opts.adminTokens}
+	for name, tenantHandlers := range tenants {
+		admin.TenantCtrls[name] = tenantHandlers.AcmeCtrl
+	}
+	ready := newReadinessChecker(h.db, h.work, map[string]issuer.Issuer{"upstream": upstream})
+	app, err = newApp(defaultHandlers, tenants, admin, handlers.HealthHandlers{Ready: ready}, ipExtractorFor(Config{TrustedProxies: opts.trustedProxies}))
+	if err != nil {
+		t.Fatalf("failed to set up app: %v", err)
+	}
+
+	return h
+}
+
+// newUpstreamLegoClient registers with the fake upstream the same way setupLego does with a real one, minus the DNS propagation checks
+func (h *testHarness) newUpstreamLegoClient() *legoUpstream {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		h.t.Fatalf("failed to generate upstream account key: %v", err)
+	}
+	user := &MyUser{Email: "test@example.com", key: key}
+
+	legoConfig := lego.NewConfig(user)
+	legoConfig.CADirURL = h.upstream.directoryURL()
+	legoConfig.Certificate.KeyType = certcrypto.EC256
+	challenges := issuer.NewChallengeTracker(legoConfig.HTTPClient.Transport)
+	retryAfter := issuer.NewRetryAfterTracker(challenges)
+	legoConfig.HTTPClient.Transport = retryAfter
+
+	client, err := lego.NewClient(legoConfig)
+	if err != nil {
+		h.t.Fatalf("failed to create upstream lego client: %v", err)
+	}
+	err = client.Challenge.SetDNS01Provider(h.records.wrap("fake", h.dns), dns01.WrapPreCheck(challenges.WrapPreCheck(func(domain, fqdn, value string, check dns01.PreCheckFunc) (bool, error) {
+		return true, nil
+	})))
+	if err != nil {
+		h.t.Fatalf("failed to set dns provider: %v", err)
+	}
+
+	user.Registration, err = client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+	if err != nil {
+		h.t.Fatalf("failed to register with fake upstream: %v", err)
+	}
+	return &legoUpstream{client: client, retryAfter: retryAfter, challenges: challenges}
+}
+
+// newClient returns a lego ACME client pointed at ACMESpider, registered and ready to order
+func (h *testHarness) newClient() (*lego.Client, *testUser) {
+	client, user := h.newUnregisteredClient(h.links)
+
+	var err error
+	user.reg, err = client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+	if err != nil {
+		h.t.Fatalf("failed to register with acmespider: %v", err)
+	}
+	return client, user
+}
+
+// newUnregisteredClient returns a lego ACME client pointed at the directory l links to, for tests to register themselves
+func (h *testHarness) newUnregisteredClient(l links.LinkController) (*lego.Client, *testUser) {
+	return h.newUnregisteredClientUsing(l, nil)
+}
+
+// newUnregisteredClientUsing is newUnregisteredClient, talking to ACMESpider with httpClient if it's set
+func (h *testHarness) newUnregisteredClientUsing(l links.LinkController, httpClient *http.Client) (*lego.Client, *testUser) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		h.t.Fatalf("failed to generate account key: %v", err)
+	}
+	user := &testUser{key: key}
+
+	legoConfig := lego.NewConfig(user)
+	legoConfig.CADirURL = l.DirectoryPath().Abs()
+	legoConfig.Certificate.KeyType = certcrypto.EC256
+	legoConfig.Certificate.Timeout = 10 * time.Second
+	if httpClient != nil {
+		legoConfig.HTTPClient = httpClient
+	}
+
+	client, err := lego.NewClient(legoConfig)
+	if err != nil {
+		h.t.Fatalf("failed to create lego client: %v", err)
+	}
+	err = client.Challenge.SetHTTP01Provider(h.responder)
+	if err != nil {
+		h.t.Fatalf("failed to set http-01 provider: %v", err)
+	}
+	return client, user
+}
+
+type testUser struct {
+	key *ecdsa.PrivateKey
+	reg *registration.Resource
+}
+
+func (u *testUser) GetEmail() string                        { return "" }
+func (u *testUser) GetRegistration() *registration.Resource { return u.reg }
+func (u *testUser) GetPrivateKey() crypto.PrivateKey        { return u.key }
+
+// onlyOrder fetches the single order an account has made, checking it's exactly one
+func (h *testHarness) onlyOrder(user *testUser) *db.DBOrder {
+	h.t.Helper()
+
+	accountID := user.reg.URI[strings.LastIndex(user.reg.URI, "/")+1:]
+	account, err := h.db.GetAccount([]byte(accountID))
+	if err != nil {
+		h.t.Fatalf("failed to get account: %v", err)
+	}
+	if len(account.Orders) != 1 {
+		h.t.Fatalf("expected account to have one order, got %d", len(account.Orders))
+	}
+	order, err := h.db.GetOrder([]byte(account.Orders[0]))
+	if err != nil {
+		h.t.Fatalf("failed to get order: %v", err)
+	}
+	return order
+}
+
+// freshNonce fetches a nonce the way a client would
+func (h *testHarness) freshNonce() string {
+	resp, err := h.srv.Client().Head(h.links.NewNoncePath().Abs())
+	if err != nil {
+		h.t.Fatalf("failed to get nonce: %v", err)
+	}
+	resp.Body.Close()
+	n := resp.Header.Get("Replay-Nonce")
+	if n == "" {
+		h.t.Fatalf("new-nonce response had no Replay-Nonce")
+	}
+	return n
+}
+
+// post sends a raw JWS-signed request, for tests that need to send things a well-behaved client wouldn't.
+// If kid is empty, the JWK is embedded instead
+func (h *testHarness) post(key *ecdsa.PrivateKey, kid string, url string, nonceStr string, payload []byte) (*http.Response, []byte) {
+	return h.do(h.signedRequest(url, key, kid, url, nonceStr, payload))
+}
+
+// postTo is post, but sends the request somewhere other than the url it's signed for
+func (h *testHarness) postTo(target string, key *ecdsa.PrivateKey, kid string, url string, nonceStr string, payload []byte) (*http.Response, []byte) {
+	return h.do(h.signedRequest(target, key, kid, url, nonceStr, payload))
+}
+
+// signedRequest builds the request post and postTo send, so tests can tweak it first. If nonceStr is empty, it's left out
+func (h *testHarness) signedRequest(target string, key *ecdsa.PrivateKey, kid string, url string, nonceStr string, payload []byte) *http.Request {
+	opts := (&jose.SignerOptions{}).WithHeader("url", url)
+	if nonceStr != "" {
+		opts = opts.WithHeader("nonce", nonceStr)
+	}
+	signingKey := jose.SigningKey{Algorithm: jose.ES256, Key: key}
+	if kid == "" {
+		opts.EmbedJWK = true
+	} else {
+		signingKey.Key = jose.JSONWebKey{Key: key, KeyID: kid}
+	}
+
+	signer, err := jose.NewSigner(signingKey, opts)
+	if err != nil {
+		h.t.Fatalf("failed to create signer: %v", err)
+	}
+	signed, err := signer.Sign(payload)
+	if err != nil {
+		h.t.Fatalf("failed to sign: %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, target, strings.NewReader(signed.FullSerialize()))
+	if err != nil {
+		h.t.Fatalf("failed to build request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/jose+json")
+	return req
+}
+
+// admin calls the admin API with a bearer token, or none if it's empty
+func (h *testHarness) admin(method string, path string, token string) (*http.Response, []byte) {
+	req, err := http.NewRequest(method, h.srv.URL+"/admin"+path, nil)
+	if err != nil {
+		h.t.Fatalf("failed to build request: %v", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return h.do(req)
+}
+
+func (h *testHarness) do(req *http.Request) (*http.Response, []byte) {
+	return h.doWith(h.srv.Client(), req)
+}
+
+// doWith is do, sending the request with client
+func (h *testHarness) doWith(client *http.Client, req *http.Request) (*http.Response, []byte) {
+	resp, err := client.Do(req)
+	if err != nil {
+		h.t.Fatalf("request to %s failed: %v", req.URL, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp, body
+}
+
+// expectProblem checks a response is a problem document of the given type and status
+func (h *testHarness) expectProblem(resp *http.Response, body []byte, status int, problemType string) dtos.ProblemDTO {
+	h.t.Helper()
+
+	var problem dtos.ProblemDTO
+	err := json.Unmarshal(body, &problem)
+	if err != nil {
+		h.t.Fatalf("response wasn't a problem document: %s", string(body))
+	}
+	if resp.StatusCode != status || problem.Type != "urn:ietf:params:acme:error:"+problemType {
+		h.t.Fatalf("expected %d %s, got %d %s (%s)", status, problemType, resp.StatusCode, problem.Type, problem.Detail)
+	}
+	return problem
+}
+
+// newFakeInternalDNS serves A records for the given names, standing in for the internal resolver. It returns the server's address
+func newFakeInternalDNS(t *testing.T, records map[string]string) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen for fake dns: %v", err)
+	}
+
+	srv := &dns.Server{
+		PacketConn: conn,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			m.Rcode = dns.RcodeNameError
+			for _, q := range r.Question {
+				addr, ok := records[strings.TrimSuffix(q.Name, ".")]
+				if !ok {
+					continue
+				}
+				m.Rcode = dns.RcodeSuccess
+				if q.Qtype == dns.TypeA {
+					m.Answer = append(m.Answer, &dns.A{
+						Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+						A:   net.ParseIP(addr),
+					})
+				}
+			}
+			w.WriteMsg(m)
+		}),
+	}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+
+	return conn.LocalAddr().String()
+}
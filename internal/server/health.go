@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-acme/lego/v4/acme"
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/lego"
+	"github.com/lachlan2k/acmespider/internal/acme_controller"
+	"github.com/lachlan2k/acmespider/internal/db"
+	"github.com/lachlan2k/acmespider/internal/health"
+	"github.com/lachlan2k/acmespider/internal/issuer"
+)
+
+const readinessTimeout = 5 * time.Second
+
+// The DNS probe creates and removes a real record, so it's done rarely
+const dnsProbeInterval = 15 * time.Minute
+
+// newReadinessChecker checks what's needed to issue: that work is being accepted, the database can be written,
+// and each upstream is reachable. upstreams are keyed by the check's name
+func newReadinessChecker(boltDb db.DB, work *acme_controller.WorkTracker, upstreams map[string]issuer.Issuer) *health.Checker {
+	checker := health.NewChecker(readinessTimeout,
+		health.Check{
+			Name: "accepting_work",
+			Run: func(ctx context.Context) error {
+				if work.Draining() {
+					return errors.New("shutting down")
+				}
+				return nil
+			},
+		},
+		health.Check{
+			Name:     "database",
+			CacheFor: 5 * time.Second,
+			Run: func(ctx context.Context) error {
+				return boltDb.CheckWritable()
+			},
+		},
+	)
+	for name, upstream := range upstreams {
+		upstream := upstream
+		checker.Add(health.Check{
+			Name:     name,
+			CacheFor: 30 * time.Second,
+			Run: func(ctx context.Context) error {
+				return upstream.Health()
+			},
+		})
+	}
+	return checker
+}
+
+// upstreamAccountCheck checks our account with the upstream ACME CA is still valid
+func upstreamAccountCheck(legoClient *lego.Client) health.Check {
+	return health.Check{
+		Name:     "upstream_account",
+		CacheFor: 5 * time.Minute,
+		Run: func(ctx context.Context) error {
+			reg, err := legoClient.Registration.QueryRegistration()
+			if err != nil {
+				return fmt.Errorf("failed to query account: %v", err)
+			}
+			if reg.Body.Status != acme.StatusValid {
+				return fmt.Errorf("account is %s", reg.Body.Status)
+			}
+			return nil
+		},
+	}
+}
+
+// ownCertificateCheck checks the certificate we serve is loaded and was renewed within its renewal window.
+// Still serving it after the window has closed means renewal is failing
+func ownCertificateCheck(o *ownCertificate) health.Check {
+	return health.Check{
+		Name:     "tls_certificate",
+		CacheFor: time.Minute,
+		Run: func(ctx context.Context) error {
+			cert := o.get()
+			if cert == nil || cert.Leaf == nil {
+				return fmt.Errorf("no certificate for %s", o.names[0])
+			}
+			if info := o.renewalInfo(); time.Now().After(info.WindowEnd) {
+				return fmt.Errorf("certificate for %s is past its renewal window and expires in %s", o.names[0], time.Until(cert.Leaf.NotAfter).Round(time.Minute))
+			}
+			return nil
+		},
+	}
+}
+
+// dnsProviderCheck checks the DNS provider's credentials work by creating and removing a TXT record under hostname
+func dnsProviderCheck(prov challenge.Provider, hostname string) health.Check {
+	probeDomain := "acmespider-readyz." + hostname
+	return health.Check{
+		Name:     "dns_provider",
+		CacheFor: dnsProbeInterval,
+		Run: func(ctx context.Context) error {
+			token, err := acme_controller.GenerateChallengeToken()
+			if err != nil {
+				return err
+			}
+			if err = prov.Present(probeDomain, token, token); err != nil {
+				return fmt.Errorf("failed to create TXT record: %v", err)
+			}
+			if err = prov.CleanUp(probeDomain, token, token); err != nil {
+				return fmt.Errorf("created TXT record, but failed to remove it: %v", err)
+			}
+			return nil
+		},
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/lachlan2k/acmespider/internal/acme_controller"
+	"github.com/lachlan2k/acmespider/internal/handlers"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -35,15 +36,17 @@ func makeLoggerMiddleware() echo.MiddlewareFunc {
 					"response_size":  values.ResponseSize,
 				}
 
+				logger := handlers.Logger(c)
+
 				if values.Error != nil {
 					wrapped := &acme_controller.ProblemDetails{}
 					if errors.As(values.Error, &wrapped) {
 						if wrapped.Unwrap() != nil {
 							// "Real error", i.e. probably a 500
-							log.WithError(wrapped.Unwrap()).WithFields(fields).WithField("error_id", wrapped.ID()).Error("request error " + wrapped.ID())
+							logger.WithError(wrapped.Unwrap()).WithFields(fields).WithField("error_id", wrapped.ID()).Error("request error " + wrapped.ID())
 						} else {
 							// Generic problem
-							log.WithError(wrapped).
+							logger.WithError(wrapped).
 								WithFields(fields).
 								WithField("problem_type", wrapped.Type).
 								WithField("problem_detail", wrapped.Detail).
@@ -52,21 +55,27 @@ func makeLoggerMiddleware() echo.MiddlewareFunc {
 						}
 						return nil
 					}
-					log.WithError(values.Error).WithFields(fields).Error("generic request error")
+					logger.WithError(values.Error).WithFields(fields).Error("generic request error")
 					return nil
 				}
 
 				if values.Status >= 500 && values.Status <= 599 {
-					log.WithFields(fields).Error("generic request error")
+					logger.WithFields(fields).Error("generic request error")
 					return nil
 				}
 
 				if values.Status == 400 || values.Status == 403 {
-					log.WithFields(fields).Warn("bad request")
+					logger.WithFields(fields).Warn("bad request")
+					return nil
+				}
+
+				// Probes are frequent, so only logged when debugging
+				if c.Path() == "/healthz" || c.Path() == "/readyz" {
+					logger.WithFields(fields).Debug("request")
 					return nil
 				}
 
-				log.WithFields(fields).Info("request")
+				logger.WithFields(fields).Info("request")
 				return nil
 			},
 		},
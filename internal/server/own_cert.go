@@ -0,0 +1,317 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/lachlan2k/acmespider/internal/acme_controller"
+	"github.com/lachlan2k/acmespider/internal/db"
+	"github.com/lachlan2k/acmespider/internal/issuer"
+	"github.com/lachlan2k/acmespider/internal/localca"
+	log "github.com/sirupsen/logrus"
+)
+
+// How often our own certificate is checked for renewal, or its files for changes
+const ownCertCheckInterval = time.Hour
+
+// ownCertificate is the certificate ACMESpider serves. It's obtained and renewed the same way as certificates for clients,
+// from the local CA if that handles every name, otherwise from the upstream. Or, it's loaded from files, reread when they change
+type ownCertificate struct {
+	db      db.DB
+	issuer  issuer.Issuer
+	keyType certcrypto.KeyType
+	names   []string
+	// The upstream's rate budget, which certificates from it are recorded against like any other
+	budget *acme_controller.UpstreamBudget
+
+	certFile string
+	keyFile  string
+
+	lock    sync.RWMutex
+	current *tls.Certificate
+	// When the files were last modified, to only reread them once they've changed
+	loadedModTime time.Time
+}
+
+func newOwnCertificate(conf Config, boltDb db.DB, upstream issuer.Issuer, budget *acme_controller.UpstreamBudget, localCA *localca.CA) *ownCertificate {
+	// Names are listed once each, even if the hostname is among the extra ones
+	names := []string{conf.Hostname}
+	seen := map[string]bool{strings.ToLower(conf.Hostname): true}
+	for _, name := range conf.TLSNames {
+		if seen[strings.ToLower(name)] {
+			continue
+		}
+		seen[strings.ToLower(name)] = true
+		names = append(names, name)
+	}
+
+	certIssuer := upstream
+	if localCA != nil {
+		allLocal := true
+		for _, name := range names {
+			allLocal = allLocal && localCA.Handles(name)
+		}
+		if allLocal {
+			certIssuer = localCA
+		}
+	}
+
+	keyType := conf.KeyType
+	if keyType == "" {
+		keyType = certcrypto.EC256
+	}
+
+	return &ownCertificate{
+		db:       boltDb,
+		issuer:   certIssuer,
+		keyType:  keyType,
+		names:    names,
+		budget:   budget,
+		certFile: conf.TLSCertFile,
+		keyFile:  conf.TLSKeyFile,
+	}
+}
+
+func (o *ownCertificate) isStatic() bool {
+	return o.certFile != ""
+}
+
+// tlsConfig serves the current certificate, whichever name the client asks for
+func (o *ownCertificate) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			o.lock.RLock()
+			defer o.lock.RUnlock()
+			if o.current == nil {
+				return nil, errors.New("no certificate loaded")
+			}
+			return o.current, nil
+		},
+	}
+}
+
+func (o *ownCertificate) set(cert *tls.Certificate) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.current = cert
+}
+
+func (o *ownCertificate) get() *tls.Certificate {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+	return o.current
+}
+
+// load gets a certificate to start serving with: the files, the one stored from last time,
+// or a new one if that's missing, expired or for different names
+func (o *ownCertificate) load() error {
+	if o.isStatic() {
+		return o.loadFiles()
+	}
+
+	stored, err := o.db.GetOwnCertificate()
+	if err != nil && !db.IsErrNotFound(err) {
+		return err
+	}
+	if stored != nil && sameNames(stored.Names, o.names) {
+		cert, err := parseKeyPair(stored.Certificate, stored.Key)
+		if err == nil && time.Now().Before(cert.Leaf.NotAfter) {
+			o.set(&cert)
+			log.WithField("names", o.names).WithField("expires", cert.Leaf.NotAfter).Info("Using stored TLS certificate")
+			return nil
+		}
+	}
+
+	return o.obtain()
+}
+
+func (o *ownCertificate) loadFiles() error {
+	info, err := os.Stat(o.certFile)
+	if err != nil {
+		return fmt.Errorf("failed to read TLS certificate: %v", err)
+	}
+
+	certPEM, err := os.ReadFile(o.certFile)
+	if err != nil {
+		return fmt.Errorf("failed to read TLS certificate: %v", err)
+	}
+	keyPEM, err := os.ReadFile(o.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to read TLS key: %v", err)
+	}
+	cert, err := parseKeyPair(certPEM, keyPEM)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate from %s and %s: %v", o.certFile, o.keyFile, err)
+	}
+	o.set(&cert)
+	o.loadedModTime = info.ModTime()
+	log.WithField("file", o.certFile).WithField("expires", cert.Leaf.NotAfter).Info("Loaded TLS certificate")
+	return nil
+}
+
+// obtain gets a new certificate with a new key, and stores it
+func (o *ownCertificate) obtain() error {
+	log.WithField("names", o.names).Info("Obtaining TLS certificate")
+
+	key, err := certcrypto.GeneratePrivateKey(o.keyType)
+	if err != nil {
+		return err
+	}
+	// Addresses among the names go in the IP SANs, where clients connecting by address look for them
+	template := &x509.CertificateRequest{Subject: pkix.Name{CommonName: o.names[0]}}
+	for _, name := range o.names {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, template, key.(crypto.Signer))
+	if err != nil {
+		return err
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		return err
+	}
+
+	certID, err := acme_controller.GenerateID()
+	if err != nil {
+		return err
+	}
+	bundle, err := o.issuer.ObtainForCSR(issuer.ObtainRequest{CSR: csr, CertificateID: certID})
+	if err != nil {
+		return fmt.Errorf("failed to obtain TLS certificate for %s: %w", strings.Join(o.names, ", "), err)
+	}
+	if o.budget != nil && issuer.LimitsIssuance(o.issuer) {
+		// The certificate exists either way, so a failure here only means the budget undercounts
+		if err := o.budget.RecordIssuance(o.db, o.names); err != nil {
+			log.WithError(err).Error("Failed to record upstream issuance of TLS certificate")
+		}
+	}
+
+	keyPEM := certcrypto.PEMEncode(key)
+	cert, err := parseKeyPair(bundle, keyPEM)
+	if err != nil {
+		return fmt.Errorf("obtained TLS certificate was unusable: %v", err)
+	}
+
+	err = o.db.SaveOwnCertificate(db.DBOwnCertificate{
+		Certificate: bundle,
+		Key:         keyPEM,
+		Names:       o.names,
+	})
+	if err != nil {
+		return err
+	}
+	o.set(&cert)
+	log.WithField("names", o.names).WithField("expires", cert.Leaf.NotAfter).Info("Obtained TLS certificate")
+	return nil
+}
+
+// renewalInfo asks the issuer when the certificate should be renewed, falling back to the last third of its lifetime.
+// Certificates loaded from files are renewed by whoever writes them, so only get the fallback
+func (o *ownCertificate) renewalInfo() *issuer.RenewalInfo {
+	cert := o.get()
+	info := issuer.DefaultRenewalInfo(cert.Leaf)
+	if o.isStatic() || len(cert.Certificate) < 2 {
+		return info
+	}
+
+	issuerCert, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return info
+	}
+	suggested, err := o.issuer.RenewalInfo(cert.Leaf, issuerCert)
+	if err != nil {
+		log.WithError(err).Debug("Couldn't get renewal info for TLS certificate, using the default window")
+		return info
+	}
+	return suggested
+}
+
+func (o *ownCertificate) renewalDue() bool {
+	return time.Now().After(o.renewalInfo().WindowStart)
+}
+
+// refresh renews the certificate once it's due, or rereads its files if they've changed
+func (o *ownCertificate) refresh() {
+	if o.isStatic() {
+		info, err := os.Stat(o.certFile)
+		if err != nil {
+			log.WithError(err).Error("Failed to check TLS certificate file")
+			return
+		}
+		if info.ModTime().Equal(o.loadedModTime) {
+			return
+		}
+		if err = o.loadFiles(); err != nil {
+			log.WithError(err).Error("Failed to reload TLS certificate, still serving the previous one")
+		}
+		return
+	}
+
+	if !o.renewalDue() {
+		return
+	}
+	if err := o.obtain(); err != nil {
+		log.WithError(err).WithField("expires", o.get().Leaf.NotAfter).Error("Failed to renew TLS certificate, will retry")
+	}
+}
+
+// run refreshes the certificate periodically until ctx is done. The returned channel is closed once it's stopped
+func (o *ownCertificate) run(ctx context.Context) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			o.refresh()
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(ownCertCheckInterval):
+			}
+		}
+	}()
+	return done
+}
+
+// parseKeyPair is tls.X509KeyPair, with the leaf parsed for checking when it expires
+func parseKeyPair(certPEM []byte, keyPEM []byte) (tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return cert, err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	return cert, err
+}
+
+func sameNames(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string{}, a...)
+	b = append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if !strings.EqualFold(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/lachlan2k/acmespider/internal/acme_controller"
+	"github.com/lachlan2k/acmespider/internal/issuer"
+)
+
+func (h *testHarness) newUpstreamIssuer() issuer.Issuer {
+	upstream := h.newUpstreamLegoClient()
+	return issuer.NewLegoIssuer(upstream.client, h.upstream.directoryURL(), upstream.retryAfter, upstream.challenges)
+}
+
+// servedLeaf is the leaf certificate the TLS config would serve
+func servedLeaf(t *testing.T, o *ownCertificate) *x509.Certificate {
+	cert, err := o.tlsConfig().GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatalf("no certificate served: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf
+}
+
+func selfSignedKeyPair(t *testing.T, name string, notBefore time.Time, notAfter time.Time) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestOwnCertificateFromUpstream(t *testing.T) {
+	h := newTestHarness(t, harnessOptions{})
+	upstream := h.newUpstreamIssuer()
+	conf := Config{Hostname: "acmespider.internal.test", TLSNames: []string{"acmespider"}}
+
+	o := newOwnCertificate(conf, h.db, upstream, nil, nil)
+	if err := o.load(); err != nil {
+		t.Fatalf("failed to obtain certificate: %v", err)
+	}
+	leaf := servedLeaf(t, o)
+	if err := leaf.CheckSignatureFrom(h.upstream.caCert); err != nil {
+		t.Fatalf("certificate wasn't issued by the upstream: %v", err)
+	}
+	if !sameNames(leaf.DNSNames, []string{"acmespider.internal.test", "acmespider"}) {
+		t.Fatalf("certificate had names %v", leaf.DNSNames)
+	}
+
+	// After a restart, the stored certificate's used
+	restarted := newOwnCertificate(conf, h.db, upstream, nil, nil)
+	if err := restarted.load(); err != nil {
+		t.Fatal(err)
+	}
+	if servedLeaf(t, restarted).SerialNumber.Cmp(leaf.SerialNumber) != 0 {
+		t.Fatal("expected the stored certificate to be reused")
+	}
+
+	// But not once the names it needs to cover have changed. The hostname's only included once
+	conf.TLSNames = []string{"acmespider", "ca.internal.test", "acmespider.internal.test"}
+	changed := newOwnCertificate(conf, h.db, upstream, nil, nil)
+	if err := changed.load(); err != nil {
+		t.Fatal(err)
+	}
+	if names := servedLeaf(t, changed).DNSNames; !sameNames(names, []string{"acmespider.internal.test", "acmespider", "ca.internal.test"}) {
+		t.Fatalf("expected a new certificate for the new names, got %v", names)
+	}
+}
+
+func TestOwnCertificateAddressesAndBudget(t *testing.T) {
+	h := newTestHarness(t, harnessOptions{})
+	budget := acme_controller.NewUpstreamBudget("", acme_controller.RateLimitConfig{})
+	conf := Config{Hostname: "acmespider.internal.test", TLSNames: []string{"10.0.0.5", "acmespider"}}
+
+	o := newOwnCertificate(conf, h.db, h.newUpstreamIssuer(), budget, nil)
+	if err := o.load(); err != nil {
+		t.Fatalf("failed to obtain certificate: %v", err)
+	}
+	leaf := servedLeaf(t, o)
+	if !sameNames(leaf.DNSNames, []string{"acmespider.internal.test", "acmespider"}) {
+		t.Fatalf("expected only hostnames in the DNS SANs, got %v", leaf.DNSNames)
+	}
+	if len(leaf.IPAddresses) != 1 || !leaf.IPAddresses[0].Equal(net.ParseIP("10.0.0.5")) {
+		t.Fatalf("expected 10.0.0.5 in the IP SANs, got %v", leaf.IPAddresses)
+	}
+
+	issuances, err := h.db.GetIssuancesSince("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issuances) != 1 || issuances[0].NameSet != "10.0.0.5,acmespider,acmespider.internal.test" {
+		t.Fatalf("expected the certificate to be recorded against the upstream's budget, got %+v", issuances)
+	}
+}
+
+func TestOwnCertificateRenewal(t *testing.T) {
+	h := newTestHarness(t, harnessOptions{})
+	o := newOwnCertificate(Config{Hostname: "acmespider.internal.test"}, h.db, h.newUpstreamIssuer(), nil, nil)
+	if err := o.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	fresh := servedLeaf(t, o)
+	o.refresh()
+	if servedLeaf(t, o).SerialNumber.Cmp(fresh.SerialNumber) != 0 {
+		t.Fatal("a new certificate was renewed straight away")
+	}
+
+	// Most of the way through its lifetime, it's renewed
+	certPEM, keyPEM := selfSignedKeyPair(t, "acmespider.internal.test", time.Now().Add(-5*time.Hour), time.Now().Add(time.Hour))
+	old, err := parseKeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.set(&old)
+	o.refresh()
+
+	renewed := servedLeaf(t, o)
+	if renewed.SerialNumber.Cmp(old.Leaf.SerialNumber) == 0 || renewed.SerialNumber.Cmp(fresh.SerialNumber) == 0 {
+		t.Fatal("expected the certificate to be renewed")
+	}
+	if err := renewed.CheckSignatureFrom(h.upstream.caCert); err != nil {
+		t.Fatalf("renewed certificate wasn't issued by the upstream: %v", err)
+	}
+}
+
+func TestOwnCertificateFromLocalCA(t *testing.T) {
+	h := newTestHarness(t, harnessOptions{localCADomains: []string{"internal.test"}})
+	o := newOwnCertificate(Config{Hostname: "acmespider.internal.test"}, h.db, h.newUpstreamIssuer(), nil, h.localCA)
+	if err := o.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := servedLeaf(t, o).CheckSignatureFrom(h.upstream.caCert); err == nil {
+		t.Fatal("expected a name the local CA handles to be issued by it, not the upstream")
+	}
+}
+
+func TestOwnCertificateFromFiles(t *testing.T) {
+	dir := t.TempDir()
+	conf := Config{
+		Hostname:    "acmespider.internal.test",
+		TLSCertFile: path.Join(dir, "tls.crt"),
+		TLSKeyFile:  path.Join(dir, "tls.key"),
+	}
+	writeKeyPair := func(modTime time.Time) {
+		certPEM, keyPEM := selfSignedKeyPair(t, "acmespider.internal.test", time.Now(), time.Now().Add(time.Hour))
+		if err := os.WriteFile(conf.TLSCertFile, certPEM, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(conf.TLSKeyFile, keyPEM, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(conf.TLSCertFile, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeKeyPair(time.Now().Add(-time.Hour))
+	o := newOwnCertificate(conf, newTestDB(t), nil, nil, nil)
+	if err := o.load(); err != nil {
+		t.Fatal(err)
+	}
+	first := servedLeaf(t, o)
+
+	// Unchanged files aren't reread, and changed ones are
+	o.refresh()
+	if servedLeaf(t, o).SerialNumber.Cmp(first.SerialNumber) != 0 {
+		t.Fatal("certificate changed without its files changing")
+	}
+	writeKeyPair(time.Now())
+	o.refresh()
+	if servedLeaf(t, o).SerialNumber.Cmp(first.SerialNumber) == 0 {
+		t.Fatal("expected the replaced files to be loaded")
+	}
+}
+
+func TestOwnCertificateCheck(t *testing.T) {
+	dir := t.TempDir()
+	conf := Config{
+		Hostname:    "acmespider.internal.test",
+		TLSCertFile: path.Join(dir, "tls.crt"),
+		TLSKeyFile:  path.Join(dir, "tls.key"),
+	}
+	checkWith := func(notBefore time.Time, notAfter time.Time) error {
+		certPEM, keyPEM := selfSignedKeyPair(t, "acmespider.internal.test", notBefore, notAfter)
+		if err := os.WriteFile(conf.TLSCertFile, certPEM, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(conf.TLSKeyFile, keyPEM, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		o := newOwnCertificate(conf, newTestDB(t), nil, nil, nil)
+		if err := o.load(); err != nil {
+			t.Fatal(err)
+		}
+		return ownCertificateCheck(o).Run(context.Background())
+	}
+
+	// A short-lived certificate is fine until its renewal window closes, however little time it has left
+	if err := checkWith(time.Now().Add(-time.Hour), time.Now().Add(2*time.Hour)); err != nil {
+		t.Fatalf("expected a certificate inside its renewal window to pass, got %v", err)
+	}
+	if err := checkWith(time.Now().Add(-10*time.Hour), time.Now().Add(time.Hour)); err == nil {
+		t.Fatal("expected a certificate past its renewal window to fail")
+	}
+}
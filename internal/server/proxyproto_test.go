@@ -0,0 +1,92 @@
+package server
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+// acceptWith dials a proxy protocol listener, writes header, and returns what the server side saw
+func acceptWith(t *testing.T, trusted []*net.IPNet, header []byte) (net.Addr, string, error) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	ln := newProxyProtoListener(inner, trusted)
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer client.Close()
+	client.Write(append(header, []byte("hello")...))
+	client.(*net.TCPConn).CloseWrite()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept: %v", err)
+	}
+	defer conn.Close()
+
+	addr := conn.RemoteAddr()
+	body, err := io.ReadAll(conn)
+	return addr, string(body), err
+}
+
+func TestProxyProtocol(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	trusted := []*net.IPNet{loopback}
+
+	v2 := append([]byte{}, proxyV2Signature...)
+	v2 = append(v2, 0x21, 0x11, 0, 12)
+	v2 = append(v2, 10, 0, 0, 5, 10, 0, 0, 1)
+	v2 = binary.BigEndian.AppendUint16(v2, 51234)
+	v2 = binary.BigEndian.AppendUint16(v2, 443)
+
+	v2Local := append([]byte{}, proxyV2Signature...)
+	v2Local = append(v2Local, 0x20, 0x00, 0, 0)
+
+	tests := []struct {
+		name    string
+		trusted []*net.IPNet
+		header  string
+		addr    string
+		wantErr bool
+	}{
+		{name: "v1 tcp4", trusted: trusted, header: "PROXY TCP4 10.0.0.5 10.0.0.1 51234 443\r\n", addr: "10.0.0.5:51234"},
+		{name: "v1 tcp6", trusted: trusted, header: "PROXY TCP6 fd00::5 fd00::1 51234 443\r\n", addr: "[fd00::5]:51234"},
+		{name: "v1 unknown", trusted: trusted, header: "PROXY UNKNOWN\r\n", addr: "127.0.0.1"},
+		{name: "v2 tcp4", trusted: trusted, header: string(v2), addr: "10.0.0.5:51234"},
+		{name: "v2 local", trusted: trusted, header: string(v2Local), addr: "127.0.0.1"},
+		{name: "missing header from trusted proxy", trusted: trusted, header: "GET / HTTP/1.1\r\n", wantErr: true},
+		{name: "v1 mismatched family", trusted: trusted, header: "PROXY TCP4 fd00::5 fd00::1 51234 443\r\n", wantErr: true},
+		{name: "untrusted peer isn't parsed", header: "", addr: "127.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, body, err := acceptWith(t, tt.trusted, []byte(tt.header))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, read %q from %s", body, addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to read: %v", err)
+			}
+			if body != "hello" {
+				t.Fatalf("expected body after header to be intact, got %q", body)
+			}
+			got := addr.String()
+			if tcpAddr, ok := addr.(*net.TCPAddr); ok && tt.addr == "127.0.0.1" {
+				got = tcpAddr.IP.String()
+			}
+			if got != tt.addr {
+				t.Fatalf("expected remote address %s, got %s", tt.addr, got)
+			}
+		})
+	}
+}
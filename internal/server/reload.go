@@ -0,0 +1,34 @@
+package server
+
+import (
+	"github.com/lachlan2k/acmespider/internal/acme_controller"
+	"github.com/lachlan2k/acmespider/internal/policy"
+	log "github.com/sirupsen/logrus"
+)
+
+// watchReloads applies the parts of each config from conf.Reloads that are safe to change while running,
+// which are the issuance policy and the approval webhook. Anything else needs a restart
+func watchReloads(conf Config, policyEngine *policy.Engine, ctrls []*acme_controller.ACMEController) {
+	current := conf
+	for next := range conf.Reloads {
+		switch {
+		case next.PolicyFile != current.PolicyFile:
+			log.Warnf("Issuance policy file changed from %q to %q, which needs a restart", current.PolicyFile, next.PolicyFile)
+		case policyEngine != nil:
+			err := policyEngine.Reload()
+			if err != nil {
+				log.WithError(err).Error("Failed to reload issuance policy, keeping the previous one")
+			} else {
+				log.WithField("path", current.PolicyFile).Info("Reloaded issuance policy")
+			}
+		}
+
+		if next.Approvals.WebhookURL != current.Approvals.WebhookURL {
+			for _, ctrl := range ctrls {
+				ctrl.SetApprovalWebhook(next.Approvals.WebhookURL)
+			}
+			current.Approvals.WebhookURL = next.Approvals.WebhookURL
+			log.Info("Changed approval webhook")
+		}
+	}
+}
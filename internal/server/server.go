@@ -3,33 +3,26 @@ package server
 import (
 	"context"
 	"crypto"
-	"crypto/ecdsa"
+	"crypto/tls"
 	"crypto/x509"
-	"encoding/pem"
 	"fmt"
 	"net"
 	"net/http"
 	"path"
-	"time"
-
-	"crypto/elliptic"
-	"crypto/rand"
-	mrand "math/rand"
 	"strings"
+	"time"
 
-	"github.com/caddyserver/certmagic"
 	"github.com/go-acme/lego/challenge"
 	"github.com/go-acme/lego/v4/certcrypto"
-	"github.com/go-acme/lego/v4/challenge/dns01"
-	"github.com/go-acme/lego/v4/lego"
-	dnsProviders "github.com/go-acme/lego/v4/providers/dns"
 	"github.com/go-acme/lego/v4/registration"
 	"github.com/lachlan2k/acmespider/internal/acme_controller"
 	"github.com/lachlan2k/acmespider/internal/db"
 	"github.com/lachlan2k/acmespider/internal/handlers"
+	"github.com/lachlan2k/acmespider/internal/issuer"
 	"github.com/lachlan2k/acmespider/internal/links"
+	"github.com/lachlan2k/acmespider/internal/localca"
 	"github.com/lachlan2k/acmespider/internal/nonce"
-	mhAcme "github.com/mholt/acmez/acme"
+	"github.com/lachlan2k/acmespider/internal/policy"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -62,230 +55,399 @@ type Config struct {
 	BaseURL            string
 	UseTLS             bool
 	Hostname           string
-	KeyType            certcrypto.KeyType
+	// Other names our own certificate covers, besides Hostname
+	TLSNames []string
+	// If set, our own certificate is loaded from these files rather than obtained
+	TLSCertFile string
+	TLSKeyFile  string
+	KeyType     certcrypto.KeyType
+	// If set, ACME clients must present a certificate chaining to one of these, and accounts are bound to its subject
+	ClientCAs *x509.CertPool
 
 	MetaTosURL  string
 	MetaCAAs    []string
 	MetaWebsite string
-}
 
-func Listen(conf Config) error {
-	app := echo.New()
+	LocalCADomains      []string
+	LocalCACertLifetime time.Duration
 
-	app.Use(makeLoggerMiddleware())
-	app.Use(middleware.Recover())
+	// Only accept orders from an address the identifiers resolve to on InternalDNSResolvers
+	SourceIPBinding      bool
+	InternalDNSResolvers []string
+	// Proxies trusted to report the client's address, with X-Forwarded-For or the PROXY protocol
+	TrustedProxies []*net.IPNet
+	ProxyProtocol  bool
+
+	HTTP01 acme_controller.HTTP01Config
+
+	RateLimits acme_controller.RateLimitConfig
+	Abuse      acme_controller.AbuseConfig
+	CertReuse  acme_controller.CertReuseConfig
+	// Whether deactivating an account revokes its certificates
+	Deactivation acme_controller.DeactivationConfig
+
+	Nonce nonce.Config
+	// If set, nonce keys are kept in the storage path, so nonces handed out before a restart still work after it
+	NoncePersist bool
+
+	// CEL rules every order and finalize request is checked against, reloaded when the file changes
+	PolicyFile string
+
+	// Names in sensitive zones that need an operator's approval the first time an account orders them
+	Approvals acme_controller.ApprovalConfig
+	// Bearer tokens for the admin API, mapped to the operator's name. The API is disabled if there are none
+	AdminTokens map[string]string
+
+	// Policy and EAB settings for the default directory at /acme. Its Name is ignored
+	DefaultTenant acme_controller.TenantConfig
+	// Named tenants, each with their own directory and account namespace
+	Tenants []TenantConfig
+
+	// If set, /readyz checks the DNS provider's credentials by creating and removing a TXT record
+	HealthDNSProbe bool
 
-	acmeAPI := app.Group("/acme")
+	// How long to wait for DNS-01 records to reach the zone's nameservers. If zero, 5 minutes, or longer if the provider asks
+	DNSPropagationTimeout time.Duration
 
+	// How long shutdown waits for requests, validations and issuance to finish. If zero, 20 seconds
+	ShutdownTimeout time.Duration
+
+	// New configs to apply while running, as far as they can be. See watchReloads
+	Reloads <-chan Config
+
+	// One of the UpstreamIssuer* constants
+	UpstreamIssuer string
+	// How long the upstream's certificates last when it picks, so issuance policy rules can check validity before issuing
+	UpstreamCertLifetime time.Duration
+	Vault                issuer.VaultConfig
+	StepCA               issuer.StepCAConfig
+}
+
+const defaultShutdownTimeout = 20 * time.Second
+
+// Listen serves ACMESpider until ctx is done, then shuts down gracefully
+func Listen(ctx context.Context, conf Config) error {
 	boltDb, err := db.NewBoltDb(path.Join(conf.StoragePath, "acmespider.db"))
 	if err != nil {
 		return err
 	}
+	// Closed once shutdown has finished with it
+	defer boltDb.Close()
 
-	var privateKey *ecdsa.PrivateKey
-	existingMarshalledPrivateKey, err := boltDb.GetGlobalKey()
-	if err != nil {
-		if !db.IsErrNotFound(err) {
-			return err
-		}
+	records := newDNSRecordTracker(boltDb)
+	work := acme_controller.NewWorkTracker()
 
-		// FIrst time, gen key
-		log.Info("Generating keypair...")
-		privateKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	var legoClient *legoUpstream
+	var prov challenge.Provider
+	if conf.UpstreamIssuer == issuer.UpstreamIssuerACME {
+		legoClient, prov, err = setupLego(work.Context(), conf, boltDb, records)
 		if err != nil {
 			return err
 		}
+	}
 
-		marshalledPrivateKey, err := x509.MarshalECPrivateKey(privateKey)
+	upstream, err := makeUpstreamIssuer(conf, legoClient)
+	if err != nil {
+		return err
+	}
+
+	fullBaseURL := conf.BaseURL
+	if !strings.HasSuffix(fullBaseURL, "/") {
+		fullBaseURL += "/"
+	}
+
+	// The local CA is shared by every tenant, and published under the default directory
+	l := links.LinkController{BaseURL: fullBaseURL + "acme"}
+
+	var localCA *localca.CA
+	if len(conf.LocalCADomains) > 0 {
+		localCA, err = localca.New(boltDb, localca.Config{
+			Domains:      conf.LocalCADomains,
+			CertLifetime: conf.LocalCACertLifetime,
+			CRLURL:       l.LocalCACRLPath().Abs(),
+			OCSPURL:      l.LocalCAOCSPPath().Abs(),
+		})
 		if err != nil {
-			return err
+			return fmt.Errorf("failed to set up local CA: %v", err)
 		}
-		err = boltDb.SaveGlobalKey(marshalledPrivateKey)
+		log.Infof("Issuing from local CA for %v", conf.LocalCADomains)
+	}
+
+	var policyEngine *policy.Engine
+	if conf.PolicyFile != "" {
+		policyEngine, err = policy.NewEngine(conf.PolicyFile)
 		if err != nil {
 			return err
 		}
-	} else {
-		log.Info("Using existing keypair...")
-		privateKey, err = x509.ParseECPrivateKey(existingMarshalledPrivateKey)
+		err = policyEngine.Watch(ctx)
 		if err != nil {
-			return fmt.Errorf("couldn't unmarshal existing private key: %v", err)
+			return fmt.Errorf("failed to watch %s: %v", conf.PolicyFile, err)
 		}
+		log.Infof("Using issuance policy from %s", conf.PolicyFile)
 	}
-	marshalledPrivateKey, err := x509.MarshalECPrivateKey(privateKey)
+
+	nonceConf := conf.Nonce
+	if conf.NoncePersist {
+		nonceConf.KeyFile = path.Join(conf.StoragePath, "nonce-keys.json")
+	}
+	nonces, err := nonce.New(nonceConf)
 	if err != nil {
 		return err
 	}
+	// Saved once requests have finished, so the nonces they used are remembered
+	defer func() {
+		if err := nonces.Close(); err != nil {
+			log.WithError(err).Error("Failed to save nonce state, nonces handed out before the restart won't be accepted")
+		}
+	}()
+	defaultTenant := conf.DefaultTenant
+	defaultTenant.Name = ""
+	budget := acme_controller.NewUpstreamBudget("", conf.RateLimits)
+	// Clients get one allowance, whichever tenants they use
+	abuse := acme_controller.NewAbuseLimiter(conf.Abuse)
+	h := newTenantHandlers(conf, defaultTenant, boltDb, upstream, budget, abuse, localCA, policyEngine, work, nonces, l.BaseURL)
+
+	upstreams := map[string]issuer.Issuer{"upstream": upstream}
+	tenants := map[string]handlers.Handlers{}
+	for _, tenant := range conf.Tenants {
+		if _, exists := tenants[tenant.Name]; exists {
+			return fmt.Errorf("tenant %s is configured more than once", tenant.Name)
+		}
+		tenantUpstream, tenantBudget := upstream, budget
+		if tenant.hasOwnUpstream() {
+			tenantUpstream, err = makeTenantUpstreamIssuer(work.Context(), conf, tenant, boltDb, records)
+			if err != nil {
+				return err
+			}
+			tenantBudget = acme_controller.NewUpstreamBudget(tenant.Name, conf.RateLimits)
+			upstreams["upstream:"+tenant.Name] = tenantUpstream
+		}
+		tenants[tenant.Name] = newTenantHandlers(conf, tenant.TenantConfig, boltDb, tenantUpstream, tenantBudget, abuse, localCA, policyEngine, work, nonces, l.BaseURL+"/"+tenant.Name)
+		log.Infof("Serving tenant %s at %s", tenant.Name, tenants[tenant.Name].LinkCtrl.DirectoryPath().Abs())
+	}
 
-	myUser := MyUser{
-		Email: conf.Email,
-		key:   privateKey,
+	ctrls := []*acme_controller.ACMEController{h.AcmeCtrl}
+	for _, tenantHandlers := range tenants {
+		ctrls = append(ctrls, tenantHandlers.AcmeCtrl)
+	}
+	for _, ctrl := range ctrls {
+		if err := ctrl.ResumeValidations(); err != nil {
+			return fmt.Errorf("failed to resume validations cut short by the last shutdown: %v", err)
+		}
+		if err := ctrl.ResumeIssuance(); err != nil {
+			return fmt.Errorf("failed to resume issuance cut short by the last shutdown: %v", err)
+		}
+	}
+	if conf.Reloads != nil {
+		go watchReloads(conf, policyEngine, ctrls)
 	}
 
-	legoConfig := lego.NewConfig(&myUser)
-	legoConfig.CADirURL = conf.CADirectory
-	legoConfig.Certificate.KeyType = conf.KeyType
+	admin := handlers.AdminHandlers{
+		AcmeCtrl:    h.AcmeCtrl,
+		TenantCtrls: map[string]*acme_controller.ACMEController{},
+		Tokens:      conf.AdminTokens,
+	}
+	for name, tenantHandlers := range tenants {
+		admin.TenantCtrls[name] = tenantHandlers.AcmeCtrl
+	}
 
-	legoClient, err := lego.NewClient(legoConfig)
+	// Started once every DNS provider is set up, so their orphaned records can be cleaned up. Stopped before the database is closed
+	reconcileCtx, stopReconciling := context.WithCancel(ctx)
+	reconciled := records.run(reconcileCtx, dnsRecordReconcileInterval)
+	defer func() {
+		stopReconciling()
+		<-reconciled
+	}()
+
+	ready := newReadinessChecker(boltDb, work, upstreams)
+	if conf.UpstreamIssuer == issuer.UpstreamIssuerACME {
+		ready.Add(upstreamAccountCheck(legoClient.client))
+	}
+	if conf.HealthDNSProbe && prov != nil {
+		ready.Add(dnsProviderCheck(prov, conf.Hostname))
+	}
+
+	app, err := newApp(h, tenants, admin, handlers.HealthHandlers{Ready: ready}, ipExtractorFor(conf))
 	if err != nil {
 		return err
 	}
 
-	prov, err := dnsProviders.NewDNSChallengeProviderByName(conf.DNSProvider)
+	// Our own certificate is obtained before listening, so there's something to serve
+	var ownCert *ownCertificate
+	if conf.UseTLS {
+		ownCert = newOwnCertificate(conf, boltDb, upstream, budget, localCA)
+		if err = ownCert.load(); err != nil {
+			return err
+		}
+		renewCtx, stopRenewing := context.WithCancel(ctx)
+		renewing := ownCert.run(renewCtx)
+		// Stopped before the database is closed
+		defer func() {
+			stopRenewing()
+			<-renewing
+		}()
+		ready.Add(ownCertificateCheck(ownCert))
+	}
+
+	ln, err := net.Listen("tcp", ":"+conf.Port)
 	if err != nil {
 		return err
 	}
-	legoClient.Challenge.SetDNS01Provider(prov, dns01.AddRecursiveNameservers(conf.PublicDNSResolvers))
-	log.Infof("Using DNS provider %s", conf.DNSProvider)
+	if conf.ProxyProtocol {
+		ln = newProxyProtoListener(ln, conf.TrustedProxies)
+	}
 
-	reg, err := legoClient.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
-	if err != nil {
+	srv := &http.Server{
+		Addr:    ":" + conf.Port,
+		Handler: app,
+	}
+
+	if !conf.UseTLS {
+		log.Info("Listening on plain HTTP...")
+		return serveUntilDone(ctx, conf, srv, work, boltDb, func() error { return srv.Serve(ln) })
+	}
+
+	log.Info("Listening with TLS...")
+	srv.TLSConfig = ownCert.tlsConfig()
+	if conf.ClientCAs != nil {
+		// Only the ACME API needs them, so health checks and the admin API still work without one
+		srv.TLSConfig.ClientCAs = conf.ClientCAs
+		srv.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return serveUntilDone(ctx, conf, srv, work, boltDb, func() error { return srv.ServeTLS(ln, "", "") })
+}
+
+// serveUntilDone runs serve until ctx is done, then stops taking new work, lets in-flight requests finish,
+// and waits for validation and issuance, all within the shutdown timeout
+func serveUntilDone(ctx context.Context, conf Config, srv *http.Server, work *acme_controller.WorkTracker, boltDb db.DB, serve func() error) error {
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- serve()
+	}()
+
+	select {
+	case err := <-serveErr:
 		return err
+	case <-ctx.Done():
 	}
-	myUser.Registration = reg
 
-	fullBaseURL := conf.BaseURL
-	if !strings.HasSuffix(fullBaseURL, "/") {
-		fullBaseURL += "/"
+	timeout := conf.ShutdownTimeout
+	if timeout == 0 {
+		timeout = defaultShutdownTimeout
 	}
+	log.WithField("timeout", timeout).Info("Shutting down, waiting for in-flight work to finish")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-	l := links.LinkController{
-		BaseURL:     fullBaseURL + "acme",
-		MetaTosURL:  conf.MetaTosURL,
-		MetaCAAs:    conf.MetaCAAs,
-		MetaWebsite: conf.MetaWebsite,
+	work.Drain()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.WithError(err).Warn("Not all requests finished before shutdown")
+	}
+	if err := work.Wait(shutdownCtx, boltDb); err != nil {
+		log.WithError(err).Warn("Not all background work finished before shutdown")
 	}
 
-	acmeCtrl := acme_controller.New(boltDb, legoClient, l)
+	log.Info("Shut down")
+	return nil
+}
 
-	h := handlers.Handlers{
-		AcmeCtrl:  acmeCtrl,
-		NonceCtrl: nonce.NewInMemCtrl(),
-		LinkCtrl:  l,
+// ipExtractorFor decides where the client's address comes from.
+// X-Forwarded-For is only believed from trusted proxies, and not at all if the PROXY protocol is in use
+func ipExtractorFor(conf Config) echo.IPExtractor {
+	if len(conf.TrustedProxies) == 0 || conf.ProxyProtocol {
+		return echo.ExtractIPDirect()
 	}
 
-	app.HTTPErrorHandler = h.ErrorHandler(app)
+	opts := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, n := range conf.TrustedProxies {
+		opts = append(opts, echo.TrustIPRange(n))
+	}
+	return echo.ExtractIPFromXFFHeader(opts...)
+}
 
-	acmeAPI.Use(h.AddIndexLinkMw)
+// newApp sets up the echo app with middleware, and the ACME routes for the default directory and each tenant's.
+// The admin API is only served if it has tokens
+func newApp(h handlers.Handlers, tenants map[string]handlers.Handlers, admin handlers.AdminHandlers, healthHandlers handlers.HealthHandlers, ipExtractor echo.IPExtractor) (*echo.Echo, error) {
+	app := echo.New()
+	app.IPExtractor = ipExtractor
 
-	acmeAPI.GET(l.NewNoncePath().Relative(), h.GetNonce, h.AddNonceMw)
-	acmeAPI.HEAD(l.NewNoncePath().Relative(), h.GetNonce, h.AddNonceMw)
-	acmeAPI.GET(l.DirectoryPath().Relative(), h.GetDirectory)
-	acmeAPI.HEAD(l.DirectoryPath().Relative(), h.GetDirectory)
+	app.Use(handlers.RequestIDMw)
+	app.Use(makeLoggerMiddleware())
+	app.Use(middleware.Recover())
 
-	acmeAPI.POST(l.NewAccountPath().Relative(), h.NewAccount, h.AddNonceMw, h.ValidateJWSWithJWKAndExtractPayload)
-	acmeAPI.POST(l.AccountPath(":"+l.AccountIDParam()).Relative(), h.GetOrUpdateAccount, h.AddNonceMw, h.ValidateJWSWithKIDAndExtractPayload)
-	acmeAPI.POST(l.AccountKeyChangePath().Relative(), h.NotImplemented, h.AddNonceMw, h.ValidateJWSWithKIDAndExtractPayload)
+	app.HTTPErrorHandler = h.ErrorHandler(app)
 
-	acmeAPI.POST(l.NewOrderPath().Relative(), h.NewOrder, h.AddNonceMw, h.ValidateJWSWithKIDAndExtractPayload)
-	acmeAPI.POST(l.OrderPath(":"+l.OrderIDParam()).Relative(), h.GetOrder, h.AddNonceMw, h.ValidateJWSWithKIDAndExtractPayload)
-	acmeAPI.POST(l.AccountOrdersPath(":"+l.AccountIDParam()).Relative(), h.GetOrdersByAccountID, h.ValidateJWSWithKIDAndExtractPayload, h.AddNonceMw, h.POSTAsGETMw)
-	acmeAPI.POST(l.FinalizeOrderPath(":"+l.OrderIDParam()).Relative(), h.FinalizeOrder, h.AddNonceMw, h.ValidateJWSWithKIDAndExtractPayload)
+	app.GET("/healthz", healthHandlers.Healthz)
+	app.GET("/readyz", healthHandlers.Readyz)
 
-	acmeAPI.POST(l.AuthzPath(":"+l.AuthzIDParam()).Relative(), h.GetAuthorization, h.AddNonceMw, h.ValidateJWSWithKIDAndExtractPayload, h.POSTAsGETMw)
-	acmeAPI.POST(l.ChallengePath(":"+l.ChallengeIDParam()).Relative(), h.InitiateChallenge, h.AddNonceMw, h.ValidateJWSWithKIDAndExtractPayload)
-	acmeAPI.POST(l.CertPath(":"+l.CertIDParam()).Relative(), h.GetCertificate, h.AddNonceMw, h.ValidateJWSWithKIDAndExtractPayload, h.POSTAsGETMw)
-	acmeAPI.POST(l.RevokeCertPath().Relative(), h.RevokeCert, h.AddNonceMw, h.ValidateJWSWithKIDAndExtractPayload)
+	addACMERoutes(app.Group("/acme"), h)
 
-	if !conf.UseTLS {
-		log.Info("Listening on plain HTTP...")
-		return app.Start(":" + conf.Port)
-	}
-
-	log.Info("Configuring certmagic and listening with TLS...")
-	certmagic.DefaultACME.DNS01Solver = solverWrapper{
-		legoProvider: prov,
-		resolvers:    conf.PublicDNSResolvers,
-	}
-	certmagic.DefaultACME.Email = conf.Email
-	certmagic.DefaultACME.DisableHTTPChallenge = true
-	certmagic.DefaultACME.DisableTLSALPNChallenge = true
-	certmagic.DefaultACME.CA = conf.CADirectory
-	certmagic.DefaultACME.Agreed = true
-	certmagic.DefaultACME.AccountKeyPEM = string(pem.EncodeToMemory(
-		&pem.Block{
-			Type:  "EC PRIVATE KEY",
-			Bytes: marshalledPrivateKey,
-		},
-	))
-	certmagic.Default.Storage = &certmagic.FileStorage{
-		Path: path.Join(conf.StoragePath, "certmagic"),
-	}
-
-	tlsConf, err := certmagic.TLS([]string{conf.Hostname})
-	if err != nil {
-		return err
+	// Checked against the default directory's routes only, so do that before adding any tenant's
+	for name := range tenants {
+		err := checkTenantName(app, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for name, tenantHandlers := range tenants {
+		addACMERoutes(app.Group("/acme/"+name), tenantHandlers)
 	}
 
-	s := http.Server{
-		Addr:      ":" + conf.Port,
-		Handler:   app,
-		TLSConfig: tlsConf,
+	if len(admin.Tokens) > 0 {
+		addAdminRoutes(app.Group("/admin"), admin)
 	}
-	return s.ListenAndServeTLS("", "")
-}
 
-type solverWrapper struct {
-	legoProvider challenge.Provider
-	resolvers    []string
+	return app, nil
 }
 
-func (s solverWrapper) Present(ctx context.Context, chall mhAcme.Challenge) error {
-	return s.legoProvider.Present(chall.Identifier.Value, chall.Token, chall.KeyAuthorization)
-}
-func (s solverWrapper) CleanUp(ctx context.Context, chall mhAcme.Challenge) error {
-	return s.legoProvider.CleanUp(chall.Identifier.Value, chall.Token, chall.KeyAuthorization)
+func addAdminRoutes(adminAPI *echo.Group, h handlers.AdminHandlers) {
+	adminAPI.Use(h.RequireTokenMw)
+
+	adminAPI.GET("/approvals", h.ListApprovals)
+	adminAPI.GET("/approvals/:id", h.GetApproval)
+	adminAPI.POST("/approvals/:id/approve", h.Approve)
+	adminAPI.POST("/approvals/:id/deny", h.Deny)
 }
-func (s solverWrapper) Wait(inCtx context.Context, chall mhAcme.Challenge) error {
-	info := dns01.GetChallengeInfo(chall.Identifier.Value, chall.KeyAuthorization)
-	fqdn := info.EffectiveFQDN
 
-	timeout := 300 * time.Second
-	interval := 30 * time.Second
+func addACMERoutes(acmeAPI *echo.Group, h handlers.Handlers) {
+	l := h.LinkCtrl
 
-	ctx, cancel := context.WithDeadline(inCtx, time.Now().Add(timeout))
-	defer cancel()
+	acmeAPI.Use(h.AddIndexLinkMw)
 
-	log.WithField("fqdn", fqdn).WithField("value", info.Value).Debug("Starting DNS record propagation check")
+	// Published for anyone checking the local CA's certificates, so they don't need a client certificate
+	if h.AcmeCtrl.HasLocalCA() {
+		acmeAPI.GET(l.LocalCARootPath().Relative(), h.GetLocalCARoot)
+		acmeAPI.GET(l.LocalCACRLPath().Relative(), h.GetLocalCACRL)
+		acmeAPI.POST(l.LocalCAOCSPPath().Relative(), h.LocalCAOCSP)
+		acmeAPI.GET(l.LocalCAOCSPPath().Relative()+"/*", h.LocalCAOCSP)
+	}
 
-	r := net.Resolver{
-		PreferGo: true,
-		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-			resolver := s.resolvers[mrand.Intn(len(s.resolvers))]
-			if !strings.Contains(resolver, ":") {
-				resolver = resolver + ":53"
-			}
+	// Middleware only applies to routes added after it. Every response from here on carries a nonce, even if it's an error
+	acmeAPI.Use(h.AddNonceMw, h.RateLimitMw, h.RequireClientCertMw)
 
-			d := net.Dialer{
-				Timeout: time.Second * 10,
-			}
-			return d.DialContext(ctx, network, resolver)
-		},
-	}
+	acmeAPI.GET(l.NewNoncePath().Relative(), h.GetNonce)
+	acmeAPI.HEAD(l.NewNoncePath().Relative(), h.GetNonce)
+	acmeAPI.GET(l.DirectoryPath().Relative(), h.GetDirectory)
+	acmeAPI.HEAD(l.DirectoryPath().Relative(), h.GetDirectory)
 
-	for {
-		select {
-		case <-ctx.Done():
-			log.WithField("fqdn", fqdn).Debug("Timed out waiting for ACME DNS record propagation")
-			return nil
-		case <-time.After(interval):
-		}
+	acmeAPI.POST(l.NewAccountPath().Relative(), h.NewAccount, h.ValidateJWSWithJWKAndExtractPayload)
+	acmeAPI.POST(l.AccountPath(":"+l.AccountIDParam()).Relative(), h.GetOrUpdateAccount, h.ValidateJWSWithKIDAndExtractPayload)
+	acmeAPI.POST(l.AccountKeyChangePath().Relative(), h.NotImplemented, h.ValidateJWSWithKIDAndExtractPayload)
 
-		lookupCtx, cancelLookup := context.WithDeadline(context.Background(), time.Now().Add(10*time.Second))
-		defer cancelLookup()
+	acmeAPI.POST(l.NewOrderPath().Relative(), h.NewOrder, h.ValidateJWSWithKIDAndExtractPayload)
+	acmeAPI.POST(l.OrderPath(":"+l.OrderIDParam()).Relative(), h.GetOrder, h.ValidateJWSWithKIDAndExtractPayload)
+	acmeAPI.POST(l.AccountOrdersPath(":"+l.AccountIDParam()).Relative(), h.GetOrdersByAccountID, h.ValidateJWSWithKIDAndExtractPayload, h.POSTAsGETMw)
+	acmeAPI.POST(l.FinalizeOrderPath(":"+l.OrderIDParam()).Relative(), h.FinalizeOrder, h.ValidateJWSWithKIDAndExtractPayload)
 
-		log.WithField("fqdn", fqdn).Debug("Looking up record for ACME verification to check propagation")
-		answers, err := r.LookupTXT(lookupCtx, fqdn)
-		if err != nil {
-			log.WithField("fqdn", fqdn).WithError(err).Debug("Failed to lookup ACME record")
-			continue
-		}
+	acmeAPI.POST(l.AuthzPath(":"+l.AuthzIDParam()).Relative(), h.GetAuthorization, h.ValidateJWSWithKIDAndExtractPayload, h.POSTAsGETMw)
+	acmeAPI.POST(l.ChallengePath(":"+l.ChallengeIDParam()).Relative(), h.InitiateChallenge, h.ValidateJWSWithKIDAndExtractPayload)
+	acmeAPI.POST(l.CertPath(":"+l.CertIDParam()).Relative(), h.GetCertificate, h.ValidateJWSWithKIDAndExtractPayload, h.POSTAsGETMw)
+	acmeAPI.POST(l.RevokeCertPath().Relative(), h.RevokeCert, h.ValidateJWSWithKIDOrJWKAndExtractPayload)
 
-		for _, ans := range answers {
-			if ans == info.Value {
-				log.WithField("fqdn", fqdn).Debug("ACME record propagated!")
-				return nil
-			}
-			log.WithField("fqdn", fqdn).WithField("exepcted_value", info.Value).WithField("found_value", ans).Debug("TXT result didn't match")
-		}
-	}
+	acmeAPI.POST(l.RateBudgetPath().Relative(), h.GetRateBudget, h.ValidateJWSWithKIDAndExtractPayload, h.POSTAsGETMw)
 }
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/labstack/echo/v4"
+	"github.com/lachlan2k/acmespider/internal/acme_controller"
+	"github.com/lachlan2k/acmespider/internal/db"
+	"github.com/lachlan2k/acmespider/internal/handlers"
+	"github.com/lachlan2k/acmespider/internal/issuer"
+	"github.com/lachlan2k/acmespider/internal/links"
+	"github.com/lachlan2k/acmespider/internal/localca"
+	"github.com/lachlan2k/acmespider/internal/nonce"
+	"github.com/lachlan2k/acmespider/internal/policy"
+	log "github.com/sirupsen/logrus"
+)
+
+// TenantConfig is a named tenant, with its own ACME directory at /acme/<name>/directory.
+// Upstream settings left empty are inherited from the server's
+type TenantConfig struct {
+	acme_controller.TenantConfig
+
+	UpstreamIssuer string
+	CADirectory    string
+	DNSProvider    string
+	KeyType        certcrypto.KeyType
+	VaultMount     string
+	VaultRole      string
+}
+
+var tenantNameRegexp = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// hasOwnUpstream reports whether the tenant overrides any upstream settings, and so needs its own issuer
+func (t TenantConfig) hasOwnUpstream() bool {
+	return t.UpstreamIssuer != "" || t.CADirectory != "" || t.DNSProvider != "" || t.KeyType != "" || t.VaultMount != "" || t.VaultRole != ""
+}
+
+// upstreamConfig is the server's config with the tenant's upstream overrides applied
+func (t TenantConfig) upstreamConfig(conf Config) Config {
+	if t.UpstreamIssuer != "" {
+		conf.UpstreamIssuer = t.UpstreamIssuer
+	}
+	if t.CADirectory != "" {
+		conf.CADirectory = t.CADirectory
+	}
+	if t.DNSProvider != "" {
+		conf.DNSProvider = t.DNSProvider
+	}
+	if t.KeyType != "" {
+		conf.KeyType = t.KeyType
+	}
+	if t.VaultMount != "" {
+		conf.Vault.Mount = t.VaultMount
+	}
+	if t.VaultRole != "" {
+		conf.Vault.Role = t.VaultRole
+	}
+	return conf
+}
+
+// makeTenantUpstreamIssuer creates the issuer for a tenant with its own upstream settings.
+// ACME upstreams share the global account key, registered with the tenant's CA
+func makeTenantUpstreamIssuer(ctx context.Context, conf Config, tenant TenantConfig, boltDb db.DB, records *dnsRecordTracker) (issuer.Issuer, error) {
+	tenantConf := tenant.upstreamConfig(conf)
+	log.WithField("tenant", tenant.Name).Infof("Using %s upstream for tenant", tenantConf.UpstreamIssuer)
+
+	if tenantConf.UpstreamIssuer != issuer.UpstreamIssuerACME {
+		return makeUpstreamIssuer(tenantConf, nil)
+	}
+
+	legoClient, _, err := setupLego(ctx, tenantConf, boltDb, records)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up ACME upstream for tenant %s: %v", tenant.Name, err)
+	}
+	return makeUpstreamIssuer(tenantConf, legoClient)
+}
+
+// newTenantHandlers creates the handlers and controller behind one tenant's directory.
+// Everything besides the tenant's own settings and upstream is shared with the other tenants,
+// and the upstream's rate budget with the other tenants using the same upstream
+func newTenantHandlers(conf Config, tenant acme_controller.TenantConfig, boltDb db.DB, upstream issuer.Issuer, budget *acme_controller.UpstreamBudget, abuse *acme_controller.AbuseLimiter, localCA *localca.CA, policyEngine *policy.Engine, work *acme_controller.WorkTracker, nonces nonce.NonceController, baseURL string) handlers.Handlers {
+	l := links.LinkController{
+		BaseURL:                     baseURL,
+		Tenant:                      tenant.Name,
+		MetaTosURL:                  conf.MetaTosURL,
+		MetaCAAs:                    conf.MetaCAAs,
+		MetaWebsite:                 conf.MetaWebsite,
+		MetaExternalAccountRequired: tenant.RequireEAB,
+	}
+
+	acmeCtrl := acme_controller.New(boltDb, upstream, localCA, l)
+	acmeCtrl.SetTenantConfig(tenant)
+	acmeCtrl.SetHTTP01Config(conf.HTTP01)
+	acmeCtrl.SetSourceIPConfig(acme_controller.SourceIPConfig{
+		Enabled:   conf.SourceIPBinding,
+		Resolvers: conf.InternalDNSResolvers,
+	})
+	acmeCtrl.SetUpstreamBudget(budget)
+	acmeCtrl.SetAbuseLimiter(abuse)
+	acmeCtrl.SetCertReuseConfig(conf.CertReuse)
+	acmeCtrl.SetDeactivationConfig(conf.Deactivation)
+	acmeCtrl.SetPolicy(policyEngine)
+	acmeCtrl.SetApprovalConfig(conf.Approvals)
+	acmeCtrl.SetWorkTracker(work)
+	acmeCtrl.SetClientCertConfig(acme_controller.ClientCertConfig{Required: conf.ClientCAs != nil})
+
+	return handlers.Handlers{
+		AcmeCtrl:  acmeCtrl,
+		NonceCtrl: nonces,
+		LinkCtrl:  l,
+	}
+}
+
+// checkTenantName makes sure a tenant's directory can be routed to without shadowing the default tenant's routes
+func checkTenantName(app *echo.Echo, name string) error {
+	if !tenantNameRegexp.MatchString(name) {
+		return fmt.Errorf("tenant name %q must be lowercase letters, digits and dashes", name)
+	}
+	for _, route := range app.Routes() {
+		first, _, _ := strings.Cut(strings.TrimPrefix(route.Path, "/acme/"), "/")
+		if first == name {
+			return fmt.Errorf("tenant name %q clashes with the route %s", name, route.Path)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"fmt"
+
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/go-acme/lego/v4/lego"
+	dnsProviders "github.com/go-acme/lego/v4/providers/dns"
+	"github.com/go-acme/lego/v4/registration"
+	"github.com/lachlan2k/acmespider/internal/db"
+	"github.com/lachlan2k/acmespider/internal/issuer"
+	"github.com/lachlan2k/acmespider/internal/propagation"
+	log "github.com/sirupsen/logrus"
+)
+
+// legoUpstream is a lego client along with the trackers installed in it, which the issuer wrapping it reads from
+type legoUpstream struct {
+	client     *lego.Client
+	retryAfter *issuer.RetryAfterTracker
+	challenges *issuer.ChallengeTracker
+}
+
+func makeUpstreamIssuer(conf Config, upstream *legoUpstream) (issuer.Issuer, error) {
+	iss, err := newUpstreamIssuer(conf, upstream)
+	if err != nil {
+		return nil, err
+	}
+	return issuer.WithDefaultLifetime(iss, conf.UpstreamCertLifetime), nil
+}
+
+func newUpstreamIssuer(conf Config, upstream *legoUpstream) (issuer.Issuer, error) {
+	switch conf.UpstreamIssuer {
+	case issuer.UpstreamIssuerACME:
+		return issuer.NewLegoIssuer(upstream.client, conf.CADirectory, upstream.retryAfter, upstream.challenges), nil
+
+	case issuer.UpstreamIssuerVault:
+		log.Infof("Using Vault PKI upstream at %s", conf.Vault.Addr)
+		return issuer.NewVaultIssuer(conf.Vault)
+
+	case issuer.UpstreamIssuerStepCA:
+		log.Infof("Using step-ca upstream at %s", conf.StepCA.URL)
+		return issuer.NewStepCAIssuer(conf.StepCA)
+	}
+
+	return nil, fmt.Errorf("unknown upstream issuer %q", conf.UpstreamIssuer)
+}
+
+// newPropagationChecker checks DNS-01 records for lego, waiting at least as long as the provider asks
+func newPropagationChecker(conf Config, prov challenge.Provider) *propagation.Checker {
+	propConf := propagation.DefaultConfig()
+	propConf.Resolvers = conf.PublicDNSResolvers
+	if conf.DNSPropagationTimeout != 0 {
+		propConf.Timeout = conf.DNSPropagationTimeout
+	}
+	if providerTimeout, ok := prov.(challenge.ProviderTimeout); ok {
+		if providerWait, _ := providerTimeout.Timeout(); providerWait > propConf.Timeout {
+			propConf.Timeout = providerWait
+		}
+	}
+	return propagation.NewChecker(propConf)
+}
+
+// setupLego loads (or generates) the global ACME account key, registers it upstream and configures the DNS provider
+// The trackers installed to catch upstream Retry-After headers and challenge failures are returned with the client.
+// The returned DNS provider is wrapped by records, to track what it presents. Waiting for DNS propagation gives up once ctx is done
+func setupLego(ctx context.Context, conf Config, boltDb db.DB, records *dnsRecordTracker) (*legoUpstream, challenge.Provider, error) {
+	var privateKey *ecdsa.PrivateKey
+	existingMarshalledPrivateKey, err := boltDb.GetGlobalKey()
+	if err != nil {
+		if !db.IsErrNotFound(err) {
+			return nil, nil, err
+		}
+
+		// FIrst time, gen key
+		log.Info("Generating keypair...")
+		privateKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		marshalledPrivateKey, err := x509.MarshalECPrivateKey(privateKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = boltDb.SaveGlobalKey(marshalledPrivateKey)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		log.Info("Using existing keypair...")
+		privateKey, err = x509.ParseECPrivateKey(existingMarshalledPrivateKey)
+		if err != nil {
+			return nil, nil, fmt.Errorf("couldn't unmarshal existing private key: %v", err)
+		}
+	}
+
+	myUser := MyUser{
+		Email: conf.Email,
+		key:   privateKey,
+	}
+
+	legoConfig := lego.NewConfig(&myUser)
+	legoConfig.CADirURL = conf.CADirectory
+	legoConfig.Certificate.KeyType = conf.KeyType
+	challenges := issuer.NewChallengeTracker(legoConfig.HTTPClient.Transport)
+	retryAfter := issuer.NewRetryAfterTracker(challenges)
+	legoConfig.HTTPClient.Transport = retryAfter
+
+	legoClient, err := lego.NewClient(legoConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	legoProv, err := dnsProviders.NewDNSChallengeProviderByName(conf.DNSProvider)
+	if err != nil {
+		return nil, nil, err
+	}
+	checker := newPropagationChecker(conf, legoProv)
+	prov := records.wrap(conf.DNSProvider, legoProv)
+	legoClient.Challenge.SetDNS01Provider(prov, dns01.AddRecursiveNameservers(conf.PublicDNSResolvers), dns01.WrapPreCheck(challenges.WrapPreCheck(checker.LegoPreCheck(ctx))))
+	log.Infof("Using DNS provider %s", conf.DNSProvider)
+
+	reg, err := legoClient.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+	if err != nil {
+		return nil, nil, err
+	}
+	myUser.Registration = reg
+
+	return &legoUpstream{client: legoClient, retryAfter: retryAfter, challenges: challenges}, prov, nil
+}